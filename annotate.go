@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+var (
+	grafanaURL = flag.String("grafana-url", "",
+		"Post an annotation to this Grafana when a module goes offline or comes back online, as seen between discoveries.")
+	grafanaToken = flag.String("grafana-token", "",
+		"Grafana service account token for -grafana-url, with permission to write annotations.")
+)
+
+// reachabilityChange is a module going offline or coming back online between two discoveries.
+type reachabilityChange struct {
+	devID, name string
+	online      bool
+	// at is when it happened, as far as we can tell: the module's last data if it went offline, or now.
+	at time.Time
+}
+
+// reachabilityChanges returns the modules in both old and stations whose reachability changed.
+func reachabilityChanges(old, stations []netatmo.Station, now time.Time) []reachabilityChange {
+	before := map[string]bool{}
+	for _, dev := range old {
+		before[export.DevID(dev.ID, "")] = dev.Reachable
+		for _, mod := range dev.Modules {
+			before[export.DevID(dev.ID, mod.ID)] = mod.Reachable
+		}
+	}
+	var changes []reachabilityChange
+	add := func(id, name string, reachable bool, lastData time.Time) {
+		was, ok := before[id]
+		if !ok || was == reachable {
+			return
+		}
+		c := reachabilityChange{devID: id, name: name, online: reachable, at: now}
+		if !reachable && !lastData.IsZero() && lastData.Before(now) {
+			c.at = lastData
+		}
+		changes = append(changes, c)
+	}
+	for _, dev := range stations {
+		add(export.DevID(dev.ID, ""), dev.Name, dev.Reachable, dev.DashboardData.TimeUTC.Time)
+		for _, mod := range dev.Modules {
+			add(export.DevID(dev.ID, mod.ID), mod.Name, mod.Reachable, mod.DashboardData.TimeUTC.Time)
+		}
+	}
+	return changes
+}
+
+// annotateReachability logs the reachability changes between old and stations, and posts them to -grafana-url.
+// Failures to post are logged, not returned.
+func annotateReachability(ctx context.Context, old, stations []netatmo.Station) {
+	for _, c := range reachabilityChanges(old, stations, time.Now()) {
+		state, tag := "offline", "offline"
+		if c.online {
+			state, tag = "back online", "online"
+		}
+		slog.Info("module "+state, "dev_id", c.devID, "module_name", c.name, "at", c.at.Format(time.RFC3339))
+		if *grafanaURL == "" {
+			continue
+		}
+		body, _ := json.Marshal(map[string]any{
+			"time": c.at.UnixMilli(),
+			"tags": []string{"netatmo", tag, c.devID},
+			"text": fmt.Sprintf("%s (%s) is %s", c.name, c.devID, state),
+		})
+		if err := postAnnotation(ctx, body); err != nil {
+			slog.Error("posting Grafana annotation", "dev_id", c.devID, "err", err)
+		}
+	}
+}
+
+func postAnnotation(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	u := strings.TrimSuffix(*grafanaURL, "/") + "/api/annotations"
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *grafanaToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*grafanaToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return nil
+}
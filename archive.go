@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	dto "github.com/prometheus/client_model/go"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// archiveRecord is a getmeasure response in the archive, one JSON object per line.
+type archiveRecord struct {
+	Time   time.Time       `json:"time"`
+	URL    string          `json:"url"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// archiveWriter appends the getmeasure responses of a Netatmo client to a gzipped NDJSON file.
+// Each record is flushed as it's written, so a crash loses at most the one being written.
+type archiveWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	gz *gzip.Writer
+	bw *bufio.Writer
+}
+
+var (
+	// responseArchive is the archive for -archive, opened by the first newClient; nil if disabled.
+	responseArchive    *archiveWriter
+	responseArchiveErr error
+	openArchiveOnce    sync.Once
+)
+
+// openArchive creates a new archive file in dir, named for the current time.
+func openArchive(dir string) (*archiveWriter, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(dir, "getmeasure-"+time.Now().UTC().Format("20060102T150405.000Z")+".ndjson.gz")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &archiveWriter{f: f, gz: gz, bw: bufio.NewWriter(gz)}, nil
+}
+
+// record is a netatmo.Hooks.OnResponse that archives successful getmeasure responses.
+func (a *archiveWriter) record(x netatmo.Exchange) {
+	if x.Err != nil || x.Response.StatusCode != http.StatusOK || x.Request.URL.Path != "/api/getmeasure" ||
+		!json.Valid(x.Body) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	err := json.NewEncoder(a.bw).Encode(archiveRecord{
+		Time: time.Now().UTC(), URL: x.Request.URL.String(), Status: x.Response.StatusCode, Body: x.Body,
+	})
+	if err == nil {
+		err = a.bw.Flush()
+	}
+	if err == nil {
+		err = a.gz.Flush()
+	}
+	if err != nil {
+		slog.Error("archiving response", "file", a.f.Name(), "err", err)
+	}
+}
+
+// Close completes the archive file.
+func (a *archiveWriter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return errors.Join(a.bw.Flush(), a.gz.Close(), a.f.Close())
+}
+
+// runReexport replays the getmeasure responses in archive files (or directories of them) into the -dest sink,
+// without calling Netatmo. The labels come from the stations in the state, as of the last run. The cursors are
+// left alone, as for backfill.
+func runReexport(args []string) (err error) {
+	stdfs := flag.NewFlagSet("reexport", flag.ContinueOnError)
+	fs := ff.NewFlagSetFrom("reexport", stdfs)
+	err = ff.Parse(fs, args, ff.WithEnvVarPrefix("REEXPORT"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		stdfs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	var paths []string
+	for _, arg := range fs.GetArgs() {
+		matches, err := filepath.Glob(filepath.Join(arg, "getmeasure-*.ndjson.gz"))
+		if err != nil {
+			return fmt.Errorf("%w: reexport: %w", errConfig, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{arg}
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("%w: reexport: usage: reexport ARCHIVE...", errConfig)
+	}
+	slices.Sort(paths) // The names sort in time order.
+
+	stateDB, err := openState()
+	if err != nil {
+		return err
+	}
+	stations := stateDB.Data.Stations
+	stateDB.Close()
+
+	exporter, closeExporter, err := newExporter(context.Background())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeExporter(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("upload: %w", cerr))
+		}
+	}()
+
+	labels := map[string][]*dto.LabelPair{} // By dev_id.
+	for _, path := range paths {
+		n, err := reexportFile(path, stations, labels, exporter)
+		if err != nil {
+			return fmt.Errorf("reexport: %s: %w", path, err)
+		}
+		slog.Info("reexported", "file", path, "points", n)
+	}
+	return nil
+}
+
+// reexportFile encodes the points of the responses in the archive file to exporter, and returns how many.
+// labels caches the labels of each dev_id.
+func reexportFile(path string, stations []netatmo.Station, labels map[string][]*dto.LabelPair, exporter export.Sink) (points int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	dec := json.NewDecoder(gz)
+	for {
+		var rec archiveRecord
+		if err := dec.Decode(&rec); err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return points, nil // A crash can leave a partial last record.
+		} else if err != nil {
+			return points, err
+		}
+		u, err := url.Parse(rec.URL)
+		if err != nil {
+			return points, err
+		}
+		q := u.Query()
+		device, module := netatmo.DeviceID(q.Get("device_id")), netatmo.ModuleID(q.Get("module_id"))
+		var dataTypes []netatmo.DataType
+		for _, dt := range strings.Split(q.Get("type"), ",") {
+			dataTypes = append(dataTypes, netatmo.DataType(dt))
+		}
+		ps, err := netatmo.DecodeMeasure(rec.Status, rec.Body)
+		if err == nil && slices.ContainsFunc(ps, func(p netatmo.DataPoint) bool { return len(p.Values) != len(dataTypes) }) {
+			err = fmt.Errorf("points don't have %d values", len(dataTypes))
+		}
+		if err != nil {
+			slog.Warn("skipping undecodable response", "file", path, "url", rec.URL, "err", err)
+			continue
+		}
+		if len(ps) == 0 {
+			continue
+		}
+		id := export.DevID(device, module)
+		if labels[id] == nil {
+			labels[id] = export.LabelPairs(archiveLabels(stations, device, module))
+		}
+		mfs := export.Families(labels[id], dataTypes, ps)
+		mfs = append(mfs, export.DerivedFamilies(labels[id], fileConfig.derived(), dataTypes, ps)...)
+		mfs = append(mfs, export.DirectionFamilies(labels[id], dataTypes, ps)...)
+		for _, mf := range mfs {
+			if err := exporter.Encode(mf); err != nil {
+				return points, err
+			}
+		}
+		points += len(ps)
+	}
+}
+
+// archiveLabels returns the labels for the device or module from the stations, or just its dev_id if it's gone.
+func archiveLabels(stations []netatmo.Station, device netatmo.DeviceID, module netatmo.ModuleID) map[string]string {
+	for _, dev := range stations {
+		if dev.ID != device {
+			continue
+		}
+		if module == "" {
+			return stationAttrs(dev)
+		}
+		for _, mod := range dev.Modules {
+			if mod.ID == module {
+				return moduleAttrs(dev, mod)
+			}
+		}
+	}
+	slog.Warn("module not in the state; exporting with only its dev_id", "device", device, "module", module)
+	return fileConfig.accountLabels(map[string]string{"dev_id": export.DevID(device, module)})
+}
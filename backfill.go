@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"golang.org/x/sync/errgroup"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// runBackfill exports a fixed time range, ignoring the incremental and resume state.
+//
+// A module that fails doesn't stop the others; the failures are returned together.
+//
+// With -manifest, the range is split into chunks per module, tracked in the manifest across runs: each run exports
+// the chunks not yet done (up to -max-chunks, or -max-api-calls), including the ones that failed before.
+func runBackfill(args []string) (err error) {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	from := fs.String("from", "", "Start of the range to export, as an RFC3339 timestamp. Required.")
+	to := fs.String("to", "", "End of the range to export, as an RFC3339 timestamp. Defaults to now.")
+	target := fs.String("module", "", "Only export the device or module with this ID or name.")
+	useTUI := fs.Bool("tui", false, "Show live progress bars instead of progress logs, if stderr is a terminal.")
+	manifestPath := fs.String("manifest", "",
+		"Track the backfill in chunks in this JSON file, resuming from it on the next run. -from and -to are only needed to create it.")
+	chunkSize := fs.Duration("chunk", 30*24*time.Hour, "With -manifest, the length of each chunk.")
+	maxChunks := fs.Int("max-chunks", 0, "With -manifest, export at most this many chunks per run. Set 0 for no limit.")
+
+	err = ff.Parse(fs, args, ff.WithEnvVarPrefix("BACKFILL"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+
+	var since, until time.Time
+	switch {
+	case *from != "":
+		if since, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fmt.Errorf("%w: backfill: -from: %w", errConfig, err)
+		}
+	case *manifestPath == "":
+		return fmt.Errorf("%w: backfill: -from is required", errConfig)
+	}
+	if *to != "" {
+		if until, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("%w: backfill: -to: %w", errConfig, err)
+		}
+	}
+	if *chunkSize < time.Hour {
+		return fmt.Errorf("%w: backfill: -chunk must be at least an hour", errConfig)
+	}
+	if !since.IsZero() {
+		if until.IsZero() {
+			until = time.Now().Truncate(time.Second)
+		}
+		if !since.Before(until) {
+			return fmt.Errorf("%w: backfill: -from %s is not before -to %s", errConfig, since, until)
+		}
+	}
+
+	ctx := context.Background()
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	source, closeMirror, err := withMirror(interleaved(client))
+	if err != nil {
+		return err
+	}
+	defer closeMirror()
+
+	exporter, closeExporter, err := newExporter(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeExporter(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("upload: %w", cerr))
+		}
+	}()
+
+	stations, err := client.GetStations(ctx)
+	if err != nil {
+		return err
+	}
+	matches := func(id, name string) bool {
+		if fileConfig.module(id, name).Skip {
+			return false
+		}
+		return *target == "" || *target == id || *target == name
+	}
+	type job struct {
+		name      string
+		attrs     map[string]string
+		device    netatmo.DeviceID
+		module    netatmo.ModuleID
+		dataTypes []netatmo.DataType
+	}
+	var jobs []job
+	for _, dev := range stations {
+		if matches(string(dev.ID), dev.Name) {
+			jobs = append(jobs, job{dev.Name, stationAttrs(dev), dev.ID, "", dev.DataTypes})
+		}
+		for _, mod := range dev.Modules {
+			if matches(string(mod.ID), mod.Name) {
+				jobs = append(jobs, job{mod.Name, moduleAttrs(dev, mod), dev.ID, mod.ID, mod.DataTypes})
+			}
+		}
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("%w: backfill: no device or module matches %q", errConfig, *target)
+	}
+
+	var mf *manifestFile
+	if *manifestPath != "" {
+		names, order := map[string]string{}, []string{}
+		for _, j := range jobs {
+			id := export.DevID(j.device, j.module)
+			names[id], order = j.name, append(order, id)
+		}
+		if mf, err = openManifest(*manifestPath, since, until, *chunkSize, names, order); err != nil {
+			return err
+		}
+		since, until = mf.db.Data.From, mf.db.Data.To
+		client.SetMaxCalls(*maxAPICalls)
+	}
+
+	var ui *tui
+	if *useTUI {
+		if isTerminal(os.Stderr) {
+			ui = newTUI(os.Stderr, client)
+			defer ui.stop()
+		} else {
+			slog.Info("stderr is not a terminal; logging progress instead of the TUI")
+		}
+	}
+	rows := make([]*tuiRow, len(jobs))
+	for i, j := range jobs {
+		rows[i] = ui.add(j.name, since, until)
+	}
+	if ui != nil {
+		ui.start()
+	}
+
+	e := &export.Exporter{Client: source, Sink: exporter, Derived: fileConfig.derived()}
+	g := &errgroup.Group{}
+	g.SetLimit(moduleLimit())
+	errs := make([]error, len(jobs))
+	var chunks atomic.Int64 // Chunks started, for -max-chunks.
+	for i, j := range jobs {
+		g.Go(func() error {
+			p := newProgress(j.name, since, until)
+			update := p.update
+			if ui != nil {
+				update = rows[i].update
+			}
+			m := export.Module{Device: j.device, Module: j.module, DataTypes: j.dataTypes, Labels: j.attrs}
+			var err error
+			if mf == nil {
+				err = e.Range(ctx, m, since, until, update)
+			} else {
+				err = exportChunks(ctx, e, mf, m, func() bool { return *maxChunks <= 0 || chunks.Add(1) <= int64(*maxChunks) }, update)
+			}
+			if err != nil {
+				slog.Error("backfill failed", "module_name", j.name, "err", err)
+				errs[i] = fmt.Errorf("%s: %w", j.name, err)
+				return nil
+			}
+			if ui != nil {
+				rows[i].finish()
+			} else {
+				p.done()
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	if mf != nil {
+		n := mf.counts()
+		slog.Info("backfill manifest", "path", *manifestPath,
+			"done", n[chunkDone], "pending", n[chunkPending], "failed", n[chunkFailed])
+	}
+
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Join(append([]error{fmt.Errorf("%w: %d of %d modules failed", errPartial, len(failed), len(jobs))}, failed...)...)
+	}
+	return nil
+}
+
+// exportChunks exports m's chunks that are not done in mf, in order, while start allows another one.
+// A chunk is marked done once its upload is confirmed, and failed (for the next run to retry) if the export fails.
+func exportChunks(ctx context.Context, e *export.Exporter, mf *manifestFile, m export.Module, start func() bool,
+	page func(points []netatmo.DataPoint, nextTime time.Time),
+) error {
+	for _, i := range mf.todo(export.DevID(m.Device, m.Module)) {
+		if !start() {
+			return nil
+		}
+		c := mf.chunk(i)
+		if err := mf.update(i, func(c *manifestChunk) { c.Attempts++ }); err != nil {
+			return err
+		}
+		points := 0
+		err := e.Range(ctx, m, c.From, c.To, func(ps []netatmo.DataPoint, nextTime time.Time) {
+			points += len(ps)
+			page(ps, nextTime)
+		})
+		if errors.Is(err, netatmo.ErrBudgetExhausted) {
+			slog.Info("stopping; the next run will continue from the manifest", "module_name", c.Name)
+			return nil
+		}
+		if err != nil {
+			if uerr := mf.update(i, func(c *manifestChunk) { c.Status, c.Error = chunkFailed, err.Error() }); uerr != nil {
+				return errors.Join(err, uerr)
+			}
+			return err
+		}
+		err = export.Checkpoint(e.Sink, func() {
+			err := mf.update(i, func(c *manifestChunk) { c.Status, c.Points, c.Error = chunkDone, points, "" })
+			if err != nil {
+				slog.Error("saving manifest", "err", err)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		slog.Debug("exported chunk", "module_name", c.Name, "from", c.From, "to", c.To, "points", points)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// captureWriter writes each Netatmo API exchange to a file of its own in dir, for -capture-dir: the request's
+// URL, the response's status, and the raw body, with any tokens redacted.
+type captureWriter struct {
+	dir string
+	seq atomic.Int64 // Orders the files of exchanges in the same millisecond.
+}
+
+// openCapture creates dir, if needed, for a captureWriter.
+func openCapture(dir string) (*captureWriter, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &captureWriter{dir: dir}, nil
+}
+
+// record is a netatmo.Hooks.OnResponse that writes x to a new file, named for the time and the API call,
+// e.g. 20240101T000000.000Z-0001-getmeasure.txt.
+func (c *captureWriter) record(x netatmo.Exchange) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\n", x.Request.Method, netatmo.RedactURL(x.Request.URL))
+	if x.Err != nil {
+		fmt.Fprintf(&b, "error: %v\n", x.Err)
+	} else {
+		fmt.Fprintf(&b, "%s\n", x.Response.Status)
+	}
+	fmt.Fprintf(&b, "duration: %v\n\n", x.Duration.Round(time.Millisecond))
+	b.Write(netatmo.RedactBody(x.Body))
+
+	name := fmt.Sprintf("%s-%04d-%s.txt", time.Now().UTC().Format("20060102T150405.000Z"), c.seq.Add(1),
+		path.Base(x.Request.URL.Path))
+	if err := os.WriteFile(filepath.Join(c.dir, name), b.Bytes(), 0o600); err != nil {
+		slog.Error("capturing response", "dir", c.dir, "err", err)
+	}
+}
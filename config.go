@@ -0,0 +1,543 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/peterbourgon/ff/v4"
+	"gopkg.in/yaml.v3"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/internal/expr"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// FileConfig is the structured configuration file, used when -config names a .yaml, .yml, or .toml file.
+//
+// Other files are read with ff.PlainParser, as flag values only.
+type FileConfig struct {
+	// Flags sets any command line flag, by name.
+	Flags map[string]any `yaml:"flags" toml:"flags"`
+
+	Accounts []AccountConfig `yaml:"accounts" toml:"accounts"`
+	Sinks    []SinkConfig    `yaml:"sinks" toml:"sinks"`
+	Relabel  []RelabelRule   `yaml:"relabel" toml:"relabel"`
+	// Labels, if set, replace the default labels (besides dev_id) with templates of the fields of the station or
+	// module; see labelFields.
+	Labels  map[string]string       `yaml:"labels" toml:"labels"`
+	Modules map[string]ModuleConfig `yaml:"modules" toml:"modules"` // By module ID or name.
+	Derived []DerivedConfig         `yaml:"derived" toml:"derived"`
+	Events  []EventConfig           `yaml:"events" toml:"events"`
+
+	// Profiles are selected with -profile, and override the settings above.
+	Profiles map[string]ProfileConfig `yaml:"profiles" toml:"profiles"`
+
+	labelTemplates map[string]*template.Template
+	// account is the name of the account in use, if the file has more than one across its profiles.
+	account string
+}
+
+// ProfileConfig is a named set of overrides. Non-empty accounts and sinks replace the top-level ones.
+type ProfileConfig struct {
+	Flags    map[string]any  `yaml:"flags" toml:"flags"`
+	Accounts []AccountConfig `yaml:"accounts" toml:"accounts"`
+	Sinks    []SinkConfig    `yaml:"sinks" toml:"sinks"`
+}
+
+// AccountConfig is a Netatmo Connect application. Its OAuth token is still kept in config.json.
+type AccountConfig struct {
+	Name         string `yaml:"name" toml:"name"`
+	ClientID     string `yaml:"client_id" toml:"client_id"`
+	ClientSecret string `yaml:"client_secret" toml:"client_secret"`
+}
+
+// SinkConfig is where exported data is written.
+type SinkConfig struct {
+	// Type is victoriametrics or stdout.
+	Type string `yaml:"type" toml:"type"`
+	// Dest is the host:port, as for -dest.
+	Dest string `yaml:"dest" toml:"dest"`
+}
+
+// RelabelRule sets Target to Replacement (which may use $1-style references) if Source matches Regex.
+type RelabelRule struct {
+	Source      string `yaml:"source" toml:"source"`
+	Regex       string `yaml:"regex" toml:"regex"`
+	Target      string `yaml:"target" toml:"target"`
+	Replacement string `yaml:"replacement" toml:"replacement"`
+
+	re *regexp.Regexp
+}
+
+// DerivedConfig is a series computed from each point of a module's data types, e.g. a unit conversion.
+type DerivedConfig struct {
+	// Name is the metric name, after "netatmo_".
+	Name string `yaml:"name" toml:"name"`
+	// Expr is the expression to compute, with the inputs as its variables; see package expr.
+	Expr string `yaml:"expr" toml:"expr"`
+	// Inputs are the data types the expression uses. Only modules with all of them get the series.
+	Inputs []string `yaml:"inputs" toml:"inputs"`
+	// Unit is the unit of the series, optional.
+	Unit string `yaml:"unit" toml:"unit"`
+
+	derived export.Derived
+}
+
+// labelFields are the fields of a station or module that label templates can use, as in "{{.HomeName}}-{{.Name | lower}}".
+type labelFields struct {
+	ID       string // The dev_id.
+	Type     string // E.g. NAMain or NAModule1.
+	Name     string
+	Firmware int
+	HomeID   string
+	HomeName string
+	// StationID and StationName are of the station the module belongs to, or the station itself.
+	StationID   string
+	StationName string
+}
+
+// labelFuncs are the functions label templates can use, besides the text/template builtins.
+var labelFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	// replace is for pipelines, as in {{.Name | replace " " "_"}}.
+	"replace": func(from, to, s string) string { return strings.ReplaceAll(s, from, to) },
+}
+
+// EventConfig is a threshold on a data type. Crossing it, in either direction, emits an event; see eventWatcher.
+type EventConfig struct {
+	Name     string `yaml:"name" toml:"name"`
+	DataType string `yaml:"data_type" toml:"data_type"`
+	// Exactly one of Above and Below is set.
+	Above *float64 `yaml:"above" toml:"above"`
+	Below *float64 `yaml:"below" toml:"below"`
+
+	dataType netatmo.DataType
+}
+
+// firing reports whether v is past the threshold.
+func (e EventConfig) firing(v float64) bool {
+	if e.Above != nil {
+		return v > *e.Above
+	}
+	return v < *e.Below
+}
+
+// ModuleConfig overrides settings for one device or module.
+type ModuleConfig struct {
+	// Skip excludes the module from exports.
+	Skip bool `yaml:"skip" toml:"skip"`
+	// Labels are added to the module's series, replacing any with the same name.
+	Labels map[string]string `yaml:"labels" toml:"labels"`
+	// Interval skips exporting the module until its newest exported sample is this old.
+	Interval duration `yaml:"interval" toml:"interval"`
+	// Intervals override Interval for some data types (e.g. CO2), which are then exported separately.
+	Intervals map[string]duration `yaml:"intervals" toml:"intervals"`
+	// Since overrides -since for the module, e.g. to backfill a new module from when it was installed.
+	Since *sinceValue `yaml:"since" toml:"since"`
+}
+
+// duration is a time.Duration read from a string like "10m".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = duration(v)
+	return err
+}
+
+// intervalGroup is a set of a module's data types exported together, at most every interval.
+type intervalGroup struct {
+	interval  time.Duration
+	dataTypes []netatmo.DataType
+}
+
+// groups splits the module's dataTypes by interval, keeping their order.
+func (m ModuleConfig) groups(dataTypes []netatmo.DataType) []intervalGroup {
+	var groups []intervalGroup
+	for _, dt := range dataTypes {
+		interval := time.Duration(m.Interval)
+		for k, d := range m.Intervals {
+			if strings.EqualFold(k, string(dt)) {
+				interval = time.Duration(d)
+			}
+		}
+		i := slices.IndexFunc(groups, func(g intervalGroup) bool { return g.interval == interval })
+		if i < 0 {
+			i = len(groups)
+			groups = append(groups, intervalGroup{interval: interval})
+		}
+		groups[i].dataTypes = append(groups[i].dataTypes, dt)
+	}
+	return groups
+}
+
+// fileConfig is the structured config file, if any, loaded while parsing flags.
+var fileConfig FileConfig
+
+// profileLoaded is set once the -profile has been applied from the config file.
+var profileLoaded bool
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseConfigFile is an ff.ConfigFileParseFunc that reads structured config files by extension,
+// and falls back to ff.PlainParser.
+func parseConfigFile(r io.Reader, set func(name, value string) error) error {
+	name := flag.Lookup("config").Value.String()
+	var decode func([]byte, *FileConfig) error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		decode = func(data []byte, c *FileConfig) error {
+			dec := yaml.NewDecoder(bytes.NewReader(data))
+			dec.KnownFields(true)
+			if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			return nil
+		}
+	case ".toml":
+		decode = func(data []byte, c *FileConfig) error {
+			dec := toml.NewDecoder(bytes.NewReader(data))
+			dec.DisallowUnknownFields()
+			err := dec.Decode(c)
+			var derr *toml.DecodeError
+			if errors.As(err, &derr) {
+				row, col := derr.Position()
+				return fmt.Errorf("line %d column %d: %s", row, col, derr.Error())
+			}
+			var serr *toml.StrictMissingError
+			if errors.As(err, &serr) {
+				return errors.New(serr.String())
+			}
+			return err
+		}
+	default:
+		return ff.PlainParser(r, set)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var c FileConfig
+	if err := decode(data, &c); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := c.validate(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for k, v := range c.Flags {
+		if err := set(k, fmt.Sprint(v)); err != nil {
+			return fmt.Errorf("%s: flags.%s: %w", name, k, err)
+		}
+	}
+	accounts := map[string]bool{}
+	for _, a := range c.Accounts {
+		accounts[a.ClientID] = true
+	}
+	for _, p := range c.Profiles {
+		for _, a := range p.Accounts {
+			accounts[a.ClientID] = true
+		}
+	}
+	if *profile != "" {
+		p, ok := c.Profiles[*profile]
+		if !ok {
+			var names []string
+			for n := range c.Profiles {
+				names = append(names, n)
+			}
+			slices.Sort(names)
+			return fmt.Errorf("%s: no profile %q (have %s)", name, *profile, strings.Join(names, ", "))
+		}
+		for k, v := range p.Flags {
+			if err := set(k, fmt.Sprint(v)); err != nil {
+				return fmt.Errorf("%s: profiles.%s.flags.%s: %w", name, *profile, k, err)
+			}
+		}
+		if len(p.Accounts) > 0 {
+			c.Accounts = p.Accounts
+		}
+		if len(p.Sinks) > 0 {
+			c.Sinks = p.Sinks
+		}
+		profileLoaded = true
+	}
+	if len(accounts) > 1 && len(c.Accounts) > 0 {
+		c.account = cmp.Or(c.Accounts[0].Name, *profile, c.Accounts[0].ClientID)
+	}
+	fileConfig = c
+	return nil
+}
+
+// validate checks the config for errors, and compiles the relabel rules.
+func (c *FileConfig) validate() error {
+	errs := []error{c.validateTargets()}
+	for name, p := range c.Profiles {
+		pc := FileConfig{Accounts: p.Accounts, Sinks: p.Sinks}
+		if err := pc.validateTargets(); err != nil {
+			errs = append(errs, fmt.Errorf("profiles.%s: %w", name, err))
+		}
+	}
+	for i := range c.Relabel {
+		r := &c.Relabel[i]
+		if !labelNameRE.MatchString(r.Source) {
+			errs = append(errs, fmt.Errorf("relabel[%d]: source %q is not a valid label name", i, r.Source))
+		}
+		if !labelNameRE.MatchString(r.Target) {
+			errs = append(errs, fmt.Errorf("relabel[%d]: target %q is not a valid label name", i, r.Target))
+		}
+		var err error
+		if r.re, err = regexp.Compile("^(?:" + r.Regex + ")$"); err != nil {
+			errs = append(errs, fmt.Errorf("relabel[%d]: regex: %w", i, err))
+		}
+	}
+	c.labelTemplates = map[string]*template.Template{}
+	for k, v := range c.Labels {
+		if !labelNameRE.MatchString(k) {
+			errs = append(errs, fmt.Errorf("labels: %q is not a valid label name", k))
+			continue
+		}
+		if k == "dev_id" {
+			errs = append(errs, errors.New("labels: dev_id is always the device or module ID"))
+			continue
+		}
+		t, err := template.New(k).Funcs(labelFuncs).Option("missingkey=error").Parse(v)
+		if err == nil {
+			err = t.Execute(io.Discard, labelFields{}) // For unknown fields.
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("labels.%s: %w", k, err))
+			continue
+		}
+		c.labelTemplates[k] = t
+	}
+	events := map[string]bool{}
+	for i := range c.Events {
+		e := &c.Events[i]
+		if !labelNameRE.MatchString(e.Name) || events[e.Name] {
+			errs = append(errs, fmt.Errorf("events[%d]: name %q is not a valid name, or is a duplicate", i, e.Name))
+		}
+		events[e.Name] = true
+		for dt := range netatmo.DataUnits {
+			if strings.EqualFold(string(dt), e.DataType) {
+				e.dataType = dt
+			}
+		}
+		if e.dataType == "" {
+			errs = append(errs, fmt.Errorf("events[%d]: unknown data_type %q", i, e.DataType))
+		}
+		if (e.Above == nil) == (e.Below == nil) {
+			errs = append(errs, fmt.Errorf("events[%d]: set one of above and below", i))
+		}
+	}
+	names := map[string]bool{}
+	for i := range c.Derived {
+		d := &c.Derived[i]
+		if err := d.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("derived[%d]: %w", i, err))
+		}
+		if names[d.Name] {
+			errs = append(errs, fmt.Errorf("derived[%d]: duplicate name %q", i, d.Name))
+		}
+		names[d.Name] = true
+	}
+	for id, m := range c.Modules {
+		for k := range m.Labels {
+			if !labelNameRE.MatchString(k) {
+				errs = append(errs, fmt.Errorf("modules[%q]: label %q is not a valid label name", id, k))
+			}
+		}
+		if m.Interval < 0 {
+			errs = append(errs, fmt.Errorf("modules[%q]: interval must not be negative", id))
+		}
+		for k, d := range m.Intervals {
+			if d < 0 {
+				errs = append(errs, fmt.Errorf("modules[%q]: intervals.%s must not be negative", id, k))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// compile checks the derived series, and compiles its expression.
+func (d *DerivedConfig) compile() error {
+	if !labelNameRE.MatchString(d.Name) || strings.Contains(d.Name, ":") {
+		return fmt.Errorf("name %q is not a valid metric name", d.Name)
+	}
+	d.derived = export.Derived{Name: "netatmo_" + d.Name, Unit: d.Unit}
+	for dt := range netatmo.DataUnits {
+		if d.derived.Name == export.MetricName(dt) {
+			return fmt.Errorf("name %q is a built-in metric", d.Name)
+		}
+	}
+	if *humidityRatio && d.derived.Name == "netatmo_humidity_ratio" {
+		return fmt.Errorf("name %q is -humidity-ratio's", d.Name)
+	}
+	if *humidityLegacyName && d.derived.Name == legacyHumidityName {
+		return fmt.Errorf("name %q is -humidity-legacy-name's", d.Name)
+	}
+	if len(d.Inputs) == 0 {
+		return errors.New("inputs are required")
+	}
+	var vars []string
+	for _, in := range d.Inputs {
+		var input netatmo.DataType
+		for dt := range netatmo.DataUnits {
+			if strings.EqualFold(string(dt), in) {
+				input = dt
+			}
+		}
+		if strings.EqualFold(in, "Humidiity") {
+			input = netatmo.DataHumidity // Its old, misspelled name; the expression may still use it.
+		}
+		if input == "" {
+			return fmt.Errorf("unknown input %q", in)
+		}
+		d.derived.Inputs = append(d.derived.Inputs, input)
+		vars = append(vars, in)
+	}
+	var err error
+	d.derived.Expr, err = expr.Compile(d.Expr, vars)
+	return err
+}
+
+// derived returns the derived series, for export.Exporter.Derived, with the built-in ones that flags enable.
+func (c *FileConfig) derived() []export.Derived {
+	var ds []export.Derived
+	for _, d := range c.Derived {
+		ds = append(ds, d.derived)
+	}
+	if *humidityRatio {
+		ds = append(ds, humidityRatioSeries())
+	}
+	if *humidityLegacyName {
+		ds = append(ds, legacyHumiditySeries())
+	}
+	return ds
+}
+
+// humidityRatioSeries is the derived series of -humidity-ratio: the relative humidity as a 0-1 ratio.
+func humidityRatioSeries() export.Derived {
+	e, err := expr.Compile("humidity / 100", []string{string(netatmo.DataHumidity)})
+	if err != nil {
+		panic(err) // A constant expression.
+	}
+	return export.Derived{Name: "netatmo_humidity_ratio", Unit: "1", Inputs: []netatmo.DataType{netatmo.DataHumidity}, Expr: e}
+}
+
+// legacyHumidityName is the humidity's metric name from before DataHumidity's spelling was fixed.
+const legacyHumidityName = "netatmo_humidiity"
+
+// legacyHumiditySeries is the derived series of -humidity-legacy-name: the humidity, under its old metric name.
+func legacyHumiditySeries() export.Derived {
+	e, err := expr.Compile("humidity", []string{string(netatmo.DataHumidity)})
+	if err != nil {
+		panic(err) // A constant expression.
+	}
+	return export.Derived{
+		Name: legacyHumidityName, Unit: netatmo.DataUnits[netatmo.DataHumidity],
+		Inputs: []netatmo.DataType{netatmo.DataHumidity}, Expr: e,
+	}
+}
+
+// validateTargets checks the accounts and sinks.
+func (c *FileConfig) validateTargets() error {
+	var errs []error
+	names := map[string]bool{}
+	for i, a := range c.Accounts {
+		if a.ClientID == "" || a.ClientSecret == "" {
+			errs = append(errs, fmt.Errorf("accounts[%d]: client_id and client_secret are required", i))
+		}
+		if names[a.Name] {
+			errs = append(errs, fmt.Errorf("accounts[%d]: duplicate name %q", i, a.Name))
+		}
+		names[a.Name] = true
+	}
+	if len(c.Accounts) > 1 {
+		errs = append(errs, errors.New("accounts: only one account is supported"))
+	}
+	for i, s := range c.Sinks {
+		switch s.Type {
+		case "victoriametrics":
+			if s.Dest == "" {
+				errs = append(errs, fmt.Errorf("sinks[%d]: dest is required for type victoriametrics", i))
+			}
+		case "stdout":
+		default:
+			errs = append(errs, fmt.Errorf("sinks[%d]: unknown type %q (want victoriametrics or stdout)", i, s.Type))
+		}
+	}
+	if len(c.Sinks) > 1 {
+		errs = append(errs, errors.New("sinks: only one sink is supported"))
+	}
+	return errors.Join(errs...)
+}
+
+// module returns the overrides for the module with the given ID or name.
+func (c *FileConfig) module(id, name string) ModuleConfig {
+	if m, ok := c.Modules[id]; ok {
+		return m
+	}
+	return c.Modules[name]
+}
+
+// accountLabels adds the -account-label label, with the account's name, to attrs if the file has several
+// accounts. It modifies attrs.
+func (c *FileConfig) accountLabels(attrs map[string]string) map[string]string {
+	if c.account != "" && *accountLabel != "" {
+		attrs[*accountLabel] = c.account
+	}
+	return attrs
+}
+
+// checkAccountLabel checks -account-label.
+func checkAccountLabel() error {
+	switch {
+	case *accountLabel == "dev_id":
+		return errors.New("-account-label: dev_id is always the device or module ID")
+	case *accountLabel != "" && !labelNameRE.MatchString(*accountLabel):
+		return fmt.Errorf("-account-label: %q is not a valid label name", *accountLabel)
+	}
+	return nil
+}
+
+// applyLabels applies the label templates, module label overrides, and relabel rules to the default labels of the
+// station or module with the fields f. It modifies attrs, unless it's replaced by the templates.
+func (c *FileConfig) applyLabels(attrs map[string]string, f labelFields) map[string]string {
+	mc := c.module(attrs["dev_id"], attrs["module_name"])
+	if len(c.labelTemplates) > 0 {
+		attrs = map[string]string{"dev_id": attrs["dev_id"]}
+		for k, t := range c.labelTemplates {
+			var b strings.Builder
+			if err := t.Execute(&b, f); err != nil {
+				slog.Warn("label template failed", "label", k, "dev_id", f.ID, "err", err)
+				continue
+			}
+			attrs[k] = b.String()
+		}
+	}
+	for k, v := range mc.Labels {
+		attrs[k] = v
+	}
+	for _, r := range c.Relabel {
+		v := attrs[r.Source]
+		if m := r.re.FindStringSubmatchIndex(v); m != nil {
+			attrs[r.Target] = string(r.re.ExpandString(nil, r.Replacement, v, m))
+		}
+	}
+	return attrs
+}
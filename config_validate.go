@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"tailscale.com/jsondb"
+)
+
+// runConfig runs the config subcommands.
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: config: missing subcommand (validate)", errConfig)
+	}
+	switch args[0] {
+	case "validate":
+		if err := validateConfig(); err != nil {
+			return fmt.Errorf("%w:\n%w", errConfig, err)
+		}
+		slog.Info("config is valid")
+		return nil
+	default:
+		return fmt.Errorf("%w: config: unknown subcommand %q", errConfig, args[0])
+	}
+}
+
+// validateConfig checks the effective configuration, from flags and config files together.
+// Syntax errors and the structured config's own checks are already reported while parsing flags.
+func validateConfig() error {
+	var errs []error
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("-log-level: %w", err))
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		errs = append(errs, fmt.Errorf("-log-format: unknown format %q", *logFormat))
+	}
+
+	for _, l := range []struct{ flag, name string }{{"-lookup", *lookup}, {"-lookup-check", *lookupCheck}} {
+		switch l.name {
+		case "", "state":
+		case "promql", "vm-export", "vm-series", "remote-read":
+			if *dest == "" {
+				errs = append(errs, fmt.Errorf("%s=%s: requires -dest or a victoriametrics sink", l.flag, l.name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown lookup %q", l.flag, l.name))
+		}
+	}
+	if err := checkOfflineSignal(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkTombstoneMarker(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkAccountLabel(); err != nil {
+		errs = append(errs, err)
+	}
+	if *resume != "" {
+		if _, err := parseResumeToken(*resume); err != nil {
+			errs = append(errs, fmt.Errorf("-resume: %w", err))
+		}
+	}
+	if *lookup == "" {
+		errs = append(errs, errors.New("-lookup: must not be empty"))
+	}
+
+	dir, err := configDir()
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	configDB, err := jsondb.Open[Config](filepath.Join(dir, "config.json"))
+	if err != nil {
+		return errors.Join(append(errs, fmt.Errorf("config.json: %w", err))...)
+	}
+	config := configDB.Data
+	if len(fileConfig.Accounts) == 0 && (config.ClientID == "" || config.ClientSecret == "") {
+		errs = append(errs, errors.New("no Netatmo client_id and client_secret: set them in config.json or in accounts"))
+	}
+	if config.Token.RefreshToken == "" {
+		errs = append(errs, errors.New("config.json: no OAuth refresh token"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+)
+
+// runDaemon runs the incremental export every interval, optionally serving a status page.
+func runDaemon(args []string) error {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	interval := fs.Duration("interval", 5*time.Minute, "How often to export.")
+	listen := fs.String("listen", "", "Serve a status page at this host:port. Empty to disable.")
+	debug := fs.Bool("debug", false, "Also serve pprof profiles at /debug/pprof/ and expvar variables at /debug/vars on -listen.")
+	debugListen := fs.String("debug-listen", "",
+		"Serve pprof and expvar at this localhost:port instead, apart from the status page.")
+	rediscover := fs.Duration("rediscover", time.Hour,
+		"How often to re-read the stations, to pick up added or removed modules. New modules are exported from -since. Only applies with -skip-unchanged=false, -offline-signal=none, and no -window: otherwise the stations are read on every run.")
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("DAEMON"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	if *debug && *listen == "" {
+		return fmt.Errorf("%w: -debug needs -listen (or use -debug-listen)", errConfig)
+	}
+	if *debugListen != "" {
+		if err := checkLoopback(*debugListen); err != nil {
+			return fmt.Errorf("%w: -debug-listen: %w", errConfig, err)
+		}
+	}
+
+	st := newStatus()
+	if *listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("GET /{$}", st)
+		if *debug {
+			handleDebug(mux)
+		}
+		go func() {
+			slog.Info("serving status", "addr", *listen)
+			if err := http.ListenAndServe(*listen, mux); err != nil {
+				slog.Error("status server", "err", err)
+			}
+		}()
+	}
+
+	if *debugListen != "" {
+		mux := http.NewServeMux()
+		handleDebug(mux)
+		go func() {
+			slog.Info("serving debug endpoints", "addr", *debugListen)
+			if err := http.ListenAndServe(*debugListen, mux); err != nil {
+				slog.Error("debug server", "err", err)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	var lastDiscovery time.Time
+	for {
+		discover := time.Since(lastDiscovery) >= *rediscover
+		err := run(st, discover)
+		if discover && err == nil {
+			lastDiscovery = time.Now()
+		}
+		st.runDone(err)
+		notifyRun(err)
+		if err != nil {
+			slog.Error("export failed", "err", err)
+		}
+		<-ticker.C
+	}
+}
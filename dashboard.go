@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/peterbourgon/ff/v4"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// dashboardUnit is the Grafana unit of a data type, and the PromQL to convert the exported values to it.
+type dashboardUnit struct {
+	unit    string
+	convert string // With %s for the query; empty for none.
+}
+
+// dashboardUnits are the units of each data type, for each -units.
+var dashboardUnits = map[string]map[netatmo.DataType]dashboardUnit{
+	"metric": {
+		netatmo.DataTemperature:  {unit: "celsius"},
+		netatmo.DataHumidity:     {unit: "humidity"},
+		netatmo.DataCO2:          {unit: "ppm"},
+		netatmo.DataPressure:     {unit: "pressurembar"},
+		netatmo.DataNoise:        {unit: "dB"},
+		netatmo.DataRain:         {unit: "lengthmm"},
+		netatmo.DataWindStrength: {unit: "velocitykmh"},
+		netatmo.DataGustStrength: {unit: "velocitykmh"},
+		netatmo.DataWindAngle:    {unit: "degree"},
+	},
+	"imperial": {
+		netatmo.DataTemperature:  {unit: "fahrenheit", convert: "%s * 9 / 5 + 32"},
+		netatmo.DataHumidity:     {unit: "humidity"},
+		netatmo.DataCO2:          {unit: "ppm"},
+		netatmo.DataPressure:     {unit: "pressurehg", convert: "%s * 0.02953"},
+		netatmo.DataNoise:        {unit: "dB"},
+		netatmo.DataRain:         {unit: "lengthin", convert: "%s / 25.4"},
+		netatmo.DataWindStrength: {unit: "velocitymph", convert: "%s * 0.621371"},
+		netatmo.DataGustStrength: {unit: "velocitymph", convert: "%s * 0.621371"},
+		netatmo.DataWindAngle:    {unit: "degree"},
+	},
+}
+
+// dashboardTypes are the data types in the order of their panels.
+var dashboardTypes = []netatmo.DataType{
+	netatmo.DataTemperature, netatmo.DataHumidity, netatmo.DataCO2, netatmo.DataNoise, netatmo.DataPressure,
+	netatmo.DataRain, netatmo.DataWindStrength, netatmo.DataGustStrength, netatmo.DataWindAngle,
+}
+
+// grafanaPanel is the part of a Grafana panel's JSON model that the dashboard sets.
+type grafanaPanel struct {
+	ID          int              `json:"id"`
+	Type        string           `json:"type"`
+	Title       string           `json:"title"`
+	GridPos     grafanaGridPos   `json:"gridPos"`
+	Datasource  grafanaRef       `json:"datasource"`
+	FieldConfig grafanaFieldConf `json:"fieldConfig"`
+	Targets     []grafanaTarget  `json:"targets"`
+}
+
+type grafanaGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type grafanaRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaFieldConf struct {
+	Defaults struct {
+		Unit   string         `json:"unit,omitempty"`
+		Custom map[string]any `json:"custom,omitempty"`
+	} `json:"defaults"`
+	Overrides []any `json:"overrides"`
+}
+
+type grafanaTarget struct {
+	RefID        string     `json:"refId"`
+	Datasource   grafanaRef `json:"datasource"`
+	Expr         string     `json:"expr"`
+	LegendFormat string     `json:"legendFormat"`
+}
+
+// runDashboard writes a Grafana dashboard for the stations in the state (or discovered now, if none), with a
+// graph per data type and a series per module.
+func runDashboard(args []string) error {
+	fs := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	out := fs.String("o", "-", "Write the dashboard JSON to this file, or - for stdout.")
+	title := fs.String("title", "Netatmo", "Dashboard title.")
+	uid := fs.String("uid", "netatmo-otel", "Dashboard UID; importing again with the same UID replaces the dashboard.")
+	prefix := fs.String("metric-prefix", "netatmo_",
+		"Prefix of the metric names in the destination, if it renames them (e.g. with a relabeling proxy).")
+	units := fs.String("units", "metric", "Units to show: metric or imperial.")
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("DASHBOARD"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	unitsByType, ok := dashboardUnits[*units]
+	if !ok {
+		return fmt.Errorf("%w: dashboard: unknown -units %q (want metric or imperial)", errConfig, *units)
+	}
+
+	stateDB, err := openState()
+	if err != nil {
+		return err
+	}
+	stations := stateDB.Data.Stations
+	stateDB.Close()
+	if len(stations) == 0 {
+		ctx := context.Background()
+		client, err := newClient(ctx)
+		if err != nil {
+			return err
+		}
+		if stations, err = client.GetStations(ctx); err != nil {
+			return err
+		}
+	}
+
+	ds := grafanaRef{Type: "prometheus", UID: "${datasource}"}
+	var panels []grafanaPanel
+	addPanel := func(p grafanaPanel) {
+		// Two panels per row.
+		p.ID = len(panels) + 1
+		p.GridPos = grafanaGridPos{X: 12 * (len(panels) % 2), Y: 8 * (len(panels) / 2), W: 12, H: 8}
+		p.Datasource = ds
+		panels = append(panels, p)
+	}
+	for _, dt := range dashboardTypes {
+		u := unitsByType[dt]
+		p := grafanaPanel{Type: "timeseries", Title: dashboardTitle(dt)}
+		p.FieldConfig.Defaults.Unit = u.unit
+		if dt == netatmo.DataRain {
+			p.FieldConfig.Defaults.Custom = map[string]any{"drawStyle": "bars", "fillOpacity": 80}
+		}
+		p.FieldConfig.Overrides = []any{}
+		add := func(id, module string, dataTypes []netatmo.DataType) {
+			if !slices.Contains(dataTypes, dt) || fileConfig.module(id, module).Skip {
+				return
+			}
+			// By dev_id, the one label that label templates can't change.
+			name := *prefix + strings.TrimPrefix(export.MetricName(dt), "netatmo_")
+			expr := fmt.Sprintf(`%s{dev_id=%q}`, name, id)
+			if u.convert != "" {
+				expr = fmt.Sprintf(u.convert, expr)
+			}
+			p.Targets = append(p.Targets, grafanaTarget{
+				RefID: refID(len(p.Targets)), Datasource: ds, Expr: expr, LegendFormat: module,
+			})
+		}
+		for _, dev := range stations {
+			add(string(dev.ID), dev.Name, dev.DataTypes)
+			for _, mod := range dev.Modules {
+				add(string(mod.ID), mod.Name, mod.DataTypes)
+			}
+		}
+		if len(p.Targets) > 0 {
+			addPanel(p)
+		}
+	}
+	if len(panels) == 0 {
+		return errors.New("dashboard: no modules with data to graph")
+	}
+	p := grafanaPanel{Type: "timeseries", Title: "Time since last export"}
+	p.FieldConfig.Defaults.Unit = "s"
+	p.FieldConfig.Overrides = []any{}
+	p.Targets = []grafanaTarget{{
+		RefID:        "A",
+		Datasource:   ds,
+		Expr:         fmt.Sprintf("time() - %sexport_last_success_timestamp_seconds", *prefix),
+		LegendFormat: "{{dev_id}}",
+	}}
+	addPanel(p)
+
+	dashboard := map[string]any{
+		"title":         *title,
+		"uid":           *uid,
+		"tags":          []string{"netatmo"},
+		"schemaVersion": 39,
+		"editable":      true,
+		"time":          map[string]string{"from": "now-7d", "to": "now"},
+		"refresh":       "5m",
+		"templating": map[string]any{"list": []any{map[string]any{
+			"name": "datasource", "label": "Data source", "type": "datasource", "query": "prometheus",
+		}}},
+		"panels": panels,
+	}
+	bs, err := json.MarshalIndent(dashboard, "", "  ")
+	if err != nil {
+		return err
+	}
+	bs = append(bs, '\n')
+	if *out == "-" {
+		_, err = os.Stdout.Write(bs)
+		return err
+	}
+	if err := os.WriteFile(*out, bs, 0o644); err != nil {
+		return err
+	}
+	slog.Info("wrote dashboard", "file", *out, "panels", len(panels))
+	return nil
+}
+
+// dashboardTitle returns the panel title for dt.
+func dashboardTitle(dt netatmo.DataType) string {
+	if dt == netatmo.DataHumidity {
+		return "Humidity"
+	}
+	return string(dt)
+}
+
+// refID returns the Grafana query ref ID for the i'th query of a panel: A, B, ..., Z, AA, AB, ...
+func refID(i int) string {
+	if i < 26 {
+		return string(rune('A' + i))
+	}
+	return refID(i/26-1) + refID(i%26)
+}
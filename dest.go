@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	destRate = flag.Float64("dest-rate", 0,
+		"Most requests per second to -dest, uploads and lookups alike, to spare a small instance during large backfills. 0 for no limit.")
+	destConcurrency = flag.Int("dest-concurrency", 0,
+		"Most requests to -dest in flight at once. 0 for no limit.")
+	maxUploadRate = uploadRateFlag("max-upload-rate",
+		"Most data uploaded to -dest per second, as points (e.g. 20000points/s; -format=prometheus only) or bytes sent (e.g. 512KB/s, with KB and MB of 1000 and 1000000 bytes), so a large backfill doesn't starve a small destination's queries. Empty for no limit.")
+)
+
+var (
+	// destClient is the HTTP client for -dest, set up by setupDest from -dest-proxy and the TLS flags.
+	destClient = http.DefaultClient
+	// destBase is the base URL of -dest, set up by setupDest.
+	destBase = &url.URL{Scheme: "http"}
+	// destTransport is destClient's transport, without the -dest-rate and -dest-concurrency limits.
+	destTransport = http.DefaultTransport.(*http.Transport)
+)
+
+// proxyFunc parses a -*-proxy flag value for http.Transport.Proxy: empty uses HTTP_PROXY, HTTPS_PROXY, and NO_PROXY
+// from the environment, "direct" uses no proxy, and otherwise it is the URL of an http, https, or socks5 proxy.
+func proxyFunc(name, value string) (func(*http.Request) (*url.URL, error), error) {
+	switch value {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "direct":
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: -%s: %w", errConfig, name, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%w: -%s: unsupported proxy scheme %q (want http, https, or socks5)", errConfig, name, u.Scheme)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// setupDest sets destBase and destClient from -dest, -dest-proxy, -dest-ca-file, -dest-insecure-skip-verify,
+// -dest-rate, -dest-concurrency, and a -max-upload-rate in bytes.
+func setupDest() error {
+	base := &url.URL{Scheme: "http", Host: *dest}
+	if strings.Contains(*dest, "://") {
+		u, err := url.Parse(*dest)
+		if err != nil {
+			return fmt.Errorf("%w: -dest: %w", errConfig, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%w: -dest: unsupported scheme %q (want http or https)", errConfig, u.Scheme)
+		}
+		base = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	}
+
+	proxy, err := proxyFunc("dest-proxy", *destProxy)
+	if err != nil {
+		return err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	if *destCAFile != "" || *destInsecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: *destInsecureSkipVerify}
+	}
+	if *destCAFile != "" {
+		pem, err := os.ReadFile(*destCAFile)
+		if err != nil {
+			return fmt.Errorf("%w: -dest-ca-file: %w", errConfig, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: -dest-ca-file: no certificates in %s", errConfig, *destCAFile)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	if *destRate < 0 || *destConcurrency < 0 {
+		return fmt.Errorf("%w: -dest-rate and -dest-concurrency can't be negative", errConfig)
+	}
+	var rt http.RoundTripper = t
+	if *destRate > 0 || *destConcurrency > 0 || maxUploadRate.unit == "bytes" {
+		lt := &limitedTransport{RoundTripper: t, bytes: maxUploadRate.limiter("bytes")}
+		if *destRate > 0 {
+			lt.limiter = rate.NewLimiter(rate.Limit(*destRate), 1)
+		}
+		if *destConcurrency > 0 {
+			lt.slots = make(chan struct{}, *destConcurrency)
+		}
+		rt = lt
+	}
+	destBase, destTransport, destClient = base, t, &http.Client{Transport: rt}
+	return nil
+}
+
+// limitedTransport is an http.RoundTripper that paces requests and caps how many are in flight, until their
+// response bodies are closed, and paces the bytes of the request bodies.
+type limitedTransport struct {
+	http.RoundTripper
+	limiter *rate.Limiter // Nil for no limit.
+	slots   chan struct{} // Nil for no limit.
+	bytes   *rate.Limiter // Nil for no limit.
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	release := func() {
+		if t.slots != nil {
+			<-t.slots
+		}
+	}
+	if t.limiter != nil {
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			release()
+			return nil, fmt.Errorf("-dest-rate: %w", err)
+		}
+	}
+	if t.bytes != nil && req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = &pacedBody{ReadCloser: req.Body, ctx: req.Context(), limiter: t.bytes}
+	}
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody calls release once, when closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// pacedBody is a request body read no faster than its limiter allows.
+type pacedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (b *pacedBody) Read(p []byte) (int, error) {
+	if len(p) > b.limiter.Burst() {
+		p = p[:b.limiter.Burst()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if werr := b.limiter.WaitN(b.ctx, n); werr != nil {
+		return n, fmt.Errorf("-max-upload-rate: %w", werr)
+	}
+	return n, err
+}
+
+// uploadRate is a flag.Value for -max-upload-rate: a number of points or bytes per second.
+type uploadRate struct {
+	perSecond float64
+	unit      string // points or bytes; empty for no limit.
+}
+
+// uploadRateFlag defines an uploadRate flag.
+func uploadRateFlag(name, usage string) *uploadRate {
+	v := &uploadRate{}
+	flag.Var(v, name, usage)
+	return v
+}
+
+// uploadRateUnits are the units an uploadRate may have, and what they count.
+var uploadRateUnits = []struct {
+	suffix string
+	unit   string
+	scale  float64
+}{
+	{"points", "points", 1},
+	{"KB", "bytes", 1e3},
+	{"MB", "bytes", 1e6},
+	{"B", "bytes", 1},
+}
+
+func (v *uploadRate) String() string {
+	if v == nil || v.unit == "" {
+		return ""
+	}
+	suffix := "points/s"
+	if v.unit == "bytes" {
+		suffix = "B/s"
+	}
+	return strconv.FormatFloat(v.perSecond, 'f', -1, 64) + suffix
+}
+
+func (v *uploadRate) Set(s string) error {
+	if s == "" {
+		*v = uploadRate{}
+		return nil
+	}
+	num := strings.TrimSuffix(s, "/s")
+	for _, u := range uploadRateUnits {
+		if n, ok := strings.CutSuffix(num, u.suffix); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+			if err != nil || f <= 0 {
+				break
+			}
+			*v = uploadRate{perSecond: f * u.scale, unit: u.unit}
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a positive number of points/s, B/s, KB/s, or MB/s", s)
+}
+
+// limiter returns a limiter for the rate if it counts unit, or nil. Its burst is a second's worth.
+func (v *uploadRate) limiter(unit string) *rate.Limiter {
+	if v.unit != unit {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(v.perSecond), max(int(v.perSecond), 1))
+}
+
+// waitN waits until the limiter allows n events, in bursts if n is more than a burst, so a large segment is paced
+// rather than refused.
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	for n > 0 {
+		k := min(n, limiter.Burst())
+		if err := limiter.WaitN(ctx, k); err != nil {
+			return err
+		}
+		n -= k
+	}
+	return nil
+}
+
+// destURL returns the URL of path on -dest.
+func destURL(path string) *url.URL {
+	u := *destBase
+	u.Path = path
+	return &u
+}
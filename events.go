@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	otellog "go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/resource"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+var eventsURL = flag.String("events-otlp-url", "",
+	"Send the config's threshold events as OTLP log records to this OTLP/HTTP logs URL, e.g. VictoriaLogs' http://host:9428/insert/opentelemetry/v1/logs. They are logged either way.")
+
+// eventWatcher checks the newly exported points against the config's events, and emits an event when a module
+// crosses a threshold, in either direction. Which events are firing, and through which point, is kept in the
+// state, so a threshold that stays crossed across runs fires once, and the points that -incremental-overlap or
+// -window export again aren't evaluated again.
+type eventWatcher struct {
+	state    *State
+	events   []EventConfig
+	provider *sdklog.LoggerProvider // Nil without -events-otlp-url.
+	logger   otellog.Logger
+
+	mu sync.Mutex
+	// pending are the events' states after each page observed but not yet saved, by key, oldest first. The state
+	// only gets them once the page is uploaded, so the events of a failed upload are evaluated again on the next run.
+	pending map[string][]eventState
+}
+
+// newEventWatcher returns a watcher for the config's events, or nil if there are none.
+func newEventWatcher(ctx context.Context, state *State) (*eventWatcher, error) {
+	if len(fileConfig.Events) == 0 {
+		return nil, nil
+	}
+	w := &eventWatcher{state: state, events: fileConfig.Events, pending: map[string][]eventState{}}
+	if *eventsURL == "" {
+		return w, nil
+	}
+	if u, err := url.Parse(*eventsURL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%w: -events-otlp-url: not a URL: %q", errConfig, *eventsURL)
+	}
+	exp, err := otlploghttp.New(ctx, otlploghttp.WithEndpointURL(*eventsURL),
+		otlploghttp.WithCompression(otlploghttp.GzipCompression))
+	if err != nil {
+		return nil, err
+	}
+	w.provider = sdklog.NewLoggerProvider(
+		sdklog.WithProcessor(sdklog.NewBatchProcessor(exp)),
+		sdklog.WithResource(resource.NewSchemaless(attribute.String("service.name", "netatmo-otel"))),
+	)
+	w.logger = w.provider.Logger("netatmo-otel/events")
+	return w, nil
+}
+
+// observe is an export.Exporter.Observe, checking the points of m after the last evaluated against the events.
+func (w *eventWatcher) observe(m export.Module, points []netatmo.DataPoint) {
+	for _, e := range w.events {
+		i := slices.Index(m.DataTypes, e.dataType)
+		if i < 0 {
+			continue
+		}
+		key := eventKey(m, e)
+		start := w.current(key)
+		s := start
+		for _, p := range points {
+			v := p.Values[i]
+			if !p.Time.After(s.Last) || math.IsNaN(v) {
+				continue
+			}
+			firing := e.firing(v)
+			changed := s.Firing != firing
+			s = eventState{Firing: firing, Last: p.Time}
+			if changed {
+				w.emit(e, m, p.Time, v, firing)
+			}
+		}
+		if s.Last.Equal(start.Last) {
+			continue // Nothing new evaluated.
+		}
+		w.mu.Lock()
+		w.pending[key] = append(w.pending[key], s)
+		w.mu.Unlock()
+	}
+}
+
+// saved is an export.Exporter.Saved, moving the states of m's events through t, now uploaded, to the state.
+func (w *eventWatcher) saved(m export.Module, t time.Time) {
+	for _, e := range w.events {
+		key := eventKey(m, e)
+		w.mu.Lock()
+		pending := w.pending[key]
+		n := 0
+		for n < len(pending) && !pending[n].Last.After(t) {
+			n++
+		}
+		if n > 0 {
+			w.state.mu.Lock()
+			w.state.Events[key] = pending[n-1]
+			w.state.mu.Unlock()
+			w.pending[key] = pending[n:]
+		}
+		w.mu.Unlock()
+	}
+}
+
+// current returns the state of the event key after the points observed so far.
+func (w *eventWatcher) current(key string) eventState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if pending := w.pending[key]; len(pending) > 0 {
+		return pending[len(pending)-1]
+	}
+	w.state.mu.Lock()
+	defer w.state.mu.Unlock()
+	return w.state.Events[key]
+}
+
+func eventKey(m export.Module, e EventConfig) string {
+	return export.DevID(m.Device, m.Module) + "/" + e.Name
+}
+
+func (w *eventWatcher) emit(e EventConfig, m export.Module, t time.Time, v float64, firing bool) {
+	state, threshold, op := "resolved", 0.0, ">"
+	if firing {
+		state = "firing"
+	}
+	if e.Above != nil {
+		threshold = *e.Above
+	} else {
+		threshold, op = *e.Below, "<"
+	}
+	msg := fmt.Sprintf("%s %s: %s %s %s %g (now %g)", e.Name, state, m.Labels["module_name"], e.dataType, op, threshold, v)
+	slog.Info("event", "event", e.Name, "state", state, "dev_id", export.DevID(m.Device, m.Module),
+		"data_type", e.dataType, "value", v, "threshold", threshold, "time", t.Format(time.RFC3339))
+	if w.logger == nil {
+		return
+	}
+
+	var r otellog.Record
+	r.SetTimestamp(t)
+	r.SetObservedTimestamp(time.Now())
+	if firing {
+		r.SetSeverity(otellog.SeverityWarn)
+		r.SetSeverityText("WARN")
+	} else {
+		r.SetSeverity(otellog.SeverityInfo)
+		r.SetSeverityText("INFO")
+	}
+	r.SetBody(otellog.StringValue(msg))
+	r.AddAttributes(
+		otellog.String("event.name", e.Name),
+		otellog.String("event.state", state),
+		otellog.String("data_type", string(e.dataType)),
+		otellog.Float64("value", v),
+		otellog.Float64("threshold", threshold),
+	)
+	for k, v := range m.Labels {
+		r.AddAttributes(otellog.String(k, v))
+	}
+	w.logger.Emit(context.Background(), r)
+}
+
+// Close sends the events still queued.
+func (w *eventWatcher) Close(ctx context.Context) error {
+	if w.provider == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return w.provider.Shutdown(ctx)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// TestEventWatcher checks that an event's state reaches the State only once its page is saved, and that points
+// exported again aren't evaluated again.
+func TestEventWatcher(t *testing.T) {
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	emitted := func() int {
+		n := strings.Count(logs.String(), "msg=event ")
+		logs.Reset()
+		return n
+	}
+
+	above := 1000.0
+	state := &State{Events: map[string]eventState{}}
+	w := &eventWatcher{state: state, pending: map[string][]eventState{},
+		events: []EventConfig{{Name: "stuffy", Above: &above, dataType: netatmo.DataCO2}}}
+	m := export.Module{Device: "70:ee:50:00:00:01", DataTypes: []netatmo.DataType{netatmo.DataCO2}}
+	key := eventKey(m, w.events[0])
+	t0 := time.Unix(1700000000, 0)
+	page := func(start time.Time, values ...float64) []netatmo.DataPoint {
+		var points []netatmo.DataPoint
+		for i, v := range values {
+			points = append(points, netatmo.DataPoint{Time: start.Add(time.Duration(i) * 5 * time.Minute), Values: []float64{v}})
+		}
+		return points
+	}
+
+	w.observe(m, page(t0, 900, 1100))
+	if n := emitted(); n != 1 {
+		t.Errorf("emitted %d events, want the firing one", n)
+	}
+	if _, ok := state.Events[key]; ok {
+		t.Errorf("state = %+v before the page was saved", state.Events[key])
+	}
+	// The next page continues from the unsaved one.
+	w.observe(m, page(t0.Add(10*time.Minute), 1200))
+	if n := emitted(); n != 0 {
+		t.Errorf("emitted %d events while still firing", n)
+	}
+
+	w.saved(m, t0.Add(5*time.Minute))
+	if got, want := state.Events[key], (eventState{Firing: true, Last: t0.Add(5 * time.Minute)}); got != want {
+		t.Errorf("state after the first page = %+v, want %+v", got, want)
+	}
+	w.saved(m, t0.Add(10*time.Minute))
+	if got := state.Events[key].Last; !got.Equal(t0.Add(10 * time.Minute)) {
+		t.Errorf("state after the second page through %v", got)
+	}
+
+	// Exported again with the overlap: only the new point is evaluated.
+	w.observe(m, page(t0, 900, 1100, 1200, 800))
+	if n := emitted(); n != 1 {
+		t.Errorf("emitted %d events, want the resolved one", n)
+	}
+}
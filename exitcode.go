@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// Exit codes, for wrapper scripts and systemd units that react per cause. Documented in the README.
+const (
+	exitOK          = 0
+	exitFailure     = 1 // Anything not covered below.
+	exitConfig      = 2 // Invalid flags, config file, or command line; same as the flag package's usage errors.
+	exitAuth        = 3 // The Netatmo token is missing, invalid, or could not be refreshed.
+	exitQuota       = 4 // Netatmo rate limited the requests.
+	exitDestination = 5 // The destination could not be written to or queried.
+	exitPartial     = 6 // Some modules were exported, and others failed.
+)
+
+var (
+	errConfig      = errors.New("invalid configuration")
+	errDestination = errors.New("destination unreachable")
+	errPartial     = errors.New("partial export")
+)
+
+// exitCode returns the exit code for err. When err matches several causes, the most specific wins:
+// a partial export that failed because of the destination exits with exitDestination.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errConfig):
+		return exitConfig
+	case errors.Is(err, netatmo.ErrUnauthorized):
+		return exitAuth
+	case errors.Is(err, netatmo.ErrRateLimited):
+		return exitQuota
+	case errors.Is(err, errDestination):
+		return exitDestination
+	case errors.Is(err, errPartial):
+		return exitPartial
+	default:
+		return exitFailure
+	}
+}
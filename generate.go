@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// runGenerate exports synthetic weather for a made-up station, for building dashboards and alerts before real
+// history accumulates. Nothing is read from Netatmo, and no state is kept.
+func runGenerate(args []string) (err error) {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	from := &sinceValue{ago: 7 * 24 * time.Hour}
+	fs.Var(from, "from", "Start of the series: this long ago, or at this RFC3339 timestamp.")
+	step := fs.Duration("step", measureInterval, "Time between samples.")
+	seed := fs.Uint64("seed", 1, "Random seed. The same seed, range, and step produce the same series.")
+
+	err = ff.Parse(fs, args, ff.WithEnvVarPrefix("GENERATE"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	until := time.Now()
+	since := from.Time()
+	if *step <= 0 {
+		return fmt.Errorf("%w: generate: -step must be positive", errConfig)
+	}
+	if !since.Before(until) {
+		return fmt.Errorf("%w: generate: -from %s is not in the past", errConfig, since)
+	}
+
+	ctx := context.Background()
+	exporter, closeExporter, err := newExporter(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeExporter(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("upload: %w", cerr))
+		}
+	}()
+
+	w := newSyntheticWeather(since.Truncate(*step), until, *step, *seed)
+	e := &export.Exporter{Client: w, Sink: exporter, Derived: fileConfig.derived()}
+	dev := syntheticStation
+	ms := []export.Module{{Device: dev.ID, DataTypes: dev.DataTypes, Labels: stationAttrs(dev)}}
+	for _, mod := range dev.Modules {
+		ms = append(ms, export.Module{Device: dev.ID, Module: mod.ID, DataTypes: mod.DataTypes, Labels: moduleAttrs(dev, mod)})
+	}
+	for _, m := range ms {
+		n := 0
+		if err := e.Range(ctx, m, since, until, func(points []netatmo.DataPoint, _ time.Time) { n += len(points) }); err != nil {
+			return err
+		}
+		slog.Info("generated", "dev_id", export.DevID(m.Device, m.Module), "points", n)
+	}
+	return nil
+}
+
+// syntheticStation is the made-up station that generate exports, with IDs in a range Netatmo doesn't assign.
+var syntheticStation = netatmo.Station{
+	ID: "70:ee:50:ff:ff:01", Type: netatmo.ModuleMain, Name: "Synthetic Indoor",
+	HomeID: "synthetic", HomeName: "Synthetic",
+	DataTypes: []netatmo.DataType{
+		netatmo.DataTemperature, netatmo.DataHumidity, netatmo.DataCO2, netatmo.DataNoise, netatmo.DataPressure,
+	},
+	Modules: []netatmo.Module{
+		{ID: "02:00:00:ff:ff:01", Type: netatmo.ModuleOutdoor, Name: "Synthetic Outdoor",
+			DataTypes: []netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity}},
+		{ID: "05:00:00:ff:ff:01", Type: netatmo.ModuleRain, Name: "Synthetic Rain",
+			DataTypes: []netatmo.DataType{netatmo.DataRain}},
+	},
+}
+
+// syntheticWeather is an export.Client serving a plausible series for syntheticStation: diurnal temperature,
+// humidity, noise, and CO2 cycles, slow pressure fronts, and rain showers that cool and humidify the outdoors.
+type syntheticWeather struct {
+	start   time.Time
+	step    time.Duration
+	samples []weatherSample
+}
+
+type weatherSample struct {
+	indoorTemp, indoorHumidity, co2, noise, pressure float64
+	outdoorTemp, outdoorHumidity, rain               float64
+}
+
+func newSyntheticWeather(start, end time.Time, step time.Duration, seed uint64) *syntheticWeather {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	w := &syntheticWeather{start: start, step: step}
+	hourly := float64(step) / float64(time.Hour)
+	raining := 0.0 // Hours of the current shower left.
+	for t := start; !t.After(end); t = t.Add(step) {
+		hour := float64(t.Hour()) + float64(t.Minute())/60
+		day := 2 * math.Pi * (hour - 9) / 24 // Peaks at 15:00.
+		days := float64(t.Sub(start)) / float64(24*time.Hour)
+
+		if raining > 0 {
+			raining -= hourly
+		} else if rng.Float64() < 0.02*hourly {
+			raining = 0.5 + 3*rng.Float64()
+		}
+		var s weatherSample
+		if raining > 0 {
+			s.rain = math.Round(rng.Float64()*2*hourly*100) / 100 // Up to 2mm/h.
+		}
+		s.outdoorTemp = 10 + 6*math.Sin(day) + 4*math.Sin(2*math.Pi*days/9) + rng.NormFloat64()*0.2
+		s.outdoorHumidity = 70 - 15*math.Sin(day) + rng.NormFloat64()
+		if raining > 0 {
+			s.outdoorTemp -= 2
+			s.outdoorHumidity = 90 + 5*rng.Float64()
+		}
+		s.pressure = 1013 + 8*math.Sin(2*math.Pi*days/5) + rng.NormFloat64()*0.3
+		s.indoorTemp = 21 + 1*math.Sin(day-0.5) + rng.NormFloat64()*0.1
+		s.indoorHumidity = 45 + 5*math.Sin(day) + rng.NormFloat64()
+		occupied := hour >= 18 || hour < 8
+		s.co2, s.noise = 450+rng.NormFloat64()*20, 35+rng.NormFloat64()
+		if occupied {
+			s.co2 += 500 * math.Min(1, math.Mod(hour+6, 24)/4) // Builds up over the evening.
+			s.noise += 10
+		}
+		w.samples = append(w.samples, s)
+	}
+	return w
+}
+
+// GetMeasure implements export.Client, in pages like netatmo.Client.
+func (w *syntheticWeather) GetMeasure(
+	ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+	since, until time.Time, yield func(points []netatmo.DataPoint, nextTime time.Time) error,
+) error {
+	i := max(0, int((since.Sub(w.start)+w.step-1)/w.step))
+	for i < len(w.samples) {
+		var points []netatmo.DataPoint
+		for ; i < len(w.samples) && len(points) < measurePageSize; i++ {
+			t := w.start.Add(time.Duration(i) * w.step)
+			if !until.IsZero() && t.After(until) {
+				break
+			}
+			values := make([]float64, len(dataTypes))
+			for j, dt := range dataTypes {
+				values[j] = w.samples[i].value(module != "", dt)
+			}
+			points = append(points, netatmo.DataPoint{Time: t, Values: values})
+		}
+		if len(points) == 0 {
+			return nil
+		}
+		if err := yield(points, points[len(points)-1].Time.Add(time.Second)); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s weatherSample) value(outdoor bool, dt netatmo.DataType) float64 {
+	round := func(v float64) float64 { return math.Round(v*10) / 10 }
+	switch {
+	case dt == netatmo.DataTemperature && outdoor:
+		return round(s.outdoorTemp)
+	case dt == netatmo.DataHumidity && outdoor:
+		return math.Round(min(100, s.outdoorHumidity))
+	case dt == netatmo.DataTemperature:
+		return round(s.indoorTemp)
+	case dt == netatmo.DataHumidity:
+		return math.Round(s.indoorHumidity)
+	case dt == netatmo.DataCO2:
+		return math.Round(s.co2)
+	case dt == netatmo.DataNoise:
+		return math.Round(s.noise)
+	case dt == netatmo.DataPressure:
+		return round(s.pressure)
+	case dt == netatmo.DataRain:
+		return s.rain
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+
+	"sgrankin.dev/netatmo-otel/internal/csvimport"
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// runImport exports the history in CSV files downloaded from the Netatmo web app, for one module, through the
+// same sink as the API history. The cursors are left alone, as for backfill.
+func runImport(args []string) (err error) {
+	stdfs := flag.NewFlagSet("import", flag.ContinueOnError)
+	target := stdfs.String("module", "", "The device or module ID or name that the files are the history of. Required.")
+	fs := ff.NewFlagSetFrom("import", stdfs)
+
+	err = ff.Parse(fs, args, ff.WithEnvVarPrefix("IMPORT"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		stdfs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	paths := fs.GetArgs()
+	if *target == "" || len(paths) == 0 {
+		return fmt.Errorf("%w: import: usage: import -module NAME FILE.csv...", errConfig)
+	}
+	files := make([]*csvimport.File, len(paths))
+	for i, path := range paths {
+		if files[i], err = readExportFile(path); err != nil {
+			return fmt.Errorf("%w: import: %s: %w", errConfig, path, err)
+		}
+	}
+
+	ctx := context.Background()
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	stations, err := client.GetStations(ctx)
+	if err != nil {
+		return err
+	}
+	var m *export.Module
+	for _, dev := range stations {
+		if *target == string(dev.ID) || *target == dev.Name {
+			m = &export.Module{Device: dev.ID, Labels: stationAttrs(dev)}
+		}
+		for _, mod := range dev.Modules {
+			if *target == string(mod.ID) || *target == mod.Name {
+				m = &export.Module{Device: dev.ID, Module: mod.ID, Labels: moduleAttrs(dev, mod)}
+			}
+		}
+	}
+	if m == nil {
+		return fmt.Errorf("%w: import: no device or module matches %q", errConfig, *target)
+	}
+
+	exporter, closeExporter, err := newExporter(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeExporter(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("upload: %w", cerr))
+		}
+	}()
+
+	for i, f := range files {
+		if len(f.Ignored) > 0 {
+			slog.Warn("ignoring unknown columns", "file", paths[i], "columns", f.Ignored)
+		}
+		first, last := f.Range()
+		e := &export.Exporter{Client: f, Sink: exporter, Derived: fileConfig.derived()}
+		// One data type at a time, so a point missing some values still has the others exported.
+		for _, dt := range f.DataTypes {
+			m.DataTypes = []netatmo.DataType{dt}
+			n := 0
+			if err := e.Range(ctx, *m, first, last, func(points []netatmo.DataPoint, _ time.Time) { n += len(points) }); err != nil {
+				return fmt.Errorf("import: %s: %w", paths[i], err)
+			}
+			slog.Info("imported", "file", paths[i], "dev_id", export.DevID(m.Device, m.Module), "data_type", dt,
+				"points", n, "from", first.Format(time.RFC3339), "to", last.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// readExportFile reads a CSV file exported from the Netatmo web app.
+func readExportFile(path string) (*csvimport.File, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".xls", ".xlsx":
+		return nil, errors.New("spreadsheets are not supported; export the data as CSV instead")
+	}
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return csvimport.Read(r)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+	"tailscale.com/jsondb"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// runInit runs the init command: an interactive first-run setup that asks for the Netatmo Connect app's
+// credentials, authorizes it, asks for a destination, and writes a structured config file that uses them.
+// The token goes to config.json, as for any run.
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	out := fs.String("o", "netatmo-otel.yaml",
+		"Write the config file here; it must not exist yet.")
+	redirect := fs.String("redirect", "http://localhost:8765/callback",
+		"The OAuth redirect URI. If it's on this host, init listens there for the browser to bring back the "+
+			"authorization code; otherwise paste the URL the browser lands on.")
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("INIT"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%w: init: %s already exists", errConfig, *out)
+	}
+	redirectURL, err := url.Parse(*redirect)
+	if err != nil || redirectURL.Host == "" {
+		return fmt.Errorf("%w: init: -redirect: not an absolute URL: %q", errConfig, *redirect)
+	}
+
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	configDB, err := jsondb.Open[Config](filepath.Join(dir, "config.json"))
+	if err != nil {
+		return fmt.Errorf("config.json: %w", err)
+	}
+
+	ctx := context.Background()
+	p := newPrompter(os.Stdin, os.Stdout)
+	fmt.Println("Create an app at https://dev.netatmo.com/apps, and enter its credentials.")
+	fmt.Printf("Add %s to the app's redirect URIs.\n", *redirect)
+	clientID, err := p.ask("Client ID", configDB.Data.ClientID)
+	if err != nil {
+		return err
+	}
+	clientSecret, err := p.askSecret("Client secret", configDB.Data.ClientSecret)
+	if err != nil {
+		return err
+	}
+
+	token, err := authorize(ctx, p, oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       []string{"read_station"},
+		Endpoint:     oauth2.Endpoint{AuthURL: *netatmoURL + "/oauth/authorize", TokenURL: *netatmoURL + "/oauth2/token"},
+		RedirectURL:  *redirect,
+	}, redirectURL)
+	if err != nil {
+		return err
+	}
+	*configDB.Data = Config{Token: *token, ClientID: clientID, ClientSecret: clientSecret}
+	if err := configDB.Save(); err != nil {
+		return fmt.Errorf("config.json: %w", err)
+	}
+
+	// Check the token with a call, and show what the exports will cover.
+	client := netatmo.NewClientAt(ctx, *netatmoURL, clientID, clientSecret, *token,
+		func(t *oauth2.Token, err error) error {
+			if err == nil {
+				configDB.Data.Token = *t
+				return configDB.Save()
+			}
+			return err
+		})
+	client.SetUserAgent(*userAgent)
+	stations, err := client.GetStations(ctx)
+	if err != nil {
+		return fmt.Errorf("init: checking the token: %w", err)
+	}
+	for _, s := range stations {
+		fmt.Printf("Found %s (%s) with %d modules.\n", s.Name, s.HomeName, len(s.Modules))
+	}
+
+	var sink SinkConfig
+	for sink.Type == "" {
+		t, err := p.ask("Destination type (victoriametrics or stdout)", "victoriametrics")
+		if err != nil {
+			return err
+		}
+		switch t {
+		case "victoriametrics":
+			dest, err := p.ask("VictoriaMetrics host:port", "localhost:8428")
+			if err != nil {
+				return err
+			}
+			if _, _, err := net.SplitHostPort(dest); err != nil {
+				fmt.Printf("%v; try again.\n", err)
+				continue
+			}
+			sink = SinkConfig{Type: t, Dest: dest}
+		case "stdout":
+			sink = SinkConfig{Type: t}
+		default:
+			fmt.Printf("Unknown destination type %q; try again.\n", t)
+		}
+	}
+
+	// Only what init asked for; a FileConfig would write every section, empty.
+	data, err := yaml.Marshal(struct {
+		Accounts []AccountConfig `yaml:"accounts"`
+		Sinks    []SinkConfig    `yaml:"sinks"`
+	}{[]AccountConfig{{ClientID: clientID, ClientSecret: clientSecret}}, []SinkConfig{sink}})
+	if err != nil {
+		return err
+	}
+	if err := checkInitConfig(data); err != nil {
+		return fmt.Errorf("init: the generated config is invalid: %w", err)
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("init: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	fmt.Printf("Wrote %s. Run:\n\n\tnetatmo-otel -config %s\n", *out, *out)
+	return nil
+}
+
+// checkInitConfig decodes data as a structured config is read, rejecting unknown keys, and checks it.
+func checkInitConfig(data []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var c FileConfig
+	if err := dec.Decode(&c); err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+// authorize runs the OAuth authorization code flow: the user opens the authorization URL in a browser, and
+// the code comes back either to a server at redirect, if it's on this host, or pasted at the prompt.
+func authorize(ctx context.Context, p *prompter, oa oauth2.Config, redirect *url.URL) (*oauth2.Token, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	state := hex.EncodeToString(b)
+
+	codes := make(chan string, 1)
+	if ln, err := listenRedirect(redirect); err != nil {
+		fmt.Printf("Not listening for the redirect (%v); paste the URL the browser lands on instead.\n", err)
+	} else {
+		srv := &http.Server{ReadHeaderTimeout: 10 * time.Second, Handler: http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != redirect.Path && redirect.Path != "" {
+					http.NotFound(w, r)
+					return
+				}
+				code, err := authCode(r.URL.Query(), state)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				fmt.Fprintln(w, "Authorized; return to the terminal.")
+				select {
+				case codes <- code:
+				default:
+				}
+			})}
+		go srv.Serve(ln)
+		defer srv.Close()
+	}
+
+	fmt.Printf("Open this URL and allow access:\n\n\t%s\n\n", oa.AuthCodeURL(state))
+	fmt.Print("Waiting for the redirect; or paste the URL the browser lands on: ")
+	var code string
+	for code == "" {
+		select {
+		case code = <-codes:
+			fmt.Println()
+		case line, ok := <-p.next():
+			p.asked = false
+			if !ok {
+				return nil, fmt.Errorf("init: %w", io.ErrUnexpectedEOF)
+			}
+			u, err := url.Parse(strings.TrimSpace(line))
+			if err == nil {
+				code, err = authCode(u.Query(), state)
+			}
+			if err != nil {
+				fmt.Printf("%v; paste the whole URL: ", err)
+			}
+		}
+	}
+
+	token, err := oa.Exchange(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("init: exchanging the authorization code: %w", err)
+	}
+	return token, nil
+}
+
+// listenRedirect listens at redirect's host and port, if it's a loopback address.
+func listenRedirect(redirect *url.URL) (net.Listener, error) {
+	host, port := redirect.Hostname(), redirect.Port()
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s is not on this host", host)
+	}
+	if redirect.Scheme != "http" {
+		return nil, fmt.Errorf("scheme %s is not http", redirect.Scheme)
+	}
+	if port == "" {
+		port = "80"
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// authCode returns the authorization code from the redirect's query, checking that it's for this state.
+func authCode(q url.Values, state string) (string, error) {
+	if e := q.Get("error"); e != "" {
+		return "", fmt.Errorf("authorization failed: %s", e)
+	}
+	if q.Get("state") != state {
+		return "", errors.New("the state doesn't match this authorization")
+	}
+	code := q.Get("code")
+	if code == "" {
+		return "", errors.New("no authorization code")
+	}
+	return code, nil
+}
+
+// prompter asks questions on a terminal. It reads lines in the background, so the OAuth flow can wait for a
+// pasted URL and the redirect at once without losing the next answer to an abandoned read. It only reads a line
+// once one is asked for, which leaves the terminal to askSecret in between.
+type prompter struct {
+	out   io.Writer
+	fd    int // Of the input, if it's a terminal; else -1.
+	want  chan struct{}
+	lines chan string
+	asked bool // A line was asked for and hasn't been received yet.
+}
+
+func newPrompter(in io.Reader, out io.Writer) *prompter {
+	p := &prompter{out: out, fd: -1, want: make(chan struct{}, 1), lines: make(chan string)}
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		p.fd = int(f.Fd())
+	}
+	go func() {
+		defer close(p.lines)
+		s := bufio.NewScanner(in)
+		for range p.want {
+			if !s.Scan() {
+				return
+			}
+			p.lines <- s.Text()
+		}
+	}()
+	return p
+}
+
+// next returns the channel the next line arrives on, asking for it unless that's already been done. Whoever
+// receives the line must clear asked.
+func (p *prompter) next() <-chan string {
+	if !p.asked {
+		p.asked = true
+		p.want <- struct{}{}
+	}
+	return p.lines
+}
+
+// readLine waits for the next line.
+func (p *prompter) readLine() (string, error) {
+	line, ok := <-p.next()
+	p.asked = false
+	if !ok {
+		return "", fmt.Errorf("init: %w", io.ErrUnexpectedEOF)
+	}
+	return line, nil
+}
+
+// ask prints question and returns the answer, or def if it's empty.
+func (p *prompter) ask(question, def string) (string, error) {
+	return p.prompt(question, def, def, p.readLine)
+}
+
+// askSecret is ask without showing def, nor the answer if the input is a terminal.
+func (p *prompter) askSecret(question, def string) (string, error) {
+	if p.fd < 0 || p.asked {
+		// Not a terminal, or a read is under way that would race with the terminal's.
+		return p.prompt(question, def, "unchanged", p.readLine)
+	}
+	return p.prompt(question, def, "unchanged", func() (string, error) {
+		b, err := term.ReadPassword(p.fd)
+		fmt.Fprintln(p.out)
+		if err != nil {
+			return "", fmt.Errorf("init: %w", err)
+		}
+		return string(b), nil
+	})
+}
+
+func (p *prompter) prompt(question, def, shown string, read func() (string, error)) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, shown)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		line, err := read()
+		if err != nil {
+			return "", err
+		}
+		if answer := strings.TrimSpace(line); answer != "" {
+			return answer, nil
+		} else if def != "" {
+			return def, nil
+		}
+	}
+}
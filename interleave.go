@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// interleaved returns client with its getmeasure calls taking turns, if -interleave is set.
+func interleaved(client export.Client) export.Client {
+	if !*interleave {
+		return client
+	}
+	return &turnClient{client, semaphore.NewWeighted(int64(max(*concurrency, 1)))}
+}
+
+// moduleLimit returns how many modules to export at once: all of them with -interleave, where the turns bound the
+// calls instead, or -concurrency.
+func moduleLimit() int {
+	if *interleave {
+		return -1
+	}
+	return max(*concurrency, 1)
+}
+
+// turnClient makes each getmeasure call wait for a turn, with up to the semaphore's size of them at once. The
+// semaphore serves its waiters in order, and a module only asks for its next turn once it has handled a page, at
+// the back of the line, so the modules exported at once advance a page each in turn under the rate limiter,
+// rather than the first ones using up the quota before the others start.
+type turnClient struct {
+	export.Client
+	turns *semaphore.Weighted
+}
+
+func (c *turnClient) GetMeasure(ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID,
+	dataTypes []netatmo.DataType, since, until time.Time,
+	yield func(points []netatmo.DataPoint, nextTime time.Time) error,
+) error {
+	if err := c.turns.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	held := true
+	defer func() {
+		if held {
+			c.turns.Release(1)
+		}
+	}()
+	return c.Client.GetMeasure(ctx, device, module, dataTypes, since, until,
+		func(points []netatmo.DataPoint, nextTime time.Time) error {
+			c.turns.Release(1)
+			held = false
+			if err := yield(points, nextTime); err != nil {
+				return err
+			}
+			if err := c.turns.Acquire(ctx, 1); err != nil {
+				return err
+			}
+			held = true
+			return nil
+		})
+}
@@ -0,0 +1,186 @@
+// Package csvimport reads the CSV files of module history that the Netatmo web app exports, to import history
+// that the API no longer serves (or that would take too much of the quota).
+package csvimport
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// File is the history in one exported file.
+type File struct {
+	DataTypes []netatmo.DataType // The columns with a known data type, in order.
+	Ignored   []string           // The other columns, besides the timestamps.
+	// Points are in time order, with Values in the order of DataTypes, and NaN for the empty cells.
+	Points []netatmo.DataPoint
+
+	// PageSize is the most points GetMeasure yields at once. Defaults to 1024, like the API.
+	PageSize int
+}
+
+// columns maps the lower case column names, without units, to data types.
+var columns = map[string]netatmo.DataType{
+	"temperature": netatmo.DataTemperature,
+	"humidity":    netatmo.DataHumidity,
+	"co2":         netatmo.DataCO2,
+	"noise":       netatmo.DataNoise,
+	"pressure":    netatmo.DataPressure,
+	"rain":        netatmo.DataRain,
+}
+
+// Read reads an exported file. The data follows a header row starting with a Timestamp column of Unix seconds;
+// anything before it (the station and module) is skipped. The columns are separated by semicolons, with decimal
+// commas, or by commas.
+func Read(r io.Reader) (*File, error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		first, rest, ok := strings.Cut(strings.TrimPrefix(line, "\uFEFF"), "Timestamp")
+		if rest = strings.TrimPrefix(rest, `"`); ok && strings.Trim(first, `"`) == "" && rest != "" {
+			comma := rune(rest[0])
+			if comma != ';' && comma != ',' && comma != '\t' {
+				return nil, fmt.Errorf("csvimport: unknown separator %q in header %q", comma, strings.TrimSpace(line))
+			}
+			return read(io.MultiReader(strings.NewReader(line), br), comma)
+		}
+		if err == io.EOF {
+			return nil, fmt.Errorf("csvimport: no Timestamp header row")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// read reads the header row and the data after it.
+func read(r io.Reader, comma rune) (*File, error) {
+	cr := csv.NewReader(r)
+	cr.Comma, cr.FieldsPerRecord, cr.LazyQuotes = comma, -1, true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{}
+	var cols []int // The header index of each of f.DataTypes.
+	for i, name := range header[1:] {
+		key, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(name)), "(")
+		dt, ok := columns[strings.TrimSpace(key)]
+		switch {
+		case ok && !slices.Contains(f.DataTypes, dt):
+			f.DataTypes, cols = append(f.DataTypes, dt), append(cols, i+1)
+		case strings.HasPrefix(strings.ToLower(name), "timezone"):
+		default:
+			f.Ignored = append(f.Ignored, name)
+		}
+	}
+	if len(f.DataTypes) == 0 {
+		return nil, fmt.Errorf("csvimport: no known data columns in %q", header)
+	}
+
+	values := make([]float64, 0, 1024*len(cols))
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csvimport: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		sec, err := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("csvimport: line %d: timestamp: %w", line, err)
+		}
+		start := len(values)
+		for _, c := range cols {
+			v := math.NaN()
+			if c < len(record) {
+				if s := strings.TrimSpace(record[c]); s != "" {
+					if comma == ';' {
+						s = strings.Replace(s, ",", ".", 1)
+					}
+					if v, err = strconv.ParseFloat(s, 64); err != nil {
+						return nil, fmt.Errorf("csvimport: line %d: %s: %w", line, header[c], err)
+					}
+				}
+			}
+			values = append(values, v)
+		}
+		f.Points = append(f.Points, netatmo.DataPoint{Time: time.Unix(sec, 0), Values: values[start:len(values):len(values)]})
+	}
+	slices.SortStableFunc(f.Points, func(a, b netatmo.DataPoint) int { return a.Time.Compare(b.Time) })
+	return f, nil
+}
+
+// Range returns the time of the first and last points, or zero times if there are none.
+func (f *File) Range() (first, last time.Time) {
+	if len(f.Points) == 0 {
+		return time.Time{}, time.Time{}
+	}
+	return f.Points[0].Time, f.Points[len(f.Points)-1].Time
+}
+
+// GetMeasure implements export.Client, ignoring the device and module, in pages like netatmo.Client.
+// Only the points with values for all of dataTypes are yielded; dataTypes must be columns of the file.
+func (f *File) GetMeasure(
+	ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+	since, until time.Time, yield func(points []netatmo.DataPoint, nextTime time.Time) error,
+) error {
+	idx := make([]int, len(dataTypes))
+	for i, dt := range dataTypes {
+		if idx[i] = slices.Index(f.DataTypes, dt); idx[i] < 0 {
+			return fmt.Errorf("csvimport: no %s column", dt)
+		}
+	}
+	pageSize := f.PageSize
+	if pageSize <= 0 {
+		pageSize = 1024
+	}
+	page := make([]netatmo.DataPoint, 0, pageSize)
+	values := make([]float64, pageSize*len(dataTypes))
+	flush := func() error {
+		if len(page) == 0 {
+			return nil
+		}
+		err := yield(page, page[len(page)-1].Time.Add(time.Second))
+		page = page[:0]
+		if err != nil {
+			return err
+		}
+		return ctx.Err()
+	}
+	for _, p := range f.Points {
+		if p.Time.Before(since) || (!until.IsZero() && p.Time.After(until)) {
+			continue
+		}
+		vs := values[len(page)*len(dataTypes) : (len(page)+1)*len(dataTypes)]
+		complete := true
+		for i, j := range idx {
+			vs[i] = p.Values[j]
+			complete = complete && !math.IsNaN(vs[i])
+		}
+		if !complete {
+			continue
+		}
+		if page = append(page, netatmo.DataPoint{Time: p.Time, Values: vs}); len(page) == pageSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
@@ -0,0 +1,108 @@
+package csvimport
+
+import (
+	"context"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+func readFile(t *testing.T, name string) *File {
+	t.Helper()
+	r, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRead(t *testing.T) {
+	f := readFile(t, "testdata/indoor.csv")
+	wantTypes := []netatmo.DataType{
+		netatmo.DataTemperature, netatmo.DataHumidity, netatmo.DataCO2, netatmo.DataNoise, netatmo.DataPressure,
+	}
+	if !slices.Equal(f.DataTypes, wantTypes) || len(f.Ignored) != 0 {
+		t.Errorf("columns = %v, ignored %v; want %v", f.DataTypes, f.Ignored, wantTypes)
+	}
+	if len(f.Points) != 3 {
+		t.Fatalf("got %d points, want 3", len(f.Points))
+	}
+	first, last := f.Range()
+	if !first.Equal(time.Unix(1704067200, 0)) || !last.Equal(time.Unix(1704067800, 0)) {
+		t.Errorf("Range() = %v, %v", first, last)
+	}
+	if got := f.Points[0].Values; got[0] != 20.5 || got[4] != 1013.2 {
+		t.Errorf("first point = %v", got)
+	}
+	if got := f.Points[2].Values; !math.IsNaN(got[1]) || got[2] != 420 {
+		t.Errorf("last point = %v, want no humidity", got)
+	}
+
+	f = readFile(t, "testdata/outdoor.csv")
+	if !slices.Equal(f.DataTypes, []netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity}) ||
+		!slices.Equal(f.Ignored, []string{"Wind Angle"}) {
+		t.Errorf("columns = %v, ignored %v", f.DataTypes, f.Ignored)
+	}
+	if len(f.Points) != 2 || f.Points[1].Values[0] != 5.4 {
+		t.Errorf("points = %v", f.Points)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"Name;Long\n\"Home\";2.3\n",
+		"Timestamp;Wind Angle\n1704067200;90\n",
+		"Timestamp;Temperature\nyesterday;20\n",
+		"Timestamp;Temperature\n1704067200;warm\n",
+	} {
+		if f, err := Read(strings.NewReader(data)); err == nil {
+			t.Errorf("Read(%q) = %+v, want an error", data, f)
+		}
+	}
+}
+
+func TestGetMeasure(t *testing.T) {
+	f := readFile(t, "testdata/indoor.csv")
+	f.PageSize = 1
+	collect := func(dataTypes []netatmo.DataType, since, until time.Time) (times []time.Time) {
+		err := f.GetMeasure(context.Background(), "", "", dataTypes, since, until,
+			func(points []netatmo.DataPoint, nextTime time.Time) error {
+				for _, p := range points {
+					times = append(times, p.Time)
+				}
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return times
+	}
+	t0 := time.Unix(1704067200, 0)
+	all := []time.Time{t0, t0.Add(5 * time.Minute), t0.Add(10 * time.Minute)}
+	if got := collect([]netatmo.DataType{netatmo.DataCO2}, time.Time{}, time.Time{}); !slices.EqualFunc(got, all, time.Time.Equal) {
+		t.Errorf("CO2 at %v, want %v", got, all)
+	}
+	// The last point has no humidity.
+	if got := collect([]netatmo.DataType{netatmo.DataCO2, netatmo.DataHumidity}, time.Time{}, time.Time{}); !slices.EqualFunc(got, all[:2], time.Time.Equal) {
+		t.Errorf("CO2 and humidity at %v, want %v", got, all[:2])
+	}
+	if got := collect([]netatmo.DataType{netatmo.DataCO2}, all[1], all[1]); !slices.EqualFunc(got, all[1:2], time.Time.Equal) {
+		t.Errorf("CO2 in range at %v, want %v", got, all[1:2])
+	}
+	err := f.GetMeasure(context.Background(), "", "", []netatmo.DataType{netatmo.DataRain}, time.Time{}, time.Time{},
+		func([]netatmo.DataPoint, time.Time) error { return nil })
+	if err == nil {
+		t.Error("GetMeasure() of a missing column succeeded")
+	}
+}
@@ -0,0 +1,5 @@
+// Package e2e holds end-to-end tests of the netatmo-otel binary against a fake Netatmo API and a real
+// VictoriaMetrics in Docker. They only build with the e2e tag:
+//
+//	go test -tags e2e ./internal/e2e
+package e2e
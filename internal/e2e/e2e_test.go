@@ -0,0 +1,282 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+	"sgrankin.dev/netatmo-otel/netatmo/netatmotest"
+)
+
+const vmImage = "victoriametrics/victoria-metrics:v1.102.0"
+
+var station = netatmo.Station{
+	ID: "70:ee:50:00:00:01", Type: netatmo.ModuleMain, Name: "Indoor", HomeID: "h1", HomeName: "Home",
+	DataTypes: []netatmo.DataType{netatmo.DataTemperature, netatmo.DataCO2},
+	Modules: []netatmo.Module{{
+		ID: "02:00:00:00:00:01", Type: netatmo.ModuleOutdoor, Name: "Outdoor",
+		DataTypes: []netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity},
+	}},
+}
+
+// TestExportIncremental exports from the fake twice, the second time with fresh local state, so the cursors must
+// come from the promql lookup, and checks that VictoriaMetrics has every sample exactly once.
+func TestExportIncremental(t *testing.T) {
+	bin := buildBinary(t)
+	vm := startVictoriaMetrics(t)
+
+	fake := netatmotest.NewServer(station)
+	t.Cleanup(fake.Close)
+	end := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	fake.Since, fake.Until = end.Add(-2*time.Hour), end
+
+	var (
+		mu     sync.Mutex
+		begins []time.Time // date_begin of the module's getmeasure calls.
+	)
+	handler := fake.Config.Handler
+	fake.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path == "/api/getmeasure" && q.Get("module_id") == string(station.Modules[0].ID) {
+			var sec int64
+			fmt.Sscan(q.Get("date_begin"), &sec)
+			mu.Lock()
+			begins = append(begins, time.Unix(sec, 0))
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	})
+
+	run := func() {
+		t.Helper()
+		mu.Lock()
+		begins = nil
+		mu.Unlock()
+		cmd := exec.Command(bin, "-dest", vm, "-netatmo-url", fake.URL, "-lookup", "promql", "-checkpoint", "0")
+		cmd.Env = append(os.Environ(), "XDG_CONFIG_HOME="+newConfigDir(t))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("export failed: %v\n%s", err, out)
+		}
+		flush(t, vm)
+	}
+
+	run()
+	checkSamples(t, vm, fake.Since, end)
+
+	fake.Until = end.Add(30 * time.Minute)
+	run()
+	checkSamples(t, vm, fake.Since, fake.Until)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(begins) == 0 || !begins[0].Equal(end.Add(time.Second)) {
+		t.Errorf("second run started the module at %v, want %v", begins, end.Add(time.Second))
+	}
+}
+
+// TestOfflineStale exports with -format=remote-write, then again once the station can't reach its module, with
+// -offline-signal=stale, and checks that VictoriaMetrics ends the module's series but not the station's.
+func TestOfflineStale(t *testing.T) {
+	bin := buildBinary(t)
+	vm := startVictoriaMetrics(t)
+
+	st := station
+	st.Reachable = true
+	st.Modules = slices.Clone(station.Modules)
+	st.Modules[0].Reachable = true
+	fake := netatmotest.NewServer(st)
+	t.Cleanup(fake.Close)
+	now := time.Now()
+	fake.Since, fake.Until = now.Truncate(5*time.Minute).Add(-time.Hour), now
+
+	configDir := newConfigDir(t)
+	run := func() time.Time {
+		t.Helper()
+		cmd := exec.Command(bin, "-dest", vm, "-netatmo-url", fake.URL, "-format", "remote-write",
+			"-offline-signal", "stale")
+		cmd.Env = append(os.Environ(), "XDG_CONFIG_HOME="+configDir)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("export failed: %v\n%s", err, out)
+		}
+		flush(t, vm)
+		return time.Now()
+	}
+	live := func(devID string, at time.Time) int {
+		t.Helper()
+		q := url.Values{
+			"query": {fmt.Sprintf("netatmo_temperature{dev_id=%q}", devID)},
+			"time":  {fmt.Sprint(at.Unix())},
+		}
+		resp, err := http.Get("http://" + vm + "/api/v1/query?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var r struct {
+			Data struct {
+				Result []json.RawMessage `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return len(r.Data.Result)
+	}
+
+	at := run()
+	if n := live(string(st.Modules[0].ID), at); n != 1 {
+		t.Fatalf("module's series before it went offline: got %d, want 1", n)
+	}
+
+	fake.Stations[0].Modules[0].Reachable = false
+	at = run().Add(time.Second)
+	if n := live(string(st.Modules[0].ID), at); n != 0 {
+		t.Errorf("offline module's series: got %d, want none after the stale marker", n)
+	}
+	if n := live(string(st.ID), at); n != 1 {
+		t.Errorf("station's series: got %d, want 1", n)
+	}
+}
+
+func buildBinary(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "netatmo-otel")
+	cmd := exec.Command("go", "build", "-o", bin, "sgrankin.dev/netatmo-otel")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+	return bin
+}
+
+// startVictoriaMetrics runs VictoriaMetrics in Docker and returns its host:port.
+func startVictoriaMetrics(t *testing.T) string {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker not found")
+	}
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::8428", vmImage,
+		"-search.latencyOffset=0s", "-search.disableCache").Output()
+	if err != nil {
+		t.Fatalf("docker run: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", id).Run() })
+
+	out, err = exec.Command("docker", "port", id, "8428/tcp").Output()
+	if err != nil {
+		t.Fatalf("docker port: %v", err)
+	}
+	addr := strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return addr
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("VictoriaMetrics did not become healthy: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// newConfigDir returns an XDG_CONFIG_HOME with a token for the fake, and no state.
+func newConfigDir(t *testing.T) string {
+	dir := t.TempDir()
+	config := map[string]any{
+		"client_id": "id", "client_secret": "secret",
+		"token": oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)},
+	}
+	bs, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "netatmo"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "netatmo", "config.json"), bs, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// flush makes the imported samples visible to queries.
+func flush(t *testing.T, vm string) {
+	resp, err := http.Get("http://" + vm + "/internal/force_flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+// exportedSeries is a series from VictoriaMetrics' /api/v1/export.
+type exportedSeries struct {
+	Values     []float64 `json:"values"`
+	Timestamps []int64   `json:"timestamps"`
+}
+
+// checkSamples checks that VictoriaMetrics has each data type of each device once per step from since through until,
+// with the fake's values.
+func checkSamples(t *testing.T, vm string, since, until time.Time) {
+	t.Helper()
+	want := int(until.Sub(since)/(5*time.Minute)) + 1
+	check := func(devID string, dataTypes []netatmo.DataType) {
+		for _, dt := range dataTypes {
+			name := "netatmo_" + strings.ToLower(string(dt))
+			q := url.Values{
+				"match[]": {fmt.Sprintf("%s{dev_id=%q}", name, devID)},
+				"start":   {fmt.Sprint(since.Add(-time.Hour).Unix())},
+			}
+			resp, err := http.Get("http://" + vm + "/api/v1/export?" + q.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// One JSON object per series and line.
+			var series []exportedSeries
+			sc := bufio.NewScanner(resp.Body)
+			sc.Buffer(nil, 1<<20)
+			for sc.Scan() {
+				var s exportedSeries
+				if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+					t.Fatal(err)
+				}
+				series = append(series, s)
+			}
+			resp.Body.Close()
+			if len(series) != 1 {
+				t.Errorf("%s %s: got %d series, want 1", devID, name, len(series))
+				continue
+			}
+			s := series[0]
+			if len(s.Timestamps) != want {
+				t.Errorf("%s %s: got %d samples, want %d", devID, name, len(s.Timestamps), want)
+			}
+			for i, ts := range s.Timestamps {
+				at := time.UnixMilli(ts)
+				if v := netatmotest.Value(dt, at); s.Values[i] != v {
+					t.Errorf("%s %s at %v = %v, want %v", devID, name, at, s.Values[i], v)
+				}
+			}
+		}
+	}
+	check(string(station.ID), station.DataTypes)
+	for _, mod := range station.Modules {
+		check(string(mod.ID), mod.DataTypes)
+	}
+}
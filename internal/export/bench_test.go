@@ -0,0 +1,21 @@
+package export
+
+import (
+	"testing"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// BenchmarkFamilies encodes a full page: 1024 samples of 2 data types.
+func BenchmarkFamilies(b *testing.B) {
+	labels := LabelPairs(testModule.Labels)
+	points := make([]netatmo.DataPoint, 1024)
+	for i := range points {
+		points[i] = netatmo.DataPoint{Time: t0.Add(time.Duration(i) * 5 * time.Minute), Values: []float64{20, 400}}
+	}
+	b.ReportAllocs()
+	for range b.N {
+		Families(labels, testModule.DataTypes, points)
+	}
+}
@@ -0,0 +1,253 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// ExecProtocolVersion is the version of the protocol ExecSink speaks to its subprocess.
+//
+// Each message is a line of JSON. The sink starts with a hello, {"hello":"netatmo-otel","version":1}, on the
+// subprocess's stdin, and the subprocess must answer with the same on its stdout before anything else. Then the
+// sink sends the families, as {"family":{...}} (see ExecFamily), and checkpoints, as {"checkpoint":N} with N
+// counting up from 1. The subprocess answers {"ack":N} once it has durably written everything before checkpoint N,
+// or {"error":"..."} to fail the export. At the end, the sink closes stdin, and the subprocess must ack the last
+// checkpoint and exit with status 0.
+const ExecProtocolVersion = 1
+
+// ExecMessage is a line of the ExecSink protocol, in either direction.
+type ExecMessage struct {
+	Hello      string      `json:"hello,omitempty"`
+	Version    int         `json:"version,omitempty"`
+	Family     *ExecFamily `json:"family,omitempty"`
+	Checkpoint int64       `json:"checkpoint,omitempty"`
+	Ack        int64       `json:"ack,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// ExecFamily is a metric family in the ExecSink protocol.
+type ExecFamily struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"` // gauge or counter.
+	Unit    string       `json:"unit,omitempty"`
+	Help    string       `json:"help,omitempty"`
+	Samples []ExecSample `json:"samples"`
+}
+
+// ExecSample is a sample of an ExecFamily.
+type ExecSample struct {
+	Labels      map[string]string `json:"labels"`
+	TimestampMs int64             `json:"timestamp_ms"`
+	Value       float64           `json:"value"`
+}
+
+// ExecSink is a Sink that sends the families to a subprocess as JSON lines, for backends without a built-in sink.
+// See ExecProtocolVersion for the protocol.
+//
+// It is a Checkpointer: checkpoints run once the subprocess acknowledges them.
+// Encode and Checkpoint are safe for concurrent use.
+type ExecSink struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{} // Closed once the subprocess's stdout is read to the end.
+
+	mu    sync.Mutex // Guards the writes; held before ackMu.
+	w     *bufio.Writer
+	enc   *json.Encoder
+	next  int64
+	dirty bool // Families were encoded since the last checkpoint.
+
+	// ackMu is separate from mu, so acks are handled while a write blocks on a subprocess that is busy acking.
+	ackMu sync.Mutex
+	marks []execMark
+	err   error // The first failure; fails later calls.
+}
+
+type execMark struct {
+	id int64
+	fn func()
+}
+
+// NewExecSink starts cmd, which must not have its Stdin or Stdout set, and completes the handshake.
+func NewExecSink(cmd *exec.Cmd) (*ExecSink, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s := &ExecSink{cmd: cmd, stdin: stdin, done: make(chan struct{}), w: bufio.NewWriter(stdin)}
+	s.enc = json.NewEncoder(s.w)
+
+	fail := func(err error) (*ExecSink, error) {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("exec sink: handshake: %w", err)
+	}
+	if err := s.send(ExecMessage{Hello: "netatmo-otel", Version: ExecProtocolVersion}); err != nil {
+		return fail(err)
+	}
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(nil, 1<<20)
+	if !sc.Scan() {
+		return fail(errors.Join(io.ErrUnexpectedEOF, sc.Err()))
+	}
+	var hello ExecMessage
+	if err := json.Unmarshal(sc.Bytes(), &hello); err != nil {
+		return fail(err)
+	}
+	if hello.Hello != "netatmo-otel" || hello.Version != ExecProtocolVersion {
+		return fail(fmt.Errorf("got %s, want a version %d hello", sc.Bytes(), ExecProtocolVersion))
+	}
+	go s.read(sc)
+	return s, nil
+}
+
+// send writes and flushes m. s.mu must be held.
+func (s *ExecSink) send(m ExecMessage) error {
+	if err := s.enc.Encode(m); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// read handles the acks and errors from the subprocess, until its stdout is closed.
+func (s *ExecSink) read(sc *bufio.Scanner) {
+	defer close(s.done)
+	for sc.Scan() {
+		var m ExecMessage
+		err := json.Unmarshal(sc.Bytes(), &m)
+		if err == nil && m.Error != "" {
+			err = errors.New(m.Error)
+		}
+		if err != nil {
+			s.fail(err)
+			continue
+		}
+		s.ackMu.Lock()
+		var ready []func()
+		for len(s.marks) > 0 && s.marks[0].id <= m.Ack {
+			ready, s.marks = append(ready, s.marks[0].fn), s.marks[1:]
+		}
+		s.ackMu.Unlock()
+		for _, fn := range ready {
+			fn()
+		}
+	}
+	if err := sc.Err(); err != nil {
+		s.fail(err)
+	}
+}
+
+// fail records the first failure, and returns it.
+func (s *ExecSink) fail(err error) error {
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	if s.err == nil {
+		s.err = fmt.Errorf("exec sink: %w", err)
+	}
+	return s.err
+}
+
+// failed returns the first failure, if any.
+func (s *ExecSink) failed() error {
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	return s.err
+}
+
+// Encode implements Sink. The families are buffered, and sent at the next checkpoint.
+func (s *ExecSink) Encode(mf *dto.MetricFamily) error {
+	f := &ExecFamily{
+		Name: mf.GetName(),
+		Type: strings.ToLower(mf.GetType().String()),
+		Unit: mf.GetUnit(),
+		Help: mf.GetHelp(),
+	}
+	for _, m := range mf.GetMetric() {
+		labels := make(map[string]string, len(m.GetLabel()))
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		v := m.GetGauge().GetValue()
+		if m.Counter != nil {
+			v = m.GetCounter().GetValue()
+		}
+		f.Samples = append(f.Samples, ExecSample{Labels: labels, TimestampMs: m.GetTimestampMs(), Value: v})
+	}
+	if len(f.Samples) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failed(); err != nil {
+		return err
+	}
+	if err := s.enc.Encode(ExecMessage{Family: f}); err != nil {
+		return s.fail(err)
+	}
+	s.dirty = true
+	return nil
+}
+
+// Checkpoint implements Checkpointer.
+func (s *ExecSink) Checkpoint(fn func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.failed(); err != nil {
+		return err
+	}
+	return s.checkpoint(fn)
+}
+
+// checkpoint sends a checkpoint for fn. s.mu must be held.
+func (s *ExecSink) checkpoint(fn func()) error {
+	s.next++
+	s.dirty = false
+	s.ackMu.Lock()
+	s.marks = append(s.marks, execMark{s.next, fn})
+	s.ackMu.Unlock()
+	if err := s.send(ExecMessage{Checkpoint: s.next}); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+// Close sends the last families with a checkpoint, closes the subprocess's stdin, and waits for it to exit.
+// It fails if the subprocess failed, or exited before acknowledging every checkpoint.
+func (s *ExecSink) Close() error {
+	s.mu.Lock()
+	if s.failed() == nil && s.dirty {
+		s.checkpoint(func() {})
+	}
+	s.mu.Unlock()
+	s.stdin.Close()
+	<-s.done
+	werr := s.cmd.Wait()
+
+	s.ackMu.Lock()
+	defer s.ackMu.Unlock()
+	switch {
+	case s.err != nil:
+		return s.err
+	case werr != nil:
+		return fmt.Errorf("exec sink: %w", werr)
+	case len(s.marks) > 0:
+		return fmt.Errorf("exec sink: exited without acknowledging %d checkpoints", len(s.marks))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// TestExecSinkHelper is the subprocess for the ExecSink tests, when run with EXEC_SINK_HELPER set to its mode:
+// ok, which acks each checkpoint and reports the families to stderr; badhello; error, which fails the first
+// checkpoint; or noack.
+func TestExecSinkHelper(t *testing.T) {
+	mode := os.Getenv("EXEC_SINK_HELPER")
+	if mode == "" {
+		t.Skip("not a test")
+	}
+	defer os.Exit(0)
+	sc := bufio.NewScanner(os.Stdin)
+	enc := json.NewEncoder(os.Stdout)
+	if mode == "badhello" {
+		enc.Encode(ExecMessage{Hello: "something-else", Version: 99})
+		return
+	}
+	enc.Encode(ExecMessage{Hello: "netatmo-otel", Version: ExecProtocolVersion})
+	sc.Scan() // The hello.
+	for sc.Scan() {
+		var m ExecMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			enc.Encode(ExecMessage{Error: err.Error()})
+			continue
+		}
+		switch {
+		case m.Family != nil:
+			for _, s := range m.Family.Samples {
+				fmt.Fprintf(os.Stderr, "%s %s %d %v\n", m.Family.Name, s.Labels["dev_id"], s.TimestampMs, s.Value)
+			}
+		case m.Checkpoint != 0 && mode == "ok":
+			enc.Encode(ExecMessage{Ack: m.Checkpoint})
+		case m.Checkpoint != 0 && mode == "error":
+			enc.Encode(ExecMessage{Error: "disk full"})
+		}
+	}
+}
+
+func execHelper(t *testing.T, mode string) (*exec.Cmd, *strings.Builder) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExecSinkHelper$")
+	cmd.Env = append(os.Environ(), "EXEC_SINK_HELPER="+mode)
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+	return cmd, stderr
+}
+
+func TestExecSink(t *testing.T) {
+	cmd, stderr := execHelper(t, "ok")
+	s, err := NewExecSink(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := LabelPairs(map[string]string{"dev_id": "70:ee:50:00:00:01"})
+	points := []netatmo.DataPoint{{Time: t0, Values: []float64{21.5}}}
+	for _, mf := range Families(labels, []netatmo.DataType{netatmo.DataTemperature}, points) {
+		if err := s.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan struct{})
+	if err := s.Checkpoint(func() { close(done) }); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("netatmo_temperature 70:ee:50:00:00:01 %d 21.5\n", t0.UnixMilli())
+	if got := stderr.String(); got != want {
+		t.Errorf("subprocess got %q, want %q", got, want)
+	}
+}
+
+func TestExecSinkErrors(t *testing.T) {
+	cmd, _ := execHelper(t, "badhello")
+	if _, err := NewExecSink(cmd); err == nil || !strings.Contains(err.Error(), "handshake") {
+		t.Errorf("NewExecSink() with a bad hello = %v, want a handshake error", err)
+	}
+
+	for _, mode := range []string{"error", "noack"} {
+		cmd, _ := execHelper(t, mode)
+		s, err := NewExecSink(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acked := false
+		if err := s.Checkpoint(func() { acked = true }); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err == nil || acked {
+			t.Errorf("%s: Close() = %v, acked %v; want an error", mode, err, acked)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+// Package export reads module history from Netatmo and encodes it as Prometheus metric families, or OTLP metrics.
+package export
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/protobuf/proto"
+
+	"sgrankin.dev/netatmo-otel/internal/expr"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// Client is the part of *netatmo.Client used to read module history.
+type Client interface {
+	// GetMeasure pages through the module data for dataTypes from since until until (if not zero).
+	GetMeasure(ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+		since, until time.Time, yield func(points []netatmo.DataPoint, nextTime time.Time) error) error
+}
+
+// Sink receives the encoded metric families. An expfmt.Encoder is a Sink.
+type Sink interface {
+	Encode(*dto.MetricFamily) error
+}
+
+// Checkpointer is implemented by sinks that can tell when the families encoded so far have been written.
+type Checkpointer interface {
+	// Checkpoint runs fn once everything encoded before the call has been written.
+	Checkpoint(fn func()) error
+}
+
+// Checkpoint runs fn once everything encoded to s so far has been written: immediately, unless s is a Checkpointer.
+func Checkpoint(s Sink, fn func()) error {
+	if c, ok := s.(Checkpointer); ok {
+		return c.Checkpoint(fn)
+	}
+	fn()
+	return nil
+}
+
+// CursorLookup finds where to resume exporting a module from.
+type CursorLookup interface {
+	// Cursor returns the time to resume exporting m's DataTypes from: one second after the oldest of their last
+	// exported samples. It returns the zero time if any of the data types has never been exported.
+	// The lookups of the destination match m's series on the Labels that identify it, not on names that a
+	// rename changes.
+	Cursor(ctx context.Context, m Module) (time.Time, error)
+}
+
+// Module is a set of a device's or module's data types, exported together.
+type Module struct {
+	Device    netatmo.DeviceID
+	Module    netatmo.ModuleID // Empty for the station itself.
+	DataTypes []netatmo.DataType
+	Labels    map[string]string // Attached to every series; see StationLabels and ModuleLabels.
+}
+
+// Exporter exports module history from a Client to a Sink.
+type Exporter struct {
+	Client Client
+	Sink   Sink
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	// Lookup finds the cursor to resume from. If nil, every export starts at Since.
+	Lookup     CursorLookup
+	LookupName string // For logs.
+	// Check is an optional second lookup, used when Lookup has no cursor and logged when they disagree.
+	Check     CursorLookup
+	CheckName string // For logs.
+	// Since returns where to start a module without a cursor. The zero time means its first recorded sample.
+	Since func(m Module) time.Time
+	// Overlap is how far before its cursor to resume a module, re-fetching the samples around the cursor in case
+	// Netatmo added some late or the destination rounded the last timestamp. The repeats are the same samples, so
+	// the destination should deduplicate them.
+	Overlap time.Duration
+	// Latest, if set, returns when Netatmo last stored data for m (e.g. the station's last_status_store), or the
+	// zero time if unknown. A module whose cursor is already there has nothing new, and is not due.
+	Latest func(m Module) time.Time
+
+	// Saved is called once the Sink has written a page of m's points through t.
+	Saved func(m Module, t time.Time)
+	// Observe, if set, is called with each page of m's points that Export encodes (but not Range), e.g. to check
+	// thresholds on new data, before the page's Saved. The points are only valid until it returns.
+	Observe func(m Module, points []netatmo.DataPoint)
+	// DropInvalid leaves out the values that aren't Valid, which are otherwise exported as they come (a NaN for a
+	// missing one).
+	DropInvalid bool
+	// Dropped, if set, is called with how many of each page's values DropInvalid left out of m's series: see Dropped.
+	Dropped func(m Module, nulls, outliers int)
+
+	// Derived are series computed from each point, exported for the modules with all of their inputs.
+	Derived []Derived
+}
+
+func (e *Exporter) now() time.Time {
+	if e.Now == nil {
+		return time.Now()
+	}
+	return e.Now()
+}
+
+func (e *Exporter) latest(m Module) time.Time {
+	if e.Latest == nil {
+		return time.Time{}
+	}
+	return e.Latest(m)
+}
+
+// Start returns where to resume exporting m from: Overlap before its cursor, or Since if it has none.
+// If m has a cursor more recent than interval ago, or no newer than Latest, it is not due, and due is false.
+func (e *Exporter) Start(ctx context.Context, m Module, interval time.Duration) (since time.Time, due bool, err error) {
+	if e.Lookup != nil {
+		if since, err = e.Lookup.Cursor(ctx, m); err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	if e.Lookup != nil && e.Check != nil {
+		checkSince, err := e.Check.Cursor(ctx, m)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		switch {
+		case since.IsZero():
+			since = checkSince
+		case !checkSince.IsZero() && !checkSince.Equal(since):
+			slog.Warn("cursors disagree", "device", m.Device, "module", m.Module,
+				"lookup", e.LookupName, "cursor", since.Format(time.RFC3339),
+				"check", e.CheckName, "check_cursor", checkSince.Format(time.RFC3339))
+		}
+	}
+	if since.IsZero() {
+		if e.Since != nil {
+			since = e.Since(m)
+		}
+		return since, true, nil
+	}
+	if interval > 0 && e.now().Sub(since) < interval {
+		slog.Debug("not due yet", "device", m.Device, "module", m.Module, "data_types", m.DataTypes,
+			"cursor", since.Format(time.RFC3339), "interval", interval)
+		return since, false, nil
+	}
+	if latest := e.latest(m); !latest.IsZero() && !latest.After(since) {
+		slog.Debug("no new data", "device", m.Device, "module", m.Module, "data_types", m.DataTypes,
+			"cursor", since.Format(time.RFC3339), "latest", latest.Format(time.RFC3339))
+		return since, false, nil
+	}
+	return since.Add(-e.Overlap), true, nil
+}
+
+// Export exports m from since through the latest data, calling page after each page is encoded,
+// and Saved once the Sink has written it. It stops at a page whose checkpoint fails, so nothing after it is
+// exported either.
+func (e *Exporter) Export(ctx context.Context, m Module, since time.Time, page func(points []netatmo.DataPoint, nextTime time.Time)) error {
+	return e.export(ctx, m, since, time.Time{}, true, page)
+}
+
+// export is Export through until (if not zero), calling Observe if observe is set.
+func (e *Exporter) export(
+	ctx context.Context, m Module, since, until time.Time, observe bool,
+	page func(points []netatmo.DataPoint, nextTime time.Time),
+) error {
+	return e.pages(ctx, m, since, until, func(points []netatmo.DataPoint, nextTime time.Time) error {
+		if len(points) > 0 && observe && e.Observe != nil {
+			e.Observe(m, points)
+		}
+		if len(points) > 0 && e.Saved != nil {
+			last := points[len(points)-1].Time
+			if err := Checkpoint(e.Sink, func() { e.Saved(m, last) }); err != nil {
+				return fmt.Errorf("checkpoint: %w", err)
+			}
+		}
+		if page != nil {
+			page(points, nextTime)
+		}
+		return nil
+	})
+}
+
+// Gap is the older data of a module that CatchUp left to export: from Since up to Until, beyond which the
+// data through Last was already exported.
+type Gap struct {
+	Module             Module
+	Since, Until, Last time.Time
+}
+
+// CatchUp starts exporting m, which is far behind, from since: it exports the data from recent through the
+// latest first, so dashboards recover quickly, and returns the Gap left to FillGap afterwards. It calls Observe,
+// but not Saved: the cursor can't skip the gap.
+func (e *Exporter) CatchUp(
+	ctx context.Context, m Module, since, recent time.Time,
+	page func(points []netatmo.DataPoint, nextTime time.Time),
+) (Gap, error) {
+	gap := Gap{Module: m, Since: since, Until: recent}
+	err := e.Range(ctx, m, recent, time.Time{}, func(points []netatmo.DataPoint, nextTime time.Time) {
+		if len(points) > 0 {
+			gap.Last = points[len(points)-1].Time
+			if e.Observe != nil {
+				e.Observe(m, points)
+			}
+		}
+		if page != nil {
+			page(points, nextTime)
+		}
+	})
+	return gap, err
+}
+
+// FillGap exports the gap CatchUp left, like Export, and then saves the cursor through the data CatchUp exported.
+// It doesn't call Observe: the data is older than what was already observed.
+func (e *Exporter) FillGap(ctx context.Context, g Gap, page func(points []netatmo.DataPoint, nextTime time.Time)) error {
+	if err := e.export(ctx, g.Module, g.Since, g.Until, false, page); err != nil {
+		return err
+	}
+	if g.Last.IsZero() || e.Saved == nil {
+		return nil
+	}
+	return Checkpoint(e.Sink, func() { e.Saved(g.Module, g.Last) })
+}
+
+// Range exports m's data between since and until (if not zero), without checkpoints.
+//
+// After each page, page is called with the page's points and the next timestamp.
+func (e *Exporter) Range(
+	ctx context.Context, m Module, since, until time.Time,
+	page func(points []netatmo.DataPoint, nextTime time.Time),
+) error {
+	return e.pages(ctx, m, since, until, func(points []netatmo.DataPoint, nextTime time.Time) error {
+		if page != nil {
+			page(points, nextTime)
+		}
+		return nil
+	})
+}
+
+// pages is Range, stopping with the error of page.
+func (e *Exporter) pages(
+	ctx context.Context, m Module, since, until time.Time,
+	page func(points []netatmo.DataPoint, nextTime time.Time) error,
+) error {
+	labels := LabelPairs(m.Labels)
+
+	n, pageStart := 0, e.now()
+	return e.Client.GetMeasure(ctx, m.Device, m.Module, m.DataTypes, since, until, func(points []netatmo.DataPoint, nextTime time.Time) error {
+		n++
+		families := Families
+		if e.DropInvalid {
+			families = ValidFamilies
+			if e.Dropped != nil {
+				if nulls, outliers := Dropped(m.DataTypes, points); nulls > 0 || outliers > 0 {
+					e.Dropped(m, nulls, outliers)
+				}
+			}
+		}
+		for _, mf := range families(labels, m.DataTypes, points) {
+			if err := e.Sink.Encode(mf); err != nil {
+				return err
+			}
+		}
+		for _, mf := range DerivedFamilies(labels, e.Derived, m.DataTypes, points) {
+			if err := e.Sink.Encode(mf); err != nil {
+				return err
+			}
+		}
+		for _, mf := range DirectionFamilies(labels, m.DataTypes, points) {
+			if err := e.Sink.Encode(mf); err != nil {
+				return err
+			}
+		}
+		slog.Debug("exported page", "device", m.Device, "module", m.Module, "page", n,
+			"points", len(points), "duration", e.now().Sub(pageStart))
+		pageStart = e.now()
+		return page(points, nextTime)
+	})
+}
+
+// Valid reports whether v is a value of dt to export: not missing (NaN), and within its netatmo.DataRanges.
+func Valid(dt netatmo.DataType, v float64) bool {
+	if math.IsNaN(v) {
+		return false
+	}
+	r, ok := netatmo.DataRanges[dt]
+	return !ok || r.Min <= v && v <= r.Max
+}
+
+// Dropped returns how many values of points ValidFamilies leaves out, as missing (nulls) or implausible (outliers).
+func Dropped(dataTypes []netatmo.DataType, points []netatmo.DataPoint) (nulls, outliers int) {
+	for i, dt := range dataTypes {
+		for _, point := range points {
+			switch v := point.Values[i]; {
+			case math.IsNaN(v):
+				nulls++
+			case !Valid(dt, v):
+				outliers++
+			}
+		}
+	}
+	return nulls, outliers
+}
+
+// Families encodes points as one gauge family per data type, in the order of dataTypes.
+// Each point's Values are in the order of dataTypes.
+func Families(labels []*dto.LabelPair, dataTypes []netatmo.DataType, points []netatmo.DataPoint) []*dto.MetricFamily {
+	return families(labels, dataTypes, points, false)
+}
+
+// ValidFamilies is Families, leaving out the values that aren't Valid, and the data types left without any.
+func ValidFamilies(labels []*dto.LabelPair, dataTypes []netatmo.DataType, points []netatmo.DataPoint) []*dto.MetricFamily {
+	return families(labels, dataTypes, points, true)
+}
+
+func families(labels []*dto.LabelPair, dataTypes []netatmo.DataType, points []netatmo.DataPoint, valid bool) []*dto.MetricFamily {
+	mfs := make([]*dto.MetricFamily, 0, len(dataTypes))
+	for i, dt := range dataTypes {
+		// MetricFamily gives the gauges a name and units.
+		mf := &dto.MetricFamily{
+			Name: proto.String(MetricName(dt)),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		if unit, ok := netatmo.DataUnits[dt]; ok {
+			mf.Unit = proto.String(unit)
+		}
+		// Gauges contain the datapoints, allocated together rather than a few allocations per point.
+		var (
+			metrics = make([]dto.Metric, len(points))
+			gauges  = make([]dto.Gauge, len(points))
+			values  = make([]float64, len(points))
+			times   = make([]int64, len(points))
+		)
+		mf.Metric = make([]*dto.Metric, 0, len(points))
+		for j, point := range points {
+			if valid && !Valid(dt, point.Values[i]) {
+				continue
+			}
+			values[j], times[j] = point.Values[i], point.Time.UnixMilli()
+			gauges[j].Value = &values[j]
+			metrics[j].Label, metrics[j].TimestampMs, metrics[j].Gauge = labels, &times[j], &gauges[j]
+			mf.Metric = append(mf.Metric, &metrics[j])
+		}
+		if len(mf.Metric) > 0 || !valid {
+			mfs = append(mfs, mf)
+		}
+	}
+	return mfs
+}
+
+// Derived is a series computed from each point of a module's data types.
+type Derived struct {
+	Name   string // The metric name.
+	Unit   string // Optional.
+	Inputs []netatmo.DataType
+	Expr   *expr.Expr // Compiled with the Inputs as its variables, in order.
+}
+
+// DerivedFamilies encodes the derived series of points as gauge families, like Families, for the derived series
+// whose inputs are all in dataTypes. Points where the expression is NaN or infinite (e.g. for a missing input) are
+// left out.
+func DerivedFamilies(labels []*dto.LabelPair, derived []Derived, dataTypes []netatmo.DataType, points []netatmo.DataPoint) []*dto.MetricFamily {
+	var mfs []*dto.MetricFamily
+	for _, d := range derived {
+		idx := make([]int, len(d.Inputs))
+		for i, in := range d.Inputs {
+			if idx[i] = slices.Index(dataTypes, in); idx[i] < 0 {
+				break
+			}
+		}
+		if len(idx) == 0 || slices.Contains(idx, -1) {
+			continue
+		}
+		mf := &dto.MetricFamily{
+			Name: proto.String(d.Name),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		if d.Unit != "" {
+			mf.Unit = proto.String(d.Unit)
+		}
+		vars := make([]float64, len(idx))
+		for _, point := range points {
+			for i, j := range idx {
+				vars[i] = point.Values[j]
+			}
+			v := d.Expr.Eval(vars)
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:       labels,
+				Gauge:       &dto.Gauge{Value: proto.Float64(v)},
+				TimestampMs: proto.Int64(point.Time.UnixMilli()),
+			})
+		}
+		if len(mf.Metric) > 0 {
+			mfs = append(mfs, mf)
+		}
+	}
+	return mfs
+}
+
+// StationLabels returns the labels for the station's own series.
+func StationLabels(dev netatmo.Station) map[string]string {
+	return map[string]string{
+		"home_id":     dev.HomeID,
+		"home_name":   dev.HomeName,
+		"dev_id":      string(dev.ID),
+		"module_name": dev.Name,
+		"module_type": string(dev.Type),
+		// attribute.Int("firmware", dev.Firmware),
+	}
+}
+
+// ModuleLabels returns the labels for the series of one of the station's modules.
+func ModuleLabels(dev netatmo.Station, mod netatmo.Module) map[string]string {
+	return map[string]string{
+		"home_id":     dev.HomeID,
+		"home_name":   dev.HomeName,
+		"dev_id":      string(mod.ID),
+		"module_name": mod.Name,
+		"module_type": string(mod.Type),
+		// attribute.Int("firmware", dev.Firmware),
+	}
+}
+
+// directionSeries are the series labeled with a cardinal direction: each point's strength, by its angle.
+var directionSeries = []struct {
+	name            string
+	angle, strength netatmo.DataType
+}{
+	{"netatmo_wind_direction", netatmo.DataWindAngle, netatmo.DataWindStrength},
+	{"netatmo_gust_direction", netatmo.DataGustAngle, netatmo.DataGustStrength},
+}
+
+// Cardinals are the 16 points of the compass, clockwise from north.
+var Cardinals = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// Cardinal returns the 16-point compass direction of an angle in degrees from north.
+func Cardinal(angle float64) string {
+	return Cardinals[int(math.Mod(angle+360/32., 360)/(360/16.))%16]
+}
+
+// DirectionFamilies encodes the wind and gust strengths of points as gauge families labeled with the cardinal
+// direction of their angle, for wind-rose graphs (e.g. count_over_time by direction). Points without an angle
+// (calm, or a missing value) are left out.
+func DirectionFamilies(labels []*dto.LabelPair, dataTypes []netatmo.DataType, points []netatmo.DataPoint) []*dto.MetricFamily {
+	var mfs []*dto.MetricFamily
+	for _, d := range directionSeries {
+		angle, strength := slices.Index(dataTypes, d.angle), slices.Index(dataTypes, d.strength)
+		if angle < 0 || strength < 0 {
+			continue
+		}
+		mf := &dto.MetricFamily{
+			Name: proto.String(d.name),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Unit: proto.String(netatmo.DataUnits[d.strength]),
+		}
+		byCardinal := map[string][]*dto.LabelPair{}
+		for _, point := range points {
+			a, v := point.Values[angle], point.Values[strength]
+			if math.IsNaN(a) || a < 0 || math.IsNaN(v) {
+				continue
+			}
+			c := Cardinal(a)
+			if byCardinal[c] == nil {
+				byCardinal[c] = withLabel(labels, "direction", c)
+			}
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:       byCardinal[c],
+				Gauge:       &dto.Gauge{Value: proto.Float64(v)},
+				TimestampMs: proto.Int64(point.Time.UnixMilli()),
+			})
+		}
+		if len(mf.Metric) > 0 {
+			mfs = append(mfs, mf)
+		}
+	}
+	return mfs
+}
+
+// withLabel returns a copy of the sorted labels with name set to value, still sorted.
+func withLabel(labels []*dto.LabelPair, name, value string) []*dto.LabelPair {
+	out := slices.DeleteFunc(slices.Clone(labels), func(l *dto.LabelPair) bool { return l.GetName() == name })
+	i, _ := slices.BinarySearchFunc(out, name, func(l *dto.LabelPair, name string) int { return strings.Compare(l.GetName(), name) })
+	return slices.Insert(out, i, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+}
+
+// LabelPairs converts labels for a dto.Metric, sorted by name so the output is stable.
+func LabelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := []*dto.LabelPair{}
+	for k, v := range labels {
+		pairs = append(pairs, &dto.LabelPair{
+			Name:  proto.String(k),
+			Value: proto.String(v),
+		})
+	}
+	slices.SortFunc(pairs, func(a, b *dto.LabelPair) int { return strings.Compare(a.GetName(), b.GetName()) })
+	return pairs
+}
+
+// NormalizeLabels replaces the label values besides dev_id with their NormalizeLabel, in place.
+func NormalizeLabels(labels map[string]string) map[string]string {
+	for k, v := range labels {
+		if k != "dev_id" {
+			labels[k] = NormalizeLabel(v)
+		}
+	}
+	return labels
+}
+
+// NormalizeLabel returns a slug of v that is easy to match in PromQL: lowercase letters and digits, with accents
+// removed, and runs of anything else (spaces, punctuation, emoji) replaced by one underscore.
+// E.g. "Salle à manger 🍽" becomes "salle_a_manger".
+func NormalizeLabel(v string) string {
+	var b strings.Builder
+	sep := false
+	for _, r := range norm.NFD.String(v) {
+		switch {
+		case unicode.Is(unicode.Mn, r): // The accents, split off by NFD.
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			sep = false
+		default:
+			sep = true
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// DevID returns the dev_id label value used for the device or module.
+func DevID(device netatmo.DeviceID, module netatmo.ModuleID) string {
+	if module != "" {
+		return string(module)
+	}
+	return string(device)
+}
+
+// MetricName returns the name of the metric for dt.
+func MetricName(dt netatmo.DataType) string {
+	return "netatmo_" + strings.ToLower(string(dt))
+}
@@ -0,0 +1,480 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"sgrankin.dev/netatmo-otel/internal/expr"
+	"sgrankin.dev/netatmo-otel/netatmo"
+	"sgrankin.dev/netatmo-otel/netatmo/netatmotest"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeClient serves pages of points, in order, ignoring the requested range.
+type fakeClient struct {
+	pages [][]netatmo.DataPoint
+	err   error
+
+	calls []time.Time // The since of each GetMeasure call.
+}
+
+func (c *fakeClient) GetMeasure(
+	ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+	since, until time.Time, yield func(points []netatmo.DataPoint, nextTime time.Time) error,
+) error {
+	c.calls = append(c.calls, since)
+	for _, page := range c.pages {
+		if err := yield(page, page[len(page)-1].Time.Add(time.Second)); err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+// fakeSink records the families, and holds checkpoints until flush if it is a Checkpointer.
+type fakeSink struct {
+	families []*dto.MetricFamily
+	marks    []func()
+}
+
+func (s *fakeSink) Encode(mf *dto.MetricFamily) error {
+	s.families = append(s.families, mf)
+	return nil
+}
+
+type checkpointSink struct {
+	fakeSink
+	err error // Fails the checkpoints, if set.
+}
+
+func (s *checkpointSink) Checkpoint(fn func()) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.marks = append(s.marks, fn)
+	return nil
+}
+
+func (s *checkpointSink) flush() {
+	for _, fn := range s.marks {
+		fn()
+	}
+	s.marks = nil
+}
+
+type fakeLookup struct {
+	cursor time.Time
+	err    error
+}
+
+func (l fakeLookup) Cursor(context.Context, Module) (time.Time, error) {
+	return l.cursor, l.err
+}
+
+var testModule = Module{
+	Device:    "70:ee:50:00:00:01",
+	Module:    "02:00:00:00:00:01",
+	DataTypes: []netatmo.DataType{netatmo.DataTemperature, netatmo.DataCO2},
+	Labels:    map[string]string{"dev_id": "02:00:00:00:00:01", "module_name": "Outdoor"},
+}
+
+func TestStart(t *testing.T) {
+	since := t0.Add(-30 * 24 * time.Hour)
+	tests := []struct {
+		name     string
+		lookup   CursorLookup
+		check    CursorLookup
+		interval time.Duration
+		overlap  time.Duration
+		latest   time.Time
+		want     time.Time
+		wantDue  bool
+		wantErr  bool
+	}{
+		{name: "no lookup", want: since, wantDue: true},
+		{name: "no cursor", lookup: fakeLookup{}, want: since, wantDue: true},
+		{name: "cursor", lookup: fakeLookup{cursor: t0.Add(-time.Hour)}, want: t0.Add(-time.Hour), wantDue: true},
+		{name: "check fills in", lookup: fakeLookup{}, check: fakeLookup{cursor: t0.Add(-2 * time.Hour)},
+			want: t0.Add(-2 * time.Hour), wantDue: true},
+		{name: "lookup wins", lookup: fakeLookup{cursor: t0.Add(-time.Hour)}, check: fakeLookup{cursor: t0.Add(-2 * time.Hour)},
+			want: t0.Add(-time.Hour), wantDue: true},
+		{name: "not due", lookup: fakeLookup{cursor: t0.Add(-5 * time.Minute)}, interval: 10 * time.Minute,
+			want: t0.Add(-5 * time.Minute), wantDue: false},
+		{name: "due", lookup: fakeLookup{cursor: t0.Add(-15 * time.Minute)}, interval: 10 * time.Minute,
+			want: t0.Add(-15 * time.Minute), wantDue: true},
+		{name: "overlap", lookup: fakeLookup{cursor: t0.Add(-time.Hour)}, overlap: 10 * time.Minute,
+			want: t0.Add(-70 * time.Minute), wantDue: true},
+		{name: "overlap after due", lookup: fakeLookup{cursor: t0.Add(-5 * time.Minute)}, interval: 10 * time.Minute,
+			overlap: 10 * time.Minute, want: t0.Add(-5 * time.Minute), wantDue: false},
+		{name: "no overlap without cursor", lookup: fakeLookup{}, overlap: 10 * time.Minute, want: since, wantDue: true},
+		{name: "no cursor is always due", lookup: fakeLookup{}, interval: 10 * time.Minute, want: since, wantDue: true},
+		{name: "nothing new", lookup: fakeLookup{cursor: t0.Add(-time.Hour)}, latest: t0.Add(-time.Hour), overlap: 10 * time.Minute,
+			want: t0.Add(-time.Hour), wantDue: false},
+		{name: "something new", lookup: fakeLookup{cursor: t0.Add(-time.Hour)}, latest: t0.Add(-55 * time.Minute),
+			want: t0.Add(-time.Hour), wantDue: true},
+		{name: "latest without cursor", lookup: fakeLookup{}, latest: since.Add(-time.Hour), want: since, wantDue: true},
+		{name: "lookup error", lookup: fakeLookup{err: errors.New("boom")}, wantErr: true},
+		{name: "check error", lookup: fakeLookup{}, check: fakeLookup{err: errors.New("boom")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Exporter{
+				Lookup:  tt.lookup,
+				Check:   tt.check,
+				Now:     func() time.Time { return t0 },
+				Since:   func(Module) time.Time { return since },
+				Overlap: tt.overlap,
+				Latest:  func(Module) time.Time { return tt.latest },
+			}
+			got, due, err := e.Start(context.Background(), testModule, tt.interval)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Start() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !got.Equal(tt.want) || due != tt.wantDue {
+				t.Errorf("Start() = %v, %v; want %v, %v", got, due, tt.want, tt.wantDue)
+			}
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	client := &fakeClient{pages: [][]netatmo.DataPoint{
+		{{Time: t0, Values: []float64{20.5, 400}}, {Time: t0.Add(5 * time.Minute), Values: []float64{20.7, 410}}},
+		{{Time: t0.Add(10 * time.Minute), Values: []float64{21, 420}}},
+	}}
+	sink := &checkpointSink{}
+	var saved []time.Time
+	var pages []time.Time
+	e := &Exporter{
+		Client: client,
+		Sink:   sink,
+		Now:    func() time.Time { return t0 },
+		Saved:  func(m Module, t time.Time) { saved = append(saved, t) },
+	}
+	err := e.Export(context.Background(), testModule, t0, func(points []netatmo.DataPoint, nextTime time.Time) {
+		pages = append(pages, nextTime)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []time.Time{t0}; !slices.Equal(client.calls, want) {
+		t.Errorf("GetMeasure since = %v, want %v", client.calls, want)
+	}
+	if want := []time.Time{t0.Add(5*time.Minute + time.Second), t0.Add(10*time.Minute + time.Second)}; !slices.Equal(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+
+	// Nothing is saved until the sink has written the pages.
+	if len(saved) != 0 {
+		t.Errorf("saved before flush: %v", saved)
+	}
+	sink.flush()
+	if want := []time.Time{t0.Add(5 * time.Minute), t0.Add(10 * time.Minute)}; !slices.Equal(saved, want) {
+		t.Errorf("saved = %v, want %v", saved, want)
+	}
+
+	// One family per data type per page.
+	var names []string
+	for _, mf := range sink.families {
+		names = append(names, mf.GetName())
+	}
+	if want := []string{"netatmo_temperature", "netatmo_co2", "netatmo_temperature", "netatmo_co2"}; !slices.Equal(names, want) {
+		t.Errorf("families = %v, want %v", names, want)
+	}
+	co2 := sink.families[1]
+	if co2.GetType() != dto.MetricType_GAUGE {
+		t.Errorf("type = %v, want GAUGE", co2.GetType())
+	}
+	if len(co2.Metric) != 2 {
+		t.Fatalf("got %d metrics, want 2", len(co2.Metric))
+	}
+	if m := co2.Metric[1]; m.GetGauge().GetValue() != 410 || m.GetTimestampMs() != t0.Add(5*time.Minute).UnixMilli() {
+		t.Errorf("metric = %v, want 410 at %v", m, t0.Add(5*time.Minute))
+	}
+	labels := map[string]string{}
+	for _, l := range co2.Metric[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	if labels["module_name"] != "Outdoor" || labels["dev_id"] != "02:00:00:00:00:01" || len(labels) != 2 {
+		t.Errorf("labels = %v", labels)
+	}
+}
+
+func TestExportFromFake(t *testing.T) {
+	fake := netatmotest.NewFake(netatmo.Station{
+		ID:      testModule.Device,
+		Modules: []netatmo.Module{{ID: testModule.Module}},
+	})
+	fake.Since, fake.Until, fake.PageSize = t0, t0.Add(time.Hour), 5
+	sink := &fakeSink{}
+	var saved []time.Time
+	observed := 0
+	e := &Exporter{
+		Client:  fake,
+		Sink:    sink,
+		Saved:   func(m Module, t time.Time) { saved = append(saved, t) },
+		Observe: func(m Module, points []netatmo.DataPoint) { observed += len(points) },
+	}
+	if err := e.Export(context.Background(), testModule, t0.Add(30*time.Minute), nil); err != nil {
+		t.Fatal(err)
+	}
+	if observed != 7 {
+		t.Errorf("observed %d points, want 7", observed)
+	}
+	// 7 samples from 00:30 through 01:00, in pages of 5.
+	if want := []time.Time{t0.Add(50 * time.Minute), t0.Add(time.Hour)}; !slices.EqualFunc(saved, want, time.Time.Equal) {
+		t.Errorf("saved = %v, want %v", saved, want)
+	}
+	var co2 []float64
+	for _, mf := range sink.families {
+		if mf.GetName() == "netatmo_co2" {
+			for _, m := range mf.Metric {
+				co2 = append(co2, m.GetGauge().GetValue())
+			}
+		}
+	}
+	if want := []float64{430, 435, 440, 445, 450, 455, 400}; !slices.Equal(co2, want) {
+		t.Errorf("co2 = %v, want %v", co2, want)
+	}
+}
+
+func TestExportCheckpointError(t *testing.T) {
+	client := &fakeClient{pages: [][]netatmo.DataPoint{
+		{{Time: t0, Values: []float64{20.5, 400}}},
+		{{Time: t0.Add(5 * time.Minute), Values: []float64{20.7, 410}}},
+	}}
+	want := errors.New("consumer refused")
+	sink := &checkpointSink{err: want}
+	e := &Exporter{Client: client, Sink: sink, Saved: func(Module, time.Time) { t.Error("saved a failed checkpoint") }}
+	if err := e.Export(context.Background(), testModule, t0, nil); !errors.Is(err, want) {
+		t.Errorf("Export() = %v, want %v", err, want)
+	}
+	if len(sink.families) != 2 {
+		t.Errorf("encoded %d families, want the first page's 2", len(sink.families))
+	}
+}
+
+func TestExportWithoutCheckpointer(t *testing.T) {
+	client := &fakeClient{pages: [][]netatmo.DataPoint{{{Time: t0, Values: []float64{1, 2}}}}}
+	var saved []time.Time
+	e := &Exporter{
+		Client: client,
+		Sink:   &fakeSink{},
+		Saved:  func(m Module, t time.Time) { saved = append(saved, t) },
+	}
+	if err := e.Export(context.Background(), testModule, t0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Time{t0}; !slices.Equal(saved, want) {
+		t.Errorf("saved = %v, want %v", saved, want)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	recent := &fakeClient{pages: [][]netatmo.DataPoint{{{Time: t0.Add(48 * time.Hour), Values: []float64{1, 2}}}}}
+	var saved []time.Time
+	observed := 0
+	e := &Exporter{
+		Client:  recent,
+		Sink:    &fakeSink{},
+		Saved:   func(m Module, t time.Time) { saved = append(saved, t) },
+		Observe: func(m Module, points []netatmo.DataPoint) { observed += len(points) },
+	}
+	gap, err := e.CatchUp(context.Background(), testModule, t0, t0.Add(47*time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Time{t0.Add(47 * time.Hour)}; !slices.Equal(recent.calls, want) {
+		t.Errorf("GetMeasure since = %v, want %v", recent.calls, want)
+	}
+	if gap.Since != t0 || gap.Until != t0.Add(47*time.Hour) || gap.Last != t0.Add(48*time.Hour) {
+		t.Errorf("gap = %v through %v, last %v; want %v through %v, last %v",
+			gap.Since, gap.Until, gap.Last, t0, t0.Add(47*time.Hour), t0.Add(48*time.Hour))
+	}
+	if len(saved) != 0 || observed != 1 {
+		t.Errorf("after CatchUp, saved = %v and observed %d points, want none saved and 1 observed", saved, observed)
+	}
+
+	older := &fakeClient{pages: [][]netatmo.DataPoint{{{Time: t0, Values: []float64{1, 2}}}}}
+	e.Client = older
+	if err := e.FillGap(context.Background(), gap, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Time{t0}; !slices.Equal(older.calls, want) {
+		t.Errorf("GetMeasure since = %v, want %v", older.calls, want)
+	}
+	// The gap's checkpoints, then through the recent data.
+	if want := []time.Time{t0, t0.Add(48 * time.Hour)}; !slices.Equal(saved, want) {
+		t.Errorf("saved = %v, want %v", saved, want)
+	}
+	if observed != 1 {
+		t.Errorf("observed %d points, want the gap's unobserved", observed)
+	}
+}
+
+func TestRangeError(t *testing.T) {
+	want := errors.New("boom")
+	e := &Exporter{Client: &fakeClient{err: want}, Sink: &fakeSink{}}
+	if err := e.Range(context.Background(), testModule, t0, t0.Add(time.Hour), nil); !errors.Is(err, want) {
+		t.Errorf("Range() error = %v, want %v", err, want)
+	}
+}
+
+func TestFamiliesDropped(t *testing.T) {
+	dataTypes := []netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity, netatmo.DataCO2}
+	points := []netatmo.DataPoint{
+		{Time: t0, Values: []float64{20.5, math.NaN(), math.NaN()}},
+		{Time: t0.Add(5 * time.Minute), Values: []float64{20.7, 104, math.NaN()}},
+		{Time: t0.Add(10 * time.Minute), Values: []float64{-3276.8, 55, math.NaN()}},
+	}
+	if nulls, outliers := Dropped(dataTypes, points); nulls != 4 || outliers != 2 {
+		t.Errorf("Dropped() = %d, %d; want 4, 2", nulls, outliers)
+	}
+	mfs := ValidFamilies(nil, dataTypes, points)
+	if len(mfs) != 2 || mfs[0].GetName() != "netatmo_temperature" || len(mfs[0].Metric) != 2 ||
+		mfs[1].GetName() != "netatmo_humidity" || len(mfs[1].Metric) != 1 || mfs[1].Metric[0].GetGauge().GetValue() != 55 {
+		t.Errorf("ValidFamilies() = %v", mfs)
+	}
+	// Families exports them all, as they come.
+	mfs = Families(nil, dataTypes, points)
+	if len(mfs) != 3 || len(mfs[0].Metric) != 3 || len(mfs[1].Metric) != 3 || len(mfs[2].Metric) != 3 ||
+		mfs[1].Metric[1].GetGauge().GetValue() != 104 || !math.IsNaN(mfs[2].Metric[0].GetGauge().GetValue()) {
+		t.Errorf("Families() = %v", mfs)
+	}
+}
+
+func TestDerivedFamilies(t *testing.T) {
+	fahrenheit, err := expr.Compile("temperature*9/5+32", []string{"Temperature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	perCO2, err := expr.Compile("co2 / (temperature - 20)", []string{"CO2", "Temperature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rain, err := expr.Compile("rain", []string{"Rain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived := []Derived{
+		{Name: "netatmo_temperature_fahrenheit", Unit: "[degF]", Inputs: []netatmo.DataType{netatmo.DataTemperature}, Expr: fahrenheit},
+		{Name: "netatmo_co2_per_degree", Inputs: []netatmo.DataType{netatmo.DataCO2, netatmo.DataTemperature}, Expr: perCO2},
+		{Name: "netatmo_rain_copy", Inputs: []netatmo.DataType{netatmo.DataRain}, Expr: rain}, // Not an input here.
+	}
+	points := []netatmo.DataPoint{
+		{Time: t0, Values: []float64{20, 400}}, // Divides by zero.
+		{Time: t0.Add(time.Minute), Values: []float64{25, 500}},
+	}
+	mfs := DerivedFamilies(nil, derived, []netatmo.DataType{netatmo.DataTemperature, netatmo.DataCO2}, points)
+	if len(mfs) != 2 {
+		t.Fatalf("got %d families, want 2", len(mfs))
+	}
+	if mf := mfs[0]; mf.GetName() != "netatmo_temperature_fahrenheit" || mf.GetUnit() != "[degF]" || len(mf.Metric) != 2 ||
+		mf.Metric[0].GetGauge().GetValue() != 68 || mf.Metric[1].GetGauge().GetValue() != 77 {
+		t.Errorf("fahrenheit = %v", mf)
+	}
+	if mf := mfs[1]; len(mf.Metric) != 1 || mf.Metric[0].GetGauge().GetValue() != 100 ||
+		mf.Metric[0].GetTimestampMs() != t0.Add(time.Minute).UnixMilli() {
+		t.Errorf("co2 per degree = %v", mf)
+	}
+}
+
+func TestCardinal(t *testing.T) {
+	for angle, want := range map[float64]string{0: "N", 11: "N", 12: "NNE", 45: "NE", 180: "S", 348: "NNW", 349: "N", 359: "N", 360: "N"} {
+		if got := Cardinal(angle); got != want {
+			t.Errorf("Cardinal(%v) = %s, want %s", angle, got, want)
+		}
+	}
+}
+
+func TestDirectionFamilies(t *testing.T) {
+	labels := LabelPairs(map[string]string{"dev_id": "06:00:00:00:00:01", "module_name": "Wind"})
+	dataTypes := []netatmo.DataType{netatmo.DataWindStrength, netatmo.DataWindAngle, netatmo.DataGustStrength, netatmo.DataGustAngle}
+	points := []netatmo.DataPoint{
+		{Time: t0, Values: []float64{10, 90, 20, 100}},
+		{Time: t0.Add(5 * time.Minute), Values: []float64{0, -1, 0, -1}}, // Calm.
+		{Time: t0.Add(10 * time.Minute), Values: []float64{12, 200, math.NaN(), math.NaN()}},
+	}
+	mfs := DirectionFamilies(labels, dataTypes, points)
+	if len(mfs) != 2 {
+		t.Fatalf("got %d families, want 2", len(mfs))
+	}
+	wind := mfs[0]
+	if wind.GetName() != "netatmo_wind_direction" || wind.GetUnit() != "km/h" || len(wind.Metric) != 2 {
+		t.Fatalf("wind = %v", wind)
+	}
+	var dirs []string
+	for _, m := range wind.Metric {
+		var names []string
+		for _, l := range m.Label {
+			names = append(names, l.GetName())
+			if l.GetName() == "direction" {
+				dirs = append(dirs, l.GetValue())
+			}
+		}
+		if !slices.IsSorted(names) {
+			t.Errorf("labels %v aren't sorted", names)
+		}
+	}
+	if !slices.Equal(dirs, []string{"E", "SSW"}) || wind.Metric[1].GetGauge().GetValue() != 12 {
+		t.Errorf("wind = %v, want 10 from E and 12 from SSW", wind)
+	}
+	if gust := mfs[1]; gust.GetName() != "netatmo_gust_direction" || len(gust.Metric) != 1 {
+		t.Errorf("gust = %v, want one point", gust)
+	}
+	if len(labels) != 2 {
+		t.Errorf("the module's labels were modified: %v", labels)
+	}
+}
+
+func TestNormalizeLabel(t *testing.T) {
+	for in, want := range map[string]string{
+		"Living Room":            "living_room",
+		"Salle à manger 🍽":       "salle_a_manger",
+		"  Kids' room (2nd) ":    "kids_room_2nd",
+		"Гостиная":               "гостиная",
+		"already_normal":         "already_normal",
+		"🌧":                      "",
+		"Ünïcödé---Straße/Küche": "unicode_straße_kuche",
+	} {
+		if got := NormalizeLabel(in); got != want {
+			t.Errorf("NormalizeLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+	labels := NormalizeLabels(map[string]string{"dev_id": "70:ee:50:00:00:01", "module_name": "Living Room"})
+	if labels["dev_id"] != "70:ee:50:00:00:01" || labels["module_name"] != "living_room" {
+		t.Errorf("NormalizeLabels() = %v", labels)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	dev := netatmo.Station{ID: "70:ee:50:00:00:01", Type: netatmo.ModuleMain, Name: "Indoor", HomeID: "h1", HomeName: "Home"}
+	mod := netatmo.Module{ID: "02:00:00:00:00:01", Type: netatmo.ModuleOutdoor, Name: "Outdoor"}
+
+	if got := StationLabels(dev); got["dev_id"] != "70:ee:50:00:00:01" || got["module_type"] != "NAMain" || got["home_name"] != "Home" {
+		t.Errorf("StationLabels() = %v", got)
+	}
+	if got := ModuleLabels(dev, mod); got["dev_id"] != "02:00:00:00:00:01" || got["module_name"] != "Outdoor" || got["home_id"] != "h1" {
+		t.Errorf("ModuleLabels() = %v", got)
+	}
+	if got := DevID(dev.ID, ""); got != "70:ee:50:00:00:01" {
+		t.Errorf("DevID(station) = %q", got)
+	}
+	if got := DevID(dev.ID, mod.ID); got != "02:00:00:00:00:01" {
+		t.Errorf("DevID(module) = %q", got)
+	}
+	if got := MetricName(netatmo.DataCO2); got != "netatmo_co2" {
+		t.Errorf("MetricName() = %q", got)
+	}
+}
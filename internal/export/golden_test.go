@@ -0,0 +1,88 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files in testdata.")
+
+// goldenFamilies is a fixed dataset covering a station and a module, several data types, and a counter.
+func goldenFamilies() []*dto.MetricFamily {
+	dev := netatmo.Station{ID: "70:ee:50:00:00:01", Type: netatmo.ModuleMain, Name: "Indoor", HomeID: "h1", HomeName: "Home"}
+	mod := netatmo.Module{ID: "02:00:00:00:00:01", Type: netatmo.ModuleOutdoor, Name: "Outdoor"}
+	step := 5 * time.Minute
+
+	mfs := Families(LabelPairs(StationLabels(dev)),
+		[]netatmo.DataType{netatmo.DataTemperature, netatmo.DataCO2, netatmo.DataNoise},
+		[]netatmo.DataPoint{{Time: t0, Values: []float64{21.5, 612, 38}}, {Time: t0.Add(step), Values: []float64{21.6, 640, 41}}})
+	mfs = append(mfs, Families(LabelPairs(ModuleLabels(dev, mod)),
+		[]netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity},
+		[]netatmo.DataPoint{{Time: t0, Values: []float64{-3.2, 81}}, {Time: t0.Add(step), Values: []float64{-3.4, 83}}})...)
+	mfs = append(mfs, &dto.MetricFamily{
+		Name: ptr("netatmo_export_points_total"),
+		Help: ptr("Points exported."),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{
+			Label:       LabelPairs(map[string]string{"dev_id": string(dev.ID)}),
+			Counter:     &dto.Counter{Value: ptr(6.0)},
+			TimestampMs: ptr(t0.Add(step).UnixMilli()),
+		}},
+	})
+	return mfs
+}
+
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		file    string
+		newSink func(buf *bytes.Buffer) (Sink, func() error)
+	}{
+		{"golden.prom", func(buf *bytes.Buffer) (Sink, func() error) {
+			return NewTextSink(buf), func() error { return nil }
+		}},
+		{"golden.otlp.json", func(buf *bytes.Buffer) (Sink, func() error) {
+			sink, err := NewOTLPJSONSink(buf, 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sink, func() error { return sink.Close(context.Background()) }
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			var buf bytes.Buffer
+			sink, close := tt.newSink(&buf)
+			for _, mf := range goldenFamilies() {
+				if err := sink.Encode(mf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := close(); err != nil {
+				t.Fatal(err)
+			}
+
+			path := filepath.Join("testdata", tt.file)
+			if *update {
+				if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("output differs from %s (rerun with -update if intended):\n%s", path, buf.Bytes())
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package export
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// OTLPSink is a Sink that converts the families to OTLP metrics, and exports them in batches.
+//
+// It is a Checkpointer: checkpoints run once the batch with the families before them has been exported.
+// Encode and Checkpoint are safe for concurrent use.
+type OTLPSink struct {
+	// ResourceLabels, if set, are moved from the points to their Resource: each combination of their values
+	// is exported as a Resource of its own, e.g. one per home. Points without any of them stay on the base one.
+	ResourceLabels []string
+
+	exporter  sdkmetric.Exporter
+	resource  *resource.Resource
+	batchSize int
+
+	mu     sync.Mutex
+	groups []*otlpGroup
+	points int
+	marks  []func()
+}
+
+// otlpGroup is the pending metrics of a Resource.
+type otlpGroup struct {
+	key      string
+	resource *resource.Resource
+	metrics  []metricdata.Metrics
+}
+
+// NewOTLPSink returns a sink exporting batches of about batchSize points to exporter.
+func NewOTLPSink(exporter sdkmetric.Exporter, batchSize int) *OTLPSink {
+	return &OTLPSink{
+		exporter:  exporter,
+		resource:  resource.NewSchemaless(attribute.String("service.name", "netatmo-otel")),
+		batchSize: max(batchSize, 1),
+	}
+}
+
+// NewOTLPJSONSink returns a sink writing batches of about batchSize points to w as JSON, one batch per line.
+func NewOTLPJSONSink(w io.Writer, batchSize int) (*OTLPSink, error) {
+	exporter, err := stdoutmetric.New(stdoutmetric.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+	return NewOTLPSink(exporter, batchSize), nil
+}
+
+// Encode implements Sink.
+func (s *OTLPSink) Encode(mf *dto.MetricFamily) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, part := range s.split(mf) {
+		m, n := OTLPMetrics(part.family)
+		if n == 0 {
+			continue
+		}
+		g := s.group(part.attrs)
+		g.metrics = append(g.metrics, m)
+		s.points += n
+	}
+	if s.points < s.batchSize {
+		return nil
+	}
+	return s.flush(context.Background())
+}
+
+// Checkpoint implements Checkpointer.
+func (s *OTLPSink) Checkpoint(fn func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.points == 0 {
+		fn()
+		return nil
+	}
+	s.marks = append(s.marks, fn)
+	return nil
+}
+
+// Close exports the last batch and shuts down the exporter.
+func (s *OTLPSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	err := s.flush(ctx)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.exporter.Shutdown(ctx)
+}
+
+// flush exports the pending metrics, then runs the pending checkpoints. s.mu must be held.
+func (s *OTLPSink) flush(ctx context.Context) error {
+	for len(s.groups) > 0 {
+		g := s.groups[0]
+		err := s.exporter.Export(ctx, &metricdata.ResourceMetrics{
+			Resource: g.resource,
+			ScopeMetrics: []metricdata.ScopeMetrics{{
+				Scope:   instrumentation.Scope{Name: "sgrankin.dev/netatmo-otel"},
+				Metrics: g.metrics,
+			}},
+		})
+		if err != nil {
+			return err
+		}
+		s.groups = s.groups[1:] // Not again, if a later one fails.
+	}
+	for _, fn := range s.marks {
+		fn()
+	}
+	s.groups, s.points, s.marks = nil, 0, nil
+	return nil
+}
+
+// otlpPart is the points of a family with the same values of the ResourceLabels, without them.
+type otlpPart struct {
+	attrs  []attribute.KeyValue
+	family *dto.MetricFamily
+}
+
+// split splits mf by the values of the ResourceLabels.
+func (s *OTLPSink) split(mf *dto.MetricFamily) []otlpPart {
+	if len(s.ResourceLabels) == 0 {
+		return []otlpPart{{family: mf}}
+	}
+	var parts []otlpPart
+	for _, m := range mf.Metric {
+		var attrs []attribute.KeyValue
+		var labels []*dto.LabelPair
+		for _, l := range m.Label {
+			if slices.Contains(s.ResourceLabels, l.GetName()) {
+				attrs = append(attrs, attribute.String(l.GetName(), l.GetValue()))
+			} else {
+				labels = append(labels, l)
+			}
+		}
+		i := slices.IndexFunc(parts, func(p otlpPart) bool { return slices.Equal(p.attrs, attrs) })
+		if i < 0 {
+			i = len(parts)
+			parts = append(parts, otlpPart{attrs: attrs, family: &dto.MetricFamily{
+				Name: mf.Name, Help: mf.Help, Type: mf.Type, Unit: mf.Unit,
+			}})
+		}
+		m := &dto.Metric{Label: labels, Gauge: m.Gauge, Counter: m.Counter, TimestampMs: m.TimestampMs}
+		parts[i].family.Metric = append(parts[i].family.Metric, m)
+	}
+	return parts
+}
+
+// group returns the pending group of the Resource with attrs added to the base one. s.mu must be held.
+func (s *OTLPSink) group(attrs []attribute.KeyValue) *otlpGroup {
+	var key strings.Builder
+	for _, kv := range attrs {
+		key.WriteString(string(kv.Key) + "\xff" + kv.Value.AsString() + "\xff")
+	}
+	for _, g := range s.groups {
+		if g.key == key.String() {
+			return g
+		}
+	}
+	res := s.resource
+	if len(attrs) > 0 {
+		res, _ = resource.Merge(s.resource, resource.NewSchemaless(attrs...)) // Schemaless, so it can't fail.
+	}
+	g := &otlpGroup{key: key.String(), resource: res}
+	s.groups = append(s.groups, g)
+	return g
+}
+
+// OTLPMetrics converts a gauge or counter family to OTLP, with the labels as attributes,
+// and returns the number of points. Other types are skipped.
+func OTLPMetrics(mf *dto.MetricFamily) (metricdata.Metrics, int) {
+	m := metricdata.Metrics{Name: mf.GetName(), Description: mf.GetHelp(), Unit: mf.GetUnit()}
+	var points []metricdata.DataPoint[float64]
+	for _, metric := range mf.Metric {
+		p := metricdata.DataPoint[float64]{
+			Attributes: Attributes(metric.Label),
+			Time:       time.UnixMilli(metric.GetTimestampMs()).UTC(),
+		}
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			p.Value = metric.GetGauge().GetValue()
+		case dto.MetricType_COUNTER:
+			p.Value = metric.GetCounter().GetValue()
+		default:
+			continue
+		}
+		if metric.TimestampMs == nil {
+			p.Time = time.Now()
+		}
+		points = append(points, p)
+	}
+	switch mf.GetType() {
+	case dto.MetricType_GAUGE:
+		m.Data = metricdata.Gauge[float64]{DataPoints: points}
+	case dto.MetricType_COUNTER:
+		m.Data = metricdata.Sum[float64]{DataPoints: points, Temporality: metricdata.CumulativeTemporality, IsMonotonic: true}
+	}
+	return m, len(points)
+}
+
+// Attributes converts labels to OTLP attributes.
+func Attributes(labels []*dto.LabelPair) attribute.Set {
+	kvs := make([]attribute.KeyValue, len(labels))
+	for i, l := range labels {
+		kvs[i] = attribute.String(l.GetName(), l.GetValue())
+	}
+	return attribute.NewSet(kvs...)
+}
@@ -0,0 +1,139 @@
+package export
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// fakeOTLPExporter records the exported batches.
+type fakeOTLPExporter struct {
+	sdkmetric.Exporter // Unused methods panic.
+
+	batches []*metricdata.ResourceMetrics
+	shut    bool
+}
+
+func (e *fakeOTLPExporter) Export(_ context.Context, rm *metricdata.ResourceMetrics) error {
+	e.batches = append(e.batches, rm)
+	return nil
+}
+
+func (e *fakeOTLPExporter) Shutdown(context.Context) error {
+	e.shut = true
+	return nil
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	labels := LabelPairs(map[string]string{"module_name": "Outdoor"})
+	points := []netatmo.DataPoint{{Time: t0, Values: []float64{20.5}}, {Time: t0.Add(5 * time.Minute), Values: []float64{21}}}
+	mf := Families(labels, []netatmo.DataType{netatmo.DataTemperature}, points)[0]
+
+	m, n := OTLPMetrics(mf)
+	if n != 2 {
+		t.Fatalf("got %d points, want 2", n)
+	}
+	if m.Name != "netatmo_temperature" || m.Unit != "Cel" {
+		t.Errorf("metric = %q in %q, want netatmo_temperature in Cel", m.Name, m.Unit)
+	}
+	g, ok := m.Data.(metricdata.Gauge[float64])
+	if !ok {
+		t.Fatalf("data is %T, want a gauge", m.Data)
+	}
+	p := g.DataPoints[1]
+	if p.Value != 21 || !p.Time.Equal(t0.Add(5*time.Minute)) {
+		t.Errorf("point = %v at %v, want 21 at %v", p.Value, p.Time, t0.Add(5*time.Minute))
+	}
+	if v, _ := p.Attributes.Value(attribute.Key("module_name")); v.AsString() != "Outdoor" {
+		t.Errorf("module_name = %q, want Outdoor", v.AsString())
+	}
+
+	counter := &dto.MetricFamily{
+		Name:   ptr("netatmo_export_points_total"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: ptr(3.0)}, TimestampMs: ptr(t0.UnixMilli())}},
+	}
+	m, _ = OTLPMetrics(counter)
+	if s, ok := m.Data.(metricdata.Sum[float64]); !ok || !s.IsMonotonic || s.Temporality != metricdata.CumulativeTemporality {
+		t.Errorf("counter data = %#v, want a cumulative monotonic sum", m.Data)
+	}
+}
+
+func TestOTLPSinkBatches(t *testing.T) {
+	exp := &fakeOTLPExporter{}
+	sink := NewOTLPSink(exp, 3)
+	labels := LabelPairs(map[string]string{"module_name": "Outdoor"})
+	page := []netatmo.DataPoint{{Time: t0, Values: []float64{1, 2}}}
+	dataTypes := []netatmo.DataType{netatmo.DataTemperature, netatmo.DataCO2}
+
+	var saved int
+	for range 2 {
+		for _, mf := range Families(labels, dataTypes, page) {
+			if err := sink.Encode(mf); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sink.Checkpoint(func() { saved++ }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 4 points in batches of 3: the first checkpoint was flushed with the batch, the second is pending.
+	if len(exp.batches) != 1 || saved != 1 {
+		t.Errorf("after encoding: %d batches, %d saved; want 1, 1", len(exp.batches), saved)
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(exp.batches) != 2 || saved != 2 || !exp.shut {
+		t.Errorf("after close: %d batches, %d saved, shut down %v; want 2, 2, true", len(exp.batches), saved, exp.shut)
+	}
+}
+
+func TestOTLPSinkResourceLabels(t *testing.T) {
+	exp := &fakeOTLPExporter{}
+	sink := NewOTLPSink(exp, 100)
+	sink.ResourceLabels = []string{"home_id", "home_name"}
+	page := []netatmo.DataPoint{{Time: t0, Values: []float64{1}}}
+	for _, home := range []string{"h1", "h2", "h1"} {
+		labels := LabelPairs(map[string]string{"home_id": home, "home_name": "Home " + home, "module_name": "Outdoor"})
+		for _, mf := range Families(labels, []netatmo.DataType{netatmo.DataTemperature}, page) {
+			if err := sink.Encode(mf); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// One export per home, with the home on the resource and not the points.
+	if len(exp.batches) != 2 {
+		t.Fatalf("got %d exports, want 2", len(exp.batches))
+	}
+	for i, want := range []string{"h1", "h2"} {
+		rm := exp.batches[i]
+		if v, ok := rm.Resource.Set().Value("home_id"); !ok || v.AsString() != want {
+			t.Errorf("export %d: resource = %v, want home_id %s", i, rm.Resource, want)
+		}
+		if _, ok := rm.Resource.Set().Value("service.name"); !ok {
+			t.Errorf("export %d: resource = %v, want the service.name kept", i, rm.Resource)
+		}
+		metrics := rm.ScopeMetrics[0].Metrics
+		if want := map[string]int{"h1": 2, "h2": 1}[want]; len(metrics) != want {
+			t.Errorf("export %d: %d metrics, want %d", i, len(metrics), want)
+		}
+		attrs := metrics[0].Data.(metricdata.Gauge[float64]).DataPoints[0].Attributes
+		if attrs.HasValue("home_id") || attrs.HasValue("home_name") || !attrs.HasValue("module_name") {
+			t.Errorf("export %d: point attributes = %v, want module_name without the home", i, attrs.ToSlice())
+		}
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,172 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// ParquetRow is a sample in a Parquet archive file.
+type ParquetRow struct {
+	Metric      string            `parquet:"metric,dict"`
+	Type        string            `parquet:"type,dict"` // gauge or counter.
+	Help        string            `parquet:"help,dict"`
+	Unit        string            `parquet:"unit,dict"`
+	Labels      map[string]string `parquet:"labels"`
+	TimestampMs int64             `parquet:"timestamp_ms"`
+	Value       float64           `parquet:"value"`
+}
+
+// ObjectStore is where a ParquetSink puts its files.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+}
+
+// ParquetSink is a Sink that archives the samples as Parquet files in an ObjectStore, partitioned by month and
+// device: one file per partition per batch, at "month=2006-01/device=70-ee-50-00-00-01/<name>-<batch>.parquet"
+// under the prefix. Samples without a dev_id label go to device "none".
+//
+// It is a Checkpointer: checkpoints run once the batch with the families before them has been stored.
+// Encode and Checkpoint are safe for concurrent use.
+type ParquetSink struct {
+	store     ObjectStore
+	prefix    string
+	name      string
+	batchSize int
+
+	mu      sync.Mutex
+	parts   map[string][]ParquetRow // By the partition's key prefix.
+	rows    int
+	batches int
+	marks   []func()
+}
+
+// NewParquetSink returns a sink storing batches of about batchSize samples under prefix in store. The files of
+// the batches are named for name, which must differ between sinks writing to the same prefix.
+func NewParquetSink(store ObjectStore, prefix, name string, batchSize int) *ParquetSink {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &ParquetSink{store: store, prefix: prefix, name: name, batchSize: max(batchSize, 1), parts: map[string][]ParquetRow{}}
+}
+
+// Encode implements Sink. Families other than gauges and counters are skipped.
+func (s *ParquetSink) Encode(mf *dto.MetricFamily) error {
+	typ := map[dto.MetricType]string{dto.MetricType_GAUGE: "gauge", dto.MetricType_COUNTER: "counter"}[mf.GetType()]
+	if typ == "" || len(mf.Metric) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range mf.Metric {
+		labels := map[string]string{}
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		row := ParquetRow{
+			Metric: mf.GetName(), Type: typ, Help: mf.GetHelp(), Unit: mf.GetUnit(),
+			Labels: labels, TimestampMs: m.GetTimestampMs(), Value: m.GetGauge().GetValue(),
+		}
+		if typ == "counter" {
+			row.Value = m.GetCounter().GetValue()
+		}
+		key := ParquetPartition(time.UnixMilli(row.TimestampMs), labels["dev_id"])
+		s.parts[key] = append(s.parts[key], row)
+		s.rows++
+	}
+	if s.rows < s.batchSize {
+		return nil
+	}
+	return s.flush(context.Background())
+}
+
+// ParquetPartition returns the key prefix of the partition of a sample at t of the device devID.
+func ParquetPartition(t time.Time, devID string) string {
+	if devID == "" {
+		devID = "none"
+	}
+	return "month=" + t.UTC().Format("2006-01") + "/device=" + strings.ReplaceAll(devID, ":", "-") + "/"
+}
+
+// Checkpoint implements Checkpointer.
+func (s *ParquetSink) Checkpoint(fn func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rows == 0 {
+		fn()
+		return nil
+	}
+	s.marks = append(s.marks, fn)
+	return nil
+}
+
+// Close stores the last batch.
+func (s *ParquetSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush(ctx)
+}
+
+// flush stores the pending rows, then runs the pending checkpoints. s.mu must be held.
+func (s *ParquetSink) flush(ctx context.Context) error {
+	if s.rows > 0 {
+		s.batches++
+		for part, rows := range s.parts {
+			var buf bytes.Buffer
+			if err := parquet.Write(&buf, rows, parquet.Compression(&parquet.Zstd)); err != nil {
+				return err
+			}
+			key := fmt.Sprintf("%s%s%s-%04d.parquet", s.prefix, part, s.name, s.batches)
+			if err := s.store.Put(ctx, key, buf.Bytes()); err != nil {
+				return fmt.Errorf("storing %s: %w", key, err)
+			}
+		}
+	}
+	for _, fn := range s.marks {
+		fn()
+	}
+	s.parts, s.rows, s.marks = map[string][]ParquetRow{}, 0, nil
+	return nil
+}
+
+// ReadParquet decodes a file written by a ParquetSink into metric families, one per run of rows of the same metric.
+func ReadParquet(data []byte) ([]*dto.MetricFamily, error) {
+	rows, err := parquet.Read[ParquetRow](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var families []*dto.MetricFamily
+	for _, row := range rows {
+		var mf *dto.MetricFamily
+		if n := len(families); n > 0 && families[n-1].GetName() == row.Metric {
+			mf = families[n-1]
+		} else {
+			mf = &dto.MetricFamily{Name: proto.String(row.Metric), Type: dto.MetricType_GAUGE.Enum()}
+			if row.Type == "counter" {
+				mf.Type = dto.MetricType_COUNTER.Enum()
+			}
+			if row.Help != "" {
+				mf.Help = proto.String(row.Help)
+			}
+			if row.Unit != "" {
+				mf.Unit = proto.String(row.Unit)
+			}
+			families = append(families, mf)
+		}
+		m := &dto.Metric{Label: LabelPairs(row.Labels), TimestampMs: proto.Int64(row.TimestampMs)}
+		if row.Type == "counter" {
+			m.Counter = &dto.Counter{Value: proto.Float64(row.Value)}
+		} else {
+			m.Gauge = &dto.Gauge{Value: proto.Float64(row.Value)}
+		}
+		mf.Metric = append(mf.Metric, m)
+	}
+	return families, nil
+}
@@ -0,0 +1,93 @@
+package export
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// memStore is an ObjectStore in memory.
+type memStore map[string][]byte
+
+func (s memStore) Put(_ context.Context, key string, data []byte) error {
+	s[key] = data
+	return nil
+}
+
+func TestParquetSink(t *testing.T) {
+	store := memStore{}
+	sink := NewParquetSink(store, "archive", "run", 3)
+	labels := LabelPairs(map[string]string{"dev_id": "70:ee:50:00:00:01", "module_name": "Indoor"})
+	// Two samples in January, one in February: a batch of two files.
+	points := []netatmo.DataPoint{
+		{Time: time.Date(2024, 1, 31, 23, 50, 0, 0, time.UTC), Values: []float64{20.5}},
+		{Time: time.Date(2024, 1, 31, 23, 55, 0, 0, time.UTC), Values: []float64{21}},
+		{Time: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), Values: []float64{21.5}},
+	}
+	marked := false
+	for _, mf := range Families(labels, []netatmo.DataType{netatmo.DataTemperature}, points) {
+		if err := sink.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Checkpoint(func() { marked = true })
+	if !marked {
+		t.Error("checkpoint after a full batch didn't run")
+	}
+	// And a counter, in a second batch on Close.
+	err := sink.Encode(&dto.MetricFamily{
+		Name:   ptr("netatmo_export_points_total"),
+		Type:   dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(3)}, TimestampMs: proto.Int64(points[2].Time.UnixMilli())}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for k := range store {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	want := []string{
+		"archive/month=2024-01/device=70-ee-50-00-00-01/run-0001.parquet",
+		"archive/month=2024-02/device=70-ee-50-00-00-01/run-0001.parquet",
+		"archive/month=2024-02/device=none/run-0002.parquet",
+	}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("keys = %v, want %v", keys, want)
+	}
+
+	families, err := ReadParquet(store[want[0]])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || len(families[0].Metric) != 2 {
+		t.Fatalf("read %v, want one family of 2", families)
+	}
+	mf := families[0]
+	if mf.GetName() != "netatmo_temperature" || mf.GetType() != dto.MetricType_GAUGE || mf.GetUnit() != "Cel" {
+		t.Errorf("family = %s %s in %s, want gauge netatmo_temperature in Cel", mf.GetType(), mf.GetName(), mf.GetUnit())
+	}
+	if m := mf.Metric[1]; m.GetGauge().GetValue() != 21 || m.GetTimestampMs() != points[1].Time.UnixMilli() ||
+		!slices.EqualFunc(m.Label, labels, func(a, b *dto.LabelPair) bool { return proto.Equal(a, b) }) {
+		t.Errorf("metric = %v, want 21 at %v with %v", m, points[1].Time, labels)
+	}
+
+	families, err = ReadParquet(store[want[2]])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetType() != dto.MetricType_COUNTER || families[0].Metric[0].GetCounter().GetValue() != 3 {
+		t.Errorf("read %v, want the counter", families)
+	}
+}
@@ -0,0 +1,209 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteReadQuery is a query of a Prometheus remote-read request: the samples from Start through End of the
+// series whose labels equal Matchers (an empty value matching a missing label, as in PromQL).
+type RemoteReadQuery struct {
+	Start, End time.Time
+	Matchers   map[string]string
+}
+
+// RemoteReadSeries is a series of a remote-read response, with its samples in order.
+type RemoteReadSeries struct {
+	Labels     map[string]string
+	Timestamps []int64 // Milliseconds since the epoch.
+	Values     []float64
+}
+
+// RemoteRead posts the queries to a Prometheus remote-read endpoint at url, and returns the series matching each,
+// in the order of the queries. It asks for the SAMPLES response type, which every remote-read server supports.
+//
+// https://prometheus.io/docs/prometheus/latest/querying/remote_read_api/
+func RemoteRead(ctx context.Context, client *http.Client, url string, queries []RemoteReadQuery) ([][]RemoteReadSeries, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(snappy.Encode(nil, RemoteReadRequest(queries))))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Read-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("remote read: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("remote read: %w", err)
+	}
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("remote read: %w", err)
+	}
+	results, err := ParseRemoteReadResponse(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != len(queries) {
+		return nil, fmt.Errorf("remote read: %d results for %d queries", len(results), len(queries))
+	}
+	return results, nil
+}
+
+// RemoteReadRequest encodes the queries as an uncompressed prometheus.ReadRequest.
+func RemoteReadRequest(queries []RemoteReadQuery) []byte {
+	var b []byte
+	for _, q := range queries {
+		var query []byte
+		query = protowire.AppendTag(query, 1, protowire.VarintType)
+		query = protowire.AppendVarint(query, uint64(q.Start.UnixMilli()))
+		query = protowire.AppendTag(query, 2, protowire.VarintType)
+		query = protowire.AppendVarint(query, uint64(q.End.UnixMilli()))
+		names := make([]string, 0, len(q.Matchers))
+		for name := range q.Matchers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			var matcher []byte // Type 0 is EQ, the default, so it is left out.
+			matcher = protowire.AppendTag(matcher, 2, protowire.BytesType)
+			matcher = protowire.AppendString(matcher, name)
+			matcher = protowire.AppendTag(matcher, 3, protowire.BytesType)
+			matcher = protowire.AppendString(matcher, q.Matchers[name])
+			query = protowire.AppendTag(query, 3, protowire.BytesType)
+			query = protowire.AppendBytes(query, matcher)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, query)
+	}
+	return b
+}
+
+// ParseRemoteReadResponse decodes an uncompressed prometheus.ReadResponse: the series of each query's result.
+func ParseRemoteReadResponse(data []byte) ([][]RemoteReadSeries, error) {
+	var results [][]RemoteReadSeries
+	err := protoFields(data, func(num protowire.Number, result []byte) error {
+		if num != 1 {
+			return nil
+		}
+		var series []RemoteReadSeries
+		err := protoFields(result, func(num protowire.Number, ts []byte) error {
+			if num != 1 {
+				return nil
+			}
+			s, err := parseRemoteReadSeries(ts)
+			series = append(series, s)
+			return err
+		})
+		results = append(results, series)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("remote read: %w", err)
+	}
+	return results, nil
+}
+
+// parseRemoteReadSeries decodes a prometheus.TimeSeries.
+func parseRemoteReadSeries(data []byte) (RemoteReadSeries, error) {
+	s := RemoteReadSeries{Labels: map[string]string{}}
+	err := protoFields(data, func(num protowire.Number, field []byte) error {
+		switch num {
+		case 1: // Label
+			var name, value string
+			err := protoFields(field, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					name = string(v)
+				case 2:
+					value = string(v)
+				}
+				return nil
+			})
+			s.Labels[name] = value
+			return err
+		case 2: // Sample
+			var (
+				value float64
+				ts    int64
+			)
+			for b := field; len(b) > 0; {
+				num, typ, n := protowire.ConsumeTag(b)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				b = b[n:]
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					v, n := protowire.ConsumeFixed64(b)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					value, b = math.Float64frombits(v), b[n:]
+				case num == 2 && typ == protowire.VarintType:
+					v, n := protowire.ConsumeVarint(b)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					ts, b = int64(v), b[n:]
+				default:
+					n := protowire.ConsumeFieldValue(num, typ, b)
+					if n < 0 {
+						return protowire.ParseError(n)
+					}
+					b = b[n:]
+				}
+			}
+			s.Timestamps = append(s.Timestamps, ts)
+			s.Values = append(s.Values, value)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// protoFields calls fn with the number and contents of each length-delimited field of the message in data,
+// skipping the others.
+func protoFields(data []byte, fn func(num protowire.Number, field []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		field, n := protowire.ConsumeBytes(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(num, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
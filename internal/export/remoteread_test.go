@@ -0,0 +1,124 @@
+package export
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteReadResponse encodes a prometheus.ReadResponse with a result per element of results.
+func remoteReadResponse(results [][]RemoteReadSeries) []byte {
+	var b []byte
+	for _, series := range results {
+		var result []byte
+		for _, s := range series {
+			var ts []byte
+			for name, value := range s.Labels {
+				var label []byte
+				label = protowire.AppendTag(label, 1, protowire.BytesType)
+				label = protowire.AppendString(label, name)
+				label = protowire.AppendTag(label, 2, protowire.BytesType)
+				label = protowire.AppendString(label, value)
+				ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+				ts = protowire.AppendBytes(ts, label)
+			}
+			for i := range s.Timestamps {
+				var sample []byte
+				sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+				sample = protowire.AppendFixed64(sample, math.Float64bits(s.Values[i]))
+				sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+				sample = protowire.AppendVarint(sample, uint64(s.Timestamps[i]))
+				ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+				ts = protowire.AppendBytes(ts, sample)
+			}
+			result = protowire.AppendTag(result, 1, protowire.BytesType)
+			result = protowire.AppendBytes(result, ts)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, result)
+	}
+	return b
+}
+
+func TestRemoteRead(t *testing.T) {
+	start, end := time.Unix(1700000000, 0), time.Unix(1700003600, 0)
+	want := [][]RemoteReadSeries{
+		{{
+			Labels:     map[string]string{"__name__": "netatmo_temperature", "dev_id": "02:00:00:00:00:01"},
+			Timestamps: []int64{1700000300000, 1700000600000},
+			Values:     []float64{21.5, 21.25},
+		}},
+		nil,
+	}
+	var gotReq []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Read-Version") == "" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		var err error
+		if gotReq, err = snappy.Decode(nil, body); err != nil {
+			t.Errorf("request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(snappy.Encode(nil, remoteReadResponse(want)))
+	}))
+	defer srv.Close()
+
+	got, err := RemoteRead(context.Background(), srv.Client(), srv.URL, []RemoteReadQuery{
+		{Start: start, End: end, Matchers: map[string]string{"__name__": "netatmo_temperature", "dev_id": "02:00:00:00:00:01"}},
+		{Start: start, End: end, Matchers: map[string]string{"__name__": "netatmo_humidity", "home_id": ""}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries := fields(t, gotReq)[1]
+	if len(queries) != 2 {
+		t.Fatalf("got %d queries, want 2", len(queries))
+	}
+	q := fields(t, queries[0].([]byte))
+	if q[1][0] != uint64(start.UnixMilli()) || q[2][0] != uint64(end.UnixMilli()) {
+		t.Errorf("query range = %v..%v", q[1], q[2])
+	}
+	var matchers []string
+	for _, m := range q[3] {
+		f := fields(t, m.([]byte))
+		if len(f[1]) > 0 {
+			t.Errorf("matcher type = %v, want EQ", f[1])
+		}
+		matchers = append(matchers, string(f[2][0].([]byte))+"="+string(f[3][0].([]byte)))
+	}
+	if len(matchers) != 2 || matchers[0] != "__name__=netatmo_temperature" || matchers[1] != "dev_id=02:00:00:00:00:01" {
+		t.Errorf("matchers = %q", matchers)
+	}
+
+	if len(got) != 2 || len(got[0]) != 1 || len(got[1]) != 0 {
+		t.Fatalf("got %+v", got)
+	}
+	s := got[0][0]
+	if s.Labels["dev_id"] != "02:00:00:00:00:01" || s.Labels["__name__"] != "netatmo_temperature" {
+		t.Errorf("labels = %v", s.Labels)
+	}
+	if len(s.Timestamps) != 2 || s.Timestamps[1] != 1700000600000 || s.Values[1] != 21.25 {
+		t.Errorf("samples = %v %v", s.Timestamps, s.Values)
+	}
+}
+
+func TestRemoteReadError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "remote read is disabled", http.StatusNotImplemented)
+	}))
+	defer srv.Close()
+	_, err := RemoteRead(context.Background(), srv.Client(), srv.URL, []RemoteReadQuery{{Matchers: map[string]string{"__name__": "x"}}})
+	if err == nil {
+		t.Fatal("want an error")
+	}
+}
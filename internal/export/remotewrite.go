@@ -0,0 +1,283 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteSink is a Sink that sends the families to a Prometheus remote-write receiver in batches, as
+// version 1.0 (prometheus.WriteRequest) or 2.0 (io.prometheus.write.v2.Request, with interned label strings
+// and per-series metadata) of the protocol. Only gauges and counters are sent.
+//
+// It is a Checkpointer: checkpoints run once the batch with the families before them has been accepted.
+// Encode and Checkpoint are safe for concurrent use.
+//
+// https://prometheus.io/docs/specs/remote_write_spec/ and https://prometheus.io/docs/specs/remote_write_spec_2_0/
+type RemoteWriteSink struct {
+	client    *http.Client
+	url       string
+	version   int
+	batchSize int
+
+	mu       sync.Mutex
+	families []*dto.MetricFamily
+	samples  int
+	marks    []func()
+}
+
+// NewRemoteWriteSink returns a sink posting batches of about batchSize samples to url, in version 1 or 2 of the
+// protocol.
+func NewRemoteWriteSink(client *http.Client, url string, version, batchSize int) (*RemoteWriteSink, error) {
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("remote write: unknown version %d (want 1 or 2)", version)
+	}
+	return &RemoteWriteSink{client: client, url: url, version: version, batchSize: max(batchSize, 1)}, nil
+}
+
+// Encode implements Sink.
+func (s *RemoteWriteSink) Encode(mf *dto.MetricFamily) error {
+	if t := mf.GetType(); t != dto.MetricType_GAUGE && t != dto.MetricType_COUNTER || len(mf.Metric) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.families = append(s.families, mf)
+	s.samples += len(mf.Metric)
+	if s.samples < s.batchSize {
+		return nil
+	}
+	return s.flush(context.Background())
+}
+
+// Checkpoint implements Checkpointer.
+func (s *RemoteWriteSink) Checkpoint(fn func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.families) == 0 {
+		fn()
+		return nil
+	}
+	s.marks = append(s.marks, fn)
+	return nil
+}
+
+// Close sends the last batch.
+func (s *RemoteWriteSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush(ctx)
+}
+
+// flush sends the pending families, then runs the pending checkpoints. s.mu must be held.
+func (s *RemoteWriteSink) flush(ctx context.Context) error {
+	if len(s.families) > 0 {
+		if err := s.send(ctx); err != nil {
+			return err
+		}
+	}
+	for _, fn := range s.marks {
+		fn()
+	}
+	s.families, s.samples, s.marks = nil, 0, nil
+	return nil
+}
+
+func (s *RemoteWriteSink) send(ctx context.Context) error {
+	body := RemoteWriteV1(s.families)
+	contentType, version := "application/x-protobuf", "0.1.0"
+	if s.version == 2 {
+		body = RemoteWriteV2(s.families)
+		contentType, version = "application/x-protobuf;proto=io.prometheus.write.v2.Request", "2.0.0"
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewReader(snappy.Encode(nil, body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", version)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	switch {
+	case resp.StatusCode == http.StatusUnsupportedMediaType && s.version == 2:
+		return fmt.Errorf("remote write: %s: the receiver doesn't support version 2.0; use version 1", resp.Status)
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("remote write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	// 2.0 receivers report what they wrote; fewer samples means some were dropped.
+	if h := resp.Header.Get("X-Prometheus-Remote-Write-Samples-Written"); s.version == 2 && h != "" {
+		if n, err := strconv.Atoi(h); err == nil && n < s.samples {
+			return fmt.Errorf("remote write: the receiver wrote %d of %d samples", n, s.samples)
+		}
+	}
+	return nil
+}
+
+// remoteWriteSeries is a series of samples with the same labels, in the order they were encoded.
+type remoteWriteSeries struct {
+	family  *dto.MetricFamily
+	labels  [][2]string // Sorted by name, with __name__.
+	samples []*dto.Metric
+}
+
+// remoteWriteSeriesOf groups the samples of the gauge and counter families by series.
+func remoteWriteSeriesOf(families []*dto.MetricFamily) []*remoteWriteSeries {
+	var series []*remoteWriteSeries
+	byKey := map[string]*remoteWriteSeries{}
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			labels := [][2]string{{"__name__", mf.GetName()}}
+			for _, l := range m.Label {
+				labels = append(labels, [2]string{l.GetName(), l.GetValue()})
+			}
+			slices.SortFunc(labels, func(a, b [2]string) int { return strings.Compare(a[0], b[0]) })
+			var key strings.Builder
+			for _, l := range labels {
+				key.WriteString(l[0] + "\xff" + l[1] + "\xff")
+			}
+			s := byKey[key.String()]
+			if s == nil {
+				s = &remoteWriteSeries{family: mf, labels: labels}
+				byKey[key.String()] = s
+				series = append(series, s)
+			}
+			s.samples = append(s.samples, m)
+		}
+	}
+	return series
+}
+
+// remoteWriteType is the metric type enum of both versions.
+func remoteWriteType(mf *dto.MetricFamily) uint64 {
+	if mf.GetType() == dto.MetricType_COUNTER {
+		return 1
+	}
+	return 2 // Gauge.
+}
+
+// appendSample appends a Sample message of m, which both versions share.
+func appendSample(b []byte, num protowire.Number, m *dto.Metric) []byte {
+	v := m.GetGauge().GetValue()
+	if m.Counter != nil {
+		v = m.GetCounter().GetValue()
+	}
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(v))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(m.GetTimestampMs()))
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, sample)
+}
+
+// RemoteWriteV1 encodes the gauge and counter families as an uncompressed 1.0 prometheus.WriteRequest, with a
+// MetricMetadata for each family.
+func RemoteWriteV1(families []*dto.MetricFamily) []byte {
+	var b []byte
+	for _, s := range remoteWriteSeriesOf(families) {
+		var ts []byte
+		for _, l := range s.labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l[0])
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l[1])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+		for _, m := range s.samples {
+			ts = appendSample(ts, 2, m)
+		}
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+	seen := map[string]bool{}
+	for _, mf := range families {
+		if seen[mf.GetName()] {
+			continue
+		}
+		seen[mf.GetName()] = true
+		var md []byte
+		md = protowire.AppendTag(md, 1, protowire.VarintType)
+		md = protowire.AppendVarint(md, remoteWriteType(mf))
+		md = protowire.AppendTag(md, 2, protowire.BytesType)
+		md = protowire.AppendString(md, mf.GetName())
+		md = protowire.AppendTag(md, 4, protowire.BytesType)
+		md = protowire.AppendString(md, mf.GetHelp())
+		md = protowire.AppendTag(md, 5, protowire.BytesType)
+		md = protowire.AppendString(md, mf.GetUnit())
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, md)
+	}
+	return b
+}
+
+// RemoteWriteV2 encodes the gauge and counter families as an uncompressed 2.0 io.prometheus.write.v2.Request:
+// every label name and value, help, and unit is a reference into one symbol table, and each series carries
+// its family's metadata.
+func RemoteWriteV2(families []*dto.MetricFamily) []byte {
+	symbols := []string{""} // The empty string is always symbol 0.
+	refs := map[string]uint64{"": 0}
+	ref := func(s string) uint64 {
+		r, ok := refs[s]
+		if !ok {
+			r = uint64(len(symbols))
+			refs[s] = r
+			symbols = append(symbols, s)
+		}
+		return r
+	}
+
+	var series []byte
+	for _, s := range remoteWriteSeriesOf(families) {
+		var labelRefs []byte
+		for _, l := range s.labels {
+			labelRefs = protowire.AppendVarint(labelRefs, ref(l[0]))
+			labelRefs = protowire.AppendVarint(labelRefs, ref(l[1]))
+		}
+		var ts []byte
+		ts = protowire.AppendTag(ts, 1, protowire.BytesType) // Packed.
+		ts = protowire.AppendBytes(ts, labelRefs)
+		for _, m := range s.samples {
+			ts = appendSample(ts, 2, m)
+		}
+		var md []byte
+		md = protowire.AppendTag(md, 1, protowire.VarintType)
+		md = protowire.AppendVarint(md, remoteWriteType(s.family))
+		if h := s.family.GetHelp(); h != "" {
+			md = protowire.AppendTag(md, 3, protowire.VarintType)
+			md = protowire.AppendVarint(md, ref(h))
+		}
+		if u := s.family.GetUnit(); u != "" {
+			md = protowire.AppendTag(md, 4, protowire.VarintType)
+			md = protowire.AppendVarint(md, ref(u))
+		}
+		ts = protowire.AppendTag(ts, 5, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, md)
+		series = protowire.AppendTag(series, 5, protowire.BytesType)
+		series = protowire.AppendBytes(series, ts)
+	}
+
+	var b []byte
+	for _, s := range symbols {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	return append(b, series...)
+}
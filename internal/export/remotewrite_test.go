@@ -0,0 +1,169 @@
+package export
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// fields parses a protobuf message into its fields by number, as raw bytes for bytes fields and as the value
+// for varint and fixed64 ones.
+func fields(t *testing.T, b []byte) map[protowire.Number][]any {
+	t.Helper()
+	out := map[protowire.Number][]any{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		var v any
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatalf("bad field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		out[num] = append(out[num], v)
+	}
+	return out
+}
+
+func remoteWriteFamilies() []*dto.MetricFamily {
+	labels := LabelPairs(map[string]string{"dev_id": "70:ee:50:00:00:01", "module_name": "Indoor"})
+	points := []netatmo.DataPoint{
+		{Time: time.Unix(1704067200, 0), Values: []float64{20.5, 40}},
+		{Time: time.Unix(1704067500, 0), Values: []float64{21, 41}},
+	}
+	return Families(labels, []netatmo.DataType{netatmo.DataTemperature, netatmo.DataCO2}, points)
+}
+
+func TestRemoteWriteV2(t *testing.T) {
+	var requests [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != "application/x-protobuf;proto=io.prometheus.write.v2.Request" {
+			http.Error(w, got, http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	sink, err := NewRemoteWriteSink(srv.Client(), srv.URL, 2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range remoteWriteFamilies() {
+		if err := sink.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marked := false
+	sink.Checkpoint(func() { marked = true })
+	if marked {
+		t.Error("checkpoint ran before its batch was sent")
+	}
+	if err := sink.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !marked || len(requests) != 1 {
+		t.Fatalf("marked = %v after %d requests, want true after 1", marked, len(requests))
+	}
+
+	req := fields(t, requests[0])
+	var symbols []string
+	for _, s := range req[4] {
+		symbols = append(symbols, string(s.([]byte)))
+	}
+	if len(symbols) == 0 || symbols[0] != "" {
+		t.Fatalf("symbols = %q, want the empty string first", symbols)
+	}
+	if len(req[5]) != 2 {
+		t.Fatalf("got %d series, want 2", len(req[5]))
+	}
+	ts := fields(t, req[5][0].([]byte))
+	var labels []string
+	for b := ts[1][0].([]byte); len(b) > 0; {
+		ref, n := protowire.ConsumeVarint(b)
+		b = b[n:]
+		labels = append(labels, symbols[ref])
+	}
+	want := []string{"__name__", "netatmo_temperature", "dev_id", "70:ee:50:00:00:01", "module_name", "Indoor"}
+	if !slices.Equal(labels, want) {
+		t.Errorf("labels = %q, want %q", labels, want)
+	}
+	if len(ts[2]) != 2 {
+		t.Fatalf("got %d samples, want 2", len(ts[2]))
+	}
+	sample := fields(t, ts[2][1].([]byte))
+	if v, ms := math.Float64frombits(sample[1][0].(uint64)), int64(sample[2][0].(uint64)); v != 21 || ms != 1704067500000 {
+		t.Errorf("sample = %v at %d, want 21 at 1704067500000", v, ms)
+	}
+	md := fields(t, ts[5][0].([]byte))
+	if md[1][0].(uint64) != 2 || len(md[4]) != 1 || symbols[md[4][0].(uint64)] != "Cel" {
+		t.Errorf("metadata = %v, want a gauge in Cel", md)
+	}
+}
+
+func TestRemoteWriteV1(t *testing.T) {
+	req := fields(t, RemoteWriteV1(remoteWriteFamilies()))
+	if len(req[1]) != 2 || len(req[3]) != 2 {
+		t.Fatalf("got %d series and %d metadata, want 2 and 2", len(req[1]), len(req[3]))
+	}
+	ts := fields(t, req[1][1].([]byte))
+	var labels []string
+	for _, l := range ts[1] {
+		f := fields(t, l.([]byte))
+		labels = append(labels, string(f[1][0].([]byte)), string(f[2][0].([]byte)))
+	}
+	want := []string{"__name__", "netatmo_co2", "dev_id", "70:ee:50:00:00:01", "module_name", "Indoor"}
+	if !slices.Equal(labels, want) {
+		t.Errorf("labels = %q, want %q", labels, want)
+	}
+	md := fields(t, req[3][1].([]byte))
+	if md[1][0].(uint64) != 2 || string(md[2][0].([]byte)) != "netatmo_co2" {
+		t.Errorf("metadata = %v, want gauge netatmo_co2", md)
+	}
+}
+
+func TestRemoteWriteUnsupported(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unsupported", http.StatusUnsupportedMediaType)
+	}))
+	defer srv.Close()
+	sink, err := NewRemoteWriteSink(srv.Client(), srv.URL, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Encode(remoteWriteFamilies()[0])
+	if err == nil || !strings.Contains(err.Error(), "use version 1") {
+		t.Errorf("err = %v, want a hint to use version 1", err)
+	}
+}
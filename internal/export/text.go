@@ -0,0 +1,28 @@
+package export
+
+import (
+	"io"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// TextSink is a Sink writing the Prometheus text format.
+// Encode is safe for concurrent use, so concurrent module exports can share it.
+type TextSink struct {
+	mu  sync.Mutex
+	enc expfmt.Encoder
+}
+
+// NewTextSink returns a sink writing the Prometheus text format to w.
+func NewTextSink(w io.Writer) *TextSink {
+	return &TextSink{enc: expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))}
+}
+
+// Encode implements Sink.
+func (s *TextSink) Encode(mf *dto.MetricFamily) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(mf)
+}
@@ -0,0 +1,251 @@
+// Package expr is a small arithmetic expression language, for series computed from each point of a module's
+// data (e.g. "temperature*9/5+32").
+//
+// An expression has numbers, variables, the operators + - * / % ^ (power, right-associative) and unary minus,
+// parentheses, and the functions abs, ceil, exp, floor, ln, log10, max, min, pow, round, and sqrt.
+// Variable names are case-insensitive.
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expr is a compiled expression.
+type Expr struct {
+	src  string
+	eval func(vars []float64) float64
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string { return e.src }
+
+// Eval evaluates the expression with the values of the variables, in the order given to Compile.
+// Like the operators and functions it's made of, it returns NaN or ±Inf where they are undefined.
+func (e *Expr) Eval(vars []float64) float64 { return e.eval(vars) }
+
+// Compile parses src, which may use the variables named in vars.
+func Compile(src string, vars []string) (*Expr, error) {
+	p := &parser{src: src, vars: vars}
+	p.next()
+	eval, err := p.expr()
+	if err == nil && p.tok != "" {
+		err = p.errorf("unexpected %q", p.tok)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Expr{src: src, eval: eval}, nil
+}
+
+type evalFunc = func(vars []float64) float64
+
+var funcs = map[string]struct {
+	arity int
+	fn    func(args []float64) float64
+}{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ln":    {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"max":   {2, func(a []float64) float64 { return math.Max(a[0], a[1]) }},
+	"min":   {2, func(a []float64) float64 { return math.Min(a[0], a[1]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+}
+
+// parser is a recursive descent parser, building the closures to evaluate as it goes.
+type parser struct {
+	src  string
+	vars []string
+	pos  int    // Of the end of tok.
+	tok  string // The current token; empty at the end.
+	at   int    // Of the start of tok.
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("expr %q: at %d: %s", p.src, p.at+1, fmt.Sprintf(format, args...))
+}
+
+// next scans the next token: a number, a name, or a single character.
+func (p *parser) next() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\n') {
+		p.pos++
+	}
+	p.at = p.pos
+	if p.pos == len(p.src) {
+		p.tok = ""
+		return
+	}
+	switch c := p.src[p.pos]; {
+	case isNum(c):
+		for p.pos < len(p.src) && isNum(p.src[p.pos]) {
+			p.pos++
+		}
+		// An exponent, as in 1e-3.
+		if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+				p.pos++
+			}
+		}
+	case isName(c):
+		for p.pos < len(p.src) && isName(p.src[p.pos]) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.tok = p.src[p.at:p.pos]
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isNum(c byte) bool   { return c == '.' || isDigit(c) }
+func isName(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || isDigit(c)
+}
+
+// expr parses a sum: term (("+" | "-") term)*.
+func (p *parser) expr() (evalFunc, error) {
+	l, err := p.term()
+	for err == nil && (p.tok == "+" || p.tok == "-") {
+		op := p.tok
+		p.next()
+		var r evalFunc
+		if r, err = p.term(); err != nil {
+			break
+		}
+		if a := l; op == "+" {
+			l = func(v []float64) float64 { return a(v) + r(v) }
+		} else {
+			l = func(v []float64) float64 { return a(v) - r(v) }
+		}
+	}
+	return l, err
+}
+
+// term parses a product: unary (("*" | "/" | "%") unary)*.
+func (p *parser) term() (evalFunc, error) {
+	l, err := p.unary()
+	for err == nil && (p.tok == "*" || p.tok == "/" || p.tok == "%") {
+		op := p.tok
+		p.next()
+		var r evalFunc
+		if r, err = p.unary(); err != nil {
+			break
+		}
+		switch a := l; op {
+		case "*":
+			l = func(v []float64) float64 { return a(v) * r(v) }
+		case "/":
+			l = func(v []float64) float64 { return a(v) / r(v) }
+		case "%":
+			l = func(v []float64) float64 { return math.Mod(a(v), r(v)) }
+		}
+	}
+	return l, err
+}
+
+// unary parses "-" unary, or a power: primary ("^" unary)?.
+func (p *parser) unary() (evalFunc, error) {
+	if p.tok == "-" {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v []float64) float64 { return -x(v) }, nil
+	}
+	l, err := p.primary()
+	if err != nil || p.tok != "^" {
+		return l, err
+	}
+	p.next()
+	r, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return func(v []float64) float64 { return math.Pow(l(v), r(v)) }, nil
+}
+
+// primary parses a number, a variable, a function call, or a parenthesized expression.
+func (p *parser) primary() (evalFunc, error) {
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, p.errorf("unexpected end")
+	case tok == "(":
+		p.next()
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok != ")" {
+			return nil, p.errorf("missing )")
+		}
+		p.next()
+		return x, nil
+	case isNum(tok[0]):
+		n, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %q", tok)
+		}
+		p.next()
+		return func([]float64) float64 { return n }, nil
+	case isName(tok[0]):
+		for i, name := range p.vars {
+			if strings.EqualFold(tok, name) {
+				p.next()
+				return func(v []float64) float64 { return v[i] }, nil
+			}
+		}
+		if _, ok := funcs[strings.ToLower(tok)]; !ok {
+			return nil, p.errorf("unknown variable %q (have %s)", tok, strings.Join(p.vars, ", "))
+		}
+		p.next()
+		if p.tok != "(" {
+			return nil, p.errorf("missing ( after %s", tok)
+		}
+		return p.call(tok)
+	default:
+		return nil, p.errorf("unexpected %q", tok)
+	}
+}
+
+// call parses the arguments of a call to the function name, from the "(".
+func (p *parser) call(name string) (evalFunc, error) {
+	f := funcs[strings.ToLower(name)]
+	var args []evalFunc
+	for p.next(); p.tok != ")"; {
+		if len(args) > 0 {
+			if p.tok != "," {
+				return nil, p.errorf("expected , or ) in the arguments of %s", name)
+			}
+			p.next()
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	p.next()
+	if len(args) != f.arity {
+		return nil, p.errorf("%s takes %d arguments, not %d", name, f.arity, len(args))
+	}
+	return func(v []float64) float64 {
+		vals := make([]float64, len(args))
+		for i, arg := range args {
+			vals[i] = arg(v)
+		}
+		return f.fn(vals)
+	}, nil
+}
@@ -0,0 +1,67 @@
+package expr
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	vars := []string{"Temperature", "Humidity"}
+	vals := []float64{20, 50}
+	for _, tt := range []struct {
+		src  string
+		want float64
+	}{
+		{"temperature*9/5+32", 68},
+		{"TEMPERATURE + humidity", 70},
+		{"-temperature^2", -400},
+		{"2^3^2", 512},
+		{"(1 + 2) * 3 - 4 / 2", 7},
+		{"temperature % 7", 6},
+		{"1.5e1", 15},
+		{".5", 0.5},
+		{"max(temperature, humidity) - min(1, 2)", 49},
+		{"round(sqrt(humidity) * 10) / 10", 7.1},
+		{"ln(exp(2)) + log10(1000) + abs(-1) + floor(1.5) + ceil(1.5) + pow(2, 3)", 2 + 3 + 1 + 1 + 2 + 8},
+	} {
+		e, err := Compile(tt.src, vars)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.src, err)
+			continue
+		}
+		if got := e.Eval(vals); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+
+	e, err := Compile("humidity / (temperature - 20)", vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Eval(vals); !math.IsInf(got, 1) {
+		t.Errorf("division by zero = %v, want +Inf", got)
+	}
+	if got := e.Eval([]float64{21, math.NaN()}); !math.IsNaN(got) {
+		t.Errorf("with a NaN input = %v, want NaN", got)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"temperature +",
+		"pressure * 2",
+		"(temperature",
+		"temperature)",
+		"sqrt",
+		"sqrt(1, 2)",
+		"max(1 2)",
+		"nosuch(1)",
+		"1..2",
+		"temperature $ 2",
+	} {
+		if _, err := Compile(src, []string{"Temperature"}); err == nil {
+			t.Errorf("Compile(%q) succeeded", src)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+// Package mirror keeps a local SQLite copy of the module history fetched from Netatmo, and serves exports from it
+// first, asking Netatmo only for the data newer than the copy: disk traded for API quota.
+//
+// Next to the samples, keyed by module, data type, and timestamp, the mirror records the span of each series it
+// has fetched without gaps. Only requests starting inside that span are served locally. Samples that Netatmo adds
+// to a span after it was fetched are not seen.
+package mirror
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS samples (
+	device    TEXT NOT NULL,
+	module    TEXT NOT NULL,
+	data_type TEXT NOT NULL,
+	time      INTEGER NOT NULL, -- Unix seconds.
+	value     REAL,             -- NULL for NaN.
+	PRIMARY KEY (device, module, data_type, time)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS coverage (
+	device    TEXT NOT NULL,
+	module    TEXT NOT NULL,
+	data_type TEXT NOT NULL,
+	first     INTEGER NOT NULL, -- The since of the fetch the span starts with; 0 for the start of history.
+	last      INTEGER NOT NULL, -- The newest sample fetched.
+	PRIMARY KEY (device, module, data_type)
+) WITHOUT ROWID;
+`
+
+// PageSize is the most points GetMeasure yields at once from the mirror, like the API.
+const PageSize = 1024
+
+// Mirror is an export.Client that reads from the SQLite database first, and from Upstream after it.
+// Everything fetched from Upstream is stored.
+type Mirror struct {
+	Upstream export.Client
+
+	db *sql.DB
+}
+
+var _ export.Client = (*Mirror)(nil)
+
+// Open opens or creates the mirror database at path, in front of upstream. Call Close when done.
+func Open(path string, upstream export.Client) (*Mirror, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection: the writes of concurrent exports take turns instead of failing as busy.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("mirror %s: %w", path, err)
+	}
+	return &Mirror{Upstream: upstream, db: db}, nil
+}
+
+// Close closes the database.
+func (m *Mirror) Close() error { return m.db.Close() }
+
+// span is the part of a series that was fetched without gaps, in Unix seconds.
+type span struct{ first, last int64 }
+
+// GetMeasure yields the points from since through the end of the mirrored span, then fetches the rest from
+// Upstream, storing it before yielding it.
+func (m *Mirror) GetMeasure(ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID,
+	dataTypes []netatmo.DataType, since, until time.Time, yield func(points []netatmo.DataPoint, nextTime time.Time) error,
+) error {
+	sp, ok, err := m.span(ctx, device, module, dataTypes)
+	if err != nil {
+		return err
+	}
+	start := since
+	if ok && unix(since) >= sp.first && unix(since) <= sp.last {
+		end := sp.last
+		if !until.IsZero() && until.Unix() < end {
+			end = until.Unix()
+		}
+		n, err := m.read(ctx, device, module, dataTypes, unix(since), end, yield)
+		if err != nil {
+			return err
+		}
+		slog.DebugContext(ctx, "read from mirror", "device", device, "module", module, "points", n)
+		start = time.Unix(sp.last+1, 0)
+		if !until.IsZero() && until.Before(start) {
+			return nil
+		}
+	}
+	return m.Upstream.GetMeasure(ctx, device, module, dataTypes, start, until,
+		func(points []netatmo.DataPoint, nextTime time.Time) error {
+			if err := m.write(ctx, device, module, dataTypes, unix(start), points); err != nil {
+				return fmt.Errorf("mirror: %w", err)
+			}
+			return yield(points, nextTime)
+		})
+}
+
+// unix returns t in Unix seconds, or 0 for the zero time (the start of history).
+func unix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// span returns the span mirrored for all of dataTypes, if there is one.
+func (m *Mirror) span(ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+) (sp span, ok bool, err error) {
+	for i, dt := range dataTypes {
+		var s span
+		err := m.db.QueryRowContext(ctx, `SELECT first, last FROM coverage WHERE device = ? AND module = ? AND data_type = ?`,
+			string(device), string(module), string(dt)).Scan(&s.first, &s.last)
+		if err == sql.ErrNoRows {
+			return span{}, false, nil
+		}
+		if err != nil {
+			return span{}, false, err
+		}
+		if i == 0 {
+			sp = s
+		}
+		sp.first, sp.last = max(sp.first, s.first), min(sp.last, s.last)
+	}
+	return sp, len(dataTypes) > 0 && sp.first <= sp.last, nil
+}
+
+// read yields the mirrored points from from through to, in pages of PageSize, and returns how many there were.
+func (m *Mirror) read(ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+	from, to int64, yield func(points []netatmo.DataPoint, nextTime time.Time) error,
+) (int, error) {
+	// One column per data type, NULL where a point lacks it.
+	var cols strings.Builder
+	args := []any{}
+	for _, dt := range dataTypes {
+		cols.WriteString(", MAX(CASE WHEN data_type = ? THEN value END)")
+		args = append(args, string(dt))
+	}
+	query := `SELECT time` + cols.String() + ` FROM samples
+		WHERE device = ? AND module = ? AND data_type IN (?` + strings.Repeat(", ?", len(dataTypes)-1) + `)
+		AND time >= ? AND time <= ?
+		GROUP BY time ORDER BY time LIMIT ?`
+	args = append(args, string(device), string(module))
+	for _, dt := range dataTypes {
+		args = append(args, string(dt))
+	}
+
+	total := 0
+	for {
+		points, err := m.page(ctx, query, append(args, from, to, PageSize), len(dataTypes))
+		if err != nil || len(points) == 0 {
+			return total, err
+		}
+		total += len(points)
+		next := points[len(points)-1].Time.Add(time.Second)
+		if err := yield(points, next); err != nil {
+			return total, err
+		}
+		if len(points) < PageSize {
+			return total, nil
+		}
+		from = next.Unix()
+	}
+}
+
+// page runs the query for a page of points, closing the rows before they are yielded.
+func (m *Mirror) page(ctx context.Context, query string, args []any, n int) ([]netatmo.DataPoint, error) {
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var points []netatmo.DataPoint
+	for rows.Next() {
+		var t int64
+		vals := make([]sql.NullFloat64, n)
+		dest := []any{&t}
+		for i := range vals {
+			dest = append(dest, &vals[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		p := netatmo.DataPoint{Time: time.Unix(t, 0), Values: make([]float64, n)}
+		for i, v := range vals {
+			p.Values[i] = math.NaN()
+			if v.Valid {
+				p.Values[i] = v.Float64
+			}
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// write stores a page of points fetched from Upstream starting at start, and extends the mirrored spans with
+// it where it's contiguous with them.
+func (m *Mirror) write(ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+	start int64, points []netatmo.DataPoint,
+) error {
+	if len(points) == 0 {
+		return nil
+	}
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.PrepareContext(ctx,
+		`INSERT OR REPLACE INTO samples (device, module, data_type, time, value) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for _, p := range points {
+		for i, dt := range dataTypes {
+			var v any
+			if !math.IsNaN(p.Values[i]) {
+				v = p.Values[i]
+			}
+			if _, err := insert.ExecContext(ctx, string(device), string(module), string(dt), p.Time.Unix(), v); err != nil {
+				return err
+			}
+		}
+	}
+	newest := points[len(points)-1].Time.Unix()
+	for _, dt := range dataTypes {
+		// A new span, or one merged with the old if they touch; a span below a disjoint old one is not recorded.
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO coverage (device, module, data_type, first, last) VALUES (?1, ?2, ?3, ?4, ?5)
+			ON CONFLICT (device, module, data_type) DO UPDATE SET first = MIN(first, ?4), last = MAX(last, ?5)
+			WHERE ?4 <= last + 1 AND ?5 >= first`,
+			string(device), string(module), string(dt), start, newest)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,119 @@
+package mirror
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+	"sgrankin.dev/netatmo-otel/netatmo/netatmotest"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var dataTypes = []netatmo.DataType{netatmo.DataTemperature, netatmo.DataCO2}
+
+func newMirror(t *testing.T) (*Mirror, *netatmotest.Fake) {
+	fake := netatmotest.NewFake(netatmo.Station{ID: "70:ee:50:00:00:01"})
+	fake.Since, fake.Until, fake.PageSize = t0, t0.Add(time.Hour), 5
+	m, err := Open(filepath.Join(t.TempDir(), "mirror.db"), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m, fake
+}
+
+// fetch returns the points from the mirror, and how many upstream calls that took.
+func fetch(t *testing.T, m *Mirror, fake *netatmotest.Fake, since, until time.Time) ([]netatmo.DataPoint, int) {
+	t.Helper()
+	calls := fake.Calls()
+	var points []netatmo.DataPoint
+	err := m.GetMeasure(context.Background(), "70:ee:50:00:00:01", "", dataTypes, since, until,
+		func(ps []netatmo.DataPoint, nextTime time.Time) error {
+			if want := ps[len(ps)-1].Time.Add(time.Second); !nextTime.Equal(want) {
+				t.Errorf("nextTime = %v, want %v", nextTime, want)
+			}
+			for _, p := range ps {
+				points = append(points, netatmo.DataPoint{Time: p.Time.UTC(), Values: slices.Clone(p.Values)})
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return points, fake.Calls() - calls
+}
+
+func TestMirror(t *testing.T) {
+	m, fake := newMirror(t)
+
+	// 13 samples, in pages of 5, then an empty page.
+	first, calls := fetch(t, m, fake, t0, time.Time{})
+	if len(first) != 13 || calls != 4 {
+		t.Fatalf("first fetch: %d points in %d calls, want 13 in 4", len(first), calls)
+	}
+
+	// Again, from the mirror, and only the empty page of newer data from upstream.
+	again, calls := fetch(t, m, fake, t0, time.Time{})
+	if calls != 1 {
+		t.Errorf("second fetch made %d calls, want 1", calls)
+	}
+	if !slices.EqualFunc(again, first, pointEqual) {
+		t.Errorf("second fetch = %v, want %v", again, first)
+	}
+
+	// Within the span, no calls at all.
+	part, calls := fetch(t, m, fake, t0.Add(20*time.Minute), t0.Add(30*time.Minute))
+	if calls != 0 || !slices.EqualFunc(part, first[4:7], pointEqual) {
+		t.Errorf("fetch within the span = %v in %d calls, want %v in 0", part, calls, first[4:7])
+	}
+
+	// New data is fetched after the span.
+	fake.Until = t0.Add(2 * time.Hour)
+	more, calls := fetch(t, m, fake, t0.Add(55*time.Minute), time.Time{})
+	if len(more) != 14 || calls != 4 {
+		t.Errorf("fetch of new data: %d points in %d calls, want 14 in 4", len(more), calls)
+	}
+	if _, calls := fetch(t, m, fake, t0.Add(55*time.Minute), t0.Add(2*time.Hour)); calls != 0 {
+		t.Errorf("refetch of new data made %d calls, want 0", calls)
+	}
+}
+
+func TestMirrorBeforeSpan(t *testing.T) {
+	m, fake := newMirror(t)
+	fetch(t, m, fake, t0.Add(30*time.Minute), time.Time{})
+
+	// Starting before the span goes upstream, and extends the span back.
+	points, calls := fetch(t, m, fake, t0, time.Time{})
+	if len(points) != 13 || calls != 4 {
+		t.Errorf("fetch before the span: %d points in %d calls, want 13 in 4", len(points), calls)
+	}
+	if _, calls := fetch(t, m, fake, t0, t0.Add(time.Hour)); calls != 0 {
+		t.Errorf("refetch made %d calls, want 0", calls)
+	}
+}
+
+func TestMirrorNaN(t *testing.T) {
+	m, _ := newMirror(t)
+	points := []netatmo.DataPoint{{Time: t0, Values: []float64{21, math.NaN()}}}
+	if err := m.write(context.Background(), "70:ee:50:00:00:01", "", dataTypes, 0, points); err != nil {
+		t.Fatal(err)
+	}
+	var got []netatmo.DataPoint
+	_, err := m.read(context.Background(), "70:ee:50:00:00:01", "", dataTypes, 0, t0.Unix(),
+		func(ps []netatmo.DataPoint, _ time.Time) error { got = append(got, ps...); return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Values[0] != 21 || !math.IsNaN(got[0].Values[1]) {
+		t.Errorf("read = %v, want 21 and NaN", got)
+	}
+}
+
+func pointEqual(a, b netatmo.DataPoint) bool {
+	return a.Time.Equal(b.Time) && slices.Equal(a.Values, b.Values)
+}
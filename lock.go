@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// acquireLock takes an exclusive lock on run.lock in the config dir, waiting up to wait for another run to release it.
+// The lock is held until the returned function is called or the process exits.
+func acquireLock(wait time.Duration) (release func(), err error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "run.lock")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if time.Now().After(deadline) {
+			pid, _ := os.ReadFile(path)
+			f.Close()
+			return nil, fmt.Errorf("another run (pid %s) holds %s; use -lock-wait to wait for it",
+				strings.TrimSpace(string(pid)), path)
+		}
+		time.Sleep(time.Second)
+	}
+
+	// Record the pid for the error message above; the lock itself is what matters.
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// acquireLock is a no-op where flock is not available.
+func acquireLock(time.Duration) (release func(), err error) {
+	return func() {}, nil
+}
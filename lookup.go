@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+
+	promclient "github.com/prometheus/client_golang/api"
+	promapi "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// newCursorLookup returns the lookup backend with the given -lookup name.
+func newCursorLookup(name string, state *State) (export.CursorLookup, error) {
+	switch name {
+	case "state":
+		return stateLookup{state}, nil
+	case "promql":
+		c, err := promclient.NewClient(promclient.Config{Address: destURL("").String(), Client: destClient})
+		if err != nil {
+			return nil, err
+		}
+		return newFallbackLookup(name, promQLLookup{promapi.NewAPI(c)}, state), nil
+	case "vm-export":
+		return newFallbackLookup(name, vmExportLookup{destClient, destURL("").String()}, state), nil
+	case "vm-series":
+		return newFallbackLookup(name, vmSeriesLookup{destClient, destURL("").String()}, state), nil
+	case "remote-read":
+		return newFallbackLookup(name, remoteReadLookup{destClient, destURL(*remoteReadPath).String()}, state), nil
+	default:
+		return nil, fmt.Errorf("unknown lookup %q", name)
+	}
+}
+
+// stateLookup reads cursors from the local state database.
+type stateLookup struct{ state *State }
+
+func (l stateLookup) Cursor(_ context.Context, m export.Module) (time.Time, error) {
+	return l.state.Cursor(m.Device, m.Module, m.DataTypes), nil
+}
+
+// fallbackLookup retries a lookup of the destination that fails, with exponential backoff, up to -lookup-retries
+// times, and then falls back to the local state's cursor, so a destination that is down for the lookup doesn't fail
+// the run's exports. Once the destination has failed a lookup's retries, the other modules' lookups try it once.
+type fallbackLookup struct {
+	name     string
+	lookup   export.CursorLookup
+	fallback stateLookup
+	down     atomic.Bool
+}
+
+func newFallbackLookup(name string, lookup export.CursorLookup, state *State) *fallbackLookup {
+	return &fallbackLookup{name: name, lookup: lookup, fallback: stateLookup{state}}
+}
+
+func (l *fallbackLookup) Cursor(ctx context.Context, m export.Module) (time.Time, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		t, err := l.lookup.Cursor(ctx, m)
+		if err == nil {
+			l.down.Store(false)
+			return t, nil
+		}
+		if ctx.Err() != nil {
+			return time.Time{}, err
+		}
+		if attempt >= *lookupRetries || l.down.Load() {
+			l.down.Store(true)
+			t, _ := l.fallback.Cursor(ctx, m)
+			slog.Warn("lookup failed; resuming from the state's cursor instead", "lookup", l.name,
+				"device", m.Device, "module", m.Module, "cursor", t.Format(time.RFC3339), "err", err)
+			return t, nil
+		}
+		slog.Warn("lookup failed; retrying", "lookup", l.name, "device", m.Device, "module", m.Module,
+			"attempt", attempt+1, "in", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return time.Time{}, ctx.Err()
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// promQLLookup queries the destination's Prometheus API for the last written sample of each data type.
+type promQLLookup struct{ api promapi.API }
+
+func (l promQLLookup) Cursor(ctx context.Context, m export.Module) (time.Time, error) {
+	last := map[netatmo.DataType]time.Time{}
+	for _, dt := range m.DataTypes {
+		val, _, err := l.api.Query(ctx,
+			fmt.Sprintf("max(timestamp(%s[%s]))", seriesSelector(export.MetricName(dt), m.Labels),
+				model.Duration(incrementalSince.Duration())),
+			time.Now())
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %w", errDestination, err)
+		}
+		if v := val.(model.Vector); len(v) > 0 {
+			last[dt] = time.Unix(int64(v[0].Value), 0)
+		}
+	}
+	return oldestCursor(last, m.DataTypes), nil
+}
+
+// seriesSelector returns a selector matching the series of the metric with labels' identity.
+func seriesSelector(name string, labels map[string]string) string {
+	return name + "{" + strings.Join(labelMatchers(labels), ",") + "}"
+}
+
+// identityLabels returns the labels that identify a module's series across runs: dev_id, home_id, and the
+// -account-label, as far as labels has them. The others, like module_name and home_name, change when the module or
+// home is renamed in the app, and a lookup matching on them would find no cursor and export the whole history again.
+func identityLabels(labels map[string]string) map[string]string {
+	ids := map[string]string{}
+	for _, k := range []string{"dev_id", "home_id", *accountLabel} {
+		if v, ok := labels[k]; ok && k != "" {
+			ids[k] = v
+		}
+	}
+	return ids
+}
+
+// labelMatchers returns matchers for the identityLabels of labels, so that modules of other accounts sharing the
+// destination don't match, but the series of a module from before a rename do. An empty value matches the label
+// being absent, which is how the destination stores it.
+func labelMatchers(labels map[string]string) []string {
+	labels = identityLabels(labels)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	matchers := make([]string, len(keys))
+	for i, k := range keys {
+		matchers[i] = fmt.Sprintf("%s=%q", k, labels[k])
+	}
+	return matchers
+}
+
+// vmExportLookup reads the raw samples from VictoriaMetrics' /api/v1/export, for destinations without PromQL
+// timestamp() support.
+type vmExportLookup struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (l vmExportLookup) Cursor(ctx context.Context, m export.Module) (time.Time, error) {
+	names := make([]string, len(m.DataTypes))
+	byName := map[string]netatmo.DataType{}
+	for i, dt := range m.DataTypes {
+		names[i] = export.MetricName(dt)
+		byName[names[i]] = dt
+	}
+	last := map[netatmo.DataType]time.Time{}
+	matchers := append([]string{fmt.Sprintf("__name__=~%q", strings.Join(names, "|"))}, labelMatchers(m.Labels)...)
+	match := "{" + strings.Join(matchers, ",") + "}"
+	err := vmExport(ctx, l.client, l.baseURL, match, incrementalSince.Time(), time.Time{}, func(s vmSeries) error {
+		dt, ok := byName[s.Metric["__name__"]]
+		if !ok {
+			return nil
+		}
+		for _, ms := range s.Timestamps {
+			if t := time.UnixMilli(ms).Truncate(time.Second); t.After(last[dt]) {
+				last[dt] = t
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return oldestCursor(last, m.DataTypes), nil
+}
+
+// vmSeriesLookup finds the window with each data type's last sample from VictoriaMetrics' /api/v1/series, which
+// answers from the index, and only then reads the raw samples of that window from /api/v1/export. The windows go
+// back from now, doubling from an hour, so an up-to-date module costs two cheap requests, where the promql lookup
+// scans -incremental-since of samples for every data type.
+type vmSeriesLookup struct {
+	client  *http.Client
+	baseURL string
+}
+
+func (l vmSeriesLookup) Cursor(ctx context.Context, m export.Module) (time.Time, error) {
+	pending := map[string]netatmo.DataType{}
+	for _, dt := range m.DataTypes {
+		pending[export.MetricName(dt)] = dt
+	}
+	last := map[netatmo.DataType]time.Time{}
+	since := incrementalSince.Time()
+	end := time.Now()
+	for width := time.Hour; len(pending) > 0 && end.After(since); width *= 2 {
+		start := end.Add(-width)
+		if start.Before(since) {
+			start = since
+		}
+		names := make([]string, 0, len(pending))
+		for name := range pending {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		matchers := append([]string{fmt.Sprintf("__name__=~%q", strings.Join(names, "|"))}, labelMatchers(m.Labels)...)
+		match := "{" + strings.Join(matchers, ",") + "}"
+		found, err := vmSeriesNames(ctx, l.client, l.baseURL, match, start, end)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if len(found) > 0 {
+			// The index is coarser than the window (a day, for VictoriaMetrics), so a series it lists may have no
+			// samples in it; those stay pending for the next window.
+			err := vmExport(ctx, l.client, l.baseURL, match, start, end, func(s vmSeries) error {
+				dt, ok := pending[s.Metric["__name__"]]
+				if !ok {
+					return nil
+				}
+				for _, ms := range s.Timestamps {
+					if t := time.UnixMilli(ms).Truncate(time.Second); t.After(last[dt]) {
+						last[dt] = t
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return time.Time{}, err
+			}
+			for name, dt := range pending {
+				if !last[dt].IsZero() {
+					delete(pending, name)
+				}
+			}
+		}
+		end = start
+	}
+	return oldestCursor(last, m.DataTypes), nil
+}
+
+// vmSeriesNames returns the metric names of the series matching the selector that have samples between start and
+// end, as far as VictoriaMetrics' /api/v1/series can tell.
+func vmSeriesNames(ctx context.Context, client *http.Client, baseURL, match string, start, end time.Time) (map[string]bool, error) {
+	v := url.Values{}
+	v.Set("match[]", match)
+	v.Set("start", fmt.Sprintf("%d", start.Unix()))
+	v.Set("end", fmt.Sprintf("%d", end.Unix()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/api/v1/series?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errDestination, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: vm series: %s", errDestination, resp.Status)
+	}
+	var body struct {
+		Data []map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("vm series: %w", err)
+	}
+	names := map[string]bool{}
+	for _, s := range body.Data {
+		names[s["__name__"]] = true
+	}
+	return names, nil
+}
+
+// remoteReadLookup reads the recent samples with the Prometheus remote-read protocol, for destinations that serve
+// it but not PromQL over HTTP (e.g. a Thanos or Cortex setup). Each data type is a query of one request.
+type remoteReadLookup struct {
+	client *http.Client
+	url    string
+}
+
+func (l remoteReadLookup) Cursor(ctx context.Context, m export.Module) (time.Time, error) {
+	start, end := incrementalSince.Time(), time.Now()
+	queries := make([]export.RemoteReadQuery, len(m.DataTypes))
+	for i, dt := range m.DataTypes {
+		matchers := map[string]string{"__name__": export.MetricName(dt)}
+		for k, v := range identityLabels(m.Labels) {
+			matchers[k] = v
+		}
+		queries[i] = export.RemoteReadQuery{Start: start, End: end, Matchers: matchers}
+	}
+	results, err := export.RemoteRead(ctx, l.client, l.url, queries)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %w", errDestination, err)
+	}
+	last := map[netatmo.DataType]time.Time{}
+	for i, series := range results {
+		dt := m.DataTypes[i]
+		for _, s := range series {
+			for _, ms := range s.Timestamps {
+				if t := time.UnixMilli(ms).Truncate(time.Second); t.After(last[dt]) {
+					last[dt] = t
+				}
+			}
+		}
+	}
+	return oldestCursor(last, m.DataTypes), nil
+}
+
+// vmSeries is a line of VictoriaMetrics' /api/v1/export output.
+type vmSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// vmExport reads the raw samples matching the series selector between start and end (if not zero),
+// and calls fn for each series.
+func vmExport(
+	ctx context.Context, client *http.Client, baseURL, match string, start, end time.Time,
+	fn func(vmSeries) error,
+) error {
+	v := url.Values{}
+	v.Set("match[]", match)
+	v.Set("start", fmt.Sprintf("%d", start.Unix()))
+	if !end.IsZero() {
+		v.Set("end", fmt.Sprintf("%d", end.Unix()))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/api/v1/export?"+v.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errDestination, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: vm export: %s", errDestination, resp.Status)
+	}
+
+	// The response is one JSON object per series per line.
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		var s vmSeries
+		if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+			return fmt.Errorf("vm export: %w", err)
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("vm export: %w", err)
+	}
+	return nil
+}
+
+// oldestCursor returns one second after the oldest of the last sample times, or zero if any data type is missing.
+func oldestCursor(last map[netatmo.DataType]time.Time, dataTypes []netatmo.DataType) time.Time {
+	var oldest time.Time
+	for _, dt := range dataTypes {
+		t, ok := last[dt]
+		if !ok || t.IsZero() {
+			return time.Time{}
+		}
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	if oldest.IsZero() {
+		return oldest
+	}
+	return oldest.Add(time.Second)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// fakeVM serves the VictoriaMetrics query routes the lookups use, over a fixed set of series.
+type fakeVM struct {
+	t      *testing.T
+	series []vmSeries
+	// indexSlack widens the start of /api/v1/series queries, like VictoriaMetrics' index, which is by day, so it
+	// lists series without samples in the queried range.
+	indexSlack time.Duration
+	requests   []vmRequest
+}
+
+// vmRequest is a query the fake served.
+type vmRequest struct {
+	path       string
+	start, end int64
+}
+
+var matcherRE = regexp.MustCompile(`(\w+)(=~|=)("(?:[^"\\]|\\.)*")`)
+
+// matching returns the series with samples between start and end that match the selector.
+func (vm *fakeVM) matching(selector string, start, end int64) []vmSeries {
+	type matcher struct {
+		name string
+		re   *regexp.Regexp
+	}
+	var matchers []matcher
+	for _, m := range matcherRE.FindAllStringSubmatch(selector, -1) {
+		v, err := strconv.Unquote(m[3])
+		if err != nil {
+			vm.t.Fatalf("selector %s: %v", selector, err)
+		}
+		if m[2] == "=" {
+			v = regexp.QuoteMeta(v)
+		}
+		matchers = append(matchers, matcher{m[1], regexp.MustCompile("^(?:" + v + ")$")})
+	}
+	var out []vmSeries
+	for _, s := range vm.series {
+		ok := true
+		for _, m := range matchers {
+			ok = ok && m.re.MatchString(s.Metric[m.name])
+		}
+		if !ok {
+			continue
+		}
+		in := vmSeries{Metric: s.Metric}
+		for i, ts := range s.Timestamps {
+			if ts >= start*1000 && (end == 0 || ts <= end*1000) {
+				in.Timestamps = append(in.Timestamps, ts)
+				in.Values = append(in.Values, s.Values[i])
+			}
+		}
+		if len(in.Timestamps) > 0 {
+			out = append(out, in)
+		}
+	}
+	return out
+}
+
+func (vm *fakeVM) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, _ := strconv.ParseInt(q.Get("start"), 10, 64)
+	end, _ := strconv.ParseInt(q.Get("end"), 10, 64)
+	vm.requests = append(vm.requests, vmRequest{r.URL.Path, start, end})
+	switch r.URL.Path {
+	case "/api/v1/series":
+		var data []map[string]string
+		for _, s := range vm.matching(q.Get("match[]"), start-int64(vm.indexSlack/time.Second), end) {
+			data = append(data, s.Metric)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": data})
+	case "/api/v1/export":
+		enc := json.NewEncoder(w)
+		for _, s := range vm.matching(q.Get("match[]"), start, end) {
+			enc.Encode(s)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sampled returns a series with the labels and a sample at each of the times.
+func sampled(labels map[string]string, times ...time.Time) vmSeries {
+	s := vmSeries{Metric: labels}
+	for _, t := range times {
+		s.Timestamps = append(s.Timestamps, t.UnixMilli())
+		s.Values = append(s.Values, 20)
+	}
+	return s
+}
+
+// TestLookupRenamed checks that the destination lookups find the cursor of a module renamed in the app, from its
+// series under the old name, and still not the series of another account's module.
+func TestLookupRenamed(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	last := now.Add(-2 * time.Hour)
+	old := func(name string, account string) map[string]string {
+		return map[string]string{"__name__": name, "dev_id": "02:00:00:00:00:01", "home_id": "h1",
+			"home_name": "Home", "module_name": "Bedroom", "module_type": "NAModule4", "account": account}
+	}
+	vm := &fakeVM{t: t, series: []vmSeries{
+		sampled(old("netatmo_temperature", "alice"), last.Add(-time.Hour), last),
+		sampled(old("netatmo_humidity", "alice"), last),
+		sampled(old("netatmo_temperature", "bob"), now.Add(-time.Minute)),
+		sampled(old("netatmo_humidity", "bob"), now.Add(-time.Minute)),
+	}}
+	srv := httptest.NewServer(vm)
+	defer srv.Close()
+
+	m := export.Module{
+		Device:    "70:ee:50:00:00:01",
+		Module:    "02:00:00:00:00:01",
+		DataTypes: []netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity},
+		Labels: map[string]string{"dev_id": "02:00:00:00:00:01", "home_id": "h1", "home_name": "Maison",
+			"module_name": "Kids room", "module_type": "NAModule4", "account": "alice"},
+	}
+	got, err := vmExportLookup{srv.Client(), srv.URL}.Cursor(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := last.Add(time.Second); !got.Equal(want) {
+		t.Errorf("cursor = %v, want %v", got, want)
+	}
+}
+
+// TestVMSeriesLookup checks the window search of the vm-series lookup: a series the index lists without samples in
+// the window stays pending for the older windows, the windows stop at -incremental-since, and a data type without
+// samples since then leaves the module without a cursor.
+func TestVMSeriesLookup(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	since := now.Add(-10 * time.Hour)
+	saved := *incrementalSince
+	*incrementalSince = sinceValue{at: since}
+	t.Cleanup(func() { *incrementalSince = saved })
+
+	labels := func(name, devID string) map[string]string {
+		return map[string]string{"__name__": name, "dev_id": devID}
+	}
+	vm := &fakeVM{t: t, indexSlack: 24 * time.Hour, series: []vmSeries{
+		// Listed by the index for the first window, an hour back, but its last sample is in the second.
+		sampled(labels("netatmo_temperature", "m1"), now.Add(-5*time.Hour), now.Add(-150*time.Minute)),
+		sampled(labels("netatmo_humidity", "m1"), now.Add(-30*time.Minute)),
+		// Only before -incremental-since.
+		sampled(labels("netatmo_temperature", "m2"), now.Add(-12*time.Hour)),
+		sampled(labels("netatmo_humidity", "m2"), now.Add(-time.Minute)),
+	}}
+	srv := httptest.NewServer(vm)
+	defer srv.Close()
+	lookup := vmSeriesLookup{srv.Client(), srv.URL}
+	module := func(devID string) export.Module {
+		return export.Module{
+			Device:    "70:ee:50:00:00:01",
+			Module:    netatmo.ModuleID(devID),
+			DataTypes: []netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity},
+			Labels:    map[string]string{"dev_id": devID},
+		}
+	}
+
+	got, err := lookup.Cursor(context.Background(), module("m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(-150*time.Minute + time.Second); !got.Equal(want) {
+		t.Errorf("m1 cursor = %v, want %v", got, want)
+	}
+	// Windows of 1h (both listed, only humidity with samples) and 2h (temperature found).
+	var exports int
+	for _, r := range vm.requests {
+		if r.path == "/api/v1/export" {
+			exports++
+		}
+	}
+	if len(vm.requests) != 4 || exports != 2 {
+		t.Errorf("m1 requests = %+v, want 2 windows of a series and an export query each", vm.requests)
+	}
+
+	vm.requests = nil
+	got, err = lookup.Cursor(context.Background(), module("m2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.IsZero() {
+		t.Errorf("m2 cursor = %v, want none", got)
+	}
+	last := vm.requests[len(vm.requests)-1]
+	for _, r := range vm.requests {
+		if r.start < since.Unix() {
+			t.Errorf("request %+v starts before -incremental-since, %d", r, since.Unix())
+		}
+	}
+	if last.start != since.Unix() {
+		t.Errorf("last request %+v, want the window clamped to start at -incremental-since, %d", last, since.Unix())
+	}
+}
@@ -1,35 +1,31 @@
 package main
 
 import (
-	"compress/gzip"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"maps"
-	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"log/slog"
+	"math/rand/v2"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/peterbourgon/ff/v4"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
 	"golang.org/x/oauth2"
 	"golang.org/x/sync/errgroup"
-	"google.golang.org/protobuf/proto"
 	"tailscale.com/jsondb"
 
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/internal/mirror"
 	"sgrankin.dev/netatmo-otel/netatmo"
-
-	promclient "github.com/prometheus/client_golang/api"
-	promapi "github.com/prometheus/client_golang/api/prometheus/v1"
-	dto "github.com/prometheus/client_model/go"
-	"github.com/prometheus/common/expfmt"
-	"github.com/prometheus/common/model"
 )
 
 func init() {
@@ -37,29 +33,150 @@ func init() {
 }
 
 var (
-	_ = flag.String("config", "", "config file (optional)")
+	profile = flag.String("profile", "", "Use this named profile from the structured config file. Each profile keeps its own token and state.")
+
+	_ = flag.String("config", "", "config file (optional). Structured if it ends in .yaml, .yml, or .toml; otherwise flag values, one per line.")
+
+	format = flag.String("format", "prometheus",
+		"How to send to -dest: prometheus (text import) or otlp (OTLP/HTTP, at VictoriaMetrics' /opentelemetry route). Without -dest, the same is written to stdout (otlp as JSON). Or remote-write, to send to -dest with the Prometheus remote-write protocol; exec, to pipe to the -exec-sink command instead; or parquet, to archive Parquet files to -parquet-url.")
+	execSink = flag.String("exec-sink", "",
+		"Command (split on spaces) for -format=exec, which reads the metrics as JSON lines on stdin; see the README for the protocol.")
+	accountLabel = flag.String("account-label", "account",
+		"Name of the label with the account's name (or its profile's) that is added to every series, self-telemetry included, when the config file has more than one account across its profiles. Empty to never add it.")
+	dropInvalid = flag.Bool("drop-invalid", false,
+		"Leave out of the export the missing values, otherwise exported as NaN, and those outside their data type's plausible range, e.g. a humidity above 100%, counting them in the netatmo_export_quality_*_dropped_total metrics. With a -lookup that queries -dest, a data type whose values were all left out has no series to find its cursor in, so its module is exported again from -incremental-since.")
+	humidityRatio = flag.Bool("humidity-ratio", false,
+		"Also export the humidity as a 0-1 ratio, netatmo_humidity_ratio, besides the percentage.")
+	humidityLegacyName = flag.Bool("humidity-legacy-name", false,
+		"Also export the humidity as netatmo_humidiity, its misspelled name from import, generate, and the dashboards of older versions, so queries of the old series keep working until they're moved over.")
+	otlpPerHome = flag.Bool("otlp-per-home", false,
+		"With -format=otlp, export each home's metrics under a Resource of its own, with home_id and home_name as resource attributes instead of point attributes.")
+	remoteWritePath = flag.String("remote-write-path", "/api/v1/write",
+		"Route on -dest that -format=remote-write posts to, e.g. /api/v1/push for Mimir.")
+	remoteReadPath = flag.String("remote-read-path", "/api/v1/read",
+		"Route on -dest that -lookup=remote-read queries, e.g. /prometheus/api/v1/read for Mimir.")
+	remoteWriteVersion = flag.Int("remote-write-version", 1,
+		"Remote-write protocol version for -format=remote-write: 1, or 2 for receivers that accept it (Prometheus 3, Mimir), which sends metadata with every series and interns label strings.")
 
 	dest = flag.String("dest", "",
-		"Destination host:port. Must accept Prometheus queries and OTLP pushes at routes matching VictoriaMetrics.")
+		"Destination host:port, or an http:// or https:// URL. Must accept Prometheus text imports (and queries, for the promql and vm-export lookups) at routes matching VictoriaMetrics.")
+
+	netatmoURL = flag.String("netatmo-url", netatmo.DefaultBaseURL,
+		"Base URL of the Netatmo API, e.g. of a fake for testing.")
+
+	userAgent = flag.String("user-agent", defaultUserAgent(),
+		"User-Agent of the Netatmo API calls, which Netatmo asks clients to identify themselves with: e.g. your application's name, and an email or URL to contact you at.")
+	optimize = flag.Bool("optimize", true,
+		"Ask getmeasure for the compact format of evenly spaced groups; false gets a map of timestamps to samples instead, larger but the same data, e.g. to compare with -capture-dir files of other tools.")
+	realTime = flag.Bool("real-time", true,
+		"Pass getmeasure's real_time parameter, for exact timestamps; without it, Netatmo offsets the timestamps of scales coarser than max by half the scale. It has no effect at the max scale the exports use.")
+
+	printVersion = flag.Bool("version", false, "Print the version and exit; same as the version command.")
+
+	netatmoProxy = flag.String("netatmo-proxy", "",
+		"Proxy for Netatmo API calls: an http://, https://, or socks5:// URL, or direct. Defaults to HTTPS_PROXY and NO_PROXY from the environment.")
+	destProxy = flag.String("dest-proxy", "",
+		"Proxy for -dest, like -netatmo-proxy. Defaults to HTTP_PROXY and NO_PROXY from the environment.")
+	destCAFile = flag.String("dest-ca-file", "",
+		"PEM file of CA certificates to trust for an https:// -dest, in addition to the system ones.")
+	destInsecureSkipVerify = flag.Bool("dest-insecure-skip-verify", false,
+		"Don't verify the TLS certificate of an https:// -dest. Prefer -dest-ca-file.")
+
+	archiveDir = flag.String("archive", "",
+		"Archive every raw getmeasure response to a new gzipped NDJSON file in this directory, for the reexport command.")
+	captureDir = flag.String("capture-dir", "",
+		"Write each Netatmo API request's URL and its response's raw body to a file of its own in this directory, with tokens redacted, to attach to a bug report.")
+
+	mirrorPath = flag.String("mirror", "",
+		"SQLite file to keep a copy of all fetched history in. Runs and backfills read it first, and only ask Netatmo for newer data.")
+
+	normalizeLabels = flag.Bool("normalize-labels", false,
+		"Normalize the label values besides dev_id (e.g. home and module names) to lowercase slugs, like living_room, after the config's label rules.")
+
+	homeAggregates = flag.Bool("home-aggregates", false,
+		"Also export per-home aggregates of the stations' current readings, as of each discovery: netatmo_home_indoor_temperature_mean, netatmo_home_co2_max, and netatmo_home_any_module_offline.")
+
+	offlineSignal = flag.String("offline-signal", "none",
+		"How to mark modules that the station can't reach: none, online (a netatmo_module_online gauge, 0 or 1, for every module), or stale (that, plus Prometheus stale markers on the unreachable modules' series; -format=remote-write only). Except for none, the stations are fetched on every run.")
+
+	tombstoneMarker = flag.Bool("tombstone-marker", false,
+		"When a module is removed from the account, end its series with Prometheus stale markers and a last netatmo_module_online of 0 (-format=remote-write and -lookup=state only), instead of leaving them to go stale.")
 
 	resume = flag.String("resume", "",
-		"The resume token that was logged.  Will skip as many requests as possible to avoid duplicate work..")
+		"The resume token that was logged.  Will skip as many requests as possible to avoid duplicate work. Older device/module/timestamp tokens are still accepted.")
 
+	window = flag.Duration("window", 0,
+		"Export exactly this long before now on every run, ignoring the cursors and -incremental, and rediscovering the stations each time. For stateless cron jobs into a destination that deduplicates the repeated samples.")
+	catchUp = flag.Duration("catch-up", 0,
+		"When a module is further behind than this, e.g. after the exporter was down for days, export the last -catch-up of every such module's data first, so dashboards recover quickly, and only then backfill the older gaps. The cursors only advance through a gap once it's filled. 0 exports each module oldest first.")
 	incremental = flag.Bool("incremental", true,
-		"Query for the last timestamp exported and start scrape from there.")
-	incrementalSince = flag.Duration("incremental-since", 90*24*time.Hour,
-		"Query this far back to find the last written sample. If not found, uses -since as the starting point.")
-	scrapeSince = flag.Duration("since", 0,
-		"Start scrape this long ago. Set 0 to disable and start from the first recorded sample in netatmo.")
+		"Resume each module from the last timestamp exported, as found by -lookup.")
+	lookup = flag.String("lookup", "state",
+		"How to find the last timestamp exported: state (the local state file), promql, vm-export, vm-series, or remote-read (queries to -dest).")
+	lookupCheck = flag.String("lookup-check", "",
+		"A second -lookup backend to cross-check against; used when the first has no cursor, and logged when it disagrees.")
+	lookupRetries = flag.Int("lookup-retries", 3,
+		"Retry a failed lookup of -dest (promql, vm-export, vm-series, or remote-read) this many times, with exponential backoff, before resuming the module from the state's cursor (or -since) instead.")
+	incrementalSince = sinceFlag("incremental-since", 90*24*time.Hour,
+		"For the lookups of -dest, query this far back (a duration or RFC3339 timestamp) to find the last written sample. If not found, uses -since as the starting point.")
+	incrementalOverlap = flag.Duration("incremental-overlap", 0,
+		"Resume each module this long before its last exported timestamp, re-fetching samples that Netatmo added late or the destination rounded. The destination should deduplicate the repeats.")
+	scrapeSince = sinceFlag("since", 0,
+		"Start scrape this long ago, or at this RFC3339 timestamp. Set 0 to disable and start from the first recorded sample in netatmo.")
+	moduleSinces = moduleSinceFlag("module-since",
+		"Override -since for a module without a cursor, as module=since, where module is its ID or name (e.g. Garden=2024-05-01T00:00:00Z, to backfill a new module from when it was installed). Repeatable.")
+	skipUnchanged = flag.Bool("skip-unchanged", true,
+		"Fetch the stations on every run, and skip the modules whose station hasn't stored data past their cursor since, without calling getmeasure for them.")
+
+	concurrency = flag.Int("concurrency", 1,
+		"Export up to this many modules at once. Netatmo calls still share one rate limiter.")
+	interleave = flag.Bool("interleave", false,
+		"Export every module at once, with their Netatmo calls taking turns, a page each (up to -concurrency calls at once), so a long backfill of one module doesn't hold up the others' recent data.")
+
+	pipelineBuffer = flag.Int("pipeline-buffer", 64,
+		"Queue up to this many metric families between the fetch and encode stages.")
+	uploadChunkSize = flag.Int("upload-chunk-size", 8<<20,
+		"Split the upload to -dest into requests of at most about this many bytes of text format (gzipped on the wire), each retried on its own.")
+	uploadRetries = flag.Int("upload-retries", 5,
+		"Retry each upload request this many times after a network error, a 408, 429, or 5xx response, with exponential backoff.")
+	uploadSpool = flag.String("upload-spool", "",
+		"Directory to spool upload requests to once they fail all their retries, instead of failing the run right away. Their cursors advance, the run still exits with the destination error, and the next run resends them first.")
+
+	maxAPICalls = flag.Int64("max-api-calls", 0,
+		"Stop cleanly after this many Netatmo API calls, saving progress for the next run. Set 0 for no limit.")
 
-	verbose = flag.Bool("verbose", false, "Verbose logging")
+	spread = flag.Duration("spread", 0,
+		"Space out the run's expected Netatmo calls evenly over this long, instead of bursting at the rate limit. E.g. a bit less than the cron interval. Set 0 to disable.")
+
+	jitter = flag.Duration("jitter", 0,
+		"Sleep a random duration up to this long before starting, to spread out runs started at the same time by cron.")
+
+	lockWait = flag.Duration("lock-wait", 0,
+		"If another run is in progress, wait this long for it to finish instead of exiting immediately.")
+
+	checkpointEvery = flag.Duration("checkpoint", 10*time.Second,
+		"Save each module's cursor once the pages exported in the last this long have been uploaded, so an interrupted run resumes from there. Set 0 to upload and save after every page.")
+
+	progressEvery = flag.Duration("progress", time.Minute,
+		"How often to log export progress for each module. Set 0 to disable.")
+
+	logFormat = flag.String("log-format", "text", "Log output format: text or json.")
+
+	logLevel = flag.String("log-level", "info", "Minimum level to log: debug, info, warn, or error.")
+	verbose  = flag.Bool("verbose", false, "Same as -log-level=debug. (Deprecated.)")
+
+	// args are the command and its arguments, left after parsing the flags above.
+	args []string
 )
 
-func init() {
-	err := ff.Parse(flag.CommandLine, os.Args[1:],
+// parseFlags parses the command line, the environment, and the -config file into the flags above. It's called from
+// main rather than init, so tests of this package don't see the test binary's flags.
+func parseFlags() {
+	fs := ff.NewFlagSetFrom(filepath.Base(os.Args[0]), flag.CommandLine)
+	err := ff.Parse(fs, os.Args[1:],
 		ff.WithEnvVars(),
 		ff.WithConfigFileFlag("config"),
-		ff.WithConfigFileParser(ff.PlainParser),
+		ff.WithConfigFileParser(parseConfigFile),
 	)
 	switch {
 	case err == nil:
@@ -67,7 +184,17 @@ func init() {
 		flag.Usage()
 		os.Exit(2)
 	default:
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(exitConfig)
+	}
+	args = fs.GetArgs()
+
+	if *profile != "" && !profileLoaded {
+		log.Printf("-profile %q requires a structured (.yaml or .toml) -config file", *profile)
+		os.Exit(exitConfig)
+	}
+	if len(fileConfig.Sinks) > 0 && *dest == "" {
+		*dest = fileConfig.Sinks[0].Dest
 	}
 }
 
@@ -78,72 +205,500 @@ type Config struct {
 }
 
 func main() {
-	if err := run(); err != nil {
-		log.Fatal(err)
+	parseFlags()
+	if *printVersion || len(args) > 0 && args[0] == "version" {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Printf("-log-level: %v", err)
+		os.Exit(exitConfig)
+	}
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	switch *logFormat {
+	case "text":
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	default:
+		log.Printf("unknown -log-format %q", *logFormat)
+		os.Exit(exitConfig)
+	}
+
+	err := setupDest()
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitConfig)
+	}
+
+	var command string
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	// Commands that talk to Netatmo share the quota, so they must not overlap.
+	if command != "config" && command != "generate" && command != "rules" {
+		if *jitter > 0 {
+			d := rand.N(*jitter)
+			slog.Debug("sleeping before starting", "duration", d.Round(time.Millisecond))
+			time.Sleep(d)
+		}
+
+		release, err := acquireLock(*lockWait)
+		if err != nil {
+			log.Print(err)
+			os.Exit(exitFailure)
+		}
+		defer release()
+	}
+
+	switch command {
+	case "":
+		err = run(nil, true)
+		notifyRun(err)
+	case "daemon":
+		err = runDaemon(args)
+	case "backfill":
+		err = runBackfill(args)
+	case "verify":
+		err = runVerify(args)
+	case "config":
+		err = runConfig(args)
+	case "generate":
+		err = runGenerate(args)
+	case "import":
+		err = runImport(args)
+	case "reexport":
+		err = runReexport(args)
+	case "restore":
+		err = runRestore(args)
+	case "state":
+		err = runState(args)
+	case "dashboard":
+		err = runDashboard(args)
+	case "rules":
+		err = runRules(args)
+	case "init":
+		err = runInit(args)
+	default:
+		err = fmt.Errorf("%w: unknown command %q", errConfig, command)
+	}
+	if responseArchive != nil {
+		if cerr := responseArchive.Close(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("archive: %w", cerr))
+		}
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(exitCode(err))
 	}
 }
 
-func run() error {
+// run exports everything new since the last run. If st is not nil, it is updated with the results.
+//
+// If discover is false, the stations from the last run are reused (if any), saving an API call, unless
+// -skip-unchanged, -offline-signal, or -window need them current.
+func run(st *status, discover bool) (err error) {
 	ctx := context.Background()
 
-	configDir, err := os.UserConfigDir()
+	if *resume != "" {
+		if _, err := parseResumeToken(*resume); err != nil {
+			return fmt.Errorf("%w: -resume: %w", errConfig, err)
+		}
+	}
+	if err := checkOfflineSignal(); err != nil {
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	if err := checkTombstoneMarker(); err != nil {
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	if err := checkAccountLabel(); err != nil {
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	if *window < 0 || *window > 0 && *resume != "" {
+		return fmt.Errorf("%w: -window must be positive, and can't be combined with -resume", errConfig)
+	}
+	// Fixed for the run, so every module covers the same window.
+	windowStart := time.Now().Add(-*window).Truncate(time.Second)
+
+	client, err := newClient(ctx)
 	if err != nil {
 		return err
 	}
+	client.SetMaxCalls(*maxAPICalls)
 
-	configDB, err := jsondb.Open[Config](filepath.Join(configDir, "netatmo", "config.json"))
+	stateDB, err := openState()
 	if err != nil {
 		return err
 	}
+	defer stateDB.Close()
 
-	var exporter expfmt.Encoder
-	if *dest != "" {
-		r, w, err := os.Pipe()
-		if err != nil {
+	source, closeMirror, err := withMirror(interleaved(client))
+	if err != nil {
+		return err
+	}
+	defer closeMirror()
+
+	exporter, closeExporter, err := newExporter(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeExporter(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("upload: %w", cerr))
+		}
+		// The cursors were only advanced as their pages were uploaded, so this is safe even if the upload failed.
+		if serr := stateDB.Save(); serr != nil {
+			err = errors.Join(err, fmt.Errorf("state: %w", serr))
+		}
+	}()
+
+	e := &export.Exporter{
+		Client:      source,
+		Sink:        exporter,
+		LookupName:  *lookup,
+		CheckName:   *lookupCheck,
+		Overlap:     *incrementalOverlap,
+		Derived:     fileConfig.derived(),
+		DropInvalid: *dropInvalid,
+		Saved: func(m export.Module, t time.Time) {
+			if err := stateDB.Checkpoint(m.Device, m.Module, m.DataTypes, t); err != nil {
+				slog.Error("saving checkpoint", "device", m.Device, "module", m.Module, "err", err)
+			}
+		},
+	}
+	var (
+		dropped   = map[string]moduleQuality{} // The nulls and outliers, by dev_id.
+		droppedMu sync.Mutex
+	)
+	e.Dropped = func(m export.Module, nulls, outliers int) {
+		droppedMu.Lock()
+		defer droppedMu.Unlock()
+		q := dropped[export.DevID(m.Device, m.Module)]
+		q.nulls += int64(nulls)
+		q.outliers += int64(outliers)
+		dropped[export.DevID(m.Device, m.Module)] = q
+	}
+	events, err := newEventWatcher(ctx, stateDB.Data)
+	if err != nil {
+		return err
+	}
+	if events != nil {
+		e.Observe = events.observe
+		saved := e.Saved
+		e.Saved = func(m export.Module, t time.Time) {
+			saved(m, t)
+			events.saved(m, t)
+		}
+		defer func() {
+			if cerr := events.Close(ctx); cerr != nil {
+				slog.Error("sending events", "err", cerr)
+			}
+		}()
+	}
+	if *window > 0 {
+		e.Since = func(export.Module) time.Time { return windowStart }
+	} else if *incremental {
+		if e.Lookup, err = newCursorLookup(*lookup, stateDB.Data); err != nil {
 			return err
 		}
-		g := &errgroup.Group{}
-		g.Go(func() error {
-			req, err := http.NewRequestWithContext(ctx, "POST", (&url.URL{
-				Scheme: "http", Host: *dest, Path: "/api/v1/import/prometheus",
-			}).String(), r)
-			if err != nil {
+		if *lookupCheck != "" {
+			if e.Check, err = newCursorLookup(*lookupCheck, stateDB.Data); err != nil {
 				return err
 			}
-			req.Header.Set("Content-Encoding", "gzip")
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
+		}
+	}
+
+	stations := stateDB.Data.Stations
+	var changes []topologyChange
+	discovered := discover || len(stations) == 0 || *offlineSignal != "none" || *window > 0 || *skipUnchanged
+	if discovered {
+		if stations, err = client.GetStations(ctx); err != nil {
+			return err
+		}
+		changes = topologyChanges(stateDB.Data.Stations, stations)
+		reportTopologyChanges(ctx, stateDB.Data, changes)
+		annotateReachability(ctx, stateDB.Data.Stations, stations)
+		stateDB.Data.Stations = stations
+	}
+	if *skipUnchanged {
+		// Only with fresh stations: an old last_status_store would skip data that arrived since.
+		stored := map[netatmo.DeviceID]time.Time{}
+		for _, dev := range stations {
+			stored[dev.ID] = dev.LastStatusStore.Time
+		}
+		e.Latest = func(m export.Module) time.Time { return stored[m.Device] }
+	}
+
+	var (
+		stats   []moduleStats
+		statsMu sync.Mutex
+		gone    []string // dev_ids
+		goneMu  sync.Mutex
+		gaps    []pendingGap // Left by -catch-up, to fill once every module has caught up.
+		gapsMu  sync.Mutex
+	)
+	defer func() {
+		// Runs before the exporter is closed, so the telemetry is part of the same upload.
+		if err := pushTelemetry(exporter, stateDB.Data, stats, client.Quota()); err != nil {
+			slog.Error("pushing telemetry", "err", err)
+		}
+		if err := pushBuildInfo(exporter); err != nil {
+			slog.Error("pushing build info", "err", err)
+		}
+		if err := pushOnline(exporter, stations, *offlineSignal); err != nil {
+			slog.Error("pushing module status", "err", err)
+		}
+		if err := pushTopologyChanges(exporter, changes); err != nil {
+			slog.Error("pushing topology changes", "err", err)
+		}
+		if discovered {
+			if err := pushModuleInfo(exporter, stations); err != nil {
+				slog.Error("pushing module info", "err", err)
+			}
+			if *homeAggregates {
+				if err := pushHomeAggregates(exporter, stations); err != nil {
+					slog.Error("pushing home aggregates", "err", err)
+				}
 			}
-			if *verbose {
-				dump, err := httputil.DumpResponse(resp, true)
-				if err != nil {
-					return err
+			if user, ok := client.User(); ok {
+				if err := pushUserInfo(exporter, user); err != nil {
+					slog.Error("pushing user info", "err", err)
 				}
-				log.Printf("response:\n%s", dump)
 			}
+		}
+		st.record(stateDB.Data, stats)
+	}()
+	defer func() {
+		points := 0
+		for _, s := range stats {
+			points += s.points
+		}
+		q := client.Quota()
+		args := []any{"modules", len(stats), "points", points, "api_calls", client.Calls(), "quota_remaining", q.Remaining}
+		if q.RateLimited > 0 {
+			args = append(args, "rate_limited", q.RateLimited)
+		}
+		if !q.Reset.IsZero() {
+			args = append(args, "quota_reset", q.Reset.Format(time.RFC3339))
+		}
+		slog.Info("run finished", args...)
+	}()
+	exportModule := func(name string, attrs map[string]string, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType) error {
+		mc := fileConfig.module(export.DevID(device, module), name)
+		if mc.Skip {
+			slog.Debug("skipping", "device", device, "module", module)
 			return nil
+		}
+		slog.Debug("exporting", "device", device, "module", module)
+		start, calls, measures := time.Now(), &atomic.Int64{}, &netatmo.MeasureStats{}
+		ctx := netatmo.WithMeasureStats(netatmo.WithCallCounter(ctx, calls), measures)
+		points := 0
+		var errs []error
+		for _, g := range mc.groups(dataTypes) {
+			n, err := exportHistory(ctx, e, name,
+				export.Module{Device: device, Module: module, DataTypes: g.dataTypes, Labels: attrs}, g.interval,
+				func(gap export.Gap) {
+					gapsMu.Lock()
+					gaps = append(gaps, pendingGap{name, gap})
+					gapsMu.Unlock()
+				})
+			points += n
+			errs = append(errs, err)
+			if errors.Is(err, netatmo.ErrBudgetExhausted) {
+				break
+			}
+		}
+		err := errors.Join(errs...)
+		if errors.Is(err, netatmo.ErrDeviceNotFound) {
+			// Removed since the stations were discovered: tombstone it below, instead of failing every run until
+			// the next discovery.
+			slog.Warn("module not found in the account", "dev_id", export.DevID(device, module), "module_name", name)
+			goneMu.Lock()
+			gone = append(gone, export.DevID(device, module))
+			goneMu.Unlock()
+			err = nil
+		}
+		droppedMu.Lock()
+		quality := dropped[export.DevID(device, module)]
+		droppedMu.Unlock()
+		quality.duplicates, quality.malformed, quality.retries =
+			measures.Duplicates.Load(), measures.Malformed.Load(), measures.Retries.Load()
+		statsMu.Lock()
+		stats = append(stats, moduleStats{
+			name:     name,
+			attrs:    attrs,
+			points:   points,
+			calls:    calls.Load(),
+			err:      err,
+			duration: time.Since(start),
+			quality:  quality,
 		})
-		defer func() {
-			log.Print("waiting on upload to complete")
-			if err := g.Wait(); err != nil {
-				log.Fatal(err)
+		statsMu.Unlock()
+		if errors.Is(err, netatmo.ErrBudgetExhausted) {
+			slog.Info("stopping; the next run will continue from here", "api_calls", client.Calls())
+		}
+		return err
+	}
+	var exhausted atomic.Bool
+	// fillGap exports a gap left by -catch-up, adding to the stats of the module's first pass.
+	fillGap := func(pg pendingGap) {
+		m := pg.gap.Module
+		start, calls, measures := time.Now(), &atomic.Int64{}, &netatmo.MeasureStats{}
+		ctx := netatmo.WithMeasureStats(netatmo.WithCallCounter(ctx, calls), measures)
+		p := newProgress(pg.name, pg.gap.Since, pg.gap.Until)
+		err := e.FillGap(ctx, pg.gap, p.update)
+		if err == nil {
+			p.done()
+		}
+		droppedMu.Lock()
+		quality := dropped[export.DevID(m.Device, m.Module)]
+		droppedMu.Unlock()
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		i := slices.IndexFunc(stats, func(s moduleStats) bool { return s.attrs["dev_id"] == export.DevID(m.Device, m.Module) })
+		if i < 0 {
+			return // Only modules that were exported have gaps.
+		}
+		s := &stats[i]
+		s.points += p.points
+		s.calls += calls.Load()
+		s.err = errors.Join(s.err, err)
+		s.duration += time.Since(start)
+		s.quality.nulls, s.quality.outliers = quality.nulls, quality.outliers
+		s.quality.duplicates += measures.Duplicates.Load()
+		s.quality.malformed += measures.Malformed.Load()
+		s.quality.retries += measures.Retries.Load()
+		if errors.Is(err, netatmo.ErrBudgetExhausted) {
+			exhausted.Store(true)
+		}
+	}
+	type job struct {
+		name      string
+		attrs     map[string]string
+		device    netatmo.DeviceID
+		module    netatmo.ModuleID
+		dataTypes []netatmo.DataType
+	}
+	var jobs []job
+	for _, dev := range stations {
+		jobs = append(jobs, job{dev.Name, stationAttrs(dev), dev.ID, "", dev.DataTypes})
+		for _, mod := range dev.Modules {
+			jobs = append(jobs, job{mod.Name, moduleAttrs(dev, mod), dev.ID, mod.ID, mod.DataTypes})
+		}
+	}
+	if *window == 0 {
+		sinces := map[string]time.Time{}
+		for _, j := range jobs {
+			sinces[export.DevID(j.device, j.module)] = moduleSince(export.DevID(j.device, j.module), j.name)
+		}
+		e.Since = func(m export.Module) time.Time { return sinces[export.DevID(m.Device, m.Module)] }
+	}
+
+	if *spread > 0 {
+		// Cursors from the state are a good enough estimate, whatever the -lookup.
+		calls, now := 0, time.Now()
+		for _, j := range jobs {
+			since := stateDB.Data.Cursor(j.device, j.module, j.dataTypes)
+			if *window > 0 {
+				since = windowStart
+			} else if since.IsZero() {
+				since = moduleSince(export.DevID(j.device, j.module), j.name)
 			}
-		}()
-		defer w.Close()
-		gzw := gzip.NewWriter(w)
-		defer gzw.Close()
-		exporter = expfmt.NewEncoder(gzw, expfmt.NewFormat(expfmt.TypeTextPlain))
+			n, ok := estimateCalls(since, now)
+			if !ok {
+				n = netatmo.HourlyLimit // Whole history; keep to the quota.
+			}
+			calls += n
+		}
+		every := spreadPacing(calls, *spread)
+		slog.Info("spreading calls", "expected_calls", calls, "window", *spread, "every", every)
+		client.SetPacing(every)
+	}
+
+	// A -resume token skips the modules before it, which only makes sense in order.
+	g := &errgroup.Group{}
+	if *resume != "" {
+		g.SetLimit(1)
 	} else {
-		exporter = expfmt.NewEncoder(os.Stdout, expfmt.NewFormat(expfmt.TypeTextPlain))
+		g.SetLimit(moduleLimit())
+	}
+	for _, j := range jobs {
+		if exhausted.Load() {
+			break
+		}
+		g.Go(func() error {
+			if err := exportModule(j.name, j.attrs, j.device, j.module, j.dataTypes); errors.Is(err, netatmo.ErrBudgetExhausted) {
+				exhausted.Store(true)
+			}
+			return nil
+		})
+	}
+	g.Wait()
+	if len(gaps) > 0 {
+		if exhausted.Load() {
+			slog.Info("leaving the older gaps for the next run", "modules", len(gaps))
+		} else {
+			slog.Info("caught up on the recent data; filling the older gaps", "modules", len(gaps))
+			g := &errgroup.Group{}
+			g.SetLimit(moduleLimit())
+			for _, pg := range gaps {
+				g.Go(func() error {
+					fillGap(pg)
+					return nil
+				})
+			}
+			g.Wait()
+		}
+	}
+	if len(gone) > 0 {
+		removed := topologyChanges(stations, withoutModules(stations, gone))
+		reportTopologyChanges(ctx, stateDB.Data, removed)
+		changes = append(changes, removed...)
+		stations = withoutModules(stations, gone)
+		stateDB.Data.Stations = stations
+	}
+
+	// The other modules were still exported, so report the failures together instead of stopping at the first.
+	var errs []error
+	for _, s := range stats {
+		if s.failed() {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, s.err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(append([]error{fmt.Errorf("%w: %d of %d modules failed", errPartial, len(errs), len(stats))}, errs...)...)
+	}
+	return nil
+}
+
+// newClient opens the config database and returns a Netatmo client that saves refreshed tokens back to it.
+func newClient(ctx context.Context) (*netatmo.Client, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+
+	configDB, err := jsondb.Open[Config](filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil, err
 	}
-	exporter.Encode(&dto.MetricFamily{
-		Metric: []*dto.Metric{{}},
-	})
 
 	config := configDB.Data
+	clientID, clientSecret := config.ClientID, config.ClientSecret
+	if len(fileConfig.Accounts) > 0 {
+		clientID, clientSecret = fileConfig.Accounts[0].ClientID, fileConfig.Accounts[0].ClientSecret
+	}
 
-	client := netatmo.NewClient(ctx, config.ClientID, config.ClientSecret, config.Token,
+	proxy, err := proxyFunc("netatmo-proxy", *netatmoProxy)
+	if err != nil {
+		return nil, err
+	}
+	client := netatmo.NewClientAt(ctx, *netatmoURL, clientID, clientSecret, config.Token,
 		func(t *oauth2.Token, err error) error {
 			if err == nil {
 				configDB.Data.Token = *t
@@ -151,137 +706,258 @@ func run() error {
 			}
 			return err
 		})
-
-	promClient, err := promclient.NewClient(promclient.Config{Address: "http://" + *dest})
-	if err != nil {
-		return err
+	client.SetProxy(proxy)
+	client.SetUserAgent(*userAgent)
+	client.SetMeasureParams(*optimize, *realTime)
+	var onResponse []func(netatmo.Exchange)
+	if *archiveDir != "" {
+		openArchiveOnce.Do(func() { responseArchive, responseArchiveErr = openArchive(*archiveDir) })
+		if responseArchiveErr != nil {
+			return nil, fmt.Errorf("%w: -archive: %w", errConfig, responseArchiveErr)
+		}
+		onResponse = append(onResponse, responseArchive.record)
+	}
+	if *captureDir != "" {
+		capture, err := openCapture(*captureDir)
+		if err != nil {
+			return nil, fmt.Errorf("%w: -capture-dir: %w", errConfig, err)
+		}
+		onResponse = append(onResponse, capture.record)
 	}
-	promAPI := promapi.NewAPI(promClient)
+	if len(onResponse) > 0 {
+		client.SetHooks(netatmo.Hooks{OnResponse: func(x netatmo.Exchange) {
+			for _, fn := range onResponse {
+				fn(x)
+			}
+		}})
+	}
+	return client, nil
+}
 
-	stations, err := client.GetStations(ctx)
+// withMirror returns client behind the -mirror, if set, and a function to close the mirror.
+func withMirror(client export.Client) (export.Client, func(), error) {
+	if *mirrorPath == "" {
+		return client, func() {}, nil
+	}
+	m, err := mirror.Open(*mirrorPath, client)
 	if err != nil {
-		return err
+		return nil, nil, fmt.Errorf("%w: -mirror: %w", errConfig, err)
 	}
-	for _, dev := range stations {
-		if *verbose {
-			log.Printf("exporting device %q", dev.ID)
-		}
-		commonAttrs := map[string]string{
-			"home_id":   dev.HomeID,
-			"home_name": dev.HomeName,
+	return m, func() {
+		if err := m.Close(); err != nil {
+			slog.Error("closing mirror", "err", err)
 		}
+	}, nil
+}
 
-		attrs := maps.Clone(commonAttrs)
-		maps.Copy(attrs, map[string]string{
-			"dev_id":      string(dev.ID),
-			"module_name": dev.Name,
-			"module_type": string(dev.Type),
-			// attribute.Int("firmware", dev.Firmware),
-		})
-		exportHistory(ctx, client, promAPI, exporter, attrs, dev.ID, "", dev.DataTypes)
-
-		for _, mod := range dev.Modules {
-			if *verbose {
-				log.Printf("exporting device %q module %q", dev.ID, mod.ID)
+// newExporter returns a sink writing to -dest in the -format, or to stdout if no destination is set.
+//
+// The returned function must be called to flush the sink and wait for the upload to complete.
+func newExporter(ctx context.Context) (export.Sink, func() error, error) {
+	switch {
+	case *format == "exec":
+		args := strings.Fields(*execSink)
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("%w: -format=exec needs -exec-sink", errConfig)
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		sink, err := export.NewExecSink(cmd)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errDestination, err)
+		}
+		return sink, func() error {
+			if err := sink.Close(); err != nil {
+				return fmt.Errorf("%w: %w", errDestination, err)
 			}
-			attrs := maps.Clone(commonAttrs)
-			maps.Copy(attrs, map[string]string{
-				"dev_id":      string(mod.ID),
-				"module_name": mod.Name,
-				"module_type": string(mod.Type),
-				// attribute.Int("firmware", dev.Firmware),
-			})
-			exportHistory(ctx, client, promAPI, exporter, attrs, dev.ID, mod.ID, mod.DataTypes)
+			return nil
+		}, nil
+	case *format == "parquet":
+		if *parquetURL == "" {
+			return nil, nil, fmt.Errorf("%w: -format=parquet needs -parquet-url", errConfig)
 		}
-	}
-	return nil
-}
-
-func exportHistory(
-	ctx context.Context,
-	client *netatmo.Client, promAPI promapi.API,
-	exporter expfmt.Encoder, attrs map[string]string,
-	device netatmo.DeviceID, module netatmo.ModuleID,
-	dataTypes []netatmo.DataType,
-) error {
-	var since time.Time
-	if *incremental {
-		val, _, err := promAPI.Query(ctx,
-			fmt.Sprintf("timestamp(netatmo_%s[%s])", strings.ToLower(string(dataTypes[0])), incrementalSince.String()),
-			time.Now())
+		store, prefix, err := openObjectStore(*parquetURL)
 		if err != nil {
-			return err
+			return nil, nil, fmt.Errorf("%w: -parquet-url: %w", errConfig, err)
 		}
-		vec := val.(model.Vector)
-		for _, sample := range vec {
-			if module != "" && string(sample.Metric["dev_id"]) == string(module) || module == "" && string(sample.Metric["dev_id"]) == string(device) {
-				since = time.Unix(int64(sample.Value), 0).Add(time.Second)
-				break
+		name := time.Now().UTC().Format("20060102T150405.000Z")
+		sink := export.NewParquetSink(store, prefix, name, parquetBatchSize)
+		return sink, func() error {
+			if err := sink.Close(ctx); err != nil {
+				return fmt.Errorf("%w: %w", errDestination, err)
+			}
+			return nil
+		}, nil
+	case *format == "otlp" && *dest == "":
+		sink, err := export.NewOTLPJSONSink(os.Stdout, otlpBatchSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		if *otlpPerHome {
+			sink.ResourceLabels = otlpHomeLabels
+		}
+		return sink, func() error { return sink.Close(ctx) }, nil
+	case *format == "otlp":
+		if *destRate > 0 || *destConcurrency > 0 || maxUploadRate.unit != "" {
+			// The OTLP exporter makes its own client, from the options below.
+			return nil, nil, fmt.Errorf("%w: -dest-rate, -dest-concurrency, and -max-upload-rate don't apply to -format=otlp", errConfig)
+		}
+		transport := destTransport
+		opts := []otlpmetrichttp.Option{
+			otlpmetrichttp.WithEndpoint(destBase.Host),
+			otlpmetrichttp.WithURLPath("/opentelemetry/v1/metrics"),
+			otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression),
+			otlpmetrichttp.WithProxy(transport.Proxy),
+		}
+		if destBase.Scheme == "http" {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		} else if transport.TLSClientConfig != nil {
+			opts = append(opts, otlpmetrichttp.WithTLSClientConfig(transport.TLSClientConfig))
+		}
+		exp, err := otlpmetrichttp.New(ctx, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink := export.NewOTLPSink(exp, otlpBatchSize)
+		if *otlpPerHome {
+			sink.ResourceLabels = otlpHomeLabels
+		}
+		return sink, func() error {
+			slog.Info("waiting on upload to complete")
+			if err := sink.Close(ctx); err != nil {
+				return fmt.Errorf("%w: %w", errDestination, err)
 			}
+			return nil
+		}, nil
+	case *format == "remote-write":
+		if *dest == "" {
+			return nil, nil, fmt.Errorf("%w: -format=remote-write needs -dest", errConfig)
+		}
+		if maxUploadRate.unit == "points" {
+			return nil, nil, fmt.Errorf("%w: -max-upload-rate in points only applies to -format=prometheus; use bytes", errConfig)
 		}
+		sink, err := export.NewRemoteWriteSink(destClient, destURL(*remoteWritePath).String(), *remoteWriteVersion, remoteWriteBatchSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", errConfig, err)
+		}
+		return sink, func() error {
+			slog.Info("waiting on upload to complete")
+			if err := sink.Close(ctx); err != nil {
+				return fmt.Errorf("%w: %w", errDestination, err)
+			}
+			return nil
+		}, nil
+	case *format != "prometheus":
+		return nil, nil, fmt.Errorf("%w: unknown -format %q", errConfig, *format)
+	case *dest != "":
+		p := newPipeline(ctx, destURL("/api/v1/import/prometheus"), max(*pipelineBuffer, 1), *checkpointEvery,
+			*uploadChunkSize, *uploadRetries, *uploadSpool, maxUploadRate.limiter("points"))
+		return p, p.Close, nil
+	default:
+		return export.NewTextSink(os.Stdout), func() error { return nil }, nil
 	}
-	if since.IsZero() && *scrapeSince != 0 {
-		since = time.Now().Add(-*scrapeSince)
+}
+
+func stationAttrs(dev netatmo.Station) map[string]string {
+	return normalizedLabels(fileConfig.accountLabels(fileConfig.applyLabels(export.StationLabels(dev), labelFields{
+		ID: string(dev.ID), Type: string(dev.Type), Name: dev.Name, Firmware: dev.Firmware,
+		HomeID: dev.HomeID, HomeName: dev.HomeName, StationID: string(dev.ID), StationName: dev.Name,
+	})))
+}
+
+func moduleAttrs(dev netatmo.Station, mod netatmo.Module) map[string]string {
+	return normalizedLabels(fileConfig.accountLabels(fileConfig.applyLabels(export.ModuleLabels(dev, mod), labelFields{
+		ID: string(mod.ID), Type: string(mod.Type), Name: mod.Name, Firmware: mod.Firmware,
+		HomeID: dev.HomeID, HomeName: dev.HomeName, StationID: string(dev.ID), StationName: dev.Name,
+	})))
+}
+
+// normalizedLabels applies -normalize-labels to attrs.
+func normalizedLabels(attrs map[string]string) map[string]string {
+	if *normalizeLabels {
+		return export.NormalizeLabels(attrs)
 	}
+	return attrs
+}
+
+// pendingGap is a gap left by -catch-up, with the name of its module, for the progress logs.
+type pendingGap struct {
+	name string
+	gap  export.Gap
+}
 
-	// Resume token present?
+// exportHistory exports m, named name, from where the last run left off, or from the -resume token, logging progress.
+// With -catch-up, if m is far behind, it only exports the recent data, and passes the gap left to onGap.
+func exportHistory(
+	ctx context.Context, e *export.Exporter, name string, m export.Module, interval time.Duration,
+	onGap func(export.Gap),
+) (points int, err error) {
+	var since time.Time
 	if *resume != "" {
-		r := strings.Split(*resume, "/")
-		if r[0] != string(device) || r[1] != string(module) {
-			// Token was given and it has some other module.. probably skip ahead.
-			return nil
+		tok, err := parseResumeToken(*resume)
+		if err != nil {
+			return 0, fmt.Errorf("%w: -resume: %w", errConfig, err)
 		}
-		sec, err := strconv.Atoi(r[2])
+		ok, err := tok.matches(m.Device, m.Module, m.DataTypes)
 		if err != nil {
-			return err
+			return 0, fmt.Errorf("%w: -resume: %w", errConfig, err)
+		}
+		if !ok {
+			// Token was given and it has some other module.. probably skip ahead.
+			return 0, nil
 		}
-		since = time.Unix(int64(sec), 0)
+		since = tok.time()
 		*resume = ""
+	} else {
+		var due bool
+		if since, due, err = e.Start(ctx, m, interval); err != nil || !due {
+			return 0, err
+		}
 	}
 
-	labels := []*dto.LabelPair{}
-	for k, v := range attrs {
-		labels = append(labels, &dto.LabelPair{
-			Name:  ptr(string(k)),
-			Value: ptr(string(v)),
-		})
-	}
-
-	err := client.GetMeasure(ctx, device, module, dataTypes, since, func(points []netatmo.DataPoint, nextTime time.Time) error {
-		// Gauges contain the datapoints.
-		for i, dt := range dataTypes {
-			// MetricFamily gives the gauges a name and units.
-			mf := &dto.MetricFamily{
-				Name: ptr("netatmo_" + strings.ToLower(string(dt))),
-				Type: dto.MetricType_GAUGE.Enum(),
-			}
-			for _, point := range points {
-				mf.Metric = append(mf.Metric,
-					&dto.Metric{
-						Label:       labels,
-						TimestampMs: proto.Int64(point.Time.UnixMilli()),
-						Gauge: &dto.Gauge{
-							Value: proto.Float64(point.Values[i]),
-						},
-					})
-			}
-			if *verbose {
-				log.Printf("Exporting %d datapoints", len(mf.Metric))
-			}
-			if err := exporter.Encode(mf); err != nil {
-				return err
-			}
+	if now := time.Now(); *catchUp > 0 && now.Sub(since) > *catchUp {
+		recent := now.Add(-*catchUp)
+		slog.Info("catching up on the recent data first", "device", m.Device, "module", m.Module,
+			"cursor", since.Format(time.RFC3339), "recent", recent.Format(time.RFC3339))
+		p := newProgress(name, recent, now)
+		gap, err := e.CatchUp(ctx, m, since, recent, p.update)
+		if err != nil {
+			return p.points, err
 		}
+		p.done()
+		onGap(gap)
+		return p.points, nil
+	}
 
-		if *verbose {
-			log.Printf("Resume token: %s/%s/%d", device, module, nextTime.Unix())
-		}
-		return nil
+	p := newProgress(name, since, time.Now())
+	err = e.Export(ctx, m, since, func(points []netatmo.DataPoint, nextTime time.Time) {
+		p.update(points, nextTime)
+		slog.Debug("resume token", "device", m.Device, "module", m.Module, "token", resumeToken{
+			Version:   resumeTokenVersion,
+			Device:    m.Device,
+			Module:    m.Module,
+			DataTypes: m.DataTypes,
+			Scale:     netatmo.MaxScale,
+			Cursor:    nextTime.Unix(),
+		}.String())
 	})
 	if err != nil {
-		return err
+		return p.points, err
 	}
-	return nil
+	p.done()
+	return p.points, nil
 }
 
+// otlpBatchSize is about how many points -format=otlp sends per request.
+const otlpBatchSize = 10000
+
+// otlpHomeLabels are the labels -otlp-per-home moves to the Resource.
+var otlpHomeLabels = []string{"home_id", "home_name"}
+
+// remoteWriteBatchSize is about how many samples -format=remote-write sends per request.
+const remoteWriteBatchSize = 10000
+
+// parquetBatchSize is about how many samples -format=parquet stores per batch of files.
+const parquetBatchSize = 100000
+
 func ptr[T any](v T) *T { return &v }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"tailscale.com/jsondb"
+)
+
+// manifest tracks a chunked backfill across runs: the range, split into chunks per module, and how each went.
+// It is plain JSON, so the progress of a long import can be audited, or a chunk reset to pending by hand.
+type manifest struct {
+	From   time.Time       `json:"from"`
+	To     time.Time       `json:"to"`
+	Chunk  string          `json:"chunk"` // A time.Duration.
+	Chunks []manifestChunk `json:"chunks"`
+}
+
+// Chunk statuses.
+const (
+	chunkPending = "pending"
+	chunkDone    = "done"
+	chunkFailed  = "failed" // Retried on the next run.
+)
+
+// manifestChunk is one module's data from From through To.
+type manifestChunk struct {
+	DevID    string     `json:"dev_id"`
+	Name     string     `json:"module_name"`
+	From     time.Time  `json:"from"`
+	To       time.Time  `json:"to"`
+	Status   string     `json:"status"`
+	Attempts int        `json:"attempts,omitempty"`
+	Points   int        `json:"points,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Updated  *time.Time `json:"updated,omitempty"`
+}
+
+// manifestFile is a manifest open for updates from concurrent module exports, saving each change.
+type manifestFile struct {
+	mu sync.Mutex
+	db *jsondb.DB[manifest]
+}
+
+// openManifest opens the manifest at path, creating it with chunks for the modules (by dev_id, with their names)
+// if it doesn't exist yet. If it does, from and to must be zero or match it.
+func openManifest(path string, from, to time.Time, chunk time.Duration, modules map[string]string, order []string) (*manifestFile, error) {
+	db, err := jsondb.Open[manifest](path)
+	if err != nil {
+		return nil, err
+	}
+	m := db.Data
+	if len(m.Chunks) > 0 {
+		if (!from.IsZero() && !from.Equal(m.From)) || (!to.IsZero() && !to.Equal(m.To)) {
+			return nil, fmt.Errorf("%w: backfill: manifest %s is for %s to %s; remove it to start over",
+				errConfig, path, m.From.Format(time.RFC3339), m.To.Format(time.RFC3339))
+		}
+		return &manifestFile{db: db}, nil
+	}
+
+	if from.IsZero() {
+		return nil, fmt.Errorf("%w: backfill: -from is required for a new manifest", errConfig)
+	}
+	m.From, m.To, m.Chunk = from, to, chunk.String()
+	for _, id := range order {
+		for t := from; t.Before(to); t = t.Add(chunk) {
+			// The ranges are inclusive, so each chunk ends a second before the next.
+			end := t.Add(chunk - time.Second)
+			if !end.Before(to) {
+				end = to
+			}
+			m.Chunks = append(m.Chunks, manifestChunk{DevID: id, Name: modules[id], From: t, To: end, Status: chunkPending})
+		}
+	}
+	if err := db.Save(); err != nil {
+		return nil, err
+	}
+	return &manifestFile{db: db}, nil
+}
+
+// todo returns the indexes of devID's chunks that are not done, in order.
+func (f *manifestFile) todo(devID string) []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var is []int
+	for i, c := range f.db.Data.Chunks {
+		if c.DevID == devID && c.Status != chunkDone {
+			is = append(is, i)
+		}
+	}
+	return is
+}
+
+// chunk returns chunk i.
+func (f *manifestFile) chunk(i int) manifestChunk {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.db.Data.Chunks[i]
+}
+
+// update applies fn to chunk i, and saves the manifest.
+func (f *manifestFile) update(i int, fn func(c *manifestChunk)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := &f.db.Data.Chunks[i]
+	fn(c)
+	now := time.Now()
+	c.Updated = &now
+	return f.db.Save()
+}
+
+// counts returns the number of chunks in each status.
+func (f *manifestFile) counts() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := map[string]int{}
+	for _, c := range f.db.Data.Chunks {
+		n[c.Status]++
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+package netatmo
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// measurePage is a full getmeasure response: 1024 samples of 2 data types, as in a backfill.
+func measurePage(b *testing.B) []byte {
+	values := make([][]float64, 1024)
+	for i := range values {
+		values[i] = []float64{20 + float64(i%100)/10, 400 + float64(i%500)}
+	}
+	data, err := json.Marshal(map[string]any{
+		"status": "ok",
+		"body":   []any{map[string]any{"beg_time": time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix(), "step_time": 300, "value": values}},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// BenchmarkDecodeMeasure decodes a page at a time, as GetMeasure does.
+func BenchmarkDecodeMeasure(b *testing.B) {
+	data := measurePage(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	var dec measureDecoder
+	for range b.N {
+		if _, _, _, err := dec.decode(http.StatusOK, data, 2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeMeasureFresh decodes each page into new buffers, as before measureDecoder.
+func BenchmarkDecodeMeasureFresh(b *testing.B) {
+	data := measurePage(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for range b.N {
+		body, err := decodeResponse[getMeasureBody](http.StatusOK, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		body.appendPoints(nil, nil, 2)
+	}
+}
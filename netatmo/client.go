@@ -1,28 +1,120 @@
 package netatmo
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/time/rate"
 )
 
+// MaxScale is the measurement scale GetMeasure uses: every sample, at the resolution the module recorded it.
+const MaxScale = "max"
+
+// ErrBudgetExhausted is returned once the client has made as many API calls as allowed by SetMaxCalls.
+var ErrBudgetExhausted = errors.New("netatmo: API call budget exhausted")
+
+var (
+	// ErrUnauthorized matches errors caused by a missing, invalid, or unrefreshable token.
+	ErrUnauthorized = errors.New("netatmo: unauthorized")
+	// ErrRateLimited matches errors caused by exceeding the Netatmo API rate limits.
+	ErrRateLimited = errors.New("netatmo: rate limited")
+	// ErrDeviceNotFound matches errors caused by asking for a device or module that isn't in the account,
+	// e.g. one removed since the stations were discovered.
+	ErrDeviceNotFound = errors.New("netatmo: device not found")
+)
+
+// APIError is an error response from the Netatmo API.
+type APIError struct {
+	StatusCode int
+	Code       int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("netatmo: %s (code %d, HTTP %d)", e.Message, e.Code, e.StatusCode)
+}
+
+// Is matches ErrUnauthorized, ErrRateLimited, and ErrDeviceNotFound by the HTTP status and Netatmo error code.
+//
+// https://dev.netatmo.com/apidocumentation/general#status-ok
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.Code == 1 || e.Code == 2 || e.Code == 3 || e.Code == 13
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests || e.Code == 26
+	case ErrDeviceNotFound:
+		return e.Code == 9
+	}
+	return false
+}
+
+// StationsAndMeasures is the part of *Client that reads the stations and their history,
+// for programs to substitute a fake (e.g. a netatmotest.Fake) in tests.
+type StationsAndMeasures interface {
+	GetStations(ctx context.Context) ([]Station, error)
+	GetMeasure(ctx context.Context, device DeviceID, module ModuleID, dataTypes []DataType, since, until time.Time,
+		yield func(points []DataPoint, nextTime time.Time) error) error
+}
+
+var _ StationsAndMeasures = (*Client)(nil)
+
 type Client struct {
 	baseURL string
 	client  *http.Client
+
+	calls    atomic.Int64
+	maxCalls atomic.Int64
+	pacer    atomic.Pointer[rate.Limiter]
+	hooks    atomic.Pointer[Hooks]
+	quota    quotaTracker
+	user     atomic.Pointer[User]
+
+	transport       *http.Transport
+	maxResponseSize int64
+	readTimeout     time.Duration
+	userAgent       string
+	optimize        bool
+	realTime        bool
 }
 
+// Default response limits; see SetResponseLimits.
+const (
+	DefaultMaxResponseSize = 32 << 20
+	DefaultReadTimeout     = time.Minute
+)
+
+// DefaultBaseURL is the Netatmo API, used by NewClient.
+const DefaultBaseURL = "https://api.netatmo.net"
+
+// DefaultUserAgent identifies the client to Netatmo unless SetUserAgent sets another.
+const DefaultUserAgent = "netatmo-otel (+https://sgrankin.dev/netatmo-otel)"
+
 func NewClient(ctx context.Context,
 	clientID, clientSecret string, token oauth2.Token,
 	newToken func(*oauth2.Token, error) error,
 ) *Client {
-	baseURL := "https://api.netatmo.net"
+	return NewClientAt(ctx, DefaultBaseURL, clientID, clientSecret, token, newToken)
+}
+
+// NewClientAt is NewClient for the API (and its OAuth endpoints) at baseURL, e.g. a netatmotest.Server.
+func NewClientAt(ctx context.Context, baseURL string,
+	clientID, clientSecret string, token oauth2.Token,
+	newToken func(*oauth2.Token, error) error,
+) *Client {
 	oa := oauth2.Config{
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
@@ -30,13 +122,52 @@ func NewClient(ctx context.Context,
 		Endpoint:     oauth2.Endpoint{AuthURL: baseURL + "/oauth/authorize", TokenURL: baseURL + "/oauth2/token"},
 	}
 
-	throttledClient := &http.Client{Transport: &throttledTransport{http.DefaultTransport,
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = DefaultReadTimeout
+	throttledClient := &http.Client{Transport: &throttledTransport{transport,
 		rate.NewLimiter(rate.Limit(300.0/3600), 50), // 500 per hour, 50 per 10s; reduced for convenience.
 	}}
 
 	ts := oauth2.ReuseTokenSource(nil, &NotifyingTokenSource{oa.TokenSource(ctx, &token), newToken})
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, throttledClient)
-	return &Client{baseURL: baseURL, client: oauth2.NewClient(ctx, ts)}
+	return &Client{
+		baseURL:         baseURL,
+		client:          oauth2.NewClient(ctx, ts),
+		transport:       transport,
+		maxResponseSize: DefaultMaxResponseSize,
+		readTimeout:     DefaultReadTimeout,
+		userAgent:       DefaultUserAgent,
+		optimize:        true,
+		realTime:        true,
+	}
+}
+
+// SetProxy sets the proxy for API and token calls, as for http.Transport.Proxy; nil uses none.
+// NewClient uses the proxy from the environment (HTTPS_PROXY and NO_PROXY). It must be called before making any calls.
+func (c *Client) SetProxy(proxy func(*http.Request) (*url.URL, error)) {
+	c.transport.Proxy = proxy
+}
+
+// SetResponseLimits bounds API responses: calls fail if a response is larger than maxSize bytes, or if its headers
+// or its body take longer than timeout each to arrive, so a misbehaving server or proxy can't exhaust memory or
+// hang the caller. It must be called before making any calls.
+func (c *Client) SetResponseLimits(maxSize int64, timeout time.Duration) {
+	c.maxResponseSize, c.readTimeout = maxSize, timeout
+	c.transport.ResponseHeaderTimeout = timeout
+}
+
+// SetUserAgent sets the User-Agent of API calls, which Netatmo asks API clients to identify themselves with:
+// the application's name and version, and how to contact its maintainer. It must be called before making any calls.
+func (c *Client) SetUserAgent(ua string) {
+	c.userAgent = ua
+}
+
+// SetMeasureParams sets GetMeasure's optimize and real_time parameters, both true by default.
+// Without optimize, Netatmo maps each sample's timestamp to its values, a larger response than the evenly spaced
+// groups, but the same points. Without real_time, at scales coarser than MaxScale, the timestamps are offset by
+// half the scale. It must be called before making any calls.
+func (c *Client) SetMeasureParams(optimize, realTime bool) {
+	c.optimize, c.realTime = optimize, realTime
 }
 
 type NotifyingTokenSource struct {
@@ -48,15 +179,189 @@ type NotifyingTokenSource struct {
 func (c *NotifyingTokenSource) Token() (*oauth2.Token, error) {
 	tok, err := c.TokenSource.Token()
 	err = c.Notify(tok, err)
-	return tok, err
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+	return tok, nil
+}
+
+// SetMaxCalls limits the number of API calls the client will make; further calls fail with ErrBudgetExhausted.
+// Zero means no limit.
+func (c *Client) SetMaxCalls(n int64) { c.maxCalls.Store(n) }
+
+// Calls returns the number of API calls made so far, including those under way.
+func (c *Client) Calls() int64 { return c.calls.Load() }
+
+// SetPacing spaces out API calls by at least every, on top of the rate limits. Zero disables pacing.
+func (c *Client) SetPacing(every time.Duration) {
+	if every <= 0 {
+		c.pacer.Store(nil)
+		return
+	}
+	c.pacer.Store(rate.NewLimiter(rate.Every(every), 1))
+}
+
+// Hooks are called around each API request, e.g. for custom logging, extra headers, metrics,
+// or capturing the raw responses.
+type Hooks struct {
+	// OnRequest is called before each request is sent, and may modify it (e.g. to add headers).
+	// An error fails the call without sending it.
+	OnRequest func(req *http.Request) error
+	// OnResponse is called once each request has completed, or failed to.
+	OnResponse func(x Exchange)
+}
+
+// Exchange is an API request and its outcome, passed to Hooks.OnResponse.
+type Exchange struct {
+	Request  *http.Request
+	Response *http.Response // Nil if Err is set. The body is in Body.
+	Body     []byte         // Only valid until OnResponse returns.
+	Duration time.Duration
+	Err      error // The transport or read error, if any.
+}
+
+// SetHooks sets the hooks called around each API request, replacing any set before.
+func (c *Client) SetHooks(h Hooks) { c.hooks.Store(&h) }
+
+type callCounterKey struct{}
+
+// WithCallCounter returns a context that counts the API calls made with it in n,
+// to attribute calls to concurrent operations sharing a client.
+func WithCallCounter(ctx context.Context, n *atomic.Int64) context.Context {
+	return context.WithValue(ctx, callCounterKey{}, n)
 }
 
+// MeasureStats counts what GetMeasure corrected or retried, for a caller to monitor the quality of the data.
+type MeasureStats struct {
+	Duplicates atomic.Int64 // Points dropped for repeating ones of the previous page.
+	Malformed  atomic.Int64 // Samples with more or fewer values than data types, padded with NaN or truncated.
+	Retries    atomic.Int64 // Pages requested again after a transient failure.
+}
+
+type measureStatsKey struct{}
+
+// WithMeasureStats returns a context that counts in s what the GetMeasure calls made with it corrected or retried.
+func WithMeasureStats(ctx context.Context, s *MeasureStats) context.Context {
+	return context.WithValue(ctx, measureStatsKey{}, s)
+}
+
+// measureStats returns the MeasureStats of ctx, or ones to discard.
+func measureStats(ctx context.Context) *MeasureStats {
+	if s, ok := ctx.Value(measureStatsKey{}).(*MeasureStats); ok {
+		return s
+	}
+	return &MeasureStats{}
+}
+
+// GetStations returns the stations and their modules.
+// Devices and modules that cannot be decoded are logged and skipped; see Stations.
 func (c *Client) GetStations(ctx context.Context) ([]Station, error) {
-	body, err := doRequest[getStationsBody](ctx, c.client, c.baseURL+"/api/getstationsdata")
-	if err != nil {
-		return nil, err
+	var stations []Station
+	for st, err := range c.Stations(ctx) {
+		var de *DecodeError
+		if errors.As(err, &de) {
+			slog.WarnContext(ctx, "skipping malformed device", "device", de.Device, "module", de.Module, "err", de.Err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stations = append(stations, st)
+	}
+	return stations, nil
+}
+
+// User returns the user section of the last stations response, if there was one.
+func (c *Client) User() (User, bool) {
+	if u := c.user.Load(); u != nil {
+		return *u, true
+	}
+	return User{}, false
+}
+
+// DecodeError is a device or module from the API that could not be decoded.
+// Stations yields it in place of the device, or next to the station without the module.
+type DecodeError struct {
+	Device DeviceID
+	Module ModuleID // Empty if the device itself is malformed.
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Module != "" {
+		return fmt.Sprintf("netatmo: decoding module %s of %s: %v", e.Module, e.Device, e.Err)
 	}
-	return body.Stations, err
+	return fmt.Sprintf("netatmo: decoding device %s: %v", e.Device, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// Stations is GetStations as an iterator, yielding a *DecodeError for each malformed device or module
+// instead of failing the call. Any other error is yielded once, with the zero Station, and ends the iteration.
+func (c *Client) Stations(ctx context.Context) iter.Seq2[Station, error] {
+	return func(yield func(Station, error) bool) {
+		body, err := doRequest[getStationsBody](ctx, c, c.baseURL+"/api/getstationsdata")
+		if err != nil {
+			yield(Station{}, err)
+			return
+		}
+		if body.User != nil {
+			c.user.Store(body.User)
+		}
+		for _, raw := range body.Stations {
+			st, errs := decodeStation(raw)
+			for _, err := range errs {
+				if !yield(Station{}, err) {
+					return
+				}
+			}
+			if st.ID != "" && !yield(st, nil) {
+				return
+			}
+		}
+	}
+}
+
+// decodeStation decodes a device and the modules that can be decoded.
+// The returned station has no ID if the device itself cannot be decoded.
+func decodeStation(raw json.RawMessage) (Station, []*DecodeError) {
+	var id struct {
+		ID DeviceID `json:"_id"`
+	}
+	_ = json.Unmarshal(raw, &id) // Best effort, for the error.
+
+	var st struct {
+		Station
+		Modules []json.RawMessage `json:"modules"` // Shadows Station.Modules.
+	}
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return Station{}, []*DecodeError{{Device: id.ID, Err: err}}
+	}
+	if st.ID == "" {
+		return Station{}, []*DecodeError{{Err: errors.New("no _id")}}
+	}
+
+	var errs []*DecodeError
+	for _, raw := range st.Modules {
+		var mod Module
+		if err := json.Unmarshal(raw, &mod); err != nil {
+			var id struct {
+				ID ModuleID `json:"_id"`
+			}
+			_ = json.Unmarshal(raw, &id)
+			if id.ID == "" {
+				err = fmt.Errorf("module: %w", err)
+			}
+			errs = append(errs, &DecodeError{Device: st.ID, Module: id.ID, Err: err})
+			continue
+		}
+		if mod.ID == "" {
+			errs = append(errs, &DecodeError{Device: st.ID, Err: errors.New("module with no _id")})
+			continue
+		}
+		st.Station.Modules = append(st.Station.Modules, mod)
+	}
+	return st.Station, errs
 }
 
 type DataPoint struct {
@@ -65,10 +370,13 @@ type DataPoint struct {
 }
 
 // GetMeasure paginates through the module data for the given dataTypes, starting at since.
+// If until is not zero, pagination stops once it is reached. A page that fails with a network error or a 5xx
+// response is requested again, up to measureRetries times.
 //
-// It yields pages of data after each request,and the next timestamp that will be used (for resuming).
+// It yields pages of data after each request, and the next timestamp that will be used (for resuming).
+// The pages, and their points' Values, are reused: they are only valid until yield returns.
 func (c *Client) GetMeasure(
-	ctx context.Context, device DeviceID, module ModuleID, dataTypes []DataType, since time.Time,
+	ctx context.Context, device DeviceID, module ModuleID, dataTypes []DataType, since, until time.Time,
 	yield func(points []DataPoint, nextTime time.Time) error,
 ) error {
 	v := url.Values{}
@@ -76,78 +384,271 @@ func (c *Client) GetMeasure(
 	if module != "" {
 		v.Set("module_id", string(module))
 	}
-	v.Set("scale", "max") // Use maximum resolution.
+	v.Set("scale", MaxScale) // Use maximum resolution.
 	v.Set("type", joinStrings(dataTypes, ","))
-	v.Set("optimize", "true")  // Use compact result format.
-	v.Set("real_time", "true") // Probably does nothing.
+	v.Set("optimize", strconv.FormatBool(c.optimize))  // Compact result format; see SetMeasureParams.
+	v.Set("real_time", strconv.FormatBool(c.realTime)) // No effect at MaxScale.
 	if !since.IsZero() {
 		v.Set("date_begin", fmt.Sprintf("%d", since.Unix()))
 	}
+	if !until.IsZero() {
+		v.Set("date_end", fmt.Sprintf("%d", until.Unix()))
+	}
 
-	for {
-		body, err := doRequest[getMeasureBody](ctx, c.client, c.baseURL+"/api/getmeasure?"+v.Encode())
+	var (
+		dec   measureDecoder
+		buf   []byte
+		stats = measureStats(ctx)
+	)
+	for attempt := 0; ; {
+		status, data, err := c.get(ctx, c.baseURL+"/api/getmeasure?"+v.Encode(), buf)
+		var (
+			points    []DataPoint
+			t         time.Time
+			malformed int
+		)
+		if err == nil {
+			buf = data
+			points, t, malformed, err = dec.decode(status, data, len(dataTypes))
+		}
+		if err != nil && attempt < measureRetries && retryable(ctx, err) {
+			attempt++
+			stats.Retries.Add(1)
+			slog.WarnContext(ctx, "netatmo: getmeasure failed; retrying", "device", device, "module", module,
+				"attempt", attempt, "err", err)
+			select {
+			case <-time.After(time.Duration(attempt) * measureRetryDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		if len(body) == 0 {
+		attempt = 0
+		if malformed > 0 {
+			stats.Malformed.Add(int64(malformed))
+			slog.WarnContext(ctx, "netatmo: getmeasure samples don't match the data types", "device", device,
+				"module", module, "data_types", dataTypes, "malformed", malformed)
+		}
+		if len(points) == 0 {
 			return nil // No data; we're done.
 		}
-
-		points := []DataPoint{}
-		var t time.Time
-		for _, group := range body {
-			t = group.Time.Time
-			for _, point := range group.Value {
-				points = append(points, DataPoint{t, point})
-				t = t.Add(time.Duration(group.Step) * time.Second)
+		// Around DST changes and clock skew, a page can start before date_begin, overlapping the previous one.
+		// Drop the points already yielded, and stop if nothing is left, as asking again would get the same page.
+		if n := len(points); !since.IsZero() {
+			points = slices.DeleteFunc(points, func(p DataPoint) bool { return p.Time.Before(since) })
+			if dropped := n - len(points); dropped > 0 {
+				stats.Duplicates.Add(int64(dropped))
+				slog.Warn("netatmo: getmeasure page overlaps the previous one", "device", device, "module", module,
+					"date_begin", since, "dropped", dropped)
+			}
+			if len(points) == 0 {
+				return nil
 			}
 		}
-		if err := yield(points, t); err != nil {
+		// Resume after the last point: t, a step later, may be the next sample.
+		next := points[len(points)-1].Time.Add(time.Second)
+		if err := yield(points, next); err != nil {
 			return err
 		}
-		v.Set("date_begin", fmt.Sprintf("%d", t.Add(time.Second).Unix()))
+		if !until.IsZero() && !t.Before(until) {
+			return nil // Reached the end of the requested range.
+		}
+		since = next
+		v.Set("date_begin", fmt.Sprintf("%d", since.Unix()))
+	}
+}
+
+// GetMeasure retries a failed page up to measureRetries times, waiting measureRetryDelay longer each time.
+const (
+	measureRetries    = 2
+	measureRetryDelay = time.Second
+)
+
+// retryable reports whether err, from a call with ctx, is likely to go away if the call is made again:
+// a network error, or a 5xx response (e.g. from an overloaded gateway).
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrBudgetExhausted) || errors.Is(err, ErrUnauthorized) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// errStopMeasures stops GetMeasure when the consumer of Measures breaks out of the loop.
+var errStopMeasures = errors.New("netatmo: stop measures")
+
+// Measures is GetMeasure as an iterator over the points, fetching pages as needed.
+// Breaking out of the loop stops fetching. An error is yielded once, with the zero DataPoint, and ends the iteration.
+func (c *Client) Measures(
+	ctx context.Context, device DeviceID, module ModuleID, dataTypes []DataType, since, until time.Time,
+) iter.Seq2[DataPoint, error] {
+	return func(yield func(DataPoint, error) bool) {
+		err := c.GetMeasure(ctx, device, module, dataTypes, since, until, func(points []DataPoint, _ time.Time) error {
+			for _, p := range points {
+				p.Values = slices.Clone(p.Values) // GetMeasure reuses them.
+				if !yield(p, nil) {
+					return errStopMeasures
+				}
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopMeasures) {
+			yield(DataPoint{}, err)
+		}
 	}
 }
 
 // doRequest GETs the given URL and on success decodes the JSON body as T.
-func doRequest[T any](ctx context.Context, client *http.Client, url string) (T, error) {
+func doRequest[T any](ctx context.Context, c *Client, url string) (T, error) {
 	var zero T
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	status, data, err := c.get(ctx, url, nil)
 	if err != nil {
 		return zero, err
 	}
+	return decodeResponse[T](status, data)
+}
 
-	resp, err := client.Do(req)
+// get GETs the given URL, and returns the response's status and body, read into buf.
+func (c *Client) get(ctx context.Context, url string, buf []byte) (status int, data []byte, err error) {
+	// The call is counted up front, so that concurrent calls waiting for their pace can't overrun the budget
+	// together, and given back if it isn't made after all.
+	if !c.reserveCall() {
+		return 0, nil, ErrBudgetExhausted
+	}
+	made := false
+	defer func() {
+		if !made {
+			c.calls.Add(-1)
+		}
+	}()
+	// Canceled to time out reading the body.
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
 	if err != nil {
-		return zero, err
+		return 0, nil, err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if p := c.pacer.Load(); p != nil {
+		if err := p.Wait(ctx); err != nil {
+			return 0, nil, fmt.Errorf("pacing: %w", err)
+		}
+	}
+	if err := c.waitQuota(ctx); err != nil {
+		return 0, nil, fmt.Errorf("pacing: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		dump, _ := httputil.DumpResponse(resp, true)
-		return zero, fmt.Errorf("code: %d; body: %s", resp.StatusCode, dump)
+	hooks := c.hooks.Load()
+	if hooks != nil && hooks.OnRequest != nil {
+		if err := hooks.OnRequest(req); err != nil {
+			return 0, nil, fmt.Errorf("request hook: %w", err)
+		}
 	}
 
-	var r genericResponse
-	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
-		return zero, err
+	made = true
+	if n, ok := ctx.Value(callCounterKey{}).(*atomic.Int64); ok {
+		n.Add(1)
+	}
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	var bs []byte
+	if err == nil {
+		bs, err = c.readBody(reqCtx, cancel, resp.Body, buf)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(bs))
+	}
+	if hooks != nil && hooks.OnResponse != nil {
+		hooks.OnResponse(Exchange{Request: req, Response: resp, Body: bs, Duration: time.Since(start), Err: err})
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	c.quota.record(start, resp.Header, resp.StatusCode != http.StatusOK &&
+		errors.Is(decodeResponseInto(resp.StatusCode, bs, &genericResponse{}, nil), ErrRateLimited))
+	slog.DebugContext(ctx, "netatmo request", "url", RedactURL(req.URL), "status", resp.StatusCode,
+		"duration", time.Since(start))
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		if dump, err := DumpResponse(resp, true); err == nil {
+			slog.DebugContext(ctx, "netatmo response", "response", string(dump))
+		}
 	}
 
-	if r.Error != nil {
-		var er errorBody
-		if err := json.Unmarshal(r.Error, &er); err != nil {
-			return zero, err
+	return resp.StatusCode, bs, nil
+}
+
+// reserveCall counts a call in c.calls, unless that would exceed the budget set by SetMaxCalls.
+func (c *Client) reserveCall() bool {
+	for {
+		n := c.calls.Load()
+		if max := c.maxCalls.Load(); max > 0 && n >= max {
+			return false
+		}
+		if c.calls.CompareAndSwap(n, n+1) {
+			return true
 		}
-		return zero, err
 	}
+}
 
+// readBody reads a response body into buf within the client's limits, canceling the request (with cancel) on timeout.
+func (c *Client) readBody(ctx context.Context, cancel context.CancelCauseFunc, body io.Reader, buf []byte) ([]byte, error) {
+	timer := time.AfterFunc(c.readTimeout, func() {
+		cancel(fmt.Errorf("netatmo: reading response: timed out after %v", c.readTimeout))
+	})
+	defer timer.Stop()
+	b := bytes.NewBuffer(buf[:0])
+	_, err := b.ReadFrom(io.LimitReader(body, c.maxResponseSize+1))
+	bs := b.Bytes()
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return nil, cause
+		}
+		return nil, err
+	}
+	if int64(len(bs)) > c.maxResponseSize {
+		return nil, fmt.Errorf("netatmo: response larger than %d bytes", c.maxResponseSize)
+	}
+	return bs, nil
+}
+
+// decodeResponse decodes an API response with the HTTP status and data: the body as T on success,
+// or an *APIError.
+func decodeResponse[T any](status int, data []byte) (T, error) {
 	var body T
-	if err := json.Unmarshal(r.Body, &body); err != nil {
+	if err := decodeResponseInto(status, data, &genericResponse{}, &body); err != nil {
+		var zero T
 		return zero, err
 	}
 	return body, nil
 }
 
+// decodeResponseInto is decodeResponse into body, reusing r (and body) from previous responses.
+func decodeResponseInto(status int, data []byte, r *genericResponse, body any) error {
+	r.Body, r.Error = r.Body[:0], nil
+	if status != http.StatusOK {
+		if err := json.Unmarshal(data, r); err != nil || r.Error == nil {
+			return &APIError{StatusCode: status, Message: fmt.Sprintf("body: %s", data)}
+		}
+	} else if err := json.Unmarshal(data, r); err != nil {
+		return err
+	}
+
+	if r.Error != nil {
+		var er errorBody
+		if err := json.Unmarshal(r.Error, &er); err != nil {
+			return err
+		}
+		return &APIError{StatusCode: status, Code: er.Code, Message: er.Message}
+	}
+	return json.Unmarshal(r.Body, body)
+}
+
 // joinStrings is strings.Join that accepts types defined as string.
 func joinStrings[T ~string](elems []T, sep string) string {
 	if len(elems) == 0 {
@@ -0,0 +1,131 @@
+package netatmo
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+var measureSeeds = []string{
+	// optimize=true
+	`{"status":"ok","body":[{"beg_time":1704067200,"step_time":300,"value":[[20.5,400],[20.7,410]]},{"beg_time":1704067900,"value":[[21,420]]}]}`,
+	`{"status":"ok","body":[]}`,
+	// optimize=false
+	`{"status":"ok","body":{"1704067500":[20.7,410],"1704067200":[20.5,null]}}`,
+	`{"status":"ok","body":{"nope":[1]}}`,
+	`{"error":{"code":26,"message":"User usage reached"}}`,
+	`{"status":"ok"}`,
+	`<html>Bad gateway</html>`,
+	``,
+}
+
+func TestDecodeMeasure(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    []time.Time
+		wantEnd time.Time
+	}{
+		{measureSeeds[0], []time.Time{time.Unix(1704067200, 0), time.Unix(1704067500, 0), time.Unix(1704067900, 0)}, time.Unix(1704067900, 0)},
+		{measureSeeds[1], nil, time.Time{}},
+		{measureSeeds[2], []time.Time{time.Unix(1704067200, 0), time.Unix(1704067500, 0)}, time.Unix(1704067500, 0)},
+	}
+	for _, tt := range tests {
+		body, err := decodeResponse[getMeasureBody](http.StatusOK, []byte(tt.data))
+		if err != nil {
+			t.Fatalf("decoding %s: %v", tt.data, err)
+		}
+		points, _, end, _ := body.appendPoints(nil, nil, 0)
+		if len(points) != len(tt.want) || !end.Equal(tt.wantEnd) {
+			t.Fatalf("decoding %s: got %v ending %v, want times %v ending %v", tt.data, points, end, tt.want, tt.wantEnd)
+		}
+		for i, p := range points {
+			if !p.Time.Equal(tt.want[i]) {
+				t.Errorf("decoding %s: point %d at %v, want %v", tt.data, i, p.Time, tt.want[i])
+			}
+		}
+	}
+}
+
+// TestMeasureDecoderReuse checks that a page's groups don't keep the fields the previous page's had and theirs lack.
+func TestMeasureDecoderReuse(t *testing.T) {
+	var d measureDecoder
+	if points, _, _, err := d.decode(http.StatusOK, []byte(measureSeeds[0]), 2); err != nil || len(points) != 3 {
+		t.Fatalf("first page: %v, %v", points, err)
+	}
+	points, _, _, err := d.decode(http.StatusOK, []byte(`{"status":"ok","body":[{"beg_time":1704068200,"step_time":300}]}`), 2)
+	if err != nil || len(points) != 0 {
+		t.Errorf("group without values: %v, %v, want no points", points, err)
+	}
+}
+
+func FuzzDecodeMeasure(f *testing.F) {
+	for _, s := range measureSeeds {
+		f.Add(http.StatusOK, []byte(s))
+	}
+	f.Add(http.StatusTooManyRequests, []byte(measureSeeds[4]))
+	f.Add(http.StatusBadGateway, []byte(measureSeeds[6]))
+	f.Fuzz(func(t *testing.T, status int, data []byte) {
+		body, err := decodeResponse[getMeasureBody](status, data)
+		if err != nil {
+			return
+		}
+		if status != http.StatusOK {
+			t.Fatalf("status %d decoded without error", status)
+		}
+		n := 0
+		for _, group := range body {
+			n += len(group.Value)
+		}
+		if points, _, _, _ := body.appendPoints(nil, nil, 0); len(points) != n {
+			t.Fatalf("got %d points from %d samples", len(points), n)
+		}
+	})
+}
+
+func FuzzDecodeStations(f *testing.F) {
+	f.Add(http.StatusOK, []byte(`{"status":"ok","body":{"devices":[{"_id":"70:ee:50:00:00:01","type":"NAMain","module_name":"Indoor",`+
+		`"data_type":["Temperature","CO2"],"dashboard_data":{"time_utc":1704067200,"Temperature":20.5},`+
+		`"modules":[{"_id":"02:00:00:00:00:01","type":"NAModule1","battery_percent":80},{"_id":"02:00:00:00:00:02","firmware":"x"},7]}]}}`))
+	f.Add(http.StatusOK, []byte(`{"status":"ok","body":{"devices":[{"firmware":"x"},null,{"_id":""}]}}`))
+	f.Add(http.StatusOK, []byte(`{"status":"ok","body":{"devices":null}}`))
+	f.Add(http.StatusForbidden, []byte(`{"error":{"code":3,"message":"Access token expired"}}`))
+	f.Fuzz(func(t *testing.T, status int, data []byte) {
+		body, err := decodeResponse[getStationsBody](status, data)
+		if err != nil {
+			return
+		}
+		for _, raw := range body.Stations {
+			st, errs := decodeStation(raw)
+			if st.ID == "" && len(errs) == 0 {
+				t.Fatalf("device %s decoded to nothing, without an error", raw)
+			}
+			// The stations must survive the round trip through the state database.
+			if _, err := json.Marshal(&st); err != nil {
+				t.Fatalf("re-encoding %+v: %v", st, err)
+			}
+		}
+	})
+}
+
+func TestDecodeWindModule(t *testing.T) {
+	var m Module
+	err := json.Unmarshal([]byte(`{"_id":"06:00:00:00:00:01","type":"NAModule2","data_type":["Wind"]}`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DataType{DataWindStrength, DataWindAngle, DataGustStrength, DataGustAngle}
+	if !slices.Equal(m.DataTypes, want) {
+		t.Errorf("DataTypes = %v, want %v", m.DataTypes, want)
+	}
+	// Stations saved since decode the same.
+	data, err := json.Marshal(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again Module
+	if err := json.Unmarshal(data, &again); err != nil || !slices.Equal(again.DataTypes, want) {
+		t.Errorf("after a round trip, DataTypes = %v (%v), want %v", again.DataTypes, err, want)
+	}
+}
@@ -0,0 +1,178 @@
+package netatmotest
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// Error is an error response from the API, injected with Fake.Fail.
+type Error struct {
+	Status  int // HTTP status.
+	Code    int // Netatmo error code.
+	Message string
+}
+
+var (
+	// RateLimited is the response to exceeding the API rate limits.
+	RateLimited = Error{Status: http.StatusTooManyRequests, Code: 26, Message: "User usage reached"}
+	// TokenExpired is the response to an expired access token.
+	TokenExpired = Error{Status: http.StatusForbidden, Code: 3, Message: "Access token expired"}
+	// DeviceNotFound is the response to measures of an unknown device or module.
+	DeviceNotFound = Error{Status: http.StatusBadRequest, Code: 9, Message: "Device not found"}
+)
+
+// APIError returns the error a netatmo.Client returns for the response.
+func (e Error) APIError() *netatmo.APIError {
+	return &netatmo.APIError{StatusCode: e.Status, Code: e.Code, Message: e.Message}
+}
+
+// Fake is a netatmo.StationsAndMeasures without HTTP, serving the stations and a deterministic measure series
+// for every device and module: one sample every Step from Since through Until, with the values from Value.
+//
+// Configure it before making calls; Fail is safe to call at any time.
+type Fake struct {
+	Stations []netatmo.Station
+	User     *netatmo.User // The user section of Server's stations; none if nil.
+	Since    time.Time     // Defaults to a day before the fake was created.
+	Until    time.Time     // Defaults to the current time.
+	Step     time.Duration // Defaults to 5 minutes.
+	PageSize int           // Most samples per getmeasure call; defaults to 1024.
+
+	mu       sync.Mutex
+	failures []Error
+	calls    int
+}
+
+var _ netatmo.StationsAndMeasures = (*Fake)(nil)
+
+// NewFake returns a fake for stations.
+func NewFake(stations ...netatmo.Station) *Fake {
+	return &Fake{
+		Stations: stations,
+		Since:    time.Now().Add(-24 * time.Hour).Truncate(time.Hour),
+		Step:     5 * time.Minute,
+		PageSize: 1024,
+	}
+}
+
+// Fail makes the next API calls fail with errs, in order.
+func (f *Fake) Fail(errs ...Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, errs...)
+}
+
+// Calls returns the number of API calls made so far, including failed ones.
+func (f *Fake) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// Value is the value the fake reports for dt at t: a base value for the data type plus the minutes past the hour.
+func Value(dt netatmo.DataType, t time.Time) float64 {
+	base := map[netatmo.DataType]float64{
+		netatmo.DataTemperature: 20,
+		netatmo.DataHumidity:    40,
+		netatmo.DataCO2:         400,
+		netatmo.DataPressure:    1000,
+		netatmo.DataNoise:       35,
+	}[dt]
+	return base + float64(t.UTC().Minute())
+}
+
+// GetStations implements netatmo.StationsAndMeasures.
+func (f *Fake) GetStations(ctx context.Context) ([]netatmo.Station, error) {
+	if fail := f.call(); fail != nil {
+		return nil, fail.APIError()
+	}
+	return f.Stations, nil
+}
+
+// GetMeasure implements netatmo.StationsAndMeasures, paging like a netatmo.Client.
+func (f *Fake) GetMeasure(
+	ctx context.Context, device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+	since, until time.Time, yield func(points []netatmo.DataPoint, nextTime time.Time) error,
+) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fail := f.call(); fail != nil {
+			return fail.APIError()
+		}
+		if !f.exists(device, module) {
+			return DeviceNotFound.APIError()
+		}
+		points := f.page(dataTypes, since, until)
+		if len(points) == 0 {
+			return nil
+		}
+		last := points[len(points)-1].Time
+		if err := yield(points, last.Add(time.Second)); err != nil {
+			return err
+		}
+		if !until.IsZero() && !last.Add(f.Step).Before(until) {
+			return nil
+		}
+		since = last.Add(time.Second)
+	}
+}
+
+// call counts an API call, and returns the injected failure for it, if any.
+func (f *Fake) call() *Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.failures) == 0 {
+		return nil
+	}
+	fail := f.failures[0]
+	f.failures = f.failures[1:]
+	return &fail
+}
+
+// page returns up to PageSize samples of dataTypes from begin through end (if not zero).
+func (f *Fake) page(dataTypes []netatmo.DataType, begin, end time.Time) []netatmo.DataPoint {
+	if f.Until.IsZero() {
+		end = minTime(end, time.Now())
+	} else {
+		end = minTime(end, f.Until)
+	}
+	// The first sample at or after begin.
+	t := f.Since
+	if begin.After(t) {
+		t = t.Add((begin.Sub(t) + f.Step - 1) / f.Step * f.Step)
+	}
+	var points []netatmo.DataPoint
+	for ; !t.After(end) && len(points) < f.PageSize; t = t.Add(f.Step) {
+		vs := make([]float64, len(dataTypes))
+		for i, dt := range dataTypes {
+			vs[i] = Value(dt, t)
+		}
+		points = append(points, netatmo.DataPoint{Time: t, Values: vs})
+	}
+	return points
+}
+
+// minTime returns the earlier of a and b, ignoring a if it is zero.
+func minTime(a, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// exists reports whether the device, or the device's module if module is not empty, is one of the stations.
+func (f *Fake) exists(device netatmo.DeviceID, module netatmo.ModuleID) bool {
+	i := slices.IndexFunc(f.Stations, func(st netatmo.Station) bool { return st.ID == device })
+	if i < 0 {
+		return false
+	}
+	return module == "" || slices.ContainsFunc(f.Stations[i].Modules, func(m netatmo.Module) bool { return m.ID == module })
+}
@@ -0,0 +1,109 @@
+// Package netatmotest provides fakes of the Netatmo API for tests of code using the netatmo client:
+// Server over HTTP, for a real netatmo.Client, and Fake without it.
+package netatmotest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// Server serves a Fake's stations, series, and failures as the Netatmo API.
+type Server struct {
+	*httptest.Server
+	*Fake
+}
+
+// NewServer starts a server for stations. Call Close when done.
+func NewServer(stations ...netatmo.Station) *Server {
+	s := &Server{Fake: NewFake(stations...)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth2/token", s.token)
+	mux.HandleFunc("/api/getstationsdata", s.api(s.getStations))
+	mux.HandleFunc("/api/getmeasure", s.api(s.getMeasure))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns a client for the server, with a valid token.
+func (s *Server) Client(ctx context.Context) *netatmo.Client {
+	token := oauth2.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+	return netatmo.NewClientAt(ctx, s.URL, "id", "secret", token, func(*oauth2.Token, error) error { return nil })
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600,
+	})
+}
+
+// api wraps an API handler with the call count, the injected failures, and the response envelope.
+func (s *Server) api(h func(r *http.Request) (any, *Error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fail := s.call()
+		var body any
+		if fail == nil {
+			body, fail = h(r)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if fail != nil {
+			w.WriteHeader(fail.Status)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"code": fail.Code, "message": fail.Message}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": "ok", "body": body, "time_server": time.Now().Unix()})
+	}
+}
+
+func (s *Server) getStations(r *http.Request) (any, *Error) {
+	body := map[string]any{"devices": s.Stations}
+	if s.User != nil {
+		body["user"] = s.User
+	}
+	return body, nil
+}
+
+func (s *Server) getMeasure(r *http.Request) (any, *Error) {
+	q := r.URL.Query()
+	if !s.exists(netatmo.DeviceID(q.Get("device_id")), netatmo.ModuleID(q.Get("module_id"))) {
+		return nil, &DeviceNotFound
+	}
+	var dataTypes []netatmo.DataType
+	for _, dt := range strings.Split(q.Get("type"), ",") {
+		dataTypes = append(dataTypes, netatmo.DataType(dt))
+	}
+	var begin, end time.Time
+	if sec, err := strconv.ParseInt(q.Get("date_begin"), 10, 64); err == nil {
+		begin = time.Unix(sec, 0)
+	}
+	if sec, err := strconv.ParseInt(q.Get("date_end"), 10, 64); err == nil {
+		end = time.Unix(sec, 0)
+	}
+
+	points := s.page(dataTypes, begin, end)
+	if len(points) == 0 {
+		return []any{}, nil
+	}
+	if q.Get("optimize") == "false" {
+		samples := map[string][]float64{}
+		for _, p := range points {
+			samples[strconv.FormatInt(p.Time.Unix(), 10)] = p.Values
+		}
+		return samples, nil
+	}
+	// The series is regular, so it fits in one group of the optimized format.
+	values := make([][]float64, len(points))
+	for i, p := range points {
+		values[i] = p.Values
+	}
+	return []any{map[string]any{"beg_time": points[0].Time.Unix(), "step_time": int(s.Step.Seconds()), "value": values}}, nil
+}
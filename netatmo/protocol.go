@@ -1,7 +1,13 @@
 package netatmo
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
 )
 
 type DeviceID string
@@ -12,30 +18,64 @@ const (
 	ModuleMain    ModuleType = "NAMain"
 	ModuleOutdoor ModuleType = "NAModule1"
 	ModuleIndoor  ModuleType = "NAModule4"
+	ModuleRain    ModuleType = "NAModule3"
+	ModuleWind    ModuleType = "NAModule2"
 )
 
 type DataType string
 
 const (
 	DataTemperature DataType = "Temperature"
-	DataHumidiity   DataType = "Humidiity"
+	DataHumidity    DataType = "Humidity"
 	DataCO2         DataType = "CO2"
 	DataPressure    DataType = "Pressure"
 	DataNoise       DataType = "Noise"
 	DataRain        DataType = "Rain"
-	DataWind        DataType = "Wind"
+	DataWind        DataType = "Wind" // The wind gauge's data_type; measured as the four below.
+
+	// Deprecated: DataHumidiity is the old, misspelled name of DataHumidity, and was "Humidiity".
+	DataHumidiity = DataHumidity
+
+	DataWindStrength DataType = "WindStrength"
+	DataWindAngle    DataType = "WindAngle" // Degrees from north; -1 when calm.
+	DataGustStrength DataType = "GustStrength"
+	DataGustAngle    DataType = "GustAngle"
 )
 
 var DataUnits = map[DataType]string{
 	DataTemperature: "Cel",
-	DataHumidiity:   "%",
+	DataHumidity:    "%",
 	DataCO2:         "[ppm]",
 	DataPressure:    "mbar",
 	DataNoise:       "dB[SPL]",
 	DataRain:        "mm",
 	DataWind:        "km/h",
+
+	DataWindStrength: "km/h",
+	DataWindAngle:    "deg",
+	DataGustStrength: "km/h",
+	DataGustAngle:    "deg",
+}
+
+// DataRanges are the plausible values of each data type, a margin beyond the sensors' measurement ranges.
+// Values outside them are glitches rather than weather.
+var DataRanges = map[DataType]struct{ Min, Max float64 }{
+	DataTemperature: {-60, 80},
+	DataHumidity:    {0, 100},
+	DataCO2:         {0, 10000},
+	DataPressure:    {260, 1160},
+	DataNoise:       {0, 150},
+	DataRain:        {0, 500},
+
+	DataWindStrength: {0, 300},
+	DataWindAngle:    {-1, 360},
+	DataGustStrength: {0, 300},
+	DataGustAngle:    {-1, 360},
 }
 
+// windMeasures are what getmeasure takes for a module with the Wind data_type, which it doesn't take itself.
+var windMeasures = []DataType{DataWindStrength, DataWindAngle, DataGustStrength, DataGustAngle}
+
 type genericResponse struct {
 	Body  json.RawMessage `json:"body"`
 	Error json.RawMessage `json:"error"`
@@ -47,7 +87,25 @@ type errorBody struct {
 }
 
 type getStationsBody struct {
-	Stations []Station `json:"devices"`
+	Stations []json.RawMessage `json:"devices"` // Decoded one by one, so one bad device doesn't fail the rest.
+	User     *User             `json:"user"`
+}
+
+// User is the account's settings, from the user section of the stations.
+type User struct {
+	Mail           string             `json:"mail"`
+	Administrative UserAdministrative `json:"administrative"`
+}
+
+// UserAdministrative is the user's locale and the units the Netatmo app shows.
+type UserAdministrative struct {
+	Country      string `json:"country"`    // e.g. FR
+	RegLocale    string `json:"reg_locale"` // e.g. fr-FR
+	Lang         string `json:"lang"`
+	Unit         int    `json:"unit"`           // 0: metric, 1: imperial.
+	WindUnit     int    `json:"windunit"`       // 0: km/h, 1: mph, 2: m/s, 3: Beaufort, 4: knots.
+	PressureUnit int    `json:"pressureunit"`   // 0: mbar, 1: inHg, 2: mmHg.
+	FeelLikeAlgo int    `json:"feel_like_algo"` // 0: humidex, 1: heat index.
 }
 
 type Station struct {
@@ -65,18 +123,33 @@ type Station struct {
 	DataTypes     []DataType    `json:"data_type"`
 	DashboardData DashboardData `json:"dashboard_data"`
 
-	Modules []struct {
-		ID             ModuleID   `json:"_id"`
-		Type           ModuleType `json:"type"` // NAModuleN
-		Name           string     `json:"module_name"`
-		Reachable      bool       `json:"reachable"`
-		Firmware       int        `json:"firmware"`
-		BatteryVP      int        `json:"battery_vp"`
-		BatteryPercent int        `json:"battery_percent"`
-
-		DataTypes     []DataType    `json:"data_type"`
-		DashboardData DashboardData `json:"dashboard_data"`
+	Modules []Module
+}
+
+type Module struct {
+	ID             ModuleID   `json:"_id"`
+	Type           ModuleType `json:"type"` // NAModuleN
+	Name           string     `json:"module_name"`
+	Reachable      bool       `json:"reachable"`
+	Firmware       int        `json:"firmware"`
+	BatteryVP      int        `json:"battery_vp"`
+	BatteryPercent int        `json:"battery_percent"`
+
+	DataTypes     []DataType    `json:"data_type"` // As getmeasure takes them: see UnmarshalJSON.
+	DashboardData DashboardData `json:"dashboard_data"`
+}
+
+// UnmarshalJSON decodes the module, replacing the Wind data_type with the WindStrength, WindAngle, GustStrength,
+// and GustAngle measures.
+func (m *Module) UnmarshalJSON(data []byte) error {
+	type module Module // Without this method.
+	if err := json.Unmarshal(data, (*module)(m)); err != nil {
+		return err
+	}
+	if i := slices.Index(m.DataTypes, DataWind); i >= 0 {
+		m.DataTypes = slices.Replace(slices.Clone(m.DataTypes), i, i+1, windMeasures...)
 	}
+	return nil
 }
 
 type DashboardData struct {
@@ -87,10 +160,131 @@ type DashboardData struct {
 	Noise            *float64
 	Pressure         *float64
 	AbsolutePressure *float64
+
+	// The day's temperature extremes, so far, and when they were measured.
+	MinTemp     *float64 `json:"min_temp"`
+	MaxTemp     *float64 `json:"max_temp"`
+	DateMinTemp unixTime `json:"date_min_temp"`
+	DateMaxTemp unixTime `json:"date_max_temp"`
+
+	TempTrend     string `json:"temp_trend"`     // up, down, or stable; empty without temperature.
+	PressureTrend string `json:"pressure_trend"` // Likewise, for the station's pressure.
+}
+
+// getMeasureBody is the getmeasure response: groups of evenly spaced samples with optimize=true,
+// or a map of timestamps to samples without it (decoded as one group per sample).
+type getMeasureBody []measureGroup
+
+type measureGroup struct {
+	Time  unixTime         `json:"beg_time"`
+	Step  int              `json:"step_time"`
+	Value [][]measureValue `json:"value"`
+}
+
+// measureValue is a sample's value, decoding a null (a value the module didn't record) as NaN.
+type measureValue float64
+
+func (v *measureValue) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*v = measureValue(math.NaN())
+		return nil
+	}
+	return json.Unmarshal(data, (*float64)(v))
+}
+
+func (b *getMeasureBody) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return json.Unmarshal(data, (*[]measureGroup)(b))
+	}
+	var samples map[string][]measureValue
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return err
+	}
+	groups := make([]measureGroup, 0, len(samples))
+	for ts, values := range samples {
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return fmt.Errorf("measure timestamp %q: %w", ts, err)
+		}
+		groups = append(groups, measureGroup{Time: unixTime{time.Unix(sec, 0)}, Value: [][]measureValue{values}})
+	}
+	slices.SortFunc(groups, func(a, b measureGroup) int { return a.Time.Compare(b.Time.Time) })
+	*b = groups
+	return nil
 }
 
-type getMeasureBody []struct {
-	Time  unixTime    `json:"beg_time"`
-	Step  int         `json:"step_time"`
-	Value [][]float64 `json:"value"`
+// appendPoints appends the samples in the groups to points, and returns the time a step after the last sample.
+// The points' Values reuse values, and have width values each (or as many as their sample, if width is zero):
+// malformed is how many samples had another number, padded with NaN or truncated.
+func (b getMeasureBody) appendPoints(points []DataPoint, values []float64, width int) (
+	_ []DataPoint, _ []float64, end time.Time, malformed int,
+) {
+	n := 0
+	for _, group := range b {
+		for _, sample := range group.Value {
+			if width > 0 {
+				n += width
+			} else {
+				n += len(sample)
+			}
+		}
+	}
+	values = slices.Grow(values[:0], n)
+	for _, group := range b {
+		end = group.Time.Time
+		for _, sample := range group.Value {
+			w := width
+			if w == 0 {
+				w = len(sample)
+			} else if len(sample) != w {
+				malformed++
+			}
+			start := len(values)
+			for i := range w {
+				v := math.NaN()
+				if i < len(sample) {
+					v = float64(sample[i])
+				}
+				values = append(values, v)
+			}
+			points = append(points, DataPoint{end, values[start:len(values):len(values)]})
+			end = end.Add(time.Duration(group.Step) * time.Second)
+		}
+	}
+	return points, values, end, malformed
+}
+
+// measureDecoder decodes getmeasure pages, reusing its buffers from one page to the next.
+type measureDecoder struct {
+	r      genericResponse
+	body   getMeasureBody
+	points []DataPoint
+	values []float64
+}
+
+// DecodeMeasure decodes a getmeasure response body with its HTTP status, e.g. one archived by Hooks.OnResponse,
+// into points with Values in the order of the request's data types.
+func DecodeMeasure(status int, data []byte) ([]DataPoint, error) {
+	var d measureDecoder
+	points, _, _, err := d.decode(status, data, 0)
+	return points, err
+}
+
+// decode decodes a response like decodeResponse, and returns its points, with width values each (see
+// appendPoints), the time a step after the last, and how many were malformed. They are only valid until the next call.
+func (d *measureDecoder) decode(status int, data []byte, width int) ([]DataPoint, time.Time, int, error) {
+	// The groups are decoded over the previous ones, which would keep the fields missing from the new ones.
+	all := d.body[:cap(d.body)]
+	for i := range all {
+		all[i] = measureGroup{}
+	}
+	if err := decodeResponseInto(status, data, &d.r, &d.body); err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	var (
+		end       time.Time
+		malformed int
+	)
+	d.points, d.values, end, malformed = d.body.appendPoints(d.points[:0], d.values, width)
+	return d.points, end, malformed, nil
 }
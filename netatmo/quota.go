@@ -0,0 +1,142 @@
+package netatmo
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HourlyLimit is the number of API calls Netatmo allows per user and hour.
+//
+// https://dev.netatmo.com/guideline#rate-limits
+const HourlyLimit = 500
+
+// Quota is the client's estimate of the hourly API calls it has left.
+//
+// Netatmo doesn't document rate limit headers, so unless a response has X-RateLimit-Limit, X-RateLimit-Remaining,
+// and X-RateLimit-Reset (as some proxies add), the estimate only counts this client's own calls in the last hour.
+// Other clients of the same account use up the quota too; a rate limited response sets Remaining to zero.
+type Quota struct {
+	Limit       int       // Calls allowed per hour.
+	Remaining   int       // Calls left before the limit.
+	Reset       time.Time // When more calls are allowed, if Remaining is low. Zero if unknown.
+	RateLimited int64     // Rate limited responses so far.
+}
+
+// quotaSlowdown is the fraction of the quota left below which the client spreads out the remaining calls until
+// the reset, instead of running into the limit.
+const quotaSlowdown = 0.1
+
+// quotaTracker estimates the Quota from the calls made and the responses to them.
+type quotaTracker struct {
+	mu          sync.Mutex
+	calls       []time.Time // In the last hour, oldest first.
+	limit       int
+	remaining   int       // From the headers or a rate limited response, if reported is not zero.
+	reset       time.Time // From the headers or a rate limited response.
+	reported    time.Time // When remaining and reset were reported.
+	rateLimited int64
+}
+
+// record records a call made at t, with the response's headers, and whether it was rate limited.
+// The quota is taken from X-RateLimit-* headers if present, and Retry-After for a rate limited call.
+func (q *quotaTracker) record(t time.Time, h http.Header, limited bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.calls = append(q.calls, t)
+	if limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil && limit > 0 {
+		q.limit = limit
+	}
+	switch remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); {
+	case limited:
+		q.rateLimited++
+		q.remaining, q.reported, q.reset = 0, t, time.Time{}
+		if after, err := strconv.ParseInt(h.Get("Retry-After"), 10, 64); err == nil {
+			q.reset = t.Add(time.Duration(after) * time.Second)
+		}
+	case err == nil:
+		q.remaining, q.reported, q.reset = max(remaining, 0), t, time.Time{}
+	case q.remaining == 0:
+		q.reported = time.Time{} // The call went through, so the quota is no longer exhausted.
+		return
+	default:
+		return
+	}
+	if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil && q.reset.IsZero() {
+		q.reset = resetTime(t, reset)
+	}
+}
+
+// resetTime interprets a reset header value as either Unix seconds or seconds after t.
+func resetTime(t time.Time, v int64) time.Time {
+	if v >= 1e9 {
+		return time.Unix(v, 0)
+	}
+	return t.Add(time.Duration(v) * time.Second)
+}
+
+// quota returns the estimate at now.
+func (q *quotaTracker) quota(now time.Time) Quota {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	hourAgo := now.Add(-time.Hour)
+	i := 0
+	for i < len(q.calls) && !q.calls[i].After(hourAgo) {
+		i++
+	}
+	q.calls = q.calls[i:]
+
+	limit := HourlyLimit
+	if q.limit > 0 {
+		limit = q.limit
+	}
+	quota := Quota{Limit: limit, Remaining: max(limit-len(q.calls), 0), RateLimited: q.rateLimited}
+	if len(q.calls) > 0 && quota.Remaining < limit {
+		quota.Reset = q.calls[0].Add(time.Hour) // When the oldest call leaves the window.
+	}
+	if !q.reported.IsZero() && (q.reset.IsZero() || now.Before(q.reset)) && now.Sub(q.reported) < time.Hour {
+		// The calls since the report count against what was left then.
+		reported := q.remaining
+		for _, t := range q.calls {
+			if t.After(q.reported) {
+				reported--
+			}
+		}
+		quota.Remaining = max(min(quota.Remaining, reported), 0)
+		if !q.reset.IsZero() {
+			quota.Reset = q.reset
+		}
+	}
+	return quota
+}
+
+// delay returns how long to wait before the next call at now, to spread out the calls left once the quota is low.
+// It doesn't wait out an exhausted quota: the call fails with ErrRateLimited, as it would have.
+func (q *quotaTracker) delay(now time.Time) time.Duration {
+	quota := q.quota(now)
+	if quota.Remaining == 0 || quota.Reset.IsZero() || float64(quota.Remaining) >= quotaSlowdown*float64(quota.Limit) {
+		return 0
+	}
+	return quota.Reset.Sub(now) / time.Duration(quota.Remaining)
+}
+
+// Quota returns the estimate of the API calls left this hour.
+func (c *Client) Quota() Quota { return c.quota.quota(time.Now()) }
+
+// waitQuota slows down calls once the quota is low; see quotaTracker.delay.
+func (c *Client) waitQuota(ctx context.Context) error {
+	d := c.quota.delay(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
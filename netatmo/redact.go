@@ -0,0 +1,71 @@
+package netatmo
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+)
+
+// Redacted replaces the credentials in the output of RedactURL, RedactBody, and DumpResponse.
+const Redacted = "REDACTED"
+
+// secretParams are the query parameters and JSON fields that hold credentials.
+var secretParams = []string{"access_token", "refresh_token", "client_secret", "code", "password"}
+
+// secretFields matches the string values of the secretParams in a JSON body.
+var secretFields = regexp.MustCompile(`"(access_token|refresh_token|client_secret|code|password)"\s*:\s*"[^"]*"`)
+
+// secretHeaders are the headers that hold credentials.
+var secretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// RedactURL returns u as a string with its password and the values of any credential query parameters
+// (access_token, refresh_token, client_secret, code, password) replaced by Redacted, for logs.
+func RedactURL(u *url.URL) string {
+	r := *u
+	if _, ok := r.User.Password(); ok {
+		r.User = url.UserPassword(r.User.Username(), Redacted)
+	}
+	q := r.Query()
+	redacted := false
+	for _, p := range secretParams {
+		if q.Has(p) {
+			q.Set(p, Redacted)
+			redacted = true
+		}
+	}
+	if redacted {
+		r.RawQuery = q.Encode()
+	}
+	return r.String()
+}
+
+// RedactBody returns a copy of a JSON body with the string values of any credential fields, as in RedactURL,
+// replaced by Redacted.
+func RedactBody(body []byte) []byte {
+	return secretFields.ReplaceAll(body, []byte(`"$1":"`+Redacted+`"`))
+}
+
+// DumpResponse is httputil.DumpResponse with the credentials in the headers (Authorization, cookies) and,
+// if body is set, in the body redacted, so debug logs of it are safe to share.
+func DumpResponse(resp *http.Response, body bool) ([]byte, error) {
+	r := *resp
+	r.Header = redactHeader(resp.Header)
+	dump, err := httputil.DumpResponse(&r, body)
+	resp.Body = r.Body // DumpResponse replaces the body it reads with a copy.
+	if err != nil {
+		return nil, err
+	}
+	return RedactBody(dump), nil
+}
+
+// redactHeader returns a copy of h with the values of the secretHeaders replaced by Redacted.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range secretHeaders {
+		if h.Get(k) != "" {
+			h.Set(k, Redacted)
+		}
+	}
+	return h
+}
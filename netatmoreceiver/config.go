@@ -0,0 +1,140 @@
+package netatmoreceiver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Config is the receiver's configuration.
+type Config struct {
+	// CredentialsFile is netatmo-otel's config.json, which every netatmo-otel run keeps up to date: the Netatmo
+	// app's client ID and secret, and the OAuth token, which the receiver refreshes and saves back to it.
+	CredentialsFile string `mapstructure:"credentials_file"`
+	// CollectionInterval is how often to fetch the new data. Netatmo stores it every 5 to 10 minutes.
+	CollectionInterval time.Duration `mapstructure:"collection_interval"`
+	// CursorsFile is where the receiver keeps where each module is exported through, so it resumes there after a
+	// restart. Defaults to netatmoreceiver-cursors.json next to CredentialsFile.
+	CursorsFile string `mapstructure:"cursors_file"`
+	// InitialLookback is how far back to start a module without a cursor, such as on the first start.
+	InitialLookback time.Duration `mapstructure:"initial_lookback"`
+	// Endpoint is the Netatmo API.
+	Endpoint string `mapstructure:"endpoint"`
+}
+
+// Validate checks the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.CredentialsFile == "" {
+		errs = append(errs, errors.New("credentials_file: must be set to netatmo-otel's config.json"))
+	}
+	if c.CollectionInterval < time.Minute {
+		errs = append(errs, fmt.Errorf("collection_interval: %v is less than a minute", c.CollectionInterval))
+	}
+	if c.InitialLookback < 0 {
+		errs = append(errs, fmt.Errorf("initial_lookback: %v is negative", c.InitialLookback))
+	}
+	if u, err := url.Parse(c.Endpoint); err != nil || u.Host == "" {
+		errs = append(errs, fmt.Errorf("endpoint: not a URL: %q", c.Endpoint))
+	}
+	return errors.Join(errs...)
+}
+
+// cursorsFile returns CursorsFile, or its default.
+func (c *Config) cursorsFile() string {
+	if c.CursorsFile != "" {
+		return c.CursorsFile
+	}
+	return filepath.Join(filepath.Dir(c.CredentialsFile), "netatmoreceiver-cursors.json")
+}
+
+// credentials is the part of netatmo-otel's config.json that the receiver uses.
+type credentials struct {
+	Token        oauth2.Token `json:"token,omitempty"`
+	ClientID     string       `json:"client_id,omitempty"`
+	ClientSecret string       `json:"client_secret,omitempty"`
+}
+
+// loadCredentials reads the credentials file at path.
+func loadCredentials(path string) (credentials, error) {
+	var c credentials
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.ClientID == "" || c.ClientSecret == "" || c.Token.RefreshToken == "" {
+		return c, fmt.Errorf("%s: no client_id, client_secret, or token", path)
+	}
+	return c, nil
+}
+
+// saveToken writes a refreshed token to the credentials file at path, keeping its other fields (netatmo-otel's
+// own included).
+func saveToken(path string, token *oauth2.Token) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if fields["token"], err = json.Marshal(token); err != nil {
+		return err
+	}
+	if data, err = json.MarshalIndent(fields, "", "  "); err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// loadCursors reads the cursors file at path, by export.DevID; there are none if it doesn't exist.
+func loadCursors(path string) (map[string]time.Time, error) {
+	cursors := map[string]time.Time{}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cursors, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cursors, nil
+}
+
+// saveCursors writes the cursors file at path.
+func saveCursors(path string, cursors map[string]time.Time) error {
+	data, err := json.MarshalIndent(cursors, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces the file at path with data at once, so a crash can't leave it half written.
+func writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,43 @@
+// Package netatmoreceiver is an OpenTelemetry Collector receiver for Netatmo weather stations. It discovers the
+// account's stations and modules, and exports their new measurements on every collection_interval, with the same
+// metric names, units, and attributes as netatmo-otel, for a collector to process and send on without a separate
+// exporter binary.
+//
+// It authenticates with netatmo-otel's config.json, as written by netatmo-otel init, and keeps its cursors in a
+// file next to it: it exports the last initial_lookback of a new module's data, and after that only what's new,
+// across restarts.
+package netatmoreceiver
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/receiver"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// typ is the receiver's type in the collector's config.
+var typ = component.MustNewType("netatmo")
+
+// NewFactory returns the receiver's factory, for a collector build to include.
+func NewFactory() receiver.Factory {
+	return receiver.NewFactory(typ, createDefaultConfig,
+		receiver.WithMetrics(createMetrics, component.StabilityLevelAlpha))
+}
+
+func createDefaultConfig() component.Config {
+	return &Config{
+		CollectionInterval: 10 * time.Minute,
+		InitialLookback:    3 * time.Hour,
+		Endpoint:           netatmo.DefaultBaseURL,
+	}
+}
+
+func createMetrics(
+	_ context.Context, set receiver.Settings, cfg component.Config, next consumer.Metrics,
+) (receiver.Metrics, error) {
+	return newReceiver(cfg.(*Config), set.Logger, next), nil
+}
@@ -0,0 +1,232 @@
+package netatmoreceiver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// scopeName is the instrumentation scope of the receiver's metrics.
+const scopeName = "sgrankin.dev/netatmo-otel/netatmoreceiver"
+
+// netatmoReceiver collects the stations' new data on every interval, and passes it on to next.
+type netatmoReceiver struct {
+	cfg    *Config
+	logger *zap.Logger
+	next   consumer.Metrics
+	// newClient returns the Netatmo client, from the credentials file unless a test substitutes a fake.
+	newClient func(ctx context.Context) (netatmo.StationsAndMeasures, error)
+	now       func() time.Time
+
+	// cursors are where to resume each module from, by export.DevID, as saved in the cursors file after each
+	// collection. Only the collecting goroutine uses them.
+	cursors map[string]time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newReceiver(cfg *Config, logger *zap.Logger, next consumer.Metrics) *netatmoReceiver {
+	r := &netatmoReceiver{cfg: cfg, logger: logger, next: next, now: time.Now, cursors: map[string]time.Time{}}
+	r.newClient = r.credentialsClient
+	return r
+}
+
+// credentialsClient returns a client with the credentials file's app and token, saving refreshed tokens back.
+func (r *netatmoReceiver) credentialsClient(ctx context.Context) (netatmo.StationsAndMeasures, error) {
+	c, err := loadCredentials(r.cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return netatmo.NewClientAt(ctx, r.cfg.Endpoint, c.ClientID, c.ClientSecret, c.Token,
+		func(t *oauth2.Token, err error) error {
+			if err != nil {
+				return err
+			}
+			return saveToken(r.cfg.CredentialsFile, t)
+		}), nil
+}
+
+// Start implements component.Component: it starts collecting in the background.
+func (r *netatmoReceiver) Start(_ context.Context, _ component.Host) error {
+	cursors, err := loadCursors(r.cfg.cursorsFile())
+	if err != nil {
+		return err
+	}
+	r.cursors = cursors
+	// The context of Start ends with it; the collection runs until Shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := r.newClient(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	r.cancel, r.done = cancel, make(chan struct{})
+	go func() {
+		defer close(r.done)
+		t := time.NewTicker(r.cfg.CollectionInterval)
+		defer t.Stop()
+		for {
+			r.collect(ctx, client)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Shutdown implements component.Component: it stops collecting, and waits for a collection under way to stop.
+func (r *netatmoReceiver) Shutdown(ctx context.Context) error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// collect discovers the stations, and exports each device's and module's data since its cursor, saving the
+// cursors after. A module that fails is logged and retried from the same cursor on the next collection.
+func (r *netatmoReceiver) collect(ctx context.Context, client netatmo.StationsAndMeasures) {
+	saved := false
+	defer func() {
+		if !saved {
+			return
+		}
+		if err := saveCursors(r.cfg.cursorsFile(), r.cursors); err != nil {
+			r.logger.Error("saving the cursors", zap.Error(err))
+		}
+	}()
+	stations, err := client.GetStations(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			r.logger.Error("getting the stations", zap.Error(err))
+		}
+		return
+	}
+	var modules []export.Module
+	for _, dev := range stations {
+		modules = append(modules, export.Module{
+			Device: dev.ID, DataTypes: dev.DataTypes, Labels: export.StationLabels(dev)})
+		for _, mod := range dev.Modules {
+			modules = append(modules, export.Module{
+				Device: dev.ID, Module: mod.ID, DataTypes: mod.DataTypes, Labels: export.ModuleLabels(dev, mod)})
+		}
+	}
+
+	sink := newPdataSink(ctx, r.next)
+	e := &export.Exporter{
+		Client: client,
+		Sink:   sink,
+		Now:    r.now,
+		Saved: func(m export.Module, t time.Time) {
+			r.cursors[export.DevID(m.Device, m.Module)] = t.Add(time.Second)
+			saved = true
+		},
+	}
+	for _, m := range modules {
+		if len(m.DataTypes) == 0 {
+			continue
+		}
+		since, ok := r.cursors[export.DevID(m.Device, m.Module)]
+		if !ok {
+			since = r.now().Add(-r.cfg.InitialLookback)
+		}
+		if err := e.Export(ctx, m, since, nil); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Warn("exporting module", zap.String("device", string(m.Device)),
+				zap.String("module", string(m.Module)), zap.Error(err))
+			if errors.Is(err, netatmo.ErrUnauthorized) || errors.Is(err, netatmo.ErrBudgetExhausted) {
+				return // The other modules would fail the same way.
+			}
+		}
+	}
+}
+
+// pdataSink is an export.Sink that converts the families to pdata, and passes them on to the next consumer at
+// each checkpoint, that is, once per page of a module's data.
+type pdataSink struct {
+	ctx     context.Context
+	next    consumer.Metrics
+	metrics pmetric.Metrics
+	points  int
+}
+
+func newPdataSink(ctx context.Context, next consumer.Metrics) *pdataSink {
+	return &pdataSink{ctx: ctx, next: next, metrics: pmetric.NewMetrics()}
+}
+
+// Encode implements export.Sink.
+func (s *pdataSink) Encode(mf *dto.MetricFamily) error {
+	rms := s.metrics.ResourceMetrics()
+	if rms.Len() == 0 {
+		rms.AppendEmpty().ScopeMetrics().AppendEmpty().Scope().SetName(scopeName)
+	}
+	s.points += appendFamily(rms.At(0).ScopeMetrics().At(0).Metrics(), mf)
+	return nil
+}
+
+// Checkpoint implements export.Checkpointer: it passes on the metrics encoded so far, and runs fn once the next
+// consumer has accepted them.
+func (s *pdataSink) Checkpoint(fn func()) error {
+	if s.points > 0 {
+		md := s.metrics
+		s.metrics, s.points = pmetric.NewMetrics(), 0
+		if err := s.next.ConsumeMetrics(s.ctx, md); err != nil {
+			return err
+		}
+	}
+	fn()
+	return nil
+}
+
+// appendFamily appends mf to metrics, as a gauge, or a cumulative sum for a counter, and returns its number of
+// points. Each point's labels become its attributes.
+func appendFamily(metrics pmetric.MetricSlice, mf *dto.MetricFamily) int {
+	m := metrics.AppendEmpty()
+	m.SetName(mf.GetName())
+	m.SetDescription(mf.GetHelp())
+	m.SetUnit(mf.GetUnit())
+	var points pmetric.NumberDataPointSlice
+	if mf.GetType() == dto.MetricType_COUNTER {
+		sum := m.SetEmptySum()
+		sum.SetIsMonotonic(true)
+		sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+		points = sum.DataPoints()
+	} else {
+		points = m.SetEmptyGauge().DataPoints()
+	}
+	for _, metric := range mf.Metric {
+		p := points.AppendEmpty()
+		p.SetTimestamp(pcommon.NewTimestampFromTime(time.UnixMilli(metric.GetTimestampMs())))
+		if metric.Counter != nil {
+			p.SetDoubleValue(metric.GetCounter().GetValue())
+		} else {
+			p.SetDoubleValue(metric.GetGauge().GetValue())
+		}
+		for _, l := range metric.Label {
+			p.Attributes().PutStr(l.GetName(), l.GetValue())
+		}
+	}
+	return len(mf.Metric)
+}
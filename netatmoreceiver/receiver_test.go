@@ -0,0 +1,177 @@
+package netatmoreceiver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+	"sgrankin.dev/netatmo-otel/netatmo/netatmotest"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// points returns the number of points of each metric in the batches, by name.
+func points(batches []pmetric.Metrics) map[string]int {
+	n := map[string]int{}
+	for _, md := range batches {
+		rms := md.ResourceMetrics()
+		for i := range rms.Len() {
+			sms := rms.At(i).ScopeMetrics()
+			for j := range sms.Len() {
+				ms := sms.At(j).Metrics()
+				for k := range ms.Len() {
+					n[ms.At(k).Name()] += ms.At(k).Gauge().DataPoints().Len()
+				}
+			}
+		}
+	}
+	return n
+}
+
+func newFake() *netatmotest.Fake {
+	fake := netatmotest.NewFake(netatmo.Station{
+		ID:        "70:ee:50:00:00:01",
+		HomeName:  "Home",
+		DataTypes: []netatmo.DataType{netatmo.DataCO2},
+		Modules: []netatmo.Module{{
+			ID: "02:00:00:00:00:01", Name: "Garden", DataTypes: []netatmo.DataType{netatmo.DataTemperature}}},
+	})
+	fake.Since, fake.Until, fake.PageSize = t0, t0.Add(2*time.Hour), 10
+	return fake
+}
+
+func newTestConfig(t *testing.T) *Config {
+	cfg := createDefaultConfig().(*Config)
+	cfg.CredentialsFile = filepath.Join(t.TempDir(), "config.json")
+	cfg.InitialLookback = time.Hour
+	return cfg
+}
+
+func TestCollect(t *testing.T) {
+	fake := newFake()
+	now := t0.Add(2 * time.Hour)
+
+	sink := &consumertest.MetricsSink{}
+	r := newReceiver(newTestConfig(t), zap.NewNop(), sink)
+	r.now = func() time.Time { return now }
+
+	r.collect(context.Background(), fake)
+	// The last hour, 01:00 through 02:00 in steps of 5 minutes, of each.
+	got := points(sink.AllMetrics())
+	if got["netatmo_co2"] != 13 || got["netatmo_temperature"] != 13 {
+		t.Errorf("points = %v, want 13 of each", got)
+	}
+	if len(sink.AllMetrics()) != 4 {
+		t.Errorf("got %d batches, want one per page: 4", len(sink.AllMetrics()))
+	}
+	attrs := sink.AllMetrics()[2].ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).
+		Gauge().DataPoints().At(0).Attributes()
+	if v, _ := attrs.Get("module_name"); v.Str() != "Garden" {
+		t.Errorf("attributes = %v", attrs.AsRaw())
+	}
+
+	// The next collection only exports what's new.
+	sink.Reset()
+	fake.Until, now = t0.Add(2*time.Hour+10*time.Minute), t0.Add(2*time.Hour+10*time.Minute)
+	r.collect(context.Background(), fake)
+	if got := points(sink.AllMetrics()); got["netatmo_co2"] != 2 || got["netatmo_temperature"] != 2 {
+		t.Errorf("second collection's points = %v, want 2 of each", got)
+	}
+}
+
+// TestCursorsFile checks that a restarted receiver resumes from the saved cursors, and that a page the next
+// consumer refuses isn't saved.
+func TestCursorsFile(t *testing.T) {
+	fake := newFake()
+	cfg := newTestConfig(t)
+	now := t0.Add(2 * time.Hour)
+	r := newReceiver(cfg, zap.NewNop(), &consumertest.MetricsSink{})
+	r.now = func() time.Time { return now }
+	r.collect(context.Background(), fake)
+	saved, err := loadCursors(cfg.cursorsFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || !saved["02:00:00:00:00:01"].Equal(now.Add(time.Second)) {
+		t.Fatalf("saved cursors = %v", saved)
+	}
+
+	// Restarted, with a consumer that refuses the data.
+	fake.Until, now = now.Add(10*time.Minute), now.Add(10*time.Minute)
+	r = newReceiver(cfg, zap.NewNop(), consumertest.NewErr(errors.New("refused")))
+	r.now = func() time.Time { return now }
+	if r.cursors, err = loadCursors(cfg.cursorsFile()); err != nil {
+		t.Fatal(err)
+	}
+	r.collect(context.Background(), fake)
+	if got, _ := loadCursors(cfg.cursorsFile()); !maps.EqualFunc(got, saved, time.Time.Equal) {
+		t.Errorf("cursors after a refused collection = %v, want %v", got, saved)
+	}
+
+	sink := &consumertest.MetricsSink{}
+	r = newReceiver(cfg, zap.NewNop(), sink)
+	r.now = func() time.Time { return now }
+	if r.cursors, err = loadCursors(cfg.cursorsFile()); err != nil {
+		t.Fatal(err)
+	}
+	r.collect(context.Background(), fake)
+	if got := points(sink.AllMetrics()); got["netatmo_co2"] != 2 || got["netatmo_temperature"] != 2 {
+		t.Errorf("points after the restart = %v, want the 2 new ones of each", got)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	if err := cfg.Validate(); err == nil {
+		t.Error("the default config, without credentials_file, is valid")
+	}
+	cfg.CredentialsFile = "config.json"
+	if err := cfg.Validate(); err != nil {
+		t.Error(err)
+	}
+	cfg.CollectionInterval = time.Second
+	if err := cfg.Validate(); err == nil {
+		t.Error("a collection_interval of a second is valid")
+	}
+}
+
+func TestSaveToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"token":{"access_token":"a","refresh_token":"r"},"client_id":"id","client_secret":"secret","other":1}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ClientID != "id" || c.Token.RefreshToken != "r" {
+		t.Errorf("credentials = %+v", c)
+	}
+
+	if err := saveToken(path, &oauth2.Token{AccessToken: "a2", RefreshToken: "r2"}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = loadCredentials(path); err != nil {
+		t.Fatal(err)
+	}
+	if c.ClientSecret != "secret" || c.Token.RefreshToken != "r2" {
+		t.Errorf("credentials after save = %+v", c)
+	}
+	var fields map[string]any
+	b, _ := os.ReadFile(path)
+	if err := json.Unmarshal(b, &fields); err != nil || fields["other"] != 1.0 {
+		t.Errorf("the other fields weren't kept: %s", b)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tailscale.com/jsondb"
+)
+
+var (
+	healthcheckURL = flag.String("healthcheck-url", "",
+		"Ping this URL after each run, as for healthchecks.io: the URL itself on success, and URL/fail with the error on failure.")
+	notifyWebhook = flag.String("notify-webhook", "",
+		"POST a Slack-compatible JSON message to this URL when runs keep failing, and again when they recover.")
+	notifyAfter = flag.Int("notify-after", 3,
+		"Number of consecutive failed runs before posting to -notify-webhook.")
+)
+
+// notifyState is kept in notify.json in the config dir, so consecutive failures are counted across cron runs.
+type notifyState struct {
+	Failures int  `json:"failures,omitempty"`
+	Notified bool `json:"notified,omitempty"`
+}
+
+// notifyRun reports the outcome of a run to the configured hooks. Failures to notify are logged, not returned.
+func notifyRun(err error) {
+	if *healthcheckURL == "" && *notifyWebhook == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if *healthcheckURL != "" {
+		u, body := *healthcheckURL, ""
+		if err != nil {
+			u, body = strings.TrimSuffix(u, "/")+"/fail", err.Error()
+		}
+		if err := post(ctx, u, "text/plain", []byte(body)); err != nil {
+			slog.Error("pinging healthcheck", "err", err)
+		}
+	}
+
+	if *notifyWebhook == "" {
+		return
+	}
+	dir, derr := configDir()
+	if derr != nil {
+		slog.Error("notify", "err", derr)
+		return
+	}
+	db, derr := jsondb.Open[notifyState](filepath.Join(dir, "notify.json"))
+	if derr != nil {
+		slog.Error("notify", "err", derr)
+		return
+	}
+	s := db.Data
+
+	var text string
+	switch {
+	case err != nil:
+		s.Failures++
+		if s.Failures >= *notifyAfter && !s.Notified {
+			text = fmt.Sprintf("netatmo-otel: %d consecutive runs failed. Last error: %v", s.Failures, err)
+			s.Notified = true
+		}
+	case s.Notified:
+		text = fmt.Sprintf("netatmo-otel: recovered after %d failed runs.", s.Failures)
+		*s = notifyState{}
+	default:
+		*s = notifyState{}
+	}
+	if text != "" {
+		msg, _ := json.Marshal(map[string]string{"text": text})
+		if err := post(ctx, *notifyWebhook, "application/json", msg); err != nil {
+			slog.Error("posting to webhook", "err", err)
+			s.Notified = false // Try again on the next run.
+		}
+	}
+	if err := db.Save(); err != nil {
+		slog.Error("notify", "err", err)
+	}
+}
+
+func post(ctx context.Context, url, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
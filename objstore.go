@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+var (
+	parquetURL = flag.String("parquet-url", "",
+		"Where -format=parquet archives to, and restore reads from: s3://bucket/prefix, gs://bucket/prefix, or file:///dir.")
+	parquetEndpoint = flag.String("parquet-endpoint", "",
+		"S3-compatible endpoint for an s3:// -parquet-url (e.g. http://minio:9000), instead of AWS.")
+)
+
+// objectStore is an object storage bucket under a prefix, for the Parquet archive.
+type objectStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// List returns the keys under prefix, recursively.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// openObjectStore returns the store for a -parquet-url, and the prefix of the archive in it.
+//
+// S3 and GCS (through its S3-compatible API, with HMAC keys) take credentials from AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY, ~/.aws/credentials, or the instance's IAM role.
+func openObjectStore(rawURL string) (objectStore, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		return dirStore(u.Path), "", nil
+	case "s3", "gs":
+		if u.Host == "" {
+			return nil, "", fmt.Errorf("%s: no bucket", rawURL)
+		}
+		endpoint, secure := "s3.amazonaws.com", true
+		if u.Scheme == "gs" {
+			endpoint = "storage.googleapis.com"
+		} else if *parquetEndpoint != "" {
+			e, err := url.Parse(*parquetEndpoint)
+			if err != nil || e.Host == "" {
+				return nil, "", fmt.Errorf("-parquet-endpoint: not a URL: %q", *parquetEndpoint)
+			}
+			endpoint, secure = e.Host, e.Scheme != "http"
+		}
+		creds := credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{}, &credentials.FileAWSCredentials{}, &credentials.IAM{},
+		})
+		client, err := minio.New(endpoint, &minio.Options{Creds: creds, Secure: secure})
+		if err != nil {
+			return nil, "", err
+		}
+		return &s3Store{client: client, bucket: u.Host}, prefix, nil
+	default:
+		return nil, "", fmt.Errorf("%s: want an s3://, gs://, or file:// URL", rawURL)
+	}
+}
+
+// s3Store is a bucket on S3 or an S3-compatible service.
+type s3Store struct {
+	client *minio.Client
+	bucket string
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/vnd.apache.parquet"})
+	return err
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		keys = append(keys, obj.Key)
+	}
+	return keys, nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+// dirStore is a local directory, with the keys as paths in it.
+type dirStore string
+
+func (d dirStore) Put(_ context.Context, key string, data []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Written to a temporary file first, so restore never reads a partial one.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d dirStore) List(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(string(d), func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == string(d) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if e.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (d dirStore) Get(_ context.Context, key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), filepath.FromSlash(key)))
+}
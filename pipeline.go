@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// pipeline is an export.Sink that uploads to -dest in stages connected by bounded queues:
+// the Netatmo fetchers calling Encode → the encoder → the uploader.
+// A slow destination then only stalls pagination once the queues are full, and vice versa.
+//
+// The upload is split into segments, one request each, of at most about chunkSize bytes of text (before
+// compression), or fewer at a Checkpoint once the segment is at least interval old. Each segment is encoded in
+// memory before it's queued, so a failed request can be retried, up to retries times. Checkpoints run once their
+// segment has been uploaded, or spooled: see deliver.
+//
+// Encode and Checkpoint are safe for concurrent use.
+type pipeline struct {
+	items     chan pipelineItem // Fetchers → encoder.
+	segments  chan *segment     // Encoder → uploader.
+	interval  time.Duration
+	chunkSize int
+	retries   int
+	points    *rate.Limiter // Paces the points uploaded, for -max-upload-rate; nil for no limit.
+
+	// The spool directory, if any, and the uploader's state of it.
+	spool   string
+	started time.Time
+	down    bool // The destination is unavailable; spool the rest.
+	spooled int
+
+	g   *errgroup.Group
+	ctx context.Context // Canceled once any stage fails.
+
+	encode, upload stageStats
+}
+
+// pipelineItem is a metric family to encode or a checkpoint to run.
+type pipelineItem struct {
+	mf   *dto.MetricFamily
+	mark func()
+}
+
+// segment is one upload request.
+type segment struct {
+	body   []byte   // Gzipped text format.
+	marks  []func() // Checkpoints to run once uploaded.
+	points int      // Samples in body; zero if unknown, as for spooled segments.
+}
+
+// uploadQueue is how many encoded segments wait for the uploader, bounding the memory they take.
+const uploadQueue = 2
+
+// stageStats is what a stage's input queue went through.
+type stageStats struct {
+	mu       sync.Mutex
+	maxDepth int
+	blocked  time.Duration // Time the previous stage spent waiting to enqueue.
+}
+
+func (s *stageStats) record(depth int, blocked time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxDepth = max(s.maxDepth, depth)
+	s.blocked += blocked
+}
+
+// newPipeline starts the encoder and uploader, with a queue of size buffer before the encoder, segments of at
+// most about chunkSize bytes or at least interval, and up to retries retries of each upload. Uploads that still
+// fail are spooled to spool, if not empty. The uploads wait on points, if not nil, for each point they carry.
+func newPipeline(ctx context.Context, u *url.URL, buffer int, interval time.Duration, chunkSize, retries int,
+	spool string, points *rate.Limiter,
+) *pipeline {
+	g, ctx := errgroup.WithContext(ctx)
+	p := &pipeline{
+		items:     make(chan pipelineItem, buffer),
+		segments:  make(chan *segment, uploadQueue),
+		interval:  interval,
+		chunkSize: max(chunkSize, 1),
+		retries:   max(retries, 0),
+		points:    points,
+		spool:     spool,
+		started:   time.Now(),
+		g:         g,
+		ctx:       ctx,
+	}
+	g.Go(p.runEncoder)
+	g.Go(func() error {
+		if err := p.resendSpool(u); err != nil {
+			return err
+		}
+		for {
+			select {
+			case seg, ok := <-p.segments:
+				if !ok {
+					return nil
+				}
+				if err := p.deliver(u, seg); err != nil {
+					return err
+				}
+				for _, mark := range seg.marks {
+					mark()
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+	return p
+}
+
+func (p *pipeline) runEncoder() error {
+	var (
+		seg      *segment
+		segStart time.Time
+		buf      bytes.Buffer
+		text     countingWriter // The uncompressed size of seg.
+		gzw      *gzip.Writer
+		enc      expfmt.Encoder
+	)
+	finish := func() error {
+		if err := gzw.Close(); err != nil {
+			return err
+		}
+		seg.body = bytes.Clone(buf.Bytes())
+		depth, start := len(p.segments), time.Now()
+		select {
+		case p.segments <- seg:
+			p.upload.record(min(depth+1, cap(p.segments)), time.Since(start))
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		seg = nil
+		return nil
+	}
+	for {
+		var item pipelineItem
+		var ok bool
+		select {
+		case item, ok = <-p.items:
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		if !ok {
+			if seg != nil {
+				if err := finish(); err != nil {
+					return err
+				}
+			}
+			close(p.segments)
+			return nil
+		}
+
+		if seg == nil {
+			seg, segStart = &segment{}, time.Now()
+			buf.Reset()
+			gzw = gzip.NewWriter(&buf)
+			text = countingWriter{w: gzw}
+			enc = expfmt.NewEncoder(&text, expfmt.NewFormat(expfmt.TypeTextPlain))
+		}
+		if item.mf != nil {
+			if err := enc.Encode(item.mf); err != nil {
+				return err
+			}
+			seg.points += len(item.mf.Metric)
+		}
+		if item.mark != nil {
+			seg.marks = append(seg.marks, item.mark)
+		}
+		if text.n >= p.chunkSize || item.mark != nil && time.Since(segStart) >= p.interval {
+			if err := finish(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// uploadSegment posts seg, retrying transport errors, 408, 429, and 5xx responses with exponential backoff.
+func (p *pipeline) uploadSegment(u *url.URL, seg *segment) error {
+	if p.points != nil {
+		if err := waitN(p.ctx, p.points, seg.points); err != nil {
+			return fmt.Errorf("-max-upload-rate: %w", err)
+		}
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		retry, err := p.post(u, seg)
+		if err == nil {
+			return nil
+		}
+		if !retry || p.ctx.Err() != nil {
+			return fmt.Errorf("%w: upload: %w", errDestination, err)
+		}
+		if attempt >= p.retries {
+			return fmt.Errorf("%w: upload: %w: %w", errDestination, errUnavailable, err)
+		}
+		slog.Warn("upload failed; retrying", "attempt", attempt+1, "in", backoff, "bytes", len(seg.body), "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// post makes one upload request, and returns whether a failure is worth retrying.
+func (p *pipeline) post(u *url.URL, seg *segment) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(p.ctx, "POST", u.String(), bytes.NewReader(seg.body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := destClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		err := errors.New(resp.Status)
+		if body, _ := io.ReadAll(io.LimitReader(resp.Body, 512)); len(bytes.TrimSpace(body)) > 0 {
+			err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+		}
+		return resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode >= 500, err
+	}
+	if slog.Default().Enabled(p.ctx, slog.LevelDebug) {
+		dump, err := netatmo.DumpResponse(resp, true)
+		if err != nil {
+			return false, err
+		}
+		slog.Debug("upload response", "response", string(dump), "bytes", len(seg.body), "checkpoints", len(seg.marks))
+	}
+	return false, nil
+}
+
+// Encode queues mf for encoding, and fails if a later stage has failed.
+func (p *pipeline) Encode(mf *dto.MetricFamily) error {
+	return p.enqueue(pipelineItem{mf: mf})
+}
+
+// Checkpoint implements export.Checkpointer: fn runs in the uploader once its segment has been uploaded.
+func (p *pipeline) Checkpoint(fn func()) error {
+	return p.enqueue(pipelineItem{mark: fn})
+}
+
+func (p *pipeline) enqueue(item pipelineItem) error {
+	depth, start := len(p.items), time.Now()
+	select {
+	case p.items <- item:
+		p.encode.record(min(depth+1, cap(p.items)), time.Since(start))
+		return nil
+	case <-p.ctx.Done():
+		return context.Cause(p.ctx)
+	}
+}
+
+// Close flushes the queues and waits for the upload to complete. Encode must not be called after Close.
+func (p *pipeline) Close() error {
+	close(p.items)
+	slog.Info("waiting on upload to complete")
+	err := errors.Join(p.g.Wait(), p.spoolError())
+	for _, s := range p.stages() {
+		s.stats.mu.Lock()
+		slog.Debug("pipeline stage", "stage", s.name, "max_queue", s.stats.maxDepth, "blocked", s.stats.blocked)
+		s.stats.mu.Unlock()
+	}
+	return err
+}
+
+type pipelineStage struct {
+	name  string
+	stats *stageStats
+}
+
+func (p *pipeline) stages() []pipelineStage {
+	return []pipelineStage{{"encode", &p.encode}, {"upload", &p.upload}}
+}
+
+// metrics returns the per-stage queue metrics so far.
+func (p *pipeline) metrics() []*dto.MetricFamily {
+	now := ptr(time.Now().UnixMilli())
+	depth := &dto.MetricFamily{
+		Name: ptr("netatmo_export_pipeline_queue_max"),
+		Help: ptr("Most items waiting in the stage's input queue during the run."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	blocked := &dto.MetricFamily{
+		Name: ptr("netatmo_export_pipeline_blocked_seconds"),
+		Help: ptr("Time spent waiting for room in the stage's input queue during the run."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, s := range p.stages() {
+		s.stats.mu.Lock()
+		labels := export.LabelPairs(fileConfig.accountLabels(map[string]string{"stage": s.name}))
+		depth.Metric = append(depth.Metric, &dto.Metric{
+			Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: ptr(float64(s.stats.maxDepth))},
+		})
+		blocked.Metric = append(blocked.Metric, &dto.Metric{
+			Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: ptr(s.stats.blocked.Seconds())},
+		})
+		s.stats.mu.Unlock()
+	}
+	return []*dto.MetricFamily{depth, blocked}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n += n
+	return n, err
+}
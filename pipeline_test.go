@@ -0,0 +1,184 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeDest is an upload destination that answers the nth request (from 0) with the status of status, given the
+// metric names in its body, and records the names of the uploads it accepts.
+type fakeDest struct {
+	t      *testing.T
+	status func(n int, names []string) int
+
+	mu       sync.Mutex
+	requests int
+	accepted [][]string
+}
+
+var metricNameRE = regexp.MustCompile(`(?m)^(\w+)\{`)
+
+func (d *fakeDest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		d.t.Errorf("upload body: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		d.t.Errorf("upload body: %v", err)
+	}
+	var names []string
+	for _, m := range metricNameRE.FindAllSubmatch(body, -1) {
+		names = append(names, string(m[1]))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := d.status(d.requests, names)
+	d.requests++
+	if status/100 == 2 {
+		d.accepted = append(d.accepted, names)
+	}
+	w.WriteHeader(status)
+}
+
+// startDest starts d as the destination of the pipelines, and returns its upload URL.
+func startDest(t *testing.T, d *fakeDest) *url.URL {
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+	saved := destClient
+	destClient = srv.Client()
+	t.Cleanup(func() { destClient = saved })
+	u, err := url.Parse(srv.URL + "/api/v1/import/prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func gauge(name string) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: ptr(name),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label:       []*dto.LabelPair{{Name: ptr("dev_id"), Value: ptr("70:ee:50:00:00:01")}},
+			TimestampMs: ptr(int64(1700000000000)),
+			Gauge:       &dto.Gauge{Value: ptr(20.5)},
+		}},
+	}
+}
+
+// TestPipelineRetry checks which failed uploads are retried, and that a checkpoint only runs once its upload
+// succeeded.
+func TestPipelineRetry(t *testing.T) {
+	tests := []struct {
+		statuses []int
+		wantErr  bool
+	}{
+		{[]int{http.StatusServiceUnavailable, http.StatusOK}, false},
+		{[]int{http.StatusTooManyRequests, http.StatusNoContent}, false},
+		{[]int{http.StatusBadRequest}, true},
+		{[]int{http.StatusInternalServerError, http.StatusBadGateway}, true}, // Out of retries.
+	}
+	for _, tt := range tests {
+		var checkpointed atomic.Bool
+		d := &fakeDest{t: t}
+		d.status = func(n int, _ []string) int {
+			if checkpointed.Load() {
+				t.Errorf("%v: checkpoint ran before the upload", tt.statuses)
+			}
+			return tt.statuses[min(n, len(tt.statuses)-1)]
+		}
+		p := newPipeline(context.Background(), startDest(t, d), 10, time.Hour, 1<<20, 1, "", nil)
+		if err := p.Encode(gauge("netatmo_temperature")); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Checkpoint(func() { checkpointed.Store(true) }); err != nil {
+			t.Fatal(err)
+		}
+		err := p.Close()
+		if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, errDestination) {
+			t.Errorf("%v: Close() = %v, want error %v", tt.statuses, err, tt.wantErr)
+		}
+		if d.requests != len(tt.statuses) {
+			t.Errorf("%v: %d requests, want %d", tt.statuses, d.requests, len(tt.statuses))
+		}
+		if checkpointed.Load() == tt.wantErr {
+			t.Errorf("%v: checkpointed = %v", tt.statuses, checkpointed.Load())
+		}
+	}
+}
+
+// TestPipelineSpool checks that a run spools its uploads once the destination is unavailable, running their
+// checkpoints, and that the next run resends them in order before its own, setting aside those rejected.
+func TestPipelineSpool(t *testing.T) {
+	spool := t.TempDir()
+	var up atomic.Bool
+	d := &fakeDest{t: t, status: func(_ int, names []string) int {
+		switch {
+		case slices.Contains(names, "netatmo_rejected"):
+			return http.StatusBadRequest
+		case up.Load():
+			return http.StatusOK
+		default:
+			return http.StatusServiceUnavailable
+		}
+	}}
+	u := startDest(t, d)
+
+	// One segment per family: with an interval of 0, each checkpoint ends one.
+	var checkpoints atomic.Int32
+	p := newPipeline(context.Background(), u, 10, 0, 1<<20, 0, spool, nil)
+	for _, name := range []string{"netatmo_a", "netatmo_rejected", "netatmo_b"} {
+		if err := p.Encode(gauge(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Checkpoint(func() { checkpoints.Add(1) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Close(); !errors.Is(err, errDestination) {
+		t.Errorf("Close() = %v, want the spooled uploads reported", err)
+	}
+	if checkpoints.Load() != 3 {
+		t.Errorf("%d checkpoints ran, want all 3 with their uploads spooled", checkpoints.Load())
+	}
+	if names, _ := filepath.Glob(filepath.Join(spool, "*.prom.gz")); len(names) != 3 {
+		t.Fatalf("spooled %v, want 3 requests", names)
+	}
+
+	up.Store(true)
+	p = newPipeline(context.Background(), u, 10, time.Hour, 1<<20, 0, spool, nil)
+	if err := p.Encode(gauge("netatmo_c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"netatmo_a"}, {"netatmo_b"}, {"netatmo_c"}}; !slices.EqualFunc(d.accepted, want, slices.Equal) {
+		t.Errorf("accepted %v, want %v", d.accepted, want)
+	}
+	entries, err := os.ReadDir(spool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || filepath.Ext(entries[0].Name()) != ".rejected" {
+		t.Errorf("spool has %v, want only the rejected request, renamed", entries)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// progress periodically logs how much of a module's time range has been exported, and an ETA for the rest.
+type progress struct {
+	name         string
+	since, until time.Time // If since is zero, the first exported point is used.
+
+	start      time.Time
+	lastLogged time.Time
+	next       time.Time
+	points     int
+	calls      int
+}
+
+func newProgress(name string, since, until time.Time) *progress {
+	now := time.Now()
+	return &progress{name: name, since: since, until: until, start: now, lastLogged: now, next: since}
+}
+
+// update records a page of points; nextTime is where the next page will start.
+func (p *progress) update(points []netatmo.DataPoint, nextTime time.Time) {
+	if p.since.IsZero() && len(points) > 0 {
+		p.since = points[0].Time
+	}
+	p.points += len(points)
+	p.calls++
+	p.next = nextTime
+	if *progressEvery > 0 && time.Since(p.lastLogged) >= *progressEvery {
+		p.log()
+	}
+}
+
+// done logs the final tally if the export ran long enough to have reported progress at all.
+func (p *progress) done() {
+	if *progressEvery > 0 && time.Since(p.start) >= *progressEvery {
+		p.next = p.until
+		p.log()
+	}
+}
+
+func (p *progress) log() {
+	p.lastLogged = time.Now()
+	total := p.until.Sub(p.since)
+	covered := min(max(p.next.Sub(p.since), 0), total)
+	if total <= 0 || covered <= 0 {
+		slog.Info("progress", "module_name", p.name, "points", p.points, "api_calls", p.calls)
+		return
+	}
+	frac := covered.Seconds() / total.Seconds()
+	elapsed := time.Since(p.start)
+	eta := time.Duration(float64(elapsed) * (1 - frac) / frac).Round(time.Second)
+	slog.Info("progress", "module_name", p.name,
+		"from", p.since.Format(time.RFC3339), "through", p.next.Format(time.RFC3339),
+		"percent", fmt.Sprintf("%.1f", 100*frac), "remaining", (total - covered).Round(time.Hour),
+		"points", p.points, "api_calls", p.calls, "eta", eta)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+)
+
+// runRestore exports the samples in a Parquet archive written by -format=parquet to the current -dest and
+// -format, without calling Netatmo.
+func runRestore(args []string) (err error) {
+	stdfs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := stdfs.String("from", "", "First month to restore, as 2006-01. Defaults to the oldest in the archive.")
+	to := stdfs.String("to", "", "Last month to restore, as 2006-01. Defaults to the newest in the archive.")
+	device := stdfs.String("device", "", "Only restore this dev_id (a station or module ID).")
+	fs := ff.NewFlagSetFrom("restore", stdfs)
+	err = ff.Parse(fs, args, ff.WithEnvVarPrefix("RESTORE"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		stdfs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	for _, m := range []string{*from, *to} {
+		if _, err := time.Parse("2006-01", m); m != "" && err != nil {
+			return fmt.Errorf("%w: restore: month %q is not like 2006-01", errConfig, m)
+		}
+	}
+	rawURL := *parquetURL
+	switch rest := fs.GetArgs(); len(rest) {
+	case 0:
+	case 1:
+		rawURL = rest[0]
+	default:
+		return fmt.Errorf("%w: restore: usage: restore [URL]", errConfig)
+	}
+	if rawURL == "" {
+		return fmt.Errorf("%w: restore: give the archive's URL, or -parquet-url", errConfig)
+	}
+	if *format == "parquet" {
+		return fmt.Errorf("%w: restore: -format=parquet would archive the archive again", errConfig)
+	}
+	store, prefix, err := openObjectStore(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: restore: %w", errConfig, err)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	ctx := context.Background()
+	keys, err := store.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("restore: listing %s: %w", rawURL, err)
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool {
+		month, dev, ok := parquetKeyPartition(strings.TrimPrefix(key, prefix))
+		return !ok || *from != "" && month < *from || *to != "" && month > *to ||
+			*device != "" && dev != strings.ReplaceAll(*device, ":", "-")
+	})
+	if len(keys) == 0 {
+		return fmt.Errorf("restore: no archive files in %s", rawURL)
+	}
+	slices.Sort(keys) // By month, then device, then run.
+
+	exporter, closeExporter, err := newExporter(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := closeExporter(); cerr != nil {
+			err = errors.Join(err, fmt.Errorf("upload: %w", cerr))
+		}
+	}()
+	for _, key := range keys {
+		data, err := store.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("restore: %s: %w", key, err)
+		}
+		families, err := export.ReadParquet(data)
+		if err != nil {
+			return fmt.Errorf("restore: %s: %w", key, err)
+		}
+		n := 0
+		for _, mf := range families {
+			if err := exporter.Encode(mf); err != nil {
+				return fmt.Errorf("%w: %w", errDestination, err)
+			}
+			n += len(mf.Metric)
+		}
+		slog.Info("restored", "file", key, "samples", n)
+	}
+	return nil
+}
+
+// parquetKeyPartition returns the month and device of an archive file's key, relative to the archive's prefix.
+func parquetKeyPartition(key string) (month, device string, ok bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], ".parquet") {
+		return "", "", false
+	}
+	month, ok1 := strings.CutPrefix(parts[0], "month=")
+	device, ok2 := strings.CutPrefix(parts[1], "device=")
+	return month, device, ok1 && ok2
+}
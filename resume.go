@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// resumeToken is where to resume a module's export from, as logged after each page and passed back via -resume.
+type resumeToken struct {
+	Version   int                `json:"v"`
+	Device    netatmo.DeviceID   `json:"d"`
+	Module    netatmo.ModuleID   `json:"m,omitempty"`
+	DataTypes []netatmo.DataType `json:"t"`
+	Scale     string             `json:"s"`
+	Cursor    int64              `json:"c"` // Unix seconds.
+}
+
+const (
+	resumeTokenVersion = 2
+	resumeTokenPrefix  = "v2."
+)
+
+// String encodes the token as "v2." followed by unpadded URL-safe base64 JSON.
+func (t resumeToken) String() string {
+	bs, _ := json.Marshal(t)
+	return resumeTokenPrefix + base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// parseResumeToken parses and validates a token from String,
+// or a version 1 "device/module/timestamp" token (which breaks if IDs contain '/').
+func parseResumeToken(s string) (resumeToken, error) {
+	if !strings.HasPrefix(s, resumeTokenPrefix) {
+		r := strings.Split(s, "/")
+		if len(r) != 3 {
+			return resumeToken{}, fmt.Errorf("resume token %q: not a v2 token, nor a device/module/timestamp one", s)
+		}
+		sec, err := strconv.ParseInt(r[2], 10, 64)
+		if err != nil {
+			return resumeToken{}, fmt.Errorf("resume token %q: %w", s, err)
+		}
+		return resumeToken{Version: 1, Device: netatmo.DeviceID(r[0]), Module: netatmo.ModuleID(r[1]), Cursor: sec}, nil
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, resumeTokenPrefix))
+	if err != nil {
+		return resumeToken{}, fmt.Errorf("resume token: %w", err)
+	}
+	var t resumeToken
+	if err := json.Unmarshal(bs, &t); err != nil {
+		return resumeToken{}, fmt.Errorf("resume token: %w", err)
+	}
+	var errs []error
+	if t.Version != resumeTokenVersion {
+		errs = append(errs, fmt.Errorf("version %d does not match its prefix", t.Version))
+	}
+	if t.Device == "" {
+		errs = append(errs, errors.New("no device"))
+	}
+	if len(t.DataTypes) == 0 {
+		errs = append(errs, errors.New("no data types"))
+	}
+	if t.Scale != netatmo.MaxScale {
+		errs = append(errs, fmt.Errorf("scale %q is not the %q used for exports", t.Scale, netatmo.MaxScale))
+	}
+	if t.Cursor <= 0 {
+		errs = append(errs, errors.New("no cursor"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return resumeToken{}, fmt.Errorf("resume token: %w", err)
+	}
+	return t, nil
+}
+
+// matches reports whether the token is for the module's dataTypes, and returns an error if it is for the module
+// but only some of the data types. (Disjoint data types are another group of the module, with its own interval.)
+// Version 1 tokens have no data types, and match any.
+func (t resumeToken) matches(device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType) (bool, error) {
+	if t.Device != device || t.Module != module {
+		return false, nil
+	}
+	if t.Version == 1 || slices.Equal(t.DataTypes, dataTypes) {
+		return true, nil
+	}
+	if !slices.ContainsFunc(t.DataTypes, func(dt netatmo.DataType) bool { return slices.Contains(dataTypes, dt) }) {
+		return false, nil
+	}
+	return false, fmt.Errorf("resume token is for data types %v, but the module now has %v", t.DataTypes, dataTypes)
+}
+
+func (t resumeToken) time() time.Time { return time.Unix(t.Cursor, 0) }
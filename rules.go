@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"gopkg.in/yaml.v3"
+)
+
+// ruleGroups is a Prometheus rules file, which vmalert reads too.
+type ruleGroups struct {
+	Groups []ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []rule `yaml:"rules"`
+}
+
+type rule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// runRules writes Prometheus alerting rules for the exported metrics: low batteries, high CO2, silent modules, and
+// an exporter that stopped succeeding.
+func runRules(args []string) error {
+	fs := flag.NewFlagSet("rules", flag.ContinueOnError)
+	out := fs.String("o", "-", "Write the rules to this file, or - for stdout.")
+	group := fs.String("group", "netatmo", "Name of the rule group.")
+	prefix := fs.String("metric-prefix", "netatmo_",
+		"Prefix of the metric names in the destination, if it renames them (e.g. with a relabeling proxy).")
+	nameLabel := fs.String("name-label", "module_name",
+		"Label with the module's name, for the alert summaries; e.g. one set by the config's label templates.")
+	severity := fs.String("severity", "warning", "Value of the severity label on the alerts.")
+	batteryBelow := fs.Int("battery-below", 20, "Alert when a module's battery is below this percentage. Set 0 to disable.")
+	co2Above := fs.Float64("co2-above", 1500, "Alert when CO2 stays above this many ppm for -co2-for. Set 0 to disable.")
+	co2For := fs.Duration("co2-for", 30*time.Minute, "How long CO2 must stay above -co2-above.")
+	silentFor := fs.Duration("silent-for", 3*time.Hour, "Alert when a module has sent no data for this long. Set 0 to disable.")
+	exporterFor := fs.Duration("exporter-stale-for", 2*time.Hour,
+		"Alert when a module hasn't been exported successfully for this long. Set 0 to disable.")
+	lookback := fs.Duration("lookback", 2*time.Hour,
+		"How far back to look for the module metrics written at discovery: more than the daemon's -rediscover, or the cron interval.")
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("RULES"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+
+	name := fmt.Sprintf("{{ $labels.%s }} ({{ $labels.dev_id }})", *nameLabel)
+	labels := map[string]string{"severity": *severity}
+	var rules []rule
+	if *batteryBelow > 0 {
+		rules = append(rules, rule{
+			Alert:       "NetatmoBatteryLow",
+			Expr:        fmt.Sprintf("last_over_time(%smodule_battery_percent[%s]) < %d", *prefix, promDuration(*lookback), *batteryBelow),
+			Labels:      labels,
+			Annotations: map[string]string{"summary": name + " battery is at {{ $value }}%."},
+		})
+	}
+	if *co2Above > 0 {
+		rules = append(rules, rule{
+			Alert:       "NetatmoCO2High",
+			Expr:        fmt.Sprintf("%sco2 > %g", *prefix, *co2Above),
+			For:         promDuration(*co2For),
+			Labels:      labels,
+			Annotations: map[string]string{"summary": name + " CO2 is at {{ $value }} ppm."},
+		})
+	}
+	if *silentFor > 0 {
+		rules = append(rules, rule{
+			Alert: "NetatmoModuleSilent",
+			Expr: fmt.Sprintf("time() - last_over_time(%smodule_last_seen_timestamp_seconds[%s]) > %g",
+				*prefix, promDuration(*lookback), silentFor.Seconds()),
+			Labels: labels,
+			Annotations: map[string]string{
+				"summary": name + " has sent no data for {{ $value | humanizeDuration }}; check its battery and range.",
+			},
+		})
+	}
+	if *exporterFor > 0 {
+		rules = append(rules, rule{
+			Alert: "NetatmoExportStale",
+			Expr: fmt.Sprintf("time() - last_over_time(%sexport_last_success_timestamp_seconds[7d]) > %g",
+				*prefix, exporterFor.Seconds()),
+			Labels: labels,
+			Annotations: map[string]string{
+				"summary": name + " hasn't been exported successfully for {{ $value | humanizeDuration }}; check the exporter's logs.",
+			},
+		}, rule{
+			Alert:       "NetatmoExporterAbsent",
+			Expr:        fmt.Sprintf("absent_over_time(%sexport_last_success_timestamp_seconds[%s])", *prefix, promDuration(*exporterFor)),
+			Labels:      labels,
+			Annotations: map[string]string{"summary": "No module has been exported successfully for " + promDuration(*exporterFor) + "."},
+		})
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("%w: rules: every rule is disabled", errConfig)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(ruleGroups{Groups: []ruleGroup{{Name: *group, Rules: rules}}}); err != nil {
+		return err
+	}
+	bs := buf.Bytes()
+	if *out == "-" {
+		_, err = os.Stdout.Write(bs)
+		return err
+	}
+	if err := os.WriteFile(*out, bs, 0o644); err != nil {
+		return err
+	}
+	slog.Info("wrote rules", "file", *out, "rules", len(rules))
+	return nil
+}
+
+// promDuration formats d for PromQL and rule files, e.g. 1h30m.
+func promDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d == 0 {
+		return "0s"
+	}
+	var s string
+	for _, u := range []struct {
+		d    time.Duration
+		unit string
+	}{{time.Hour, "h"}, {time.Minute, "m"}, {time.Second, "s"}} {
+		if n := d / u.d; n > 0 {
+			s += fmt.Sprintf("%d%s", n, u.unit)
+			d -= n * u.d
+		}
+	}
+	return s
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sinceValue is a flag.Value for a starting point given either as a duration before now or as an RFC3339 timestamp.
+type sinceValue struct {
+	ago time.Duration
+	at  time.Time
+}
+
+// sinceFlag defines a sinceValue flag with the given default duration.
+func sinceFlag(name string, ago time.Duration, usage string) *sinceValue {
+	v := &sinceValue{ago: ago}
+	flag.Var(v, name, usage)
+	return v
+}
+
+func (v *sinceValue) String() string {
+	if v == nil {
+		return ""
+	}
+	if !v.at.IsZero() {
+		return v.at.Format(time.RFC3339)
+	}
+	return v.ago.String()
+}
+
+func (v *sinceValue) Set(s string) error {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		*v = sinceValue{at: t}
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%q is neither a duration nor an RFC3339 timestamp", s)
+	}
+	*v = sinceValue{ago: d}
+	return nil
+}
+
+// UnmarshalText reads a since in a config file, as Set.
+func (v *sinceValue) UnmarshalText(text []byte) error {
+	return v.Set(string(text))
+}
+
+// Time returns the absolute starting point, or the zero time if the value is unset (0).
+func (v *sinceValue) Time() time.Time {
+	if !v.at.IsZero() {
+		return v.at
+	}
+	if v.ago == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-v.ago)
+}
+
+// Duration returns how long before now the starting point is.
+func (v *sinceValue) Duration() time.Duration {
+	if !v.at.IsZero() {
+		return time.Since(v.at).Round(time.Second)
+	}
+	return v.ago
+}
+
+// moduleSinceValue is a repeatable flag.Value of starting points for some modules, each given as
+// module=since, where module is an ID or name, and since is as for sinceValue.
+type moduleSinceValue map[string]*sinceValue
+
+// moduleSinceFlag defines a moduleSinceValue flag.
+func moduleSinceFlag(name, usage string) moduleSinceValue {
+	v := moduleSinceValue{}
+	flag.Var(v, name, usage)
+	return v
+}
+
+func (v moduleSinceValue) String() string {
+	var ss []string
+	for _, k := range slices.Sorted(maps.Keys(v)) {
+		ss = append(ss, k+"="+v[k].String())
+	}
+	return strings.Join(ss, ",")
+}
+
+func (v moduleSinceValue) Set(s string) error {
+	module, since, ok := strings.Cut(s, "=")
+	if !ok || module == "" {
+		return fmt.Errorf("%q is not module=since", s)
+	}
+	sv := &sinceValue{}
+	if err := sv.Set(since); err != nil {
+		return err
+	}
+	v[module] = sv
+	return nil
+}
+
+// moduleSince returns where to start exporting a module without a cursor: its -module-since or its since in the
+// config's modules, by ID or name, or else -since.
+func moduleSince(devID, name string) time.Time {
+	for _, k := range []string{devID, name} {
+		if v, ok := moduleSinces[k]; ok {
+			return v.Time()
+		}
+	}
+	if v := fileConfig.module(devID, name).Since; v != nil {
+		return v.Time()
+	}
+	return scrapeSince.Time()
+}
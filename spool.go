@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// errUnavailable marks an upload that still failed after its retries with a status worth retrying later.
+var errUnavailable = errors.New("still failing after retries")
+
+// deliver uploads seg or, once the destination has been found unavailable and there is a spool, spools it.
+func (p *pipeline) deliver(u *url.URL, seg *segment) error {
+	if !p.down {
+		err := p.uploadSegment(u, seg)
+		if err == nil || p.spool == "" || !errors.Is(err, errUnavailable) {
+			return err
+		}
+		slog.Error("destination unavailable; spooling the rest of the upload", "dir", p.spool, "err", err)
+		p.down = true
+	}
+	return p.spoolSegment(seg)
+}
+
+// spoolSegment writes seg's body to the spool, to be resent by the next run. Its checkpoints can then run:
+// the data is safe.
+func (p *pipeline) spoolSegment(seg *segment) error {
+	if err := os.MkdirAll(p.spool, 0o700); err != nil {
+		return err
+	}
+	// Named to sort in upload order, across runs.
+	name := filepath.Join(p.spool, fmt.Sprintf("%s-%06d.prom.gz", p.started.UTC().Format("20060102T150405.000Z"), p.spooled))
+	if err := os.WriteFile(name+".tmp", seg.body, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	p.spooled++
+	return nil
+}
+
+// resendSpool uploads the spooled requests of earlier runs, in order, deleting each once uploaded. If the
+// destination is still unavailable, it leaves the rest, and the run spools its own requests after them.
+func (p *pipeline) resendSpool(u *url.URL) error {
+	if p.spool == "" {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(p.spool, "*.prom.gz"))
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	slices.Sort(names)
+	slog.Info("resending spooled uploads", "dir", p.spool, "requests", len(names))
+	for _, name := range names {
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		err = p.uploadSegment(u, &segment{body: body})
+		if errors.Is(err, errUnavailable) {
+			slog.Error("destination unavailable; keeping the spooled uploads", "dir", p.spool, "err", err)
+			p.down = true
+			return nil
+		}
+		if err != nil && p.ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			// Rejected, so it would be forever: set it aside for a look, instead of failing every run.
+			slog.Error("destination rejected a spooled upload; renamed it to .rejected", "file", name, "err", err)
+			if err := os.Rename(name, name+".rejected"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// spoolError is the error for a run that spooled n requests instead of uploading them.
+func (p *pipeline) spoolError() error {
+	if p.spooled == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: spooled %d upload requests to %s, to resend on the next run", errDestination, p.spooled, p.spool)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+const (
+	// measureInterval is how often the modules record a sample.
+	measureInterval = 5 * time.Minute
+	// measurePageSize is the most samples getmeasure returns per call.
+	measurePageSize = 1024
+)
+
+// estimateCalls returns how many getmeasure calls exporting from since until now should take, and false if since
+// is zero (the module's whole history, of unknown length).
+func estimateCalls(since, now time.Time) (int, bool) {
+	if since.IsZero() {
+		return 0, false
+	}
+	samples := int(now.Sub(since) / measureInterval)
+	// One call per full page, and a last one that comes back short or empty.
+	return max(samples, 0)/measurePageSize + 1, true
+}
+
+// spreadPacing returns the time between calls that spreads calls evenly over window,
+// never faster than the hourly quota allows.
+func spreadPacing(calls int, window time.Duration) time.Duration {
+	return max(window/time.Duration(max(calls, 1)), time.Hour/netatmo.HourlyLimit)
+}
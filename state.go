@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// State is the run state persisted between runs, next to the config.
+type State struct {
+	mu sync.Mutex // Guards Cursors and Events, for concurrent module exports.
+
+	// Cursors holds the timestamp of the last exported sample, keyed by cursorKey.
+	Cursors map[string]time.Time
+	// Stations is the station topology seen on the last run.
+	Stations []netatmo.Station
+	// Counters holds the cumulative self-telemetry counters, keyed by dev_id and metric name.
+	Counters map[string]float64
+	// Events holds the state of the threshold events, keyed by dev_id and event name.
+	Events map[string]eventState
+	// Archived holds the cursors of the modules removed from the account, keyed by cursorKey, so a module that
+	// comes back resumes where it left off instead of exporting its whole history again.
+	Archived map[string]time.Time
+}
+
+func cursorKey(device netatmo.DeviceID, module netatmo.ModuleID, dt netatmo.DataType) string {
+	return string(device) + "/" + string(module) + "/" + string(dt)
+}
+
+// Cursor returns the time to resume exporting dataTypes from: one second after the oldest of their cursors.
+// It returns the zero time if any of the data types has never been exported.
+func (s *State) Cursor(device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := map[netatmo.DataType]time.Time{}
+	for _, dt := range dataTypes {
+		if t, ok := s.Cursors[cursorKey(device, module, dt)]; ok {
+			last[dt] = t
+		}
+	}
+	return oldestCursor(last, dataTypes)
+}
+
+// Advance records that dataTypes have been exported through t.
+func (s *State) Advance(device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Cursors == nil {
+		s.Cursors = map[string]time.Time{}
+	}
+	for _, dt := range dataTypes {
+		key := cursorKey(device, module, dt)
+		if t.After(s.Cursors[key]) {
+			s.Cursors[key] = t
+		}
+	}
+}
+
+// Archive moves the cursors of a removed device or module to Archived, returning how many it moved.
+func (s *State) Archive(device netatmo.DeviceID, module netatmo.ModuleID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Archived == nil {
+		s.Archived = map[string]time.Time{}
+	}
+	return moveCursors(s.Cursors, s.Archived, cursorKey(device, module, ""))
+}
+
+// Unarchive moves the archived cursors of a device or module back, returning how many it moved.
+func (s *State) Unarchive(device netatmo.DeviceID, module netatmo.ModuleID) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Cursors == nil {
+		s.Cursors = map[string]time.Time{}
+	}
+	return moveCursors(s.Archived, s.Cursors, cursorKey(device, module, ""))
+}
+
+// moveCursors moves the cursors with the prefix from one map to the other, keeping the later of any both have.
+func moveCursors(from, to map[string]time.Time, prefix string) int {
+	n := 0
+	for k, t := range from {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if t.After(to[k]) {
+			to[k] = t
+		}
+		delete(from, k)
+		n++
+	}
+	return n
+}
+
+// configDir returns the directory holding the config and state files, which is separate for each -profile.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	if *profile != "" {
+		return filepath.Join(dir, "netatmo", "profiles", *profile), nil
+	}
+	return filepath.Join(dir, "netatmo"), nil
+}
+
+// eventState is a threshold event's state for a module, as of the last point it was evaluated on.
+type eventState struct {
+	Firing bool      `json:"firing"`
+	Last   time.Time `json:"last"`
+}
+
+// Buckets and keys in the state database.
+var (
+	metaBucket     = []byte("meta")
+	cursorsBucket  = []byte("cursors")  // cursorKey -> big-endian unix seconds
+	stationsBucket = []byte("stations") // DeviceID -> JSON netatmo.Station
+	countersBucket = []byte("counters") // dev_id/metric -> big-endian float64 bits
+	eventsBucket   = []byte("events")   // dev_id/event -> firing byte and big-endian unix seconds of the last point
+	archivedBucket = []byte("archived") // cursorKey -> big-endian unix seconds, for removed modules
+
+	schemaVersionKey = []byte("schema_version")
+)
+
+// stateMigrations upgrade the database schema; the schema version is the number of migrations applied.
+var stateMigrations = []func(tx *bolt.Tx, dir string) error{
+	// 1: Create buckets and import the cursors from the JSON state file, if any.
+	func(tx *bolt.Tx, dir string) error {
+		for _, name := range [][]byte{cursorsBucket, stationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, "state.json"))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var old struct {
+			Cursors map[string]time.Time `json:"cursors"`
+		}
+		if err := json.Unmarshal(bs, &old); err != nil {
+			return fmt.Errorf("state.json: %w", err)
+		}
+		b := tx.Bucket(cursorsBucket)
+		for k, t := range old.Cursors {
+			if err := b.Put([]byte(k), binary.BigEndian.AppendUint64(nil, uint64(t.Unix()))); err != nil {
+				return err
+			}
+		}
+		slog.Info("imported cursors from state.json", "cursors", len(old.Cursors))
+		return nil
+	},
+	// 2: Add self-telemetry counters.
+	func(tx *bolt.Tx, dir string) error {
+		_, err := tx.CreateBucketIfNotExists(countersBucket)
+		return err
+	},
+	// 3: Add threshold events.
+	func(tx *bolt.Tx, dir string) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	},
+	// 4: Rename the cursors of the misspelled Humidiity data type, keeping the later one if both exist.
+	func(tx *bolt.Tx, dir string) error {
+		b := tx.Bucket(cursorsBucket)
+		old := map[string][]byte{}
+		err := b.ForEach(func(k, v []byte) error {
+			if bytes.HasSuffix(k, []byte("/Humidiity")) {
+				old[string(k)] = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range old {
+			key := []byte(strings.TrimSuffix(k, "Humidiity") + string(netatmo.DataHumidity))
+			if cur := b.Get(key); cur == nil || binary.BigEndian.Uint64(v) > binary.BigEndian.Uint64(cur) {
+				if err := b.Put(key, v); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		if len(old) > 0 {
+			slog.Info("renamed Humidiity cursors to Humidity", "cursors", len(old))
+		}
+		// Likewise in the data types of the stations, such as those of generate.
+		stations := tx.Bucket(stationsBucket)
+		renamed := map[string][]byte{}
+		err = stations.ForEach(func(k, v []byte) error {
+			if bytes.Contains(v, []byte(`"Humidiity"`)) {
+				renamed[string(k)] = bytes.ReplaceAll(v, []byte(`"Humidiity"`), []byte(`"Humidity"`))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, v := range renamed {
+			if err := stations.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 5: Add the archived cursors of removed modules.
+	func(tx *bolt.Tx, dir string) error {
+		_, err := tx.CreateBucketIfNotExists(archivedBucket)
+		return err
+	},
+	// 6: Add the time of the last point evaluated to the events, which were only the firing ones.
+	func(tx *bolt.Tx, dir string) error {
+		b := tx.Bucket(eventsBucket)
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Put(k, encodeEvent(eventState{Firing: true})); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// encodeEvent encodes s for the events bucket.
+func encodeEvent(s eventState) []byte {
+	b := []byte{0}
+	if s.Firing {
+		b[0] = 1
+	}
+	var last int64
+	if !s.Last.IsZero() {
+		last = s.Last.Unix()
+	}
+	return binary.BigEndian.AppendUint64(b, uint64(last))
+}
+
+// decodeEvent decodes a value of the events bucket.
+func decodeEvent(v []byte) (eventState, error) {
+	if len(v) != 9 {
+		return eventState{}, fmt.Errorf("bad event %x", v)
+	}
+	s := eventState{Firing: v[0] == 1}
+	if last := int64(binary.BigEndian.Uint64(v[1:])); last != 0 {
+		s.Last = time.Unix(last, 0)
+	}
+	return s, nil
+}
+
+// stateDB is a State backed by a bbolt database.
+//
+// Like jsondb, Data is loaded on open and only written back by Save.
+type stateDB struct {
+	Data *State
+
+	db *bolt.DB
+}
+
+// openState opens the state database, creating or migrating it as needed.
+func openState() (*stateDB, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("state: %w", err)
+	}
+	if err := migrateState(db, dir); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &stateDB{Data: &State{Cursors: map[string]time.Time{}, Counters: map[string]float64{}, Events: map[string]eventState{},
+		Archived: map[string]time.Time{}}, db: db}
+	if err := db.View(s.load); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("state: %w", err)
+	}
+	return s, nil
+}
+
+func migrateState(db *bolt.DB, dir string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get(schemaVersionKey); v != nil {
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return fmt.Errorf("state: bad schema version %q", v)
+			}
+		}
+		if version > len(stateMigrations) {
+			return fmt.Errorf("state: schema version %d is newer than supported (%d)", version, len(stateMigrations))
+		}
+		for ; version < len(stateMigrations); version++ {
+			if err := stateMigrations[version](tx, dir); err != nil {
+				return fmt.Errorf("state: migrating to schema version %d: %w", version+1, err)
+			}
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(version)))
+	})
+}
+
+func (s *stateDB) load(tx *bolt.Tx) error {
+	err := tx.Bucket(cursorsBucket).ForEach(func(k, v []byte) error {
+		s.Data.Cursors[string(k)] = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(countersBucket).ForEach(func(k, v []byte) error {
+		s.Data.Counters[string(k)] = math.Float64frombits(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(eventsBucket).ForEach(func(k, v []byte) error {
+		e, err := decodeEvent(v)
+		if err != nil {
+			return fmt.Errorf("event %s: %w", k, err)
+		}
+		s.Data.Events[string(k)] = e
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket(archivedBucket).ForEach(func(k, v []byte) error {
+		s.Data.Archived[string(k)] = time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(stationsBucket).ForEach(func(k, v []byte) error {
+		var st netatmo.Station
+		if err := json.Unmarshal(v, &st); err != nil {
+			return fmt.Errorf("station %s: %w", k, err)
+		}
+		s.Data.Stations = append(s.Data.Stations, st)
+		return nil
+	})
+}
+
+// Save writes s.Data back to the database.
+func (s *stateDB) Save() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(cursorsBucket)
+		for k, t := range s.Data.Cursors {
+			if err := b.Put([]byte(k), binary.BigEndian.AppendUint64(nil, uint64(t.Unix()))); err != nil {
+				return err
+			}
+		}
+		if err := tx.DeleteBucket(archivedBucket); err != nil {
+			return err
+		}
+		archived, err := tx.CreateBucket(archivedBucket)
+		if err != nil {
+			return err
+		}
+		for k, t := range s.Data.Archived {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+			if err := archived.Put([]byte(k), binary.BigEndian.AppendUint64(nil, uint64(t.Unix()))); err != nil {
+				return err
+			}
+		}
+		b = tx.Bucket(countersBucket)
+		for k, v := range s.Data.Counters {
+			if err := b.Put([]byte(k), binary.BigEndian.AppendUint64(nil, math.Float64bits(v))); err != nil {
+				return err
+			}
+		}
+		if err := tx.DeleteBucket(eventsBucket); err != nil {
+			return err
+		}
+		b, err = tx.CreateBucket(eventsBucket)
+		if err != nil {
+			return err
+		}
+		s.Data.mu.Lock()
+		for k, e := range s.Data.Events {
+			if err := b.Put([]byte(k), encodeEvent(e)); err != nil {
+				s.Data.mu.Unlock()
+				return err
+			}
+		}
+		s.Data.mu.Unlock()
+		if err := tx.DeleteBucket(stationsBucket); err != nil {
+			return err
+		}
+		b, err = tx.CreateBucket(stationsBucket)
+		if err != nil {
+			return err
+		}
+		for _, st := range s.Data.Stations {
+			bs, err := json.Marshal(&st)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(st.ID), bs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Checkpoint advances the cursors for dataTypes to t, and writes them to the database right away,
+// so an interrupted run resumes from here.
+func (s *stateDB) Checkpoint(device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType, t time.Time) error {
+	s.Data.Advance(device, module, dataTypes, t)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		s.Data.mu.Lock()
+		defer s.Data.mu.Unlock()
+		b := tx.Bucket(cursorsBucket)
+		for _, dt := range dataTypes {
+			k := cursorKey(device, module, dt)
+			if err := b.Put([]byte(k), binary.BigEndian.AppendUint64(nil, uint64(s.Data.Cursors[k].Unix()))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *stateDB) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// TestArchive checks that a removed module's cursors are archived, kept across a save, and brought back when it
+// returns.
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	const device, module = netatmo.DeviceID("70:ee:50:00:00:01"), netatmo.ModuleID("02:00:00:00:00:01")
+	dataTypes := []netatmo.DataType{netatmo.DataTemperature, netatmo.DataHumidity}
+	cursor := time.Unix(1700000000, 0)
+
+	reopen := func(s *stateDB) *stateDB {
+		t.Helper()
+		if s != nil {
+			if err := s.Save(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s, err := openState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := reopen(nil)
+	if err := s.Checkpoint(device, module, dataTypes, cursor); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Checkpoint(device, "", []netatmo.DataType{netatmo.DataTemperature}, cursor); err != nil {
+		t.Fatal(err)
+	}
+	want := s.Data.Cursor(device, module, dataTypes)
+	if n := s.Data.Archive(device, module); n != 2 {
+		t.Errorf("Archive moved %d cursors, want 2", n)
+	}
+
+	s = reopen(s)
+	if got := s.Data.Cursor(device, module, dataTypes); !got.IsZero() {
+		t.Errorf("archived module's cursor = %v, want none", got)
+	}
+	if got := s.Data.Cursor(device, "", []netatmo.DataType{netatmo.DataTemperature}); !got.Equal(want) {
+		t.Errorf("station's cursor = %v, want %v", got, want)
+	}
+	if len(s.Data.Archived) != 2 {
+		t.Errorf("Archived = %v, want the module's 2 cursors", s.Data.Archived)
+	}
+
+	if n := s.Data.Unarchive(device, module); n != 2 {
+		t.Errorf("Unarchive moved %d cursors, want 2", n)
+	}
+	s = reopen(s)
+	defer s.Close()
+	if got := s.Data.Cursor(device, module, dataTypes); !got.Equal(want) {
+		t.Errorf("unarchived module's cursor = %v, want %v", got, want)
+	}
+	if len(s.Data.Archived) != 0 {
+		t.Errorf("Archived = %v, want none", s.Data.Archived)
+	}
+}
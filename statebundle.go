@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"golang.org/x/crypto/scrypt"
+	"tailscale.com/jsondb"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// stateBundle is everything a run keeps between runs, in one file, to move the exporter to another host without
+// it starting over (and backfilling everything again).
+type stateBundle struct {
+	Version  int                   `json:"version"`
+	Created  time.Time             `json:"created"`
+	Cursors  map[string]time.Time  `json:"cursors"`
+	Archived map[string]time.Time  `json:"archived,omitempty"`
+	Stations []netatmo.Station     `json:"stations"`
+	Counters map[string]float64    `json:"counters"`
+	Events   map[string]eventState `json:"events,omitempty"`
+
+	// Config is config.json, with the OAuth client and token, unless it's sealed or left out.
+	Config json.RawMessage `json:"config,omitempty"`
+	// SealedConfig is config.json encrypted with a passphrase.
+	SealedConfig *sealedBox `json:"sealed_config,omitempty"`
+}
+
+const stateBundleVersion = 1
+
+// sealedBox is data encrypted with AES-256-GCM, with a key derived from a passphrase by scrypt.
+type sealedBox struct {
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+// sealKey derives the key for passphrase and salt.
+func sealKey(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(passphrase, data []byte) (*sealedBox, error) {
+	b := &sealedBox{Salt: make([]byte, 16)}
+	if _, err := rand.Read(b.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := sealKey(passphrase, b.Salt)
+	if err != nil {
+		return nil, err
+	}
+	b.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(b.Nonce); err != nil {
+		return nil, err
+	}
+	b.Data = aead.Seal(nil, b.Nonce, data, nil)
+	return b, nil
+}
+
+func (b *sealedBox) open(passphrase []byte) ([]byte, error) {
+	aead, err := sealKey(passphrase, b.Salt)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, b.Nonce, b.Data, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or the bundle is corrupt")
+	}
+	return data, nil
+}
+
+// readPassphrase reads the passphrase from the first line of path.
+func readPassphrase(path string) ([]byte, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	line, _, _ := strings.Cut(string(bs), "\n")
+	if line = strings.TrimRight(line, "\r"); line == "" {
+		return nil, fmt.Errorf("%s: empty passphrase", path)
+	}
+	return []byte(line), nil
+}
+
+// runState runs the state subcommands, which move the state to another host.
+func runState(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: state: missing subcommand (export or import)", errConfig)
+	}
+	switch args[0] {
+	case "export":
+		return runStateExport(args[1:])
+	case "import":
+		return runStateImport(args[1:])
+	default:
+		return fmt.Errorf("%w: state: unknown subcommand %q", errConfig, args[0])
+	}
+}
+
+func runStateExport(args []string) error {
+	fs := flag.NewFlagSet("state export", flag.ContinueOnError)
+	out := fs.String("o", "-", "Write the bundle to this file, or - for stdout.")
+	tokens := fs.String("tokens", "encrypted",
+		"How to include the OAuth client and token: encrypted (with -passphrase-file), plain, or none (to authorize the new host again).")
+	passphraseFile := fs.String("passphrase-file", "", "File with the passphrase to encrypt the token with, on its first line.")
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("STATE"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+
+	var passphrase []byte
+	switch *tokens {
+	case "encrypted":
+		if *passphraseFile == "" {
+			return fmt.Errorf("%w: state export: -tokens=encrypted needs -passphrase-file (or use -tokens=plain or none)", errConfig)
+		}
+		if passphrase, err = readPassphrase(*passphraseFile); err != nil {
+			return fmt.Errorf("%w: state export: %w", errConfig, err)
+		}
+	case "plain", "none":
+	default:
+		return fmt.Errorf("%w: state export: unknown -tokens %q", errConfig, *tokens)
+	}
+
+	stateDB, err := openState()
+	if err != nil {
+		return err
+	}
+	b := stateBundle{
+		Version:  stateBundleVersion,
+		Created:  time.Now().UTC(),
+		Cursors:  stateDB.Data.Cursors,
+		Archived: stateDB.Data.Archived,
+		Stations: stateDB.Data.Stations,
+		Counters: stateDB.Data.Counters,
+		Events:   stateDB.Data.Events,
+	}
+	stateDB.Close()
+
+	if *tokens != "none" {
+		dir, err := configDir()
+		if err != nil {
+			return err
+		}
+		config, err := os.ReadFile(filepath.Join(dir, "config.json"))
+		if err != nil {
+			return err
+		}
+		if *tokens == "plain" {
+			b.Config = config
+		} else if b.SealedConfig, err = seal(passphrase, config); err != nil {
+			return err
+		}
+	}
+
+	bs, err := json.MarshalIndent(&b, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *out == "-" {
+		_, err = os.Stdout.Write(append(bs, '\n'))
+		return err
+	}
+	if err := os.WriteFile(*out, append(bs, '\n'), 0o600); err != nil {
+		return err
+	}
+	slog.Info("exported state", "file", *out, "cursors", len(b.Cursors), "stations", len(b.Stations), "tokens", *tokens)
+	return nil
+}
+
+func runStateImport(args []string) error {
+	stdfs := flag.NewFlagSet("state import", flag.ContinueOnError)
+	passphraseFile := stdfs.String("passphrase-file", "", "File with the passphrase the token was encrypted with.")
+	force := stdfs.Bool("force", false, "Import over existing cursors and token, instead of refusing to.")
+	fs := ff.NewFlagSetFrom("state import", stdfs)
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("STATE"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		stdfs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	if len(fs.GetArgs()) != 1 {
+		return fmt.Errorf("%w: state import: usage: state import [flags] BUNDLE (or - for stdin)", errConfig)
+	}
+
+	r := io.Reader(os.Stdin)
+	if path := fs.GetArgs()[0]; path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var b stateBundle
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return fmt.Errorf("state import: %w", err)
+	}
+	if b.Version != stateBundleVersion {
+		return fmt.Errorf("state import: unsupported bundle version %d", b.Version)
+	}
+
+	config := b.Config
+	if b.SealedConfig != nil {
+		if *passphraseFile == "" {
+			return fmt.Errorf("%w: state import: the token is encrypted; give -passphrase-file", errConfig)
+		}
+		passphrase, err := readPassphrase(*passphraseFile)
+		if err != nil {
+			return fmt.Errorf("%w: state import: %w", errConfig, err)
+		}
+		if config, err = b.SealedConfig.open(passphrase); err != nil {
+			return fmt.Errorf("state import: %w", err)
+		}
+	}
+
+	stateDB, err := openState()
+	if err != nil {
+		return err
+	}
+	defer stateDB.Close()
+	if len(stateDB.Data.Cursors) > 0 && !*force {
+		return fmt.Errorf("%w: state import: the state already has %d cursors; use -force to import over them",
+			errConfig, len(stateDB.Data.Cursors))
+	}
+	if config != nil {
+		if err := importConfig(config, *force); err != nil {
+			return err
+		}
+	}
+	// A module is either exported or archived: the bundle's word on it replaces this host's.
+	for k, t := range b.Cursors {
+		stateDB.Data.Cursors[k] = t
+		delete(stateDB.Data.Archived, k)
+	}
+	for k, t := range b.Archived {
+		stateDB.Data.Archived[k] = t
+		delete(stateDB.Data.Cursors, k)
+	}
+	for k, v := range b.Counters {
+		stateDB.Data.Counters[k] = v
+	}
+	for k, e := range b.Events {
+		stateDB.Data.Events[k] = e
+	}
+	stateDB.Data.Stations = b.Stations
+	if err := stateDB.Save(); err != nil {
+		return err
+	}
+	slog.Info("imported state", "created", b.Created.Format(time.RFC3339), "cursors", len(b.Cursors),
+		"stations", len(b.Stations), "token", config != nil)
+	return nil
+}
+
+// importConfig writes config.json from a bundle, unless there is a token already and not force.
+func importConfig(config []byte, force bool) error {
+	var c Config
+	if err := json.Unmarshal(config, &c); err != nil {
+		return fmt.Errorf("state import: config: %w", err)
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	db, err := jsondb.Open[Config](filepath.Join(dir, "config.json"))
+	if err != nil {
+		return err
+	}
+	if db.Data.Token.RefreshToken != "" && !force {
+		return fmt.Errorf("%w: state import: config.json already has a token; use -force to replace it", errConfig)
+	}
+	*db.Data = c
+	return db.Save()
+}
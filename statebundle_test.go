@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+func TestSeal(t *testing.T) {
+	data := []byte(`{"token":{"refresh_token":"r"}}`)
+	b, err := seal([]byte("correct horse"), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := b.open([]byte("correct horse"))
+	if err != nil || string(got) != string(data) {
+		t.Errorf("open() = %s, %v, want %s", got, err, data)
+	}
+	if _, err := b.open([]byte("battery staple")); err == nil {
+		t.Error("open() with the wrong passphrase succeeded")
+	}
+}
+
+// TestStateImport checks that an import restores the cursors, archived ones included, the events, and the token,
+// and refuses to overwrite the cursors or the token without -force.
+func TestStateImport(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	configDir, err := configDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(configDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	passphraseFile := filepath.Join(dir, "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("correct horse\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	key := cursorKey("70:ee:50:00:00:01", "", netatmo.DataTemperature)
+	archivedKey := cursorKey("70:ee:50:00:00:01", "02:00:00:00:00:01", netatmo.DataTemperature)
+	cursor := time.Unix(1700000000, 0)
+	event := eventState{Firing: true, Last: cursor.Add(-time.Minute)}
+	bundle := filepath.Join(dir, "bundle.json")
+	b := stateBundle{Version: stateBundleVersion, Cursors: map[string]time.Time{key: cursor},
+		Archived: map[string]time.Time{archivedKey: cursor.Add(-time.Hour)},
+		Events:   map[string]eventState{"stuffy/70:ee:50:00:00:01": event}}
+	if b.SealedConfig, err = seal([]byte("correct horse"),
+		[]byte(`{"client_id":"id","client_secret":"secret","token":{"refresh_token":"new"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bundle, bs, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// This host archived the module the bundle still exports.
+	s, err := openState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Data.Archived[key] = cursor.Add(-2 * time.Hour)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	configFile := filepath.Join(configDir, "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"token":{"refresh_token":"old"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	refreshToken := func() string {
+		t.Helper()
+		var c Config
+		bs, err := os.ReadFile(configFile)
+		if err == nil {
+			err = json.Unmarshal(bs, &c)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Token.RefreshToken
+	}
+
+	// Over the token.
+	if err := runStateImport([]string{"-passphrase-file", passphraseFile, bundle}); !errors.Is(err, errConfig) {
+		t.Errorf("import over the token: %v, want a refusal", err)
+	}
+	if got := refreshToken(); got != "old" {
+		t.Errorf("refresh token = %q after a refused import, want the old one", got)
+	}
+
+	if err := runStateImport([]string{"-force", "-passphrase-file", passphraseFile, bundle}); err != nil {
+		t.Fatal(err)
+	}
+	if got := refreshToken(); got != "new" {
+		t.Errorf("refresh token = %q, want the bundle's", got)
+	}
+	if s, err = openState(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Data.Cursors[key]; !got.Equal(cursor) {
+		t.Errorf("cursor = %v, want %v", got, cursor)
+	}
+	if _, ok := s.Data.Archived[key]; ok {
+		t.Errorf("%s is still archived", key)
+	}
+	if got, ok := s.Data.Cursors[archivedKey]; ok {
+		t.Errorf("archived cursor %v is exported", got)
+	}
+	if got := s.Data.Archived[archivedKey]; !got.Equal(cursor.Add(-time.Hour)) {
+		t.Errorf("archived cursor = %v, want %v", got, cursor.Add(-time.Hour))
+	}
+	if got := s.Data.Events["stuffy/70:ee:50:00:00:01"]; got.Firing != event.Firing || !got.Last.Equal(event.Last) {
+		t.Errorf("event = %+v, want %+v", got, event)
+	}
+	s.Close()
+
+	// Over the cursors.
+	if err := runStateImport([]string{"-passphrase-file", passphraseFile, bundle}); !errors.Is(err, errConfig) {
+		t.Errorf("import over the cursors: %v, want a refusal", err)
+	}
+}
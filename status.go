@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// status is what the daemon's status page shows. A nil *status ignores updates.
+type status struct {
+	mu sync.Mutex
+
+	started  time.Time
+	lastRun  time.Time
+	lastErr  error
+	stations []netatmo.Station
+	cursors  map[string]time.Time
+	modules  map[string]moduleStatus // By dev_id.
+	errors   []statusError           // Most recent last.
+	calls    []statusCalls           // API calls per run, most recent last.
+}
+
+type moduleStatus struct {
+	Name        string
+	LastExport  time.Time
+	LastSuccess time.Time
+	Points      int
+}
+
+type statusError struct {
+	Time    time.Time
+	Context string
+	Err     string
+}
+
+type statusCalls struct {
+	Time  time.Time
+	Calls int64
+}
+
+// maxStatusErrors is how many recent errors the status page keeps.
+const maxStatusErrors = 20
+
+func newStatus() *status {
+	return &status{started: time.Now(), modules: map[string]moduleStatus{}}
+}
+
+// record updates the status with a run's state and per-module results.
+func (st *status) record(state *State, stats []moduleStats) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+
+	st.stations = slices.Clone(state.Stations)
+	st.cursors = maps.Clone(state.Cursors)
+	var calls int64
+	for _, s := range stats {
+		calls += s.calls
+		id := s.attrs["dev_id"]
+		m := st.modules[id]
+		m.Name = s.name
+		m.LastExport = now
+		m.Points = s.points
+		if s.err == nil {
+			m.LastSuccess = now
+		} else {
+			st.addError(id, s.err)
+		}
+		st.modules[id] = m
+	}
+	st.calls = append(st.calls, statusCalls{now, calls})
+	st.calls = slices.DeleteFunc(st.calls, func(c statusCalls) bool { return now.Sub(c.Time) > time.Hour })
+}
+
+// runDone records the end of a run.
+func (st *status) runDone(err error) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.lastRun = time.Now()
+	st.lastErr = err
+	if err != nil {
+		st.addError("run", err)
+	}
+}
+
+func (st *status) addError(context string, err error) {
+	st.errors = append(st.errors, statusError{time.Now(), context, err.Error()})
+	if len(st.errors) > maxStatusErrors {
+		st.errors = st.errors[len(st.errors)-maxStatusErrors:]
+	}
+}
+
+// ServeHTTP renders the status page.
+func (st *status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st.mu.Lock()
+	data := struct {
+		Started, LastRun time.Time
+		LastErr          error
+		CallsLastHour    int64
+		Modules          []statusRow
+		Errors           []statusError
+	}{
+		Started: st.started,
+		LastRun: st.lastRun,
+		LastErr: st.lastErr,
+		Errors:  slices.Clone(st.errors),
+	}
+	for _, c := range st.calls {
+		data.CallsLastHour += c.Calls
+	}
+	for _, dev := range st.stations {
+		data.Modules = append(data.Modules, st.row(dev.HomeName, dev.Name, dev.DataTypes, dev.ID, ""))
+		for _, mod := range dev.Modules {
+			data.Modules = append(data.Modules, st.row(dev.HomeName, mod.Name, mod.DataTypes, dev.ID, mod.ID))
+		}
+	}
+	st.mu.Unlock()
+	slices.Reverse(data.Errors)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		slog.Error("rendering status", "err", err)
+	}
+}
+
+type statusRow struct {
+	Home, ID string
+	moduleStatus
+	Cursor string
+}
+
+func (st *status) row(home, name string, dataTypes []netatmo.DataType, device netatmo.DeviceID, module netatmo.ModuleID) statusRow {
+	id := export.DevID(device, module)
+	cursor := "-"
+	if t := (&State{Cursors: st.cursors}).Cursor(device, module, dataTypes); !t.IsZero() {
+		cursor = t.Format(time.RFC3339)
+	}
+	row := statusRow{Home: home, ID: id, moduleStatus: st.modules[id], Cursor: cursor}
+	row.Name = name
+	return row
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return fmt.Sprintf("%s ago", time.Since(t).Round(time.Second))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>netatmo-otel</title></head>
+<body>
+<h1>netatmo-otel</h1>
+<p>Started {{ago .Started}}. Last run {{ago .LastRun}}{{with .LastErr}}, failed: {{.}}{{end}}.
+API calls in the last hour: {{.CallsLastHour}}.</p>
+<h2>Modules</h2>
+<table>
+<tr><th>Home</th><th>Module</th><th>ID</th><th>Last export</th><th>Last success</th><th>Points</th><th>Cursor</th></tr>
+{{range .Modules}}<tr><td>{{.Home}}</td><td>{{.Name}}</td><td>{{.ID}}</td><td>{{ago .LastExport}}</td><td>{{ago .LastSuccess}}</td><td>{{.Points}}</td><td>{{.Cursor}}</td></tr>
+{{end}}</table>
+<h2>Recent errors</h2>
+<ul>
+{{range .Errors}}<li>{{.Time.Format "2006-01-02T15:04:05Z07:00"}} {{.Context}}: {{.Err}}</li>
+{{else}}<li>None.</li>
+{{end}}</ul>
+</body>
+</html>
+`))
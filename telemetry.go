@@ -0,0 +1,469 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"strconv"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// moduleStats is what one module's export did during a run.
+type moduleStats struct {
+	name     string
+	attrs    map[string]string
+	points   int
+	calls    int64
+	err      error
+	duration time.Duration
+	quality  moduleQuality
+}
+
+// moduleQuality is what one module's export left out of the data, or had to retry, during a run.
+type moduleQuality struct {
+	nulls, outliers int64 // Values left out as missing, or outside their data type's plausible range.
+	duplicates      int64 // Points dropped for repeating ones of the previous page.
+	malformed       int64 // Samples with more or fewer values than data types.
+	retries         int64 // Pages requested again.
+}
+
+// failed reports whether the export failed, as opposed to being cut short by the API call budget.
+func (s moduleStats) failed() bool {
+	return s.err != nil && !errors.Is(s.err, netatmo.ErrBudgetExhausted)
+}
+
+// pushTelemetry encodes the exporter's own metrics for the modules exported in this run.
+//
+// The _total counters accumulate across runs in the state, so they behave like counters of a long-running process.
+func pushTelemetry(exporter export.Sink, state *State, stats []moduleStats, quota netatmo.Quota) error {
+	if len(stats) == 0 {
+		return nil
+	}
+	if p, ok := exporter.(*pipeline); ok {
+		for _, mf := range p.metrics() {
+			if err := exporter.Encode(mf); err != nil {
+				return err
+			}
+		}
+	}
+	if state.Counters == nil {
+		state.Counters = map[string]float64{}
+	}
+	now := proto.Int64(time.Now().UnixMilli())
+
+	counters := []struct {
+		name, help string
+		value      func(moduleStats) float64
+	}{
+		{"netatmo_export_points_total", "Datapoints exported.",
+			func(s moduleStats) float64 { return float64(s.points) }},
+		{"netatmo_export_api_requests_total", "Netatmo API requests made.",
+			func(s moduleStats) float64 { return float64(s.calls) }},
+		{"netatmo_export_errors_total", "Failed exports.",
+			func(s moduleStats) float64 {
+				if s.failed() {
+					return 1
+				}
+				return 0
+			}},
+		{"netatmo_export_quality_nulls_dropped_total", "Missing values left out of the export, with -drop-invalid.",
+			func(s moduleStats) float64 { return float64(s.quality.nulls) }},
+		{"netatmo_export_quality_outliers_dropped_total", "Values outside the data type's plausible range left out of the export, with -drop-invalid.",
+			func(s moduleStats) float64 { return float64(s.quality.outliers) }},
+		{"netatmo_export_quality_duplicates_dropped_total", "Points dropped for repeating ones of the previous getmeasure page.",
+			func(s moduleStats) float64 { return float64(s.quality.duplicates) }},
+		{"netatmo_export_quality_pages_retried_total", "Getmeasure pages requested again after a network error or 5xx response.",
+			func(s moduleStats) float64 { return float64(s.quality.retries) }},
+		{"netatmo_export_quality_decode_warnings_total", "Samples with more or fewer values than data types, padded or truncated.",
+			func(s moduleStats) float64 { return float64(s.quality.malformed) }},
+	}
+	for _, c := range counters {
+		mf := &dto.MetricFamily{Name: ptr(c.name), Help: ptr(c.help), Type: dto.MetricType_COUNTER.Enum()}
+		for _, s := range stats {
+			key := s.attrs["dev_id"] + "/" + c.name
+			state.Counters[key] += c.value(s)
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label:       export.LabelPairs(s.attrs),
+				TimestampMs: now,
+				Counter:     &dto.Counter{Value: proto.Float64(state.Counters[key])},
+			})
+		}
+		if err := exporter.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	mf := &dto.MetricFamily{
+		Name: ptr("netatmo_export_duration_seconds"),
+		Help: ptr("Time spent exporting the module in the last run."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, s := range stats {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label:       export.LabelPairs(s.attrs),
+			TimestampMs: now,
+			Gauge:       &dto.Gauge{Value: proto.Float64(s.duration.Seconds())},
+		})
+	}
+	if err := exporter.Encode(mf); err != nil {
+		return err
+	}
+
+	// Not per module: the quota is the account's.
+	account := export.LabelPairs(fileConfig.accountLabels(map[string]string{}))
+	state.Counters["netatmo_api_rate_limited_total"] += float64(quota.RateLimited)
+	for _, mf := range []*dto.MetricFamily{{
+		Name: ptr("netatmo_api_quota_remaining"),
+		Help: ptr("Estimated Netatmo API calls left in the hourly quota at the end of the run."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Label: account, TimestampMs: now,
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(quota.Remaining))}}},
+	}, {
+		Name: ptr("netatmo_api_rate_limited_total"),
+		Help: ptr("Netatmo API calls that were rate limited."),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{{Label: account, TimestampMs: now,
+			Counter: &dto.Counter{Value: proto.Float64(state.Counters["netatmo_api_rate_limited_total"])}}},
+	}} {
+		if err := exporter.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	// Absent-data alerts can compare this against the data itself to tell a broken exporter from an offline module.
+	mf = &dto.MetricFamily{
+		Name: ptr("netatmo_export_last_success_timestamp_seconds"),
+		Help: ptr("When the module was last exported completely."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, s := range stats {
+		if s.err != nil {
+			continue
+		}
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label:       export.LabelPairs(s.attrs),
+			TimestampMs: now,
+			Gauge:       &dto.Gauge{Value: proto.Float64(float64(*now) / 1000)},
+		})
+	}
+	if len(mf.Metric) == 0 {
+		return nil
+	}
+	return exporter.Encode(mf)
+}
+
+// staleNaN is the NaN that Prometheus uses as a stale marker, to end a series.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// checkOfflineSignal checks -offline-signal.
+func checkOfflineSignal() error {
+	switch *offlineSignal {
+	case "none", "online":
+	case "stale":
+		// The stale marker is a NaN with particular bits, which only remote-write keeps: the text format has a plain
+		// NaN, which VictoriaMetrics drops, and OTLP marks staleness with a flag instead.
+		if *format != "remote-write" {
+			return errors.New("-offline-signal=stale: requires -format=remote-write")
+		}
+		// The markers are samples at the time of the run, which the other lookups would take as the cursor.
+		if *lookup != "state" || *lookupCheck != "" && *lookupCheck != "state" {
+			return errors.New("-offline-signal=stale: requires -lookup=state")
+		}
+	default:
+		return fmt.Errorf("-offline-signal: unknown signal %q", *offlineSignal)
+	}
+	return nil
+}
+
+// pushOnline encodes whether each of the stations' modules was reachable, as of the last discovery, for
+// -offline-signal: a netatmo_module_online gauge, and with mode stale, stale markers on the unreachable modules'
+// series.
+func pushOnline(exporter export.Sink, stations []netatmo.Station, mode string) error {
+	if mode == "none" {
+		return nil
+	}
+	now := proto.Int64(time.Now().UnixMilli())
+	online := &dto.MetricFamily{
+		Name: ptr("netatmo_module_online"),
+		Help: ptr("Whether the station could reach the module at the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	var stale []*dto.MetricFamily
+	add := func(name string, attrs map[string]string, reachable bool, dataTypes []netatmo.DataType) {
+		if fileConfig.module(attrs["dev_id"], name).Skip {
+			return
+		}
+		labels := export.LabelPairs(attrs)
+		v := 0.0
+		if reachable {
+			v = 1
+		}
+		online.Metric = append(online.Metric, &dto.Metric{Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: &v}})
+		if mode != "stale" || reachable {
+			return
+		}
+		slog.Debug("marking module stale", "dev_id", attrs["dev_id"], "module_name", name)
+		for _, dt := range dataTypes {
+			stale = append(stale, &dto.MetricFamily{
+				Name:   ptr(export.MetricName(dt)),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(staleNaN)}}},
+			})
+		}
+	}
+	for _, dev := range stations {
+		add(dev.Name, stationAttrs(dev), dev.Reachable, dev.DataTypes)
+		for _, mod := range dev.Modules {
+			add(mod.Name, moduleAttrs(dev, mod), mod.Reachable, mod.DataTypes)
+		}
+	}
+	if len(online.Metric) == 0 {
+		return nil
+	}
+	for _, mf := range append([]*dto.MetricFamily{online}, stale...) {
+		if err := exporter.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trendValues are the gauge values of the trends in the stations' dashboard data.
+var trendValues = map[string]float64{"down": -1, "stable": 0, "up": 1}
+
+// pushModuleInfo encodes what the stations report about their modules, besides measurements: the battery level,
+// when each last sent data, the day's temperature extremes, and the temperature and pressure trends. It is only
+// current as of the discovery, so alerts should look back over the discovery interval (e.g. with last_over_time).
+func pushModuleInfo(exporter export.Sink, stations []netatmo.Station) error {
+	now := proto.Int64(time.Now().UnixMilli())
+	battery := &dto.MetricFamily{
+		Name: ptr("netatmo_module_battery_percent"),
+		Help: ptr("Battery level of the module, as of the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Unit: ptr("%"),
+	}
+	lastSeen := &dto.MetricFamily{
+		Name: ptr("netatmo_module_last_seen_timestamp_seconds"),
+		Help: ptr("When the module last sent data to the station, as of the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	tempTrend := &dto.MetricFamily{
+		Name: ptr("netatmo_temperature_trend"),
+		Help: ptr("Whether the temperature is falling (-1), stable (0), or rising (1), also as the trend label, as of the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	pressureTrend := &dto.MetricFamily{
+		Name: ptr("netatmo_pressure_trend"),
+		Help: ptr("Whether the pressure is falling (-1), stable (0), or rising (1), also as the trend label, as of the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	minTemp := &dto.MetricFamily{
+		Name: ptr("netatmo_temperature_daily_min"),
+		Help: ptr("The day's lowest temperature so far, stamped at when it was measured."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Unit: ptr(netatmo.DataUnits[netatmo.DataTemperature]),
+	}
+	maxTemp := &dto.MetricFamily{
+		Name: ptr("netatmo_temperature_daily_max"),
+		Help: ptr("The day's highest temperature so far, stamped at when it was measured."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Unit: ptr(netatmo.DataUnits[netatmo.DataTemperature]),
+	}
+	addExtreme := func(mf *dto.MetricFamily, labels []*dto.LabelPair, v *float64, at time.Time) {
+		if v == nil || at.IsZero() {
+			return
+		}
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: labels, TimestampMs: proto.Int64(at.UnixMilli()), Gauge: &dto.Gauge{Value: proto.Float64(*v)},
+		})
+	}
+	addTrend := func(mf *dto.MetricFamily, attrs map[string]string, trend string) {
+		v, ok := trendValues[trend]
+		if !ok {
+			return
+		}
+		labels := maps.Clone(attrs)
+		labels["trend"] = trend
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: export.LabelPairs(labels), TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(v)},
+		})
+	}
+	add := func(name string, attrs map[string]string, data netatmo.DashboardData) []*dto.LabelPair {
+		if fileConfig.module(attrs["dev_id"], name).Skip {
+			return nil
+		}
+		labels := export.LabelPairs(attrs)
+		if last := data.TimeUTC.Time; !last.IsZero() {
+			lastSeen.Metric = append(lastSeen.Metric, &dto.Metric{
+				Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(float64(last.Unix()))},
+			})
+		}
+		addExtreme(minTemp, labels, data.MinTemp, data.DateMinTemp.Time)
+		addExtreme(maxTemp, labels, data.MaxTemp, data.DateMaxTemp.Time)
+		addTrend(tempTrend, attrs, data.TempTrend)
+		addTrend(pressureTrend, attrs, data.PressureTrend)
+		return labels
+	}
+	for _, dev := range stations {
+		add(dev.Name, stationAttrs(dev), dev.DashboardData)
+		for _, mod := range dev.Modules {
+			// Only the modules run on batteries; the station is plugged in.
+			if labels := add(mod.Name, moduleAttrs(dev, mod), mod.DashboardData); labels != nil && mod.BatteryPercent > 0 {
+				battery.Metric = append(battery.Metric, &dto.Metric{
+					Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(float64(mod.BatteryPercent))},
+				})
+			}
+		}
+	}
+	for _, mf := range []*dto.MetricFamily{battery, lastSeen, minTemp, maxTemp, tempTrend, pressureTrend} {
+		if len(mf.Metric) == 0 {
+			continue
+		}
+		if err := exporter.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushHomeAggregates encodes aggregates of each home's modules, for -home-aggregates, from what the stations
+// reported at the discovery: the mean temperature of the indoor modules (the station's included), the highest CO2
+// level, and whether any module was unreachable. Unreachable modules' stale readings are left out.
+func pushHomeAggregates(exporter export.Sink, stations []netatmo.Station) error {
+	type home struct {
+		attrs          map[string]string
+		tempSum        float64
+		temps          int
+		co2            *float64
+		offline, count int
+	}
+	var homes []*home
+	byID := map[string]*home{}
+	add := func(dev netatmo.Station, name string, attrs map[string]string, typ netatmo.ModuleType, reachable bool,
+		data netatmo.DashboardData) {
+		if fileConfig.module(attrs["dev_id"], name).Skip {
+			return
+		}
+		h := byID[dev.HomeID]
+		if h == nil {
+			h = &home{attrs: normalizedLabels(fileConfig.accountLabels(map[string]string{
+				"home_id": dev.HomeID, "home_name": dev.HomeName,
+			}))}
+			byID[dev.HomeID] = h
+			homes = append(homes, h)
+		}
+		h.count++
+		if !reachable {
+			h.offline++
+			return
+		}
+		if t := data.Temperature; t != nil && (typ == netatmo.ModuleMain || typ == netatmo.ModuleIndoor) {
+			h.tempSum += *t
+			h.temps++
+		}
+		if c := data.CO2; c != nil && (h.co2 == nil || *c > *h.co2) {
+			h.co2 = c
+		}
+	}
+	for _, dev := range stations {
+		add(dev, dev.Name, stationAttrs(dev), dev.Type, dev.Reachable, dev.DashboardData)
+		for _, mod := range dev.Modules {
+			add(dev, mod.Name, moduleAttrs(dev, mod), mod.Type, mod.Reachable, mod.DashboardData)
+		}
+	}
+
+	now := proto.Int64(time.Now().UnixMilli())
+	temp := &dto.MetricFamily{
+		Name: ptr("netatmo_home_indoor_temperature_mean"),
+		Help: ptr("Mean temperature of the home's reachable indoor modules, as of the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Unit: ptr(netatmo.DataUnits[netatmo.DataTemperature]),
+	}
+	co2 := &dto.MetricFamily{
+		Name: ptr("netatmo_home_co2_max"),
+		Help: ptr("Highest CO2 level of the home's reachable modules, as of the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Unit: ptr(netatmo.DataUnits[netatmo.DataCO2]),
+	}
+	offline := &dto.MetricFamily{
+		Name: ptr("netatmo_home_any_module_offline"),
+		Help: ptr("Whether any of the home's modules was unreachable at the last discovery (1) or not (0)."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, h := range homes {
+		labels := export.LabelPairs(h.attrs)
+		if h.temps > 0 {
+			temp.Metric = append(temp.Metric, &dto.Metric{
+				Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(h.tempSum / float64(h.temps))},
+			})
+		}
+		if h.co2 != nil {
+			co2.Metric = append(co2.Metric, &dto.Metric{
+				Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(*h.co2)},
+			})
+		}
+		v := 0.0
+		if h.offline > 0 {
+			v = 1
+		}
+		offline.Metric = append(offline.Metric, &dto.Metric{Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: &v}})
+	}
+	for _, mf := range []*dto.MetricFamily{temp, co2, offline} {
+		if len(mf.Metric) == 0 {
+			continue
+		}
+		if err := exporter.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Names of the user's unit settings, by their number in the stations response; see netatmo.UserAdministrative.
+var (
+	userUnits         = []string{"metric", "imperial"}
+	userWindUnits     = []string{"kph", "mph", "ms", "beaufort", "knot"}
+	userPressureUnits = []string{"mbar", "inhg", "mmhg"}
+	userFeelLike      = []string{"humidex", "heat_index"}
+)
+
+// userSetting returns the name of setting i, or its number if it's unknown.
+func userSetting(names []string, i int) string {
+	if i >= 0 && i < len(names) {
+		return names[i]
+	}
+	return strconv.Itoa(i)
+}
+
+// pushUserInfo exports the account's unit and locale settings from the Netatmo app as netatmo_user_info, for
+// dashboards to show the same units.
+func pushUserInfo(exporter export.Sink, user netatmo.User) error {
+	a := user.Administrative
+	return exporter.Encode(&dto.MetricFamily{
+		Name: ptr("netatmo_user_info"),
+		Help: ptr("The Netatmo account's unit and locale settings, as of the last discovery; always 1."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: export.LabelPairs(fileConfig.accountLabels(map[string]string{
+				"unit":          userSetting(userUnits, a.Unit),
+				"wind_unit":     userSetting(userWindUnits, a.WindUnit),
+				"pressure_unit": userSetting(userPressureUnits, a.PressureUnit),
+				"feel_like":     userSetting(userFeelLike, a.FeelLikeAlgo),
+				"country":       a.Country,
+				"locale":        a.RegLocale,
+				"lang":          a.Lang,
+			})),
+			TimestampMs: proto.Int64(time.Now().UnixMilli()),
+			Gauge:       &dto.Gauge{Value: proto.Float64(1)},
+		}},
+	})
+}
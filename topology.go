@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// topologyChange is a device or module added, removed, renamed, or updated to another firmware between two
+// discoveries.
+type topologyChange struct {
+	device      netatmo.DeviceID
+	module      netatmo.ModuleID
+	devID, name string
+	change      string // added, removed, renamed, or firmware.
+	from, to    string // The old and new name or firmware; empty for added and removed.
+
+	// For removed modules, their labels and data types, as last seen, for -tombstone-marker.
+	attrs     map[string]string
+	dataTypes []netatmo.DataType
+}
+
+func (c topologyChange) String() string {
+	switch c.change {
+	case "renamed":
+		return fmt.Sprintf("%s was renamed to %s", c.from, c.to)
+	case "firmware":
+		return fmt.Sprintf("%s was updated from firmware %s to %s", c.name, c.from, c.to)
+	}
+	return fmt.Sprintf("%s was %s", c.name, c.change)
+}
+
+// topologyChanges returns the changes from the devices and modules in old to those in stations.
+// With no old stations, as on the first run, there are none: everything would be new.
+func topologyChanges(old, stations []netatmo.Station) []topologyChange {
+	if len(old) == 0 {
+		return nil
+	}
+	type seen struct {
+		device    netatmo.DeviceID
+		module    netatmo.ModuleID
+		name      string
+		firmware  int
+		attrs     func() map[string]string
+		dataTypes []netatmo.DataType
+	}
+	index := func(stations []netatmo.Station) map[string]seen {
+		m := map[string]seen{}
+		for _, dev := range stations {
+			m[export.DevID(dev.ID, "")] = seen{dev.ID, "", dev.Name, dev.Firmware,
+				func() map[string]string { return stationAttrs(dev) }, dev.DataTypes}
+			for _, mod := range dev.Modules {
+				m[export.DevID(dev.ID, mod.ID)] = seen{dev.ID, mod.ID, mod.Name, mod.Firmware,
+					func() map[string]string { return moduleAttrs(dev, mod) }, mod.DataTypes}
+			}
+		}
+		return m
+	}
+	before, after := index(old), index(stations)
+	var changes []topologyChange
+	for id, a := range after {
+		c := topologyChange{device: a.device, module: a.module, devID: id, name: a.name}
+		b, ok := before[id]
+		switch {
+		case !ok:
+			c.change = "added"
+			changes = append(changes, c)
+			continue
+		case b.name != a.name:
+			c.change, c.from, c.to = "renamed", b.name, a.name
+			changes = append(changes, c)
+		}
+		// Zero is unknown, e.g. a module that hasn't reported since it was paired.
+		if b.firmware != a.firmware && b.firmware != 0 && a.firmware != 0 {
+			c.change, c.from, c.to = "firmware", strconv.Itoa(b.firmware), strconv.Itoa(a.firmware)
+			changes = append(changes, c)
+		}
+	}
+	for id, b := range before {
+		if _, ok := after[id]; !ok {
+			changes = append(changes, topologyChange{device: b.device, module: b.module, devID: id, name: b.name,
+				change: "removed", attrs: b.attrs(), dataTypes: b.dataTypes})
+		}
+	}
+	return changes
+}
+
+// withoutModules returns stations without the devices and modules with the dev_ids; without a device, also
+// without its modules.
+func withoutModules(stations []netatmo.Station, devIDs []string) []netatmo.Station {
+	var out []netatmo.Station
+	for _, dev := range stations {
+		if slices.Contains(devIDs, export.DevID(dev.ID, "")) {
+			continue
+		}
+		dev.Modules = slices.DeleteFunc(slices.Clone(dev.Modules), func(mod netatmo.Module) bool {
+			return slices.Contains(devIDs, export.DevID(dev.ID, mod.ID))
+		})
+		out = append(out, dev)
+	}
+	return out
+}
+
+// reportTopologyChanges logs changes, and posts them to -grafana-url as annotations tagged netatmo, topology,
+// the change, and the dev_id. Failures to post are logged, not returned.
+//
+// The cursors of removed modules are archived in state, and restored if they come back. New modules have no
+// cursor, so are exported from -since: a one-time historical backfill.
+func reportTopologyChanges(ctx context.Context, state *State, changes []topologyChange) {
+	now := time.Now()
+	for _, c := range changes {
+		attrs := []any{"dev_id", c.devID, "module_name", c.name}
+		switch c.change {
+		case "added":
+			if n := state.Unarchive(c.device, c.module); n > 0 {
+				slog.Info("module is back; resuming from its archived cursor", attrs...)
+			} else {
+				slog.Info("discovered new module; exporting its history", append(attrs,
+					"since", moduleSince(c.devID, c.name).Format(time.RFC3339))...)
+			}
+		case "removed":
+			slog.Info("module removed; archiving its cursor", append(attrs, "cursors", state.Archive(c.device, c.module))...)
+		default:
+			slog.Info("module "+c.change, append(attrs, "from", c.from, "to", c.to)...)
+		}
+		if *grafanaURL == "" {
+			continue
+		}
+		body, _ := json.Marshal(map[string]any{
+			"time": now.UnixMilli(),
+			"tags": []string{"netatmo", "topology", c.change, c.devID},
+			"text": fmt.Sprintf("%s (%s)", c, c.devID),
+		})
+		if err := postAnnotation(ctx, body); err != nil {
+			slog.Error("posting Grafana annotation", "dev_id", c.devID, "err", err)
+		}
+	}
+}
+
+// pushTopologyChanges encodes changes as netatmo_module_topology_change samples, one per change, at the time of
+// the discovery, as an audit trail of hardware changes alongside the data. With -tombstone-marker, it also ends
+// the series of the removed modules.
+func pushTopologyChanges(exporter export.Sink, changes []topologyChange) error {
+	if err := pushTombstones(exporter, changes); err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	now := proto.Int64(time.Now().UnixMilli())
+	mf := &dto.MetricFamily{
+		Name: ptr("netatmo_module_topology_change"),
+		Help: ptr("A device or module added, removed, renamed, or updated to another firmware since the previous discovery; always 1."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, c := range changes {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: export.LabelPairs(fileConfig.accountLabels(map[string]string{
+				"dev_id": c.devID, "module_name": c.name, "change": c.change, "from": c.from, "to": c.to,
+			})),
+			TimestampMs: now,
+			Gauge:       &dto.Gauge{Value: proto.Float64(1)},
+		})
+	}
+	return exporter.Encode(mf)
+}
+
+// checkTombstoneMarker checks -tombstone-marker, whose stale markers have the same needs as -offline-signal=stale's.
+func checkTombstoneMarker() error {
+	if !*tombstoneMarker {
+		return nil
+	}
+	// Like -offline-signal=stale's, the markers need remote-write to keep their NaN, and -lookup=state not to be
+	// taken for the cursor.
+	if *format != "remote-write" {
+		return errors.New("-tombstone-marker: requires -format=remote-write")
+	}
+	if *lookup != "state" || *lookupCheck != "" && *lookupCheck != "state" {
+		return errors.New("-tombstone-marker: requires -lookup=state")
+	}
+	return nil
+}
+
+// pushTombstones encodes, for -tombstone-marker, a netatmo_module_online of 0 and stale markers on the series of
+// each removed module, so graphs and alerts see it as gone rather than waiting for the series to go stale.
+func pushTombstones(exporter export.Sink, changes []topologyChange) error {
+	if !*tombstoneMarker {
+		return nil
+	}
+	now := proto.Int64(time.Now().UnixMilli())
+	online := &dto.MetricFamily{
+		Name: ptr("netatmo_module_online"),
+		Help: ptr("Whether the station could reach the module at the last discovery."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	var stale []*dto.MetricFamily
+	for _, c := range changes {
+		if c.change != "removed" || fileConfig.module(c.devID, c.name).Skip {
+			continue
+		}
+		labels := export.LabelPairs(c.attrs)
+		online.Metric = append(online.Metric, &dto.Metric{Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(0)}})
+		for _, dt := range c.dataTypes {
+			stale = append(stale, &dto.MetricFamily{
+				Name:   ptr(export.MetricName(dt)),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Label: labels, TimestampMs: now, Gauge: &dto.Gauge{Value: proto.Float64(staleNaN)}}},
+			})
+		}
+	}
+	if len(online.Metric) == 0 {
+		return nil
+	}
+	for _, mf := range append([]*dto.MetricFamily{online}, stale...) {
+		if err := exporter.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// tui redraws per-module progress bars in place on a terminal. A nil *tui ignores updates.
+type tui struct {
+	w       io.Writer
+	client  *netatmo.Client
+	started time.Time
+
+	mu    sync.Mutex
+	rows  []*tuiRow
+	drawn int // Lines drawn by the last redraw.
+
+	stopc chan struct{}
+	done  chan struct{}
+}
+
+type tuiRow struct {
+	ui           *tui
+	name         string
+	since, until time.Time
+	next         time.Time
+	points       int
+	finished     bool
+}
+
+// isTerminal reports whether f is a character device, which is as close as we need to get to isatty.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func newTUI(w io.Writer, client *netatmo.Client) *tui {
+	return &tui{w: w, client: client, stopc: make(chan struct{}), done: make(chan struct{})}
+}
+
+// add registers a row for a module to be exported between since and until.
+func (ui *tui) add(name string, since, until time.Time) *tuiRow {
+	if ui == nil {
+		return nil
+	}
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	r := &tuiRow{ui: ui, name: name, since: since, until: until, next: since}
+	ui.rows = append(ui.rows, r)
+	return r
+}
+
+// start begins redrawing periodically until stop is called.
+func (ui *tui) start() {
+	ui.started = time.Now()
+	go func() {
+		defer close(ui.done)
+		t := time.NewTicker(500 * time.Millisecond)
+		defer t.Stop()
+		for {
+			ui.redraw()
+			select {
+			case <-t.C:
+			case <-ui.stopc:
+				ui.redraw()
+				return
+			}
+		}
+	}()
+}
+
+// stop draws the final state and stops redrawing.
+func (ui *tui) stop() {
+	if ui == nil || ui.started.IsZero() {
+		return
+	}
+	close(ui.stopc)
+	<-ui.done
+}
+
+func (r *tuiRow) update(points []netatmo.DataPoint, nextTime time.Time) {
+	r.ui.mu.Lock()
+	defer r.ui.mu.Unlock()
+	r.points += len(points)
+	r.next = nextTime
+}
+
+func (r *tuiRow) finish() {
+	r.ui.mu.Lock()
+	defer r.ui.mu.Unlock()
+	r.finished = true
+	r.next = r.until
+}
+
+func (ui *tui) redraw() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	var b strings.Builder
+	if ui.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dF", ui.drawn) // Back to the start of the first line drawn.
+	}
+	nameWidth := 0
+	points := 0
+	for _, r := range ui.rows {
+		nameWidth = max(nameWidth, len(r.name))
+		points += r.points
+	}
+	for _, r := range ui.rows {
+		frac := 0.0
+		if total := r.until.Sub(r.since); total > 0 {
+			frac = min(max(r.next.Sub(r.since).Seconds()/total.Seconds(), 0), 1)
+		}
+		fmt.Fprintf(&b, "\x1b[2K%-*s %s %5.1f%% %8d points\n", nameWidth, r.name, bar(frac, 30), 100*frac, r.points)
+	}
+	elapsed := time.Since(ui.started)
+	calls, quota := ui.client.Calls(), ui.client.Quota()
+	used := quota.Limit - quota.Remaining
+	fmt.Fprintf(&b, "\x1b[2K%.0f points/s; API calls %d; hourly quota %s %d of %d left\n",
+		float64(points)/max(elapsed.Seconds(), 1), calls, bar(float64(used)/float64(quota.Limit), 10), quota.Remaining, quota.Limit)
+	ui.drawn = len(ui.rows) + 1
+	io.WriteString(ui.w, b.String())
+}
+
+// bar renders frac (0 to 1) as a bar width characters wide.
+func bar(frac float64, width int) string {
+	n := int(min(max(frac, 0), 1) * float64(width))
+	return "[" + strings.Repeat("#", n) + strings.Repeat(".", width-n) + "]"
+}
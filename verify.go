@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+	"sgrankin.dev/netatmo-otel/netatmo"
+)
+
+// runVerify compares randomly sampled time windows in the destination against the same windows in Netatmo.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	samples := fs.Int("samples", 3, "Number of random windows to check per module.")
+	window := fs.Duration("window", 6*time.Hour, "Length of each window.")
+	over := fs.Duration("over", 30*24*time.Hour, "Pick windows from this far back until now.")
+	target := fs.String("module", "", "Only verify the device or module with this ID or name.")
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("VERIFY"))
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+		fs.Usage()
+		return nil
+	default:
+		return fmt.Errorf("%w: %w", errConfig, err)
+	}
+	if *dest == "" {
+		return fmt.Errorf("%w: verify: -dest is required", errConfig)
+	}
+	if *window >= *over {
+		return fmt.Errorf("%w: verify: -window %s must be shorter than -over %s", errConfig, *window, *over)
+	}
+
+	ctx := context.Background()
+
+	client, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	stations, err := client.GetStations(ctx)
+	if err != nil {
+		return err
+	}
+
+	v := &verifier{client: client, baseURL: destURL("").String()}
+	for _, dev := range stations {
+		if *target == "" || *target == string(dev.ID) || *target == dev.Name {
+			for range *samples {
+				if err := v.verify(ctx, dev.Name, dev.ID, "", dev.DataTypes, randomWindow(*over, *window), *window); err != nil {
+					return err
+				}
+			}
+		}
+		for _, mod := range dev.Modules {
+			if *target != "" && *target != string(mod.ID) && *target != mod.Name {
+				continue
+			}
+			for range *samples {
+				if err := v.verify(ctx, mod.Name, dev.ID, mod.ID, mod.DataTypes, randomWindow(*over, *window), *window); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if v.bad > 0 {
+		return fmt.Errorf("verify: %d of %d points differ", v.bad, v.total)
+	}
+	slog.Info("verify: all points match", "points", v.total)
+	return nil
+}
+
+// randomWindow returns the start of a random window of the given length within the last over.
+func randomWindow(over, window time.Duration) time.Time {
+	return time.Now().Add(-over).Add(rand.N(over - window)).Truncate(time.Second)
+}
+
+type verifier struct {
+	client  *netatmo.Client
+	baseURL string
+
+	total, bad int
+}
+
+func (v *verifier) verify(
+	ctx context.Context, name string,
+	device netatmo.DeviceID, module netatmo.ModuleID, dataTypes []netatmo.DataType,
+	since time.Time, window time.Duration,
+) error {
+	until := since.Add(window)
+
+	// want[metric name][unix seconds] is the value in Netatmo.
+	want := map[string]map[int64]float64{}
+	for _, dt := range dataTypes {
+		want[export.MetricName(dt)] = map[int64]float64{}
+	}
+	err := v.client.GetMeasure(ctx, device, module, dataTypes, since, until, func(points []netatmo.DataPoint, _ time.Time) error {
+		for _, p := range points {
+			if p.Time.After(until) {
+				continue
+			}
+			for i, dt := range dataTypes {
+				want[export.MetricName(dt)][p.Time.Unix()] = p.Values[i]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	total := 0
+	names := make([]string, len(dataTypes))
+	for i, dt := range dataTypes {
+		names[i] = export.MetricName(dt)
+		total += len(want[names[i]])
+	}
+	match := fmt.Sprintf(`{__name__=~%q,dev_id=%q}`, strings.Join(names, "|"), export.DevID(device, module))
+	var mismatched, extra int
+	err = vmExport(ctx, destClient, v.baseURL, match, since, until, func(s vmSeries) error {
+		w := want[s.Metric["__name__"]]
+		for i, ms := range s.Timestamps {
+			ts := time.UnixMilli(ms).Unix()
+			wv, ok := w[ts]
+			switch {
+			case !ok:
+				extra++
+			case math.Abs(wv-s.Values[i]) > 1e-9:
+				mismatched++
+				slog.Debug("verify: mismatch", "module_name", name, "metric", s.Metric["__name__"],
+					"time", time.Unix(ts, 0).Format(time.RFC3339), "netatmo", wv, "destination", s.Values[i])
+				delete(w, ts)
+			default:
+				delete(w, ts)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	missing := 0
+	for _, w := range want {
+		missing += len(w) // Everything left was not found in the destination.
+	}
+
+	v.total += total
+	v.bad += missing + mismatched + extra
+	slog.Info("verify", "module_name", name, "device", device, "module", module,
+		"from", since.Format(time.RFC3339), "to", until.Format(time.RFC3339),
+		"missing", missing, "mismatched", mismatched, "extra", extra)
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"sgrankin.dev/netatmo-otel/internal/export"
+)
+
+// Set by release builds, e.g. with -ldflags "-X main.version=v1.2.0 -X main.commit=abc1234 -X main.date=2024-01-01T00:00:00Z".
+// Otherwise they come from the module and VCS information Go embeds in the binary; see buildInfo.
+var (
+	version string
+	commit  string
+	date    string
+)
+
+// build describes the running binary.
+type build struct {
+	Version, Commit, Date, GoVersion string
+}
+
+// buildInfo returns what the binary was built from: the ldflags variables, or what go build or go install
+// recorded, or "unknown".
+func buildInfo() build {
+	b := build{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		dirty := false
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && date == "":
+				b.Date = s.Value
+			case s.Key == "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && commit == "" && b.Commit != "" {
+			b.Commit += "-dirty"
+		}
+	}
+	for _, v := range []*string{&b.Version, &b.Commit, &b.Date} {
+		if *v == "" {
+			*v = "unknown"
+		}
+	}
+	return b
+}
+
+func (b build) String() string {
+	return fmt.Sprintf("netatmo-otel %s (commit %s, built %s, %s)", b.Version, b.Commit, b.Date, b.GoVersion)
+}
+
+// defaultUserAgent is the -user-agent default: the name and version, and where to find the project.
+func defaultUserAgent() string {
+	return fmt.Sprintf("netatmo-otel/%s (+https://sgrankin.dev/netatmo-otel)", buildInfo().Version)
+}
+
+// pushBuildInfo encodes netatmo_exporter_build_info, for dashboards and alerts to tell which binary wrote the data.
+func pushBuildInfo(exporter export.Sink) error {
+	b := buildInfo()
+	return exporter.Encode(&dto.MetricFamily{
+		Name: ptr("netatmo_exporter_build_info"),
+		Help: ptr("The exporter's version, commit, build date, and Go version; always 1."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{
+			Label: export.LabelPairs(fileConfig.accountLabels(map[string]string{
+				"version": b.Version, "commit": b.Commit, "date": b.Date, "goversion": b.GoVersion,
+			})),
+			TimestampMs: proto.Int64(time.Now().UnixMilli()),
+			Gauge:       &dto.Gauge{Value: proto.Float64(1)},
+		}},
+	})
+}